@@ -13,11 +13,26 @@ import (
 type KubeOIDCProxyOptions struct {
 	DisableImpersonation bool
 	ReadinessProbePort   int
+	MetricsPort          int
+
+	SelfSubjectReviewTokenClaims bool
 
 	FlushInterval time.Duration
 
-	ExtraHeaderOptions ExtraHeaderOptions
-	TokenPassthrough   TokenPassthroughOptions
+	RequestIDTrustedCIDRs []string
+	ClientIPTrustedCIDRs  []string
+
+	ExtraHeaderOptions  ExtraHeaderOptions
+	TokenPassthrough    TokenPassthroughOptions
+	TokenReviewEndpoint TokenReviewEndpointOptions
+	ImpersonationPolicy ImpersonationPolicyOptions
+	FrontProxy          FrontProxyOptions
+	Clusters            ClusterOptions
+	Upstream            UpstreamOptions
+	RateLimit           RateLimitOptions
+	InFlight            InFlightOptions
+	LongRunning         LongRunningOptions
+	Tracing             TracingOptions
 }
 
 type TokenPassthroughOptions struct {
@@ -25,10 +40,70 @@ type TokenPassthroughOptions struct {
 	Enabled   bool
 }
 
+type TokenReviewEndpointOptions struct {
+	Enabled bool
+
+	AllowedUsers  []string
+	AllowedGroups []string
+	ClientCAFile  string
+}
+
+type TracingOptions struct {
+	Endpoint      string
+	Headers       map[string]string
+	SamplingRatio float64
+}
+
+type LongRunningOptions struct {
+	TerminateOnExpiry        bool
+	ExpiryGracePeriod        time.Duration
+	ReauthenticationInterval time.Duration
+}
+
+type InFlightOptions struct {
+	Limits        map[string]string
+	PerUserLimits map[string]string
+	ExemptGroups  []string
+}
+
+type RateLimitOptions struct {
+	Key          string
+	QPS          map[string]string
+	Burst        map[string]string
+	TotalQPS     map[string]string
+	TotalBurst   map[string]string
+	QueueLength  int
+	QueueTimeout time.Duration
+}
+
+type UpstreamOptions struct {
+	Endpoints           []string
+	Balancer            string
+	HealthCheckInterval time.Duration
+	EjectionDuration    time.Duration
+	MaxRetries          int
+}
+
+type ClusterOptions struct {
+	File       string
+	Kubeconfig string
+}
+
+type FrontProxyOptions struct {
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+type ImpersonationPolicyOptions struct {
+	File string
+	URL  string
+}
+
 type ExtraHeaderOptions struct {
 	EnableClientIPExtraUserHeader bool
 
-	ExtraUserHeaders map[string][]string
+	ExtraUserHeaders         map[string][]string
+	ExtraUserHeaderTemplates map[string][]string
 }
 
 func NewKubeOIDCProxyOptions(nfs *cliflag.NamedFlagSets) *KubeOIDCProxyOptions {
@@ -43,13 +118,46 @@ func (k *KubeOIDCProxyOptions) AddFlags(fs *pflag.FlagSet) *KubeOIDCProxyOptions
 	fs.IntVarP(&k.ReadinessProbePort, "readiness-probe-port", "P", 8080,
 		"Port to expose readiness probe.")
 
+	fs.IntVar(&k.MetricsPort, "metrics-port", k.MetricsPort,
+		"Port to expose Prometheus metrics on at '/metrics', in addition to the "+
+			"readiness probe port. If 0, metrics are only exposed on the readiness "+
+			"probe port.")
+
 	fs.DurationVar(&k.FlushInterval, "flush-interval", time.Millisecond*50,
 		"Specifies the interval to flush request bodies. If 0ms, "+
 			"no periodic flushing is done. A negative value means to flush "+
 			"immediately after each write. Streaming requests such as 'kubectl exec' "+
 			"will ignore this option and flush immediately.")
 
+	fs.BoolVar(&k.SelfSubjectReviewTokenClaims, "self-subject-review-token-claims",
+		k.SelfSubjectReviewTokenClaims, "(Alpha) If enabled, SelfSubjectReview "+
+			"responses ('kubectl auth whoami') will include the claims of the "+
+			"authenticating token in the annotation "+
+			"'kube-oidc-proxy.jetstack.io/token-claims'. Useful for debugging "+
+			"claim mappings.")
+
+	fs.StringSliceVar(&k.RequestIDTrustedCIDRs, "request-id-trusted-cidrs", k.RequestIDTrustedCIDRs, ""+
+		"Networks of trusted front ends, such as load balancers, whose 'X-Request-Id' "+
+		"header is used as the ID of the request. Requests from other clients are "+
+		"given a new ID. The ID is returned in the response, logged, and forwarded "+
+		"to the API server as the 'X-Request-Id' and 'Audit-ID' headers.")
+
+	fs.StringSliceVar(&k.ClientIPTrustedCIDRs, "client-ip-trusted-cidrs", k.ClientIPTrustedCIDRs, ""+
+		"Networks of trusted front ends, such as load balancers, whose 'X-Forwarded-For' "+
+		"header is used to find the IP of the client. The IP of other clients is the "+
+		"source address of the connection. The client IP is used by IP rate limits and "+
+		"the authorizer input.")
+
 	k.TokenPassthrough.AddFlags(fs)
+	k.TokenReviewEndpoint.AddFlags(fs)
+	k.ImpersonationPolicy.AddFlags(fs)
+	k.FrontProxy.AddFlags(fs)
+	k.Clusters.AddFlags(fs)
+	k.Upstream.AddFlags(fs)
+	k.RateLimit.AddFlags(fs)
+	k.InFlight.AddFlags(fs)
+	k.LongRunning.AddFlags(fs)
+	k.Tracing.AddFlags(fs)
 	k.ExtraHeaderOptions.AddFlags(fs)
 	return k
 }
@@ -68,6 +176,173 @@ func (t *TokenPassthroughOptions) AddFlags(fs *pflag.FlagSet) {
 		"is sent on as is, with no impersonation.")
 }
 
+func (t *TokenReviewEndpointOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&t.Enabled, "token-review-endpoint", t.Enabled, ""+
+		"(Alpha) Serve the TokenReview API at "+
+		"/apis/authentication.k8s.io/v1/tokenreviews. Tokens are reviewed using "+
+		"the proxy's configured authenticators so the proxy may be used as a "+
+		"webhook token authenticator.")
+
+	fs.StringSliceVar(&t.AllowedUsers, "token-review-endpoint-allowed-users", t.AllowedUsers, ""+
+		"(Alpha) List of client usernames that are allowed to call the TokenReview "+
+		"endpoint. Only used when --token-review-endpoint is also enabled.")
+
+	fs.StringSliceVar(&t.AllowedGroups, "token-review-endpoint-allowed-groups", t.AllowedGroups, ""+
+		"(Alpha) List of client groups that are allowed to call the TokenReview "+
+		"endpoint. Only used when --token-review-endpoint is also enabled.")
+
+	fs.StringVar(&t.ClientCAFile, "token-review-endpoint-client-ca-file", t.ClientCAFile, ""+
+		"(Alpha) If set, clients of the TokenReview endpoint may authenticate using "+
+		"a client certificate signed by one of the authorities in this file. The "+
+		"certificate common name is used as the username and organizations as "+
+		"groups. Otherwise clients authenticate with an OIDC bearer token.")
+}
+
+func (t *TracingOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&t.Endpoint, "tracing-endpoint", t.Endpoint, ""+
+		"(Alpha) Base URL of an OpenTelemetry collector to export traces to using "+
+		"OTLP over HTTP, e.g. 'http://localhost:4318'. The trace context is "+
+		"propagated to the API server using the 'traceparent' header. If empty, "+
+		"tracing is disabled.")
+
+	fs.StringToStringVar(&t.Headers, "tracing-headers", t.Headers, ""+
+		"(Alpha) Headers to add to requests exporting traces, such as for "+
+		"authenticating to the collector.")
+
+	fs.Float64Var(&t.SamplingRatio, "tracing-sampling-ratio", 1, ""+
+		"(Alpha) Ratio of requests, between 0 and 1, to sample traces of. Requests "+
+		"with a trace context sampled by the client are always sampled.")
+}
+
+func (l *LongRunningOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&l.TerminateOnExpiry, "long-running-terminate-on-expiry", l.TerminateOnExpiry, ""+
+		"(Alpha) If enabled, long running requests such as watches and exec sessions "+
+		"are terminated once the token that authenticated them expires, or is found "+
+		"to be revoked.")
+
+	fs.DurationVar(&l.ExpiryGracePeriod, "long-running-expiry-grace-period", l.ExpiryGracePeriod, ""+
+		"(Alpha) Grace period after a token expires or is revoked before long "+
+		"running requests it authenticated are terminated.")
+
+	fs.DurationVar(&l.ReauthenticationInterval, "long-running-reauthentication-interval",
+		l.ReauthenticationInterval, ""+
+			"(Alpha) Interval to re-authenticate the tokens of long running requests, "+
+			"terminating requests whose token is no longer valid, such as deleted "+
+			"service account tokens reviewed with token passthrough. If 0, tokens are "+
+			"not re-authenticated.")
+}
+
+func (i *InFlightOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringToStringVar(&i.Limits, "max-inflight", i.Limits, ""+
+		"(Alpha) Maximum number of requests in flight in total, per kind of request, "+
+		"e.g. 'readonly=400,mutating=200,watch=1000,exec=100'. 'readonly' and "+
+		"'mutating' limit requests that are not long running, 'watch' limits open "+
+		"watches and 'exec' limits open exec, attach and port forward sessions. "+
+		"Requests over the limit are rejected with a 429.")
+
+	fs.StringToStringVar(&i.PerUserLimits, "max-inflight-per-user", i.PerUserLimits, ""+
+		"(Alpha) Maximum number of requests in flight of each authenticated user, "+
+		"per kind of request, e.g. 'watch=50,exec=5'.")
+
+	fs.StringSliceVar(&i.ExemptGroups, "max-inflight-exempt-groups", i.ExemptGroups, ""+
+		"(Alpha) Groups whose members are not limited by --max-inflight or "+
+		"--max-inflight-per-user, e.g. 'system:masters'.")
+}
+
+func (r *RateLimitOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&r.Key, "rate-limit-key", "user", ""+
+		"(Alpha) What authenticated requests are rate limited by, one of 'user', "+
+		"'group' or 'ip'. When limited by group, a request must be within the limit "+
+		"of every group of the user.")
+
+	fs.StringToStringVar(&r.QPS, "rate-limit-qps", r.QPS, ""+
+		"(Alpha) Queries per second allowed for each --rate-limit-key, per verb "+
+		"class, e.g. 'read=50,write=10,watch=5,exec=1'. Requests over the limit are "+
+		"rejected with a 429. Verb classes without a limit are not rate limited.")
+
+	fs.StringToStringVar(&r.Burst, "rate-limit-burst", r.Burst, ""+
+		"(Alpha) Burst allowed for each --rate-limit-key, per verb class. Defaults "+
+		"to the --rate-limit-qps of the class.")
+
+	fs.StringToStringVar(&r.TotalQPS, "rate-limit-total-qps", r.TotalQPS, ""+
+		"(Alpha) Queries per second allowed in total, per verb class. Requests over "+
+		"the limit are queued and dispatched fairly between each --rate-limit-key.")
+
+	fs.StringToStringVar(&r.TotalBurst, "rate-limit-total-burst", r.TotalBurst, ""+
+		"(Alpha) Burst allowed in total, per verb class. Defaults to the "+
+		"--rate-limit-total-qps of the class.")
+
+	fs.IntVar(&r.QueueLength, "rate-limit-queue-length", 50, ""+
+		"(Alpha) Maximum number of requests of each --rate-limit-key queued per verb "+
+		"class when over the --rate-limit-total-qps. Requests over the length are "+
+		"rejected with a 429.")
+
+	fs.DurationVar(&r.QueueTimeout, "rate-limit-queue-timeout", time.Second*15, ""+
+		"(Alpha) Maximum time a request is queued before being rejected with a 429.")
+}
+
+func (u *UpstreamOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&u.Endpoints, "upstream-endpoints", u.Endpoints, ""+
+		"(Alpha) List of API server endpoint URLs to balance requests across, "+
+		"e.g. https://10.0.0.1:6443. The serving certificate of each endpoint must be "+
+		"valid for its address. If not set, only the configured API server host is used.")
+
+	fs.StringVar(&u.Balancer, "upstream-balancer", "round-robin", ""+
+		"(Alpha) How requests are balanced across --upstream-endpoints, either "+
+		"'round-robin' or 'least-connections'.")
+
+	fs.DurationVar(&u.HealthCheckInterval, "upstream-health-check-interval", time.Second*10, ""+
+		"(Alpha) Interval to check /readyz of each of the --upstream-endpoints. "+
+		"Endpoints that are not ready are ejected. If 0, endpoints are only ejected on "+
+		"connection errors.")
+
+	fs.DurationVar(&u.EjectionDuration, "upstream-ejection-duration", time.Second*30, ""+
+		"(Alpha) Duration an upstream endpoint is ejected for after a connection "+
+		"error or failed health check.")
+
+	fs.IntVar(&u.MaxRetries, "upstream-max-retries", 2, ""+
+		"(Alpha) Maximum number of times an idempotent request that failed to "+
+		"connect is retried on another of the --upstream-endpoints.")
+}
+
+func (c *ClusterOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.File, "clusters-file", c.File, ""+
+		"(Alpha) File listing additional upstream clusters, each with its own "+
+		"kubeconfig, host names, impersonation setting and authorizer URL. Requests "+
+		"are routed to a cluster by the path prefix /clusters/<name>/ or by host name. "+
+		"All other requests are sent to the default cluster.")
+
+	fs.StringVar(&c.Kubeconfig, "clusters-kubeconfig", c.Kubeconfig, ""+
+		"(Alpha) Kubeconfig file where each context is loaded as an additional "+
+		"upstream cluster, named after the context. Requests are routed to a cluster "+
+		"by the path prefix /clusters/<name>/.")
+}
+
+func (f *FrontProxyOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&f.ClientCertFile, "front-proxy-client-cert-file", f.ClientCertFile, ""+
+		"(Alpha) Client certificate used to authenticate to the API server as a front "+
+		"proxy. If set, the identity of proxied requests is asserted using the "+
+		"X-Remote-User, X-Remote-Group and X-Remote-Extra-* request headers instead of "+
+		"impersonation. The certificate must be signed by the API server's "+
+		"--requestheader-client-ca-file.")
+
+	fs.StringVar(&f.ClientKeyFile, "front-proxy-client-key-file", f.ClientKeyFile, ""+
+		"(Alpha) Private key of the --front-proxy-client-cert-file certificate.")
+}
+
+func (i *ImpersonationPolicyOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&i.File, "impersonation-policy-file", i.File, ""+
+		"(Alpha) File containing the policy of which users may impersonate other "+
+		"identities using the Impersonate-* headers. If neither this nor "+
+		"--impersonation-policy-url is set, requests with impersonation headers "+
+		"are rejected.")
+
+	fs.StringVar(&i.URL, "impersonation-policy-url", i.URL, ""+
+		"(Alpha) Open Policy Agent URL queried with a SubjectAccessReview for the "+
+		"'impersonate' verb to decide whether a user may impersonate the identity "+
+		"requested using the Impersonate-* headers.")
+}
+
 func (e *ExtraHeaderOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.BoolVar(&e.EnableClientIPExtraUserHeader, "extra-user-header-client-ip",
 		e.EnableClientIPExtraUserHeader, "(Alpha) If enabled, proxied requests will "+
@@ -79,4 +354,11 @@ func (e *ExtraHeaderOptions) AddFlags(fs *pflag.FlagSet) {
 		"(Alpha) A list of key value pairs of extra user headers to pass with "+
 			"proxied requests as part of the impersonated request. A single key can "+
 			"hold multiple values.")
+
+	fs.Var(flags.NewStringToStringSliceValue(&e.ExtraUserHeaderTemplates), "extra-user-header-templates",
+		"(Alpha) A list of key value pairs of extra user headers to pass with "+
+			"proxied requests, where values are Go templates rendered per request "+
+			"with the token claims, issuer, user and request attributes, e.g. "+
+			"'department={{ .Claims.department }}'. Values that fail to render, "+
+			"such as when the claim is missing, or are empty are omitted.")
 }
@@ -3,19 +3,275 @@
 package options
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/util/sets"
 	cliflag "k8s.io/component-base/cli/flag"
 )
 
+// Names of the authorizers which may be chained with --authorizer-chain.
+const (
+	AuthorizerOPA     = "opa"
+	AuthorizerWebhook = "webhook"
+	AuthorizerPolicy  = "policy"
+	AuthorizerDeny    = "deny"
+)
+
+// Final decisions of the authorizer chain when no authorizer has an opinion.
+const (
+	AuthorizerDecisionAllow = "allow"
+	AuthorizerDecisionDeny  = "deny"
+)
+
+// Modes of authorizing requests when Open Policy Agent cannot be queried.
+const (
+	AuthorizerFailureModeNoOpinion     = "no-opinion"
+	AuthorizerFailureModeDeny          = "deny"
+	AuthorizerFailureModeAllowReadOnly = "allow-read-only"
+	AuthorizerFailureModeUpstream      = "upstream"
+)
+
+// Versions of the input document sent to Open Policy Agent.
+const (
+	// AuthorizerInputV1 is the SubjectAccessReview of the request.
+	AuthorizerInputV1 = "v1"
+
+	// AuthorizerInputV2 adds the context of the request and the token it was
+	// authenticated with to the SubjectAccessReview.
+	AuthorizerInputV2 = "v2"
+)
+
 type AuthorizerOptions struct {
 	AuthorizerUri          string
+	RulesUri               string
 	ExtrasPath             string
 	ExtrasAnnotationPrefix string
+
+	// QueryTimeout is the maximum time a query to Open Policy Agent is made
+	// for, including retries. A query is shared by the identical requests
+	// waiting on it, so is not bound to the deadline of any one of them.
+	QueryTimeout time.Duration
+
+	// FallbackUris are the Open Policy Agent endpoints queried in order if
+	// AuthorizerUri cannot be.
+	FallbackUris []string
+
+	// Chain is the ordered list of authorizers requests are authorized by. If
+	// empty, requests are authorized by Open Policy Agent if AuthorizerUri is
+	// set.
+	Chain         []string
+	FinalDecision string
+
+	WebhookConfigFile         string
+	WebhookVersion            string
+	WebhookCacheAuthorizedTTL time.Duration
+	WebhookCacheDeniedTTL     time.Duration
+
+	PolicyFile    string
+	DenyRulesFile string
+
+	Cache   AuthorizerCacheOptions
+	Client  AuthorizerClientOptions
+	Failure AuthorizerFailureOptions
+	Rego    AuthorizerRegoOptions
+	Shadow  AuthorizerShadowOptions
+
+	DecisionLog AuthorizerDecisionLogOptions
+	Body        AuthorizerBodyOptions
+	Input       AuthorizerInputOptions
+}
+
+// AuthorizerCacheOptions configure the cache of Open Policy Agent decisions.
+type AuthorizerCacheOptions struct {
+	// Size is the maximum number of cached decisions. The cache is disabled
+	// if zero.
+	Size int
+
+	// AllowedTTL and DeniedTTL are how long allowed, and denied or no
+	// opinion, decisions are cached for. Decisions are not cached if zero.
+	AllowedTTL time.Duration
+	DeniedTTL  time.Duration
+
+	// TTLField is the field of the Open Policy Agent result which, if set,
+	// overrides the TTL of the decision.
+	TTLField string
+}
+
+// AuthorizerClientOptions configure the HTTP client queries are sent to Open
+// Policy Agent with.
+type AuthorizerClientOptions struct {
+	// Timeout is the timeout of each attempt of a query.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a query which failed to connect or
+	// received a 5xx or 429 response is retried, with an exponential backoff
+	// starting at RetryInitialInterval, for up to RetryMaxElapsedTime.
+	MaxRetries           int
+	RetryInitialInterval time.Duration
+	RetryMaxElapsedTime  time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections kept open to
+	// Open Policy Agent.
+	MaxIdleConns int
+
+	// MaxResponseBytes is the maximum size of an authorization response.
+	MaxResponseBytes int64
+
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	TokenFile string
+}
+
+// AuthorizerFailureOptions configure how requests are authorized when Open
+// Policy Agent cannot be queried.
+type AuthorizerFailureOptions struct {
+	// Mode is how requests are authorized, one of the failure modes. Requests
+	// are given no opinion if empty.
+	Mode string
+
+	// CircuitBreakerFailures is the number of consecutive failed queries
+	// after which an endpoint is no longer queried for CircuitBreakerCooldown.
+	// The circuit breaker is disabled if zero.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+}
+
+// AuthorizerRegoOptions configure Rego policies evaluated by the proxy, rather
+// than querying Open Policy Agent.
+type AuthorizerRegoOptions struct {
+	// Paths are files or directories of Rego policies and JSON or YAML data
+	// loaded into the proxy, and Bundles are paths of bundles.
+	Paths   []string
+	Bundles []string
+
+	// Query is the query evaluated for the decision.
+	Query string
+
+	// ReloadInterval is how often the policies are checked for changes and
+	// reloaded. Policies are not reloaded if zero.
+	ReloadInterval time.Duration
+}
+
+// Enabled returns whether Rego policies are evaluated by the proxy.
+func (o *AuthorizerRegoOptions) Enabled() bool {
+	return len(o.Paths) > 0 || len(o.Bundles) > 0
+}
+
+// AuthorizerShadowOptions configure a shadow policy, evaluated alongside
+// Open Policy Agent without being enforced.
+type AuthorizerShadowOptions struct {
+	// Uri is the Open Policy Agent endpoint of the shadow policy.
+	Uri string
+
+	// RegoQuery is the query of the shadow policy, evaluated with the Rego
+	// policies loaded into the proxy.
+	RegoQuery string
+
+	// Warnings is whether requests the shadow policy would deny are given a
+	// Warning header.
+	Warnings bool
+
+	// Timeout is how long the decision of the shadow policy is waited for
+	// after the enforced decision, before it is no longer recorded.
+	Timeout time.Duration
+}
+
+// Enabled returns whether a shadow policy is evaluated.
+func (o *AuthorizerShadowOptions) Enabled() bool {
+	return len(o.Uri) > 0 || len(o.RegoQuery) > 0
+}
+
+// AuthorizerDecisionLogOptions configure the log of authorization decisions.
+type AuthorizerDecisionLogOptions struct {
+	File          string
+	URL           string
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// AuthorizerBodyOptions configure the requests whose bodies are sent to Open
+// Policy Agent.
+type AuthorizerBodyOptions struct {
+	// Rules are the verbs and resources of requests whose bodies are sent,
+	// each of the form 'verb:resource[/subresource][.group]'.
+	Rules []string
+
+	// MaxBytes is the maximum size of a body sent. Larger requests are
+	// rejected.
+	MaxBytes int64
+}
+
+// AuthorizerBodyRule matches the verb and resource of requests whose bodies
+// are sent to Open Policy Agent. Any field may be '*' to match all.
+type AuthorizerBodyRule struct {
+	Verb     string
+	Resource string
+	Group    string
+}
+
+// AuthorizerBodyVerbs are the verbs of requests with bodies.
+var AuthorizerBodyVerbs = sets.NewString("create", "update", "patch")
+
+// ParseRules parses the rules of the requests whose bodies are sent.
+func (o *AuthorizerBodyOptions) ParseRules() ([]AuthorizerBodyRule, error) {
+	var rules []AuthorizerBodyRule
+	for _, r := range o.Rules {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid authorizer body rule %q, must be of the form 'verb:resource[.group]'", r)
+		}
+
+		verb := parts[0]
+		if verb != "*" && !AuthorizerBodyVerbs.Has(verb) {
+			return nil, fmt.Errorf("invalid verb of authorizer body rule %q, must be one of %s or '*'",
+				r, strings.Join(AuthorizerBodyVerbs.List(), ", "))
+		}
+
+		resource, group := parts[1], ""
+		if i := strings.Index(resource, "."); i >= 0 {
+			resource, group = resource[:i], resource[i+1:]
+		}
+		// A resource of '*' without a group matches resources of all groups.
+		if resource == "*" && len(group) == 0 {
+			group = "*"
+		}
+
+		rules = append(rules, AuthorizerBodyRule{Verb: verb, Resource: resource, Group: group})
+	}
+
+	return rules, nil
 }
 
+// AuthorizerInputOptions configure the input document sent to Open Policy
+// Agent.
+type AuthorizerInputOptions struct {
+	// Version is the version of the input document, one of the input
+	// versions.
+	Version string
+
+	// Claims are the claims of the token added to the input of version v2.
+	Claims []string
+
+	// CacheKeyFields are the fields of the request in the input of version
+	// v2 that cached decisions are keyed by. Decisions are not cached if the
+	// time of the request is one of them.
+	CacheKeyFields []string
+}
+
+// AuthorizerInputRequestFields are the fields of the request in the input of
+// version v2.
+var AuthorizerInputRequestFields = sets.NewString("clientIP", "userAgent", "path", "query", "authMethod", "time")
+
 func NewAuthorizerOptions(cfs *cliflag.NamedFlagSets) *AuthorizerOptions {
 	ao := AuthorizerOptions{
 		AuthorizerUri:          "",
+		RulesUri:               "",
 		ExtrasPath:             "",
 		ExtrasAnnotationPrefix: "",
 	}
@@ -25,6 +281,362 @@ func NewAuthorizerOptions(cfs *cliflag.NamedFlagSets) *AuthorizerOptions {
 
 func (o *AuthorizerOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.AuthorizerUri, "authorizer-url", "", "Authorizer Open policy agent URI")
+	fs.StringVar(&o.RulesUri, "authorizer-rules-url", "", "Authorizer Open policy agent URI queried for the rules of a user to answer SelfSubjectRulesReviews")
+	fs.StringSliceVar(&o.FallbackUris, "authorizer-fallback-urls", nil,
+		"Open policy agent URIs queried in order if --authorizer-url cannot be.")
 	fs.StringVar(&o.ExtrasPath, "extras-url", "", "extra-data added to user.extras")
 	fs.StringVar(&o.ExtrasAnnotationPrefix, "extras-prefix", "authorization.example.com/", "extra-data annotation prefix")
+	fs.DurationVar(&o.QueryTimeout, "authorizer-query-timeout", time.Second*30,
+		"Maximum time a query to Open Policy Agent, shared by identical requests waiting on it, "+
+			"is made for including retries. Queries are also cancelled once no request is waiting on them.")
+
+	fs.StringSliceVar(&o.Chain, "authorizer-chain", nil,
+		"Ordered list of authorizers to authorize requests with, any of 'opa', 'webhook', "+
+			"'policy' and 'deny'. The first authorizer to allow or deny a request decides it, "+
+			"authorizers with no opinion pass it to the next. Defaults to 'opa' if --authorizer-url is set.")
+
+	fs.StringVar(&o.FinalDecision, "authorizer-final-decision", AuthorizerDecisionDeny,
+		"Decision for requests that no authorizer in the chain has an opinion on, 'allow' or 'deny'.")
+
+	fs.StringVar(&o.WebhookConfigFile, "authorizer-webhook-config-file", "",
+		"File with webhook configuration in kubeconfig format, used by the 'webhook' authorizer "+
+			"to send SubjectAccessReviews to.")
+
+	fs.StringVar(&o.WebhookVersion, "authorizer-webhook-version", "v1beta1",
+		"The API version of the SubjectAccessReviews sent to the webhook, 'v1' or 'v1beta1'.")
+
+	fs.DurationVar(&o.WebhookCacheAuthorizedTTL, "authorizer-webhook-cache-authorized-ttl", time.Minute*5,
+		"The duration to cache 'authorized' responses from the webhook.")
+
+	fs.DurationVar(&o.WebhookCacheDeniedTTL, "authorizer-webhook-cache-unauthorized-ttl", time.Second*30,
+		"The duration to cache 'unauthorized' responses from the webhook.")
+
+	fs.StringVar(&o.PolicyFile, "authorizer-policy-file", "",
+		"File of rules allowing requests, used by the 'policy' authorizer.")
+
+	fs.StringVar(&o.DenyRulesFile, "authorizer-deny-rules-file", "",
+		"File of rules denying requests, used by the 'deny' authorizer.")
+
+	o.Cache.AddFlags(fs)
+	o.Client.AddFlags(fs)
+	o.Failure.AddFlags(fs)
+	o.Rego.AddFlags(fs)
+	o.Shadow.AddFlags(fs)
+	o.DecisionLog.AddFlags(fs)
+	o.Body.AddFlags(fs)
+	o.Input.AddFlags(fs)
+}
+
+func (o *AuthorizerCacheOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&o.Size, "authorizer-cache-size", 1024,
+		"Maximum number of Open Policy Agent decisions to cache. Set to 0 to disable the cache.")
+
+	fs.DurationVar(&o.AllowedTTL, "authorizer-cache-allowed-ttl", time.Minute*5,
+		"The duration to cache allowed decisions of Open Policy Agent.")
+
+	fs.DurationVar(&o.DeniedTTL, "authorizer-cache-denied-ttl", time.Second*30,
+		"The duration to cache denied and no opinion decisions of Open Policy Agent.")
+
+	fs.StringVar(&o.TTLField, "authorizer-cache-ttl-field", "",
+		"Field of the Open Policy Agent result holding the duration to cache the decision for, "+
+			"either as seconds or a duration string such as '1m'. Overrides the TTLs of the cache if set.")
+}
+
+func (o *AuthorizerClientOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&o.Timeout, "authorizer-timeout", time.Second*5,
+		"Timeout of each attempt of a query to Open Policy Agent.")
+
+	fs.IntVar(&o.MaxRetries, "authorizer-max-retries", 3,
+		"Number of times a query to Open Policy Agent which failed to connect, or received a "+
+			"5xx or 429 response, is retried. Set to 0 to disable retries.")
+
+	fs.DurationVar(&o.RetryInitialInterval, "authorizer-retry-initial-interval", time.Millisecond*100,
+		"Initial interval between retries of a query to Open Policy Agent, which increases exponentially.")
+
+	fs.DurationVar(&o.RetryMaxElapsedTime, "authorizer-retry-max-elapsed-time", time.Second*5,
+		"Maximum time a query to Open Policy Agent is retried for.")
+
+	fs.IntVar(&o.MaxIdleConns, "authorizer-max-idle-conns", 100,
+		"Maximum number of idle keep-alive connections to Open Policy Agent.")
+
+	fs.Int64Var(&o.MaxResponseBytes, "authorizer-max-response-bytes", 1<<16,
+		"Maximum size in bytes of an authorization response from Open Policy Agent.")
+
+	fs.StringVar(&o.CAFile, "authorizer-ca-file", "",
+		"File of the CA certificates used to verify the serving certificate of Open Policy Agent. "+
+			"Defaults to the system roots.")
+
+	fs.StringVar(&o.CertFile, "authorizer-client-cert-file", "",
+		"File of the client certificate presented to Open Policy Agent.")
+
+	fs.StringVar(&o.KeyFile, "authorizer-client-key-file", "",
+		"File of the key of the client certificate presented to Open Policy Agent.")
+
+	fs.StringVar(&o.TokenFile, "authorizer-token-file", "",
+		"File of a bearer token sent to Open Policy Agent. The file is periodically reread.")
+}
+
+func (o *AuthorizerFailureOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Mode, "authorizer-failure-mode", AuthorizerFailureModeNoOpinion,
+		"How requests are authorized when Open Policy Agent cannot be queried. One of 'no-opinion', "+
+			"passing the request to the next authorizer in the chain, 'deny', 'allow-read-only', "+
+			"denying all but read-only requests, or 'upstream', authorizing the request with the API server only.")
+
+	fs.IntVar(&o.CircuitBreakerFailures, "authorizer-circuit-breaker-failures", 5,
+		"Number of consecutive failed queries after which an Open Policy Agent endpoint is no "+
+			"longer queried until the cool-down has passed. Set to 0 to disable the circuit breaker.")
+
+	fs.DurationVar(&o.CircuitBreakerCooldown, "authorizer-circuit-breaker-cooldown", time.Second*30,
+		"Duration an Open Policy Agent endpoint is not queried for once the circuit breaker opens, "+
+			"after which a single query is sent to check whether it has recovered.")
+}
+
+func (o *AuthorizerRegoOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.Paths, "authorizer-rego-paths", nil,
+		"Files or directories of Rego policies and JSON or YAML data to evaluate in the proxy, "+
+			"rather than querying --authorizer-url.")
+
+	fs.StringSliceVar(&o.Bundles, "authorizer-rego-bundles", nil,
+		"Bundles of Rego policies and data to evaluate in the proxy, either directories or "+
+			"compressed bundle files, rather than querying --authorizer-url.")
+
+	fs.StringVar(&o.Query, "authorizer-rego-query", "data.kubernetes.authz",
+		"Query evaluated for the SubjectAccessReview of a request when evaluating Rego policies in the proxy.")
+
+	fs.DurationVar(&o.ReloadInterval, "authorizer-rego-reload-interval", time.Second*10,
+		"How often the Rego policies, data and bundles are checked for changes and reloaded. "+
+			"Set to 0 to disable reloading.")
+}
+
+func (o *AuthorizerShadowOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Uri, "authorizer-shadow-url", "",
+		"Open policy agent URI of a shadow policy, evaluated alongside the 'opa' authorizer without "+
+			"being enforced. Decisions which disagree with the enforced decision are logged, audited and counted.")
+
+	fs.StringVar(&o.RegoQuery, "authorizer-shadow-rego-query", "",
+		"Query of a shadow policy evaluated with the Rego policies loaded into the proxy, alongside "+
+			"--authorizer-rego-query without being enforced.")
+
+	fs.BoolVar(&o.Warnings, "authorizer-shadow-warnings", false,
+		"Add a Warning header to the responses of requests that the shadow policy would deny, if "+
+			"decided by the time of the enforced decision.")
+
+	fs.DurationVar(&o.Timeout, "authorizer-shadow-timeout", time.Second*5,
+		"How long a decision of the shadow policy is waited for, before it is no longer recorded. "+
+			"Enforced decisions never wait for the shadow policy.")
+}
+
+func (o *AuthorizerDecisionLogOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.File, "authorizer-decision-log-file", "",
+		"File the authorization decisions of the proxy are appended to as lines of JSON, "+
+			"or '-' for stdout.")
+
+	fs.StringVar(&o.URL, "authorizer-decision-log-url", "",
+		"URL of an endpoint compatible with the Open Policy Agent decision log API that "+
+			"authorization decisions are sent to.")
+
+	fs.IntVar(&o.BufferSize, "authorizer-decision-log-buffer-size", 10000,
+		"Maximum number of decisions waiting to be logged. Decisions are dropped, rather than "+
+			"delaying requests, once the buffer is full.")
+
+	fs.IntVar(&o.BatchSize, "authorizer-decision-log-batch-size", 100,
+		"Maximum number of decisions logged at once.")
+
+	fs.DurationVar(&o.FlushInterval, "authorizer-decision-log-flush-interval", time.Second*5,
+		"Maximum time a decision waits to be logged in a batch.")
+}
+
+func (o *AuthorizerBodyOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.Rules, "authorizer-body-rules", nil,
+		"Requests whose bodies are decoded and sent to Open Policy Agent, each of the form "+
+			"'verb:resource[/subresource][.group]', such as 'create:pods' or '*:deployments.apps'. "+
+			"The verb may be 'create', 'update', 'patch' or '*', and the resource '*'. The current "+
+			"object is also sent for updates and patches.")
+
+	fs.Int64Var(&o.MaxBytes, "authorizer-body-max-bytes", 1<<20,
+		"Maximum size in bytes of a request body sent to Open Policy Agent. Larger requests "+
+			"matching --authorizer-body-rules are rejected.")
+}
+
+func (o *AuthorizerInputOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Version, "authorizer-input-version", AuthorizerInputV1,
+		"Version of the input document sent to Open Policy Agent. 'v1' is the SubjectAccessReview "+
+			"of the request, 'v2' adds the client IP, user agent, path, query, time and authentication "+
+			"method of the request, and the issuer and selected claims of the token.")
+
+	fs.StringSliceVar(&o.Claims, "authorizer-input-claims", nil,
+		"Claims of the token added to the input document of version 'v2', such as 'email,acr'.")
+
+	fs.StringSliceVar(&o.CacheKeyFields, "authorizer-input-cache-key-fields", []string{"clientIP", "path", "authMethod"},
+		"Fields of the request in the input document of version 'v2' that cached decisions are keyed by, "+
+			"any of "+strings.Join(AuthorizerInputRequestFields.List(), ", ")+". The token is always part "+
+			"of the key. Decisions are not cached if 'time' is set, which policies relying on the time "+
+			"of the request should set unless they bound the TTL of their decisions.")
+}
+
+// Enabled returns whether requests are authorized by the proxy.
+func (o *AuthorizerOptions) Enabled() bool {
+	return len(o.Steps()) > 0
+}
+
+// Steps returns the names of the authorizers in the chain.
+func (o *AuthorizerOptions) Steps() []string {
+	if len(o.Chain) > 0 {
+		return o.Chain
+	}
+
+	if len(o.AuthorizerUri) > 0 || o.Rego.Enabled() {
+		return []string{AuthorizerOPA}
+	}
+
+	return nil
+}
+
+func (o *AuthorizerOptions) Validate() []error {
+	var errs []error
+
+	if o.FinalDecision != AuthorizerDecisionAllow && o.FinalDecision != AuthorizerDecisionDeny {
+		errs = append(errs, fmt.Errorf("--authorizer-final-decision must be 'allow' or 'deny', got %q", o.FinalDecision))
+	}
+
+	seen := sets.NewString()
+	for _, step := range o.Chain {
+		if seen.Has(step) {
+			errs = append(errs, fmt.Errorf("authorizer %q appears more than once in --authorizer-chain", step))
+			continue
+		}
+		seen.Insert(step)
+
+		switch step {
+		case AuthorizerOPA:
+			if len(o.AuthorizerUri) == 0 && !o.Rego.Enabled() {
+				errs = append(errs, fmt.Errorf("authorizer %q requires --authorizer-url or --authorizer-rego-paths", step))
+			}
+		case AuthorizerWebhook:
+			if len(o.WebhookConfigFile) == 0 {
+				errs = append(errs, fmt.Errorf("authorizer %q requires --authorizer-webhook-config-file", step))
+			}
+			if o.WebhookVersion != "v1" && o.WebhookVersion != "v1beta1" {
+				errs = append(errs, fmt.Errorf("--authorizer-webhook-version must be 'v1' or 'v1beta1', got %q", o.WebhookVersion))
+			}
+		case AuthorizerPolicy:
+			if len(o.PolicyFile) == 0 {
+				errs = append(errs, fmt.Errorf("authorizer %q requires --authorizer-policy-file", step))
+			}
+		case AuthorizerDeny:
+			if len(o.DenyRulesFile) == 0 {
+				errs = append(errs, fmt.Errorf("authorizer %q requires --authorizer-deny-rules-file", step))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown authorizer %q in --authorizer-chain", step))
+		}
+	}
+
+	if o.Cache.Size < 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-cache-size must not be negative, got %d", o.Cache.Size))
+	}
+
+	if o.Cache.AllowedTTL < 0 || o.Cache.DeniedTTL < 0 {
+		errs = append(errs, errors.New("--authorizer-cache-allowed-ttl and --authorizer-cache-denied-ttl must not be negative"))
+	}
+
+	if o.QueryTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-query-timeout must be positive, got %s", o.QueryTimeout))
+	}
+
+	if o.Client.Timeout < 0 || o.Client.RetryInitialInterval < 0 || o.Client.RetryMaxElapsedTime < 0 {
+		errs = append(errs, errors.New("--authorizer-timeout, --authorizer-retry-initial-interval and "+
+			"--authorizer-retry-max-elapsed-time must not be negative"))
+	}
+
+	if o.Client.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-max-retries must not be negative, got %d", o.Client.MaxRetries))
+	}
+
+	if o.Client.MaxResponseBytes <= 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-max-response-bytes must be positive, got %d", o.Client.MaxResponseBytes))
+	}
+
+	if (len(o.Client.CertFile) > 0) != (len(o.Client.KeyFile) > 0) {
+		errs = append(errs, errors.New("--authorizer-client-cert-file and --authorizer-client-key-file must be set together"))
+	}
+
+	switch o.Failure.Mode {
+	case "", AuthorizerFailureModeNoOpinion, AuthorizerFailureModeDeny, AuthorizerFailureModeAllowReadOnly, AuthorizerFailureModeUpstream:
+	default:
+		errs = append(errs, fmt.Errorf("--authorizer-failure-mode must be one of 'no-opinion', 'deny', "+
+			"'allow-read-only' or 'upstream', got %q", o.Failure.Mode))
+	}
+
+	if o.Failure.CircuitBreakerFailures < 0 || o.Failure.CircuitBreakerCooldown < 0 {
+		errs = append(errs, errors.New("--authorizer-circuit-breaker-failures and "+
+			"--authorizer-circuit-breaker-cooldown must not be negative"))
+	}
+
+	if len(o.AuthorizerUri) > 0 && o.Rego.Enabled() {
+		errs = append(errs, errors.New("--authorizer-url may not be set with --authorizer-rego-paths or --authorizer-rego-bundles"))
+	}
+
+	if o.Rego.Enabled() && len(o.Rego.Query) == 0 {
+		errs = append(errs, errors.New("--authorizer-rego-query must be set"))
+	}
+
+	if o.Rego.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-rego-reload-interval must not be negative, got %s", o.Rego.ReloadInterval))
+	}
+
+	if len(o.Shadow.Uri) > 0 && len(o.Shadow.RegoQuery) > 0 {
+		errs = append(errs, errors.New("--authorizer-shadow-url and --authorizer-shadow-rego-query may not both be set"))
+	}
+
+	if len(o.Shadow.RegoQuery) > 0 && !o.Rego.Enabled() {
+		errs = append(errs, errors.New("--authorizer-shadow-rego-query requires --authorizer-rego-paths or --authorizer-rego-bundles"))
+	}
+
+	if o.Shadow.Enabled() && o.Shadow.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-shadow-timeout must be positive, got %s", o.Shadow.Timeout))
+	}
+
+	if o.Shadow.Enabled() && !sets.NewString(o.Steps()...).Has(AuthorizerOPA) {
+		errs = append(errs, fmt.Errorf("a shadow policy is set but the %q authorizer is not enabled", AuthorizerOPA))
+	}
+
+	if _, err := o.Body.ParseRules(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(o.Body.Rules) > 0 && o.Body.MaxBytes <= 0 {
+		errs = append(errs, fmt.Errorf("--authorizer-body-max-bytes must be positive, got %d", o.Body.MaxBytes))
+	}
+
+	switch o.Input.Version {
+	case "", AuthorizerInputV1:
+		if len(o.Input.Claims) > 0 {
+			errs = append(errs, fmt.Errorf("--authorizer-input-claims requires --authorizer-input-version=%s", AuthorizerInputV2))
+		}
+	case AuthorizerInputV2:
+		for _, field := range o.Input.CacheKeyFields {
+			if !AuthorizerInputRequestFields.Has(field) {
+				errs = append(errs, fmt.Errorf("--authorizer-input-cache-key-fields must be any of %s, got %q",
+					strings.Join(AuthorizerInputRequestFields.List(), ", "), field))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("--authorizer-input-version must be one of '%s' or '%s', got %q",
+			AuthorizerInputV1, AuthorizerInputV2, o.Input.Version))
+	}
+
+	if len(o.FallbackUris) > 0 && len(o.AuthorizerUri) == 0 {
+		errs = append(errs, errors.New("--authorizer-fallback-urls requires --authorizer-url"))
+	}
+
+	if len(o.Chain) > 0 && len(o.AuthorizerUri) > 0 && !seen.Has(AuthorizerOPA) {
+		errs = append(errs, fmt.Errorf("--authorizer-url is set but %q is not in --authorizer-chain", AuthorizerOPA))
+	}
+
+	if len(o.Chain) > 0 && o.Rego.Enabled() && !seen.Has(AuthorizerOPA) {
+		errs = append(errs, fmt.Errorf("rego policies are set but %q is not in --authorizer-chain", AuthorizerOPA))
+	}
+
+	return errs
 }
@@ -15,6 +15,7 @@ type OIDCAuthenticationOptions struct {
 	IssuerURL      string
 	UsernameClaim  string
 	UsernamePrefix string
+	UIDClaim       string
 	GroupsClaim    string
 	GroupsPrefix   string
 	SigningAlgs    []string
@@ -53,6 +54,11 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 		"username claims other than 'email' are prefixed by the issuer URL to avoid "+
 		"clashes. To skip any prefixing, provide the value '-'.")
 
+	fs.StringVar(&o.UIDClaim, "oidc-uid-claim", "", ""+
+		"(Alpha) If provided, the OpenID claim to use as the user UID. The claim should "+
+		"be stable and unique per user, e.g. 'sub' or an object ID. The UID is forwarded "+
+		"to the API server using the Impersonate-Uid header.")
+
 	fs.StringVar(&o.GroupsClaim, "oidc-groups-claim", "", ""+
 		"If provided, the name of a custom OpenID Connect claim for specifying user groups. "+
 		"The claim value is expected to be a string or array of strings.")
@@ -82,15 +82,47 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		errs = append(errs, errors.New("unable to securely serve on port 8080 (used by readiness probe)"))
 	}
 
+	if o.App.MetricsPort != 0 &&
+		(o.App.MetricsPort == o.SecureServing.BindPort || o.App.MetricsPort == o.App.ReadinessProbePort) {
+		errs = append(errs, errors.New("--metrics-port must differ from the secure serving and readiness probe ports"))
+	}
+
 	if err := o.Audit.Validate(); len(err) > 0 {
 		errs = append(errs, err...)
 	}
 
+	if err := o.Authorizer.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
 	if o.App.DisableImpersonation &&
-		(o.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader || len(o.App.ExtraHeaderOptions.ExtraUserHeaders) > 0) {
+		(o.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader || len(o.App.ExtraHeaderOptions.ExtraUserHeaders) > 0 ||
+			len(o.App.ExtraHeaderOptions.ExtraUserHeaderTemplates) > 0) {
 		errs = append(errs, errors.New("cannot add extra user headers when impersonation disabled"))
 	}
 
+	if len(o.App.ImpersonationPolicy.File) > 0 && len(o.App.ImpersonationPolicy.URL) > 0 {
+		errs = append(errs, errors.New("only one of --impersonation-policy-file and --impersonation-policy-url may be set"))
+	}
+
+	if o.App.DisableImpersonation &&
+		(len(o.App.ImpersonationPolicy.File) > 0 || len(o.App.ImpersonationPolicy.URL) > 0) {
+		errs = append(errs, errors.New("cannot set an impersonation policy when impersonation disabled"))
+	}
+
+	if (len(o.App.FrontProxy.ClientCertFile) > 0) != (len(o.App.FrontProxy.ClientKeyFile) > 0) {
+		errs = append(errs, errors.New("--front-proxy-client-cert-file and --front-proxy-client-key-file must be set together"))
+	}
+
+	if o.App.DisableImpersonation && len(o.App.FrontProxy.ClientCertFile) > 0 {
+		errs = append(errs, errors.New("cannot use a front proxy client certificate when impersonation disabled"))
+	}
+
+	if o.App.TokenReviewEndpoint.Enabled &&
+		len(o.App.TokenReviewEndpoint.AllowedUsers) == 0 && len(o.App.TokenReviewEndpoint.AllowedGroups) == 0 {
+		errs = append(errs, errors.New("token review endpoint requires at least one allowed user or group"))
+	}
+
 	if o.Audit.DynamicOptions.Enabled {
 		errs = append(errs, errors.New("The flag --audit-dynamic-configuration may not be set"))
 	}
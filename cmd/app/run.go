@@ -2,7 +2,11 @@
 package app
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 	"k8s.io/apiserver/pkg/server"
@@ -10,9 +14,17 @@ import (
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer"
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/decisionlog"
 	"github.com/jetstack/kube-oidc-proxy/pkg/probe"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/cluster"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/ratelimit"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/upstream"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/userextra"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
 	"github.com/jetstack/kube-oidc-proxy/pkg/util"
 )
 
@@ -29,6 +41,12 @@ func NewRunCommand(stopCh <-chan struct{}) *cobra.Command {
 	return cmd
 }
 
+const (
+	// tracingShutdownTimeout is how long to wait for remaining spans and
+	// authorization decisions to be exported on shutdown.
+	tracingShutdownTimeout = time.Second * 5
+)
+
 // Proxy command
 func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Command {
 	return &cobra.Command{
@@ -39,8 +57,29 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return err
 			}
 
+			// Export traces if enabled
+			shutdownTracing, err := tracing.Setup(tracing.Options{
+				Endpoint:      opts.App.Tracing.Endpoint,
+				Headers:       opts.App.Tracing.Headers,
+				SamplingRatio: opts.App.Tracing.SamplingRatio,
+			})
+			if err != nil {
+				return err
+			}
+
+			// Log authorization decisions if enabled
+			shutdownDecisionLog, err := decisionlog.Setup(decisionlog.Options{
+				File:          opts.Authorizer.DecisionLog.File,
+				URL:           opts.Authorizer.DecisionLog.URL,
+				BufferSize:    opts.Authorizer.DecisionLog.BufferSize,
+				BatchSize:     opts.Authorizer.DecisionLog.BatchSize,
+				FlushInterval: opts.Authorizer.DecisionLog.FlushInterval,
+			})
+			if err != nil {
+				return err
+			}
+
 			// Here we determine to either use custom or 'in-cluster' client configuration
-			var err error
 			var restConfig *rest.Config
 			if opts.Client.ClientFlagsChanged(cmd) {
 				// One or more client flags have been set to use client flag built
@@ -73,21 +112,141 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return err
 			}
 
+			requestIDTrustedCIDRs, err := parseCIDRs(opts.App.RequestIDTrustedCIDRs)
+			if err != nil {
+				return err
+			}
+
+			clientIPTrustedCIDRs, err := parseCIDRs(opts.App.ClientIPTrustedCIDRs)
+			if err != nil {
+				return err
+			}
+
 			proxyConfig := &proxy.Config{
 				TokenReview:          opts.App.TokenPassthrough.Enabled,
 				DisableImpersonation: opts.App.DisableImpersonation,
 
+				FrontProxy:               len(opts.App.FrontProxy.ClientCertFile) > 0,
+				FrontProxyClientCertFile: opts.App.FrontProxy.ClientCertFile,
+				FrontProxyClientKeyFile:  opts.App.FrontProxy.ClientKeyFile,
+
+				TerminateExpiredLongRunning:         opts.App.LongRunning.TerminateOnExpiry,
+				LongRunningExpiryGracePeriod:        opts.App.LongRunning.ExpiryGracePeriod,
+				LongRunningReauthenticationInterval: opts.App.LongRunning.ReauthenticationInterval,
+
+				RequestIDTrustedCIDRs: requestIDTrustedCIDRs,
+				ClientIPTrustedCIDRs:  clientIPTrustedCIDRs,
+
+				Upstream: upstream.Options{
+					Endpoints:           opts.App.Upstream.Endpoints,
+					Balancer:            opts.App.Upstream.Balancer,
+					HealthCheckInterval: opts.App.Upstream.HealthCheckInterval,
+					EjectionDuration:    opts.App.Upstream.EjectionDuration,
+					MaxRetries:          opts.App.Upstream.MaxRetries,
+				},
+
 				FlushInterval:   opts.App.FlushInterval,
 				ExternalAddress: opts.SecureServing.BindAddress.String(),
 
 				ExtraUserHeaders:                opts.App.ExtraHeaderOptions.ExtraUserHeaders,
 				ExtraUserHeadersClientIPEnabled: opts.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader,
-				Authorizer:                      len(opts.Authorizer.AuthorizerUri) > 0,
+				Authorizer:                      opts.Authorizer.Enabled(),
+
+				SelfSubjectReviewTokenClaims: opts.App.SelfSubjectReviewTokenClaims,
+
+				TokenReviewEndpoint:              opts.App.TokenReviewEndpoint.Enabled,
+				TokenReviewEndpointAllowedUsers:  opts.App.TokenReviewEndpoint.AllowedUsers,
+				TokenReviewEndpointAllowedGroups: opts.App.TokenReviewEndpoint.AllowedGroups,
+				TokenReviewEndpointClientCAFile:  opts.App.TokenReviewEndpoint.ClientCAFile,
+			}
+			// Parse extra user header templates if set
+			if len(opts.App.ExtraHeaderOptions.ExtraUserHeaderTemplates) > 0 {
+				proxyConfig.ExtraUserHeaderTemplates, err = userextra.New(opts.App.ExtraHeaderOptions.ExtraUserHeaderTemplates)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise rate limiter if any limits are set
+			if len(opts.App.RateLimit.QPS) > 0 || len(opts.App.RateLimit.TotalQPS) > 0 {
+				proxyConfig.RateLimiter, err = newRateLimiter(&opts.App.RateLimit)
+				if err != nil {
+					return err
+				}
 			}
+
+			// Initialise in flight limiter if any limits are set
+			if len(opts.App.InFlight.Limits) > 0 || len(opts.App.InFlight.PerUserLimits) > 0 {
+				proxyConfig.InFlightLimiter, err = newInFlightLimiter(&opts.App.InFlight)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise user impersonation policy if enabled
+			switch {
+			case len(opts.App.ImpersonationPolicy.File) > 0:
+				proxyConfig.ImpersonationPolicy, err = impersonation.LoadStaticPolicy(opts.App.ImpersonationPolicy.File)
+				if err != nil {
+					return err
+				}
+			case len(opts.App.ImpersonationPolicy.URL) > 0:
+				policy, err := authorizer.NewOPAPolicy(&options.AuthorizerOptions{
+					AuthorizerUri: opts.App.ImpersonationPolicy.URL,
+					QueryTimeout:  opts.Authorizer.QueryTimeout,
+					Cache:         opts.Authorizer.Cache,
+					Client:        opts.Authorizer.Client,
+				})
+				if err != nil {
+					return err
+				}
+				proxyConfig.ImpersonationPolicy = policy
+			}
+
+			// Load additional upstream clusters if set
+			if len(opts.App.Clusters.File) > 0 {
+				clusters, err := cluster.LoadFile(opts.App.Clusters.File)
+				if err != nil {
+					return err
+				}
+				proxyConfig.Clusters = append(proxyConfig.Clusters, clusters...)
+			}
+			if len(opts.App.Clusters.Kubeconfig) > 0 {
+				clusters, err := cluster.LoadKubeconfig(opts.App.Clusters.Kubeconfig)
+				if err != nil {
+					return err
+				}
+				proxyConfig.Clusters = append(proxyConfig.Clusters, clusters...)
+			}
+			// Requests routed to a cluster are authorized by the Open Policy
+			// Agent of the cluster if set, and otherwise by the authorizers of
+			// the default cluster built with the credentials of the cluster.
+			for _, c := range proxyConfig.Clusters {
+				if len(c.AuthorizerURL) > 0 {
+					// Built as a chain so that its decisions are logged.
+					c.Authorizer, err = authorizer.New(c.RESTConfig, &options.AuthorizerOptions{
+						AuthorizerUri: c.AuthorizerURL,
+						QueryTimeout:  opts.Authorizer.QueryTimeout,
+						Cache:         opts.Authorizer.Cache,
+						Client:        opts.Authorizer.Client,
+						Failure:       opts.Authorizer.Failure,
+					})
+					if err != nil {
+						return fmt.Errorf("cluster %q: %s", c.Name, err)
+					}
+					continue
+				}
+
+				c.Authorizer, err = authorizer.New(c.RESTConfig, opts.Authorizer)
+				if err != nil {
+					return fmt.Errorf("cluster %q: %s", c.Name, err)
+				}
+			}
+
 			// Initialize authorizer if enabled
-			var authz *authorizer.OPAAuthorizer
-			if proxyConfig.Authorizer {
-				authz = authorizer.NewOPAAuthorizer(restConfig, opts.Authorizer)
+			authz, err := authorizer.New(restConfig, opts.Authorizer)
+			if err != nil {
+				return err
 			}
 
 			// Initialise proxy with OIDC token authenticator
@@ -109,6 +268,13 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return err
 			}
 
+			// Start dedicated metrics listener
+			if opts.App.MetricsPort != 0 {
+				if err := probe.RunMetrics(strconv.Itoa(opts.App.MetricsPort)); err != nil {
+					return err
+				}
+			}
+
 			// Run proxy
 			waitCh, err := p.Run(stopCh)
 			if err != nil {
@@ -121,7 +287,67 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return err
 			}
 
-			return nil
+			// Flush any remaining decisions and spans
+			ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+
+			decisionLogErr := shutdownDecisionLog(ctx)
+			if err := shutdownTracing(ctx); err != nil {
+				return err
+			}
+
+			return decisionLogErr
 		},
 	}
 }
+
+func newRateLimiter(opts *options.RateLimitOptions) (*ratelimit.Limiter, error) {
+	limits, err := ratelimit.ParseLimits(opts.QPS, opts.Burst)
+	if err != nil {
+		return nil, err
+	}
+
+	totalLimits, err := ratelimit.ParseLimits(opts.TotalQPS, opts.TotalBurst)
+	if err != nil {
+		return nil, err
+	}
+
+	return ratelimit.New(ratelimit.Options{
+		Key:          opts.Key,
+		Limits:       limits,
+		TotalLimits:  totalLimits,
+		QueueLength:  opts.QueueLength,
+		QueueTimeout: opts.QueueTimeout,
+	})
+}
+
+func newInFlightLimiter(opts *options.InFlightOptions) (*inflight.Limiter, error) {
+	limits, err := inflight.ParseLimits(opts.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	perUserLimits, err := inflight.ParseLimits(opts.PerUserLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	return inflight.New(inflight.Options{
+		Limits:        limits,
+		PerUserLimits: perUserLimits,
+		ExemptGroups:  opts.ExemptGroups,
+	}), nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
@@ -6,41 +6,223 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net/http"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/authzcache"
 	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/clusterinfo"
-	"github.com/taskcluster/httpbackoff"
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/decisionlog"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/authorization/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sJson "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	k8saudit "k8s.io/apiserver/pkg/audit"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
 
+const (
+	// decisionAttributeKey is the span attribute of an authorization decision.
+	decisionAttributeKey = attribute.Key("kube_oidc_proxy.authorization.decision")
+
+	// degradedAttributeKey is the span attribute of the failure mode a
+	// decision was made with, as Open Policy Agent could not be queried.
+	degradedAttributeKey = attribute.Key("kube_oidc_proxy.authorization.degraded")
+
+	// AuditDegradedKey is the audit annotation of the failure mode a decision
+	// was made with, as Open Policy Agent could not be queried.
+	AuditDegradedKey = "kube-oidc-proxy.jetstack.io/authorizer-degraded"
+)
+
+// Interface is an authorizer which the proxy authorizes requests with.
+type Interface interface {
+	authorizer.Authorizer
+
+	// WithRequest authorizes requests before they are served by the handler.
+	WithRequest(handler http.Handler) http.Handler
+}
+
+// rulesResolver is an authorizer which may answer rules queries.
+type rulesResolver interface {
+	authorizer.RuleResolver
+
+	HasRules() bool
+}
+
 // Open Policy Agent authorizer
 type OPAAuthorizer struct {
-	opaURI        string
+	endpoints     []*opaEndpoint
+	rego          *regoEvaluator
+	rulesURI      string
 	cacher        *authzcache.OPACache
+	client        *opaClient
+	cacheOpts     options.AuthorizerCacheOptions
+	inflight      queryGroup
+	queryTimeout  time.Duration
+	failureMode   string
+	upstream      authorizer.Authorizer
+	noDecisionLog bool
+	shadow        bool
+	bodies        *requestBodies
+	input         *requestInput
 	restConfig    *rest.Config
 	userExtraData *clusterinfo.ClusterInfo
 }
+
+// decisionInfo records how a decision was made, for the decision log.
+type decisionInfo struct {
+	input    *v1.SubjectAccessReview
+	payload  []byte
+	result   *v1.SubjectAccessReview
+	revision string
+	cacheHit bool
+	err      error
+}
+
+// opaEndpoint is an Open Policy Agent endpoint decisions are queried from.
+type opaEndpoint struct {
+	uri     string
+	breaker *circuitBreaker
+}
+
+func newOPAEndpoints(uris []string, opts *options.AuthorizerFailureOptions) []*opaEndpoint {
+	endpoints := make([]*opaEndpoint, 0, len(uris))
+	for _, uri := range uris {
+		endpoints = append(endpoints, &opaEndpoint{
+			uri:     uri,
+			breaker: newCircuitBreaker(opts.CircuitBreakerFailures, opts.CircuitBreakerCooldown),
+		})
+	}
+	return endpoints
+}
+
+var _ Interface = &OPAAuthorizer{}
+
 type opaResponse struct {
-	Result v1.SubjectAccessReview
+	Result     v1.SubjectAccessReview
+	Provenance *opaProvenance `json:"provenance,omitempty"`
+}
+
+// opaProvenance is returned by Open Policy Agent when queried with the
+// 'provenance' parameter, and holds the revisions of the policy bundles.
+type opaProvenance struct {
+	Revision string                       `json:"revision,omitempty"`
+	Bundles  map[string]opaBundleRevision `json:"bundles,omitempty"`
+}
+
+type opaBundleRevision struct {
+	Revision string `json:"revision"`
+}
+
+// revision returns the revision of the policy the decision was made with, or
+// an empty string if unknown.
+func (p *opaProvenance) revision() string {
+	if p == nil {
+		return ""
+	}
+
+	if len(p.Bundles) == 0 {
+		return p.Revision
+	}
+
+	names := make([]string, 0, len(p.Bundles))
+	for name := range p.Bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	revisions := make([]string, 0, len(names))
+	for _, name := range names {
+		revisions = append(revisions, name+"="+p.Bundles[name].Revision)
+	}
+
+	return strings.Join(revisions, ",")
+}
+
+func NewOPAAuthorizer(restConfig *rest.Config, opts *options.AuthorizerOptions) (*OPAAuthorizer, error) {
+	shared, err := newSharedHandlers(restConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newOPAAuthorizer(restConfig, opts, shared)
 }
 
-func NewOPAAuthorizer(restConfig *rest.Config, opts *options.AuthorizerOptions) *OPAAuthorizer {
+// NewOPAPolicy returns an Open Policy Agent authorizer which only queries the
+// policy, such as a user impersonation policy. Unlike NewOPAAuthorizer, it
+// does not authorize requests with the API server or read their bodies, so it
+// cannot serve requests.
+func NewOPAPolicy(opts *options.AuthorizerOptions) (*OPAAuthorizer, error) {
+	return newOPAAuthorizer(nil, opts, &sharedHandlers{})
+}
+
+// newOPAAuthorizer returns the Open Policy Agent authorizer using the shared
+// upstream authorizer, request bodies and request input.
+func newOPAAuthorizer(restConfig *rest.Config, opts *options.AuthorizerOptions, shared *sharedHandlers) (*OPAAuthorizer, error) {
+	registerMetrics()
+	client, err := newOPAClient(&opts.Client)
+	if err != nil {
+		return nil, err
+	}
 	ue, err := clusterinfo.FromUrl(opts.ExtrasPath, opts.ExtrasAnnotationPrefix)
 	if err != nil {
 		klog.Error(err.Error())
 		ue = nil
 	}
-	return &OPAAuthorizer{restConfig: restConfig, opaURI: opts.AuthorizerUri, cacher: authzcache.NewOPACache(), userExtraData: ue}
+	var cacher *authzcache.OPACache
+	if opts.Cache.Size > 0 {
+		cacher = authzcache.NewOPACache(opts.Cache.Size)
+	}
+	var evaluator *regoEvaluator
+	if opts.Rego.Enabled() {
+		evaluator, err = newRegoEvaluator(&opts.Rego)
+		if err != nil {
+			return nil, err
+		}
+	}
+	queryTimeout := opts.QueryTimeout
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+	endpoints := newOPAEndpoints(append([]string{opts.AuthorizerUri}, opts.FallbackUris...), &opts.Failure)
+	return &OPAAuthorizer{restConfig: restConfig, endpoints: endpoints, rego: evaluator, rulesURI: opts.RulesUri, client: client, cacher: cacher, cacheOpts: opts.Cache,
+		queryTimeout: queryTimeout, failureMode: opts.Failure.Mode, upstream: shared.upstream, bodies: shared.bodies, input: shared.input, userExtraData: ue}, nil
+}
+
+// sharedHandlers are the upstream authorizer, request bodies and request input
+// of authorizers, which are used both to authorize requests and by the
+// handlers of requests. A chain builds them once for all of its authorizers.
+type sharedHandlers struct {
+	upstream authorizer.Authorizer
+	bodies   *requestBodies
+	input    *requestInput
+}
+
+func newSharedHandlers(restConfig *rest.Config, opts *options.AuthorizerOptions) (*sharedHandlers, error) {
+	shared := &sharedHandlers{input: newRequestInput(&opts.Input)}
+
+	var err error
+	if restConfig != nil {
+		if shared.upstream, err = NewUpstreamAuthorizer(restConfig); err != nil {
+			return nil, err
+		}
+	}
+	if shared.bodies, err = newRequestBodies(restConfig, &opts.Body); err != nil {
+		return nil, err
+	}
+
+	return shared, nil
 }
 
 func convertToV1Authz(clusterinfo map[string][]string) map[string]v1.ExtraValue {
@@ -74,6 +256,7 @@ func NewSubjectAccessReviewFromAttributes(attrs authorizer.Attributes) *v1.Subje
 				Verb: attrs.GetVerb(),
 			},
 			User:   attrs.GetUser().GetName(),
+			UID:    attrs.GetUser().GetUID(),
 			Groups: attrs.GetUser().GetGroups(),
 			Extra:  userExtraValues,
 		},
@@ -90,7 +273,84 @@ func NewSubjectAccessReviewFromAttributes(attrs authorizer.Attributes) *v1.Subje
 // }
 
 func (a *OPAAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
-	return a.authorize(ctx, attrs, authzRequestFunc(a.opaURI))
+	ctx, span := tracing.Start(ctx, "opa")
+	defer span.End()
+
+	info := &decisionInfo{}
+	var rc *requestContext
+	if a.input != nil {
+		rc = requestContextFrom(ctx)
+	}
+	decision, reason, err := a.authorize(ctx, attrs, a.authzRequestFunc(ctx, info, requestObjectFrom(ctx), rc))
+	span.SetAttributes(decisionAttributeKey.String(decisionString(decision)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	if record := decisionRecordFrom(ctx); record != nil && !a.noDecisionLog {
+		a.recordDecision(record, info)
+	}
+
+	return decision, reason, err
+}
+
+// recordDecision adds how the decision was made to the record of the
+// authorization of the request, logged by the chain.
+func (a *OPAAuthorizer) recordDecision(record *decisionlog.Record, info *decisionInfo) {
+	record.Path = a.decisionPath()
+	record.Revision = info.revision
+	record.CacheHit = info.cacheHit
+	if len(info.payload) > 0 {
+		var payload struct {
+			Input map[string]json.RawMessage `json:"input"`
+		}
+		if err := json.Unmarshal(info.payload, &payload); err == nil {
+			// Request objects may hold secrets, and the old object is read
+			// with the credentials of the proxy, so neither is logged.
+			delete(payload.Input, "object")
+			delete(payload.Input, "oldObject")
+			record.Input = payload.Input
+		}
+	} else if info.input != nil {
+		record.Input = info.input
+	}
+	switch {
+	case info.result != nil:
+		record.Result = info.result.Status
+	case info.err != nil && !unavailable(info.err):
+		record.Error = info.err.Error()
+	default:
+		record.Degraded = a.failureModeName()
+	}
+}
+
+// decisionPath returns the query or endpoint decisions are made by.
+func (a *OPAAuthorizer) decisionPath() string {
+	if a.rego != nil {
+		return a.rego.query
+	}
+	return a.endpoints[0].uri
+}
+
+// failureModeName returns the failure mode requests are authorized with when
+// Open Policy Agent cannot be queried.
+func (a *OPAAuthorizer) failureModeName() string {
+	if len(a.failureMode) == 0 {
+		return options.AuthorizerFailureModeNoOpinion
+	}
+	return a.failureMode
+}
+
+func decisionString(decision authorizer.Decision) string {
+	switch decision {
+	case authorizer.DecisionAllow:
+		return "allow"
+	case authorizer.DecisionDeny:
+		return "deny"
+	default:
+		return "no_opinion"
+	}
 }
 
 func (a *OPAAuthorizer) authorize(ctx context.Context, attrs authorizer.Attributes, authzFn func(*v1.SubjectAccessReview, *authzcache.OPACache) (*v1.SubjectAccessReview, error)) (authorizer.Decision, string, error) {
@@ -98,8 +358,15 @@ func (a *OPAAuthorizer) authorize(ctx context.Context, attrs authorizer.Attribut
 	// a.addClusterInfo(&sar.Spec.Extra)
 	// request authorizer
 	responseSAR, err := authzFn(sar, a.cacher)
+	if err != nil && (ctx.Err() != nil || !unavailable(err)) {
+		// Errors of the query itself, such as invalid policy results, are
+		// not authorized with the failure mode, so that requests cannot be
+		// crafted to be authorized by it. Nor are requests which were
+		// cancelled while waiting on the query.
+		return authorizer.DecisionNoOpinion, "", err
+	}
 	if responseSAR == nil || err != nil {
-		return authorizer.DecisionNoOpinion, "I have no idea about it", err
+		return a.degraded(ctx, attrs, err)
 	}
 	if responseSAR.Status.Denied {
 		return authorizer.DecisionDeny, responseSAR.Status.Reason, nil
@@ -108,61 +375,222 @@ func (a *OPAAuthorizer) authorize(ctx context.Context, attrs authorizer.Attribut
 	if !responseSAR.Status.Allowed {
 		return authorizer.DecisionNoOpinion, responseSAR.Status.Reason, nil
 	}
-	if a.cacher != nil {
-		cachePositive, err := json.Marshal(responseSAR)
-		if err == nil {
-			cacheKey, err := createOpaRequestPayload(sar)
-			if err == nil {
-				if err = a.cacher.Put(string(cacheKey), cachePositive); err != nil {
-					klog.Error(err.Error())
-				}
-			}
-		} else {
-			klog.Errorf("error marshaling SAR: %s", err.Error())
+	return authorizer.DecisionAllow, responseSAR.Status.Reason, nil
+}
+
+// degraded authorizes the request with the failure mode, as Open Policy Agent
+// could not be queried. The decision is recorded as an annotation of the
+// audit event.
+func (a *OPAAuthorizer) degraded(ctx context.Context, attrs authorizer.Attributes, err error) (authorizer.Decision, string, error) {
+	mode := a.failureModeName()
+
+	// Decisions of shadow policies are not enforced.
+	if !a.shadow {
+		opaDegradedDecisions.WithLabelValues(mode).Inc()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(degradedAttributeKey.String(mode))
+	if ae := genericapirequest.AuditEventFrom(ctx); ae != nil {
+		k8saudit.LogAnnotation(ae, AuditDegradedKey, mode)
+	}
+
+	if mode != options.AuthorizerFailureModeNoOpinion {
+		klog.Errorf("[%s] Authorizing request with failure mode %q: %s", proxycontext.RequestIDFrom(ctx), mode, err)
+	}
+
+	switch mode {
+	case options.AuthorizerFailureModeDeny:
+		return authorizer.DecisionDeny, "authorizer is unavailable", nil
+	case options.AuthorizerFailureModeAllowReadOnly:
+		if attrs.IsReadOnly() {
+			return authorizer.DecisionAllow, "authorizer is unavailable, read-only request allowed", nil
 		}
+		return authorizer.DecisionDeny, "authorizer is unavailable, only read-only requests are allowed", nil
+	case options.AuthorizerFailureModeUpstream:
+		if a.upstream == nil {
+			return authorizer.DecisionNoOpinion, "authorizer is unavailable", err
+		}
+		return a.upstream.Authorize(ctx, attrs)
+	default:
+		return authorizer.DecisionNoOpinion, "I have no idea about it", err
 	}
-	return authorizer.DecisionAllow, responseSAR.Status.Reason, nil
 }
 
-func authzRequestFunc(uri string) func(*v1.SubjectAccessReview, *authzcache.OPACache) (*v1.SubjectAccessReview, error) {
-	return func(sar *v1.SubjectAccessReview, cache *authzcache.OPACache) (*v1.SubjectAccessReview, error) {
-		var resp opaResponse
+// authzRequestFunc returns the function querying the decision, recording how
+// it was made in info. The context and object of the request are added to the
+// input if set. Decisions of requests with an object, or whose time is part
+// of the cache key, are not cached.
+func (a *OPAAuthorizer) authzRequestFunc(ctx context.Context, info *decisionInfo, obj *requestObject, rc *requestContext) func(*v1.SubjectAccessReview, *authzcache.OPACache) (*v1.SubjectAccessReview, error) {
+	return func(sar *v1.SubjectAccessReview, cache *authzcache.OPACache) (_ *v1.SubjectAccessReview, err error) {
+		defer func() { info.err = err }()
+
+		info.input = sar
 		jsonPayload, err := createOpaRequestPayload(sar)
 		if err != nil {
 			return nil, err
 		}
+		cacheKey := jsonPayload
+		if rc != nil {
+			if jsonPayload, err = addInputFields(jsonPayload, rc); err != nil {
+				return nil, err
+			}
+			info.payload = jsonPayload
+
+			if key, ok := a.input.cacheKey(rc); ok {
+				if cacheKey, err = addInputFields(cacheKey, key); err != nil {
+					return nil, err
+				}
+			} else {
+				cacheKey = jsonPayload
+				cache = nil
+			}
+		}
+		if obj != nil {
+			if jsonPayload, err = addInputFields(jsonPayload, obj); err != nil {
+				return nil, err
+			}
+			info.payload = jsonPayload
+			cacheKey = jsonPayload
+			cache = nil
+		}
 		// check cache
 		if cache != nil {
-			bytes, ok := cache.Get(string(jsonPayload))
+			bytes, ok := cache.Get(string(cacheKey))
 			if ok {
 				cachedResponse := &v1.SubjectAccessReview{}
 				err := json.Unmarshal(bytes, cachedResponse)
 				if err == nil {
+					info.result = cachedResponse
+					info.revision = cache.Revision()
+					info.cacheHit = true
 					return cachedResponse, nil
 				}
 			}
 		}
-		backoffClient := httpbackoff.Client{BackOffSettings: backoff.NewExponentialBackOff()}
-		backoffClient.BackOffSettings.MaxElapsedTime = time.Second * 5
-		authzResponse, _, err := backoffClient.Post(uri, "application/json", jsonPayload)
+		// Identical queries made while one is in flight share its response,
+		// rather than each querying Open Policy Agent.
+		resp, err, shared := a.inflight.do(ctx, string(cacheKey), a.queryTimeout, func(ctx context.Context) (opaResponse, error) {
+			return a.queryOPA(ctx, jsonPayload, cacheKey, cache)
+		})
+		if shared {
+			opaCoalescedRequests.Inc()
+		}
 		if err != nil {
-			klog.Errorf("Authorization server is not responding: %s", err.Error())
 			return nil, err
 		}
-		defer authzResponse.Body.Close()
-		// if authzResponse.StatusCode != 200 {
-		// 	return nil, fmt.Errorf("response code not HTTP.OK: %d", authzResponse.StatusCode)
-		// }
-		bodyBytes := make([]byte, 2048)
-		bytesRead, err := authzResponse.Body.Read(bodyBytes)
-		if err != nil && err != io.EOF {
-			klog.Errorf("Error reading Authz response body: %s", err.Error())
-			return nil, err
+		// Each caller gets its own copy of the shared response.
+		responseSAR := resp.Result
+		info.result = &responseSAR
+		info.revision = resp.Provenance.revision()
+		return &responseSAR, nil
+	}
+}
+
+// queryOPA posts the query to Open Policy Agent, or evaluates it with the
+// Rego policies loaded into the proxy, and caches the decision under the key.
+func (a *OPAAuthorizer) queryOPA(ctx context.Context, jsonPayload, cacheKey []byte, cache *authzcache.OPACache) (opaResponse, error) {
+	var resp opaResponse
+	var body json.RawMessage
+	var err error
+	if a.rego != nil {
+		err = a.rego.eval(ctx, jsonPayload, &body)
+	} else {
+		err = a.postEndpoints(ctx, jsonPayload, &body)
+	}
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	if cache != nil {
+		// Decisions made with a previous revision of the policy are no
+		// longer valid.
+		cache.ObserveRevision(resp.Provenance.revision())
+		cached, err := json.Marshal(&resp.Result)
+		if err == nil {
+			if err = cache.Put(string(cacheKey), cached, cacheTTL(body, &resp.Result, a.cacheOpts)); err != nil {
+				klog.Errorf("[%s] %s", proxycontext.RequestIDFrom(ctx), err)
+			}
+		} else {
+			klog.Errorf("[%s] error marshaling SAR: %s", proxycontext.RequestIDFrom(ctx), err)
+		}
+	}
+	return resp, nil
+}
+
+// postEndpoints queries each endpoint in turn until one responds, skipping
+// those with an open circuit breaker. Only endpoints which are unavailable
+// count as failures of their circuit breaker, errors of the query itself are
+// returned without querying other endpoints.
+func (a *OPAAuthorizer) postEndpoints(ctx context.Context, jsonPayload []byte, body *json.RawMessage) error {
+	var errs []error
+	for _, e := range a.endpoints {
+		if !e.breaker.allow() {
+			errs = append(errs, fmt.Errorf("%s: %s", e.uri, errCircuitOpen))
+			continue
+		}
+
+		err := a.client.post(ctx, e.uri, jsonPayload, a.client.maxResponseBytes, body)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			// The query was abandoned, which says nothing of the endpoint.
+			return err
+		}
+		if err != nil && unavailable(err) {
+			e.breaker.failure()
+			errs = append(errs, fmt.Errorf("%s: %s", e.uri, err))
+			continue
+		}
+
+		// The endpoint responded, even if the query failed.
+		e.breaker.success()
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.uri, err)
 		}
-		bodyBytes = bodyBytes[:bytesRead]
-		err = json.Unmarshal(bodyBytes, &resp)
-		return &resp.Result, err
+		return nil
 	}
+
+	return &unavailableError{utilerrors.NewAggregate(errs)}
+}
+
+// cacheTTL returns how long the decision is cached for. This is the value of
+// the TTL field of the result if configured and set, or otherwise the TTL of
+// allowed or denied decisions.
+func cacheTTL(body []byte, sar *v1.SubjectAccessReview, opts options.AuthorizerCacheOptions) time.Duration {
+	if len(opts.TTLField) > 0 {
+		var resp struct {
+			Result map[string]json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(body, &resp); err == nil {
+			if raw, ok := resp.Result[opts.TTLField]; ok {
+				ttl, err := parseTTL(raw)
+				if err == nil {
+					return ttl
+				}
+				klog.Errorf("invalid cache TTL %s in authorizer response: %s", raw, err)
+			}
+		}
+	}
+
+	if sar.Status.Allowed && !sar.Status.Denied {
+		return opts.AllowedTTL
+	}
+
+	return opts.DeniedTTL
+}
+
+// parseTTL parses a TTL given as a number of seconds or a duration string.
+func parseTTL(raw json.RawMessage) (time.Duration, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, err
+	}
+
+	return time.ParseDuration(s)
 }
 
 func createOpaRequestPayload(sar *v1.SubjectAccessReview) ([]byte, error) {
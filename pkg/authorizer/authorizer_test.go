@@ -3,22 +3,28 @@
 package authorizer
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
-	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/authzcache"
 	v1 "k8s.io/api/authorization/v1"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
 )
 
 type userInfoT struct {
@@ -66,6 +72,31 @@ var testAccess = attrsType{
 	},
 }
 
+func newTestOPAAuthorizer(t *testing.T, opts *options.AuthorizerOptions) *OPAAuthorizer {
+	t.Helper()
+	a, err := NewOPAAuthorizer(nil, opts)
+	if err != nil {
+		t.Fatalf("failed to create authorizer: %s", err)
+	}
+	return a
+}
+
+func TestNewOPAPolicy(t *testing.T) {
+	a, err := NewOPAPolicy(&options.AuthorizerOptions{
+		AuthorizerUri: "http://localhost:8181/v1/data/impersonation",
+		Body:          options.AuthorizerBodyOptions{Rules: []string{"create:pods"}, MaxBytes: 1024},
+		Input:         options.AuthorizerInputOptions{Version: options.AuthorizerInputV2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.upstream != nil || a.bodies != nil || a.input != nil {
+		t.Errorf("expected policy only to query Open Policy Agent, got upstream=%v bodies=%v input=%v",
+			a.upstream, a.bodies, a.input)
+	}
+}
+
 func alwaysDeny(sar *v1.SubjectAccessReview, cache *authzcache.OPACache) (*v1.SubjectAccessReview, error) {
 	sar.Status.Denied = true
 	sar.Status.Allowed = true
@@ -88,11 +119,11 @@ func notAllowed(sar *v1.SubjectAccessReview, cache *authzcache.OPACache) (*v1.Su
 }
 
 func authzError(sar *v1.SubjectAccessReview, cache *authzcache.OPACache) (*v1.SubjectAccessReview, error) {
-	return sar, fmt.Errorf("oops, something goes wrong")
+	return sar, &unavailableError{fmt.Errorf("oops, something goes wrong")}
 }
 
 func TestDecision(t *testing.T) {
-	authzer := NewOPAAuthorizer(nil, &options.AuthorizerOptions{AuthorizerUri: "localhost:8080"})
+	authzer := newTestOPAAuthorizer(t, &options.AuthorizerOptions{AuthorizerUri: "localhost:8080"})
 	decision, reason, err := authzer.authorize(context.Background(), testAccess, alwaysDeny)
 	if err != nil {
 		t.Error(err.Error())
@@ -124,7 +155,7 @@ func TestHttpAuthorizer(t *testing.T) {
 	testURI := "http://127.0.0.1:32700"
 	testUrlParsed, _ := url.Parse(testURI)
 	testContext, cancelFn := context.WithCancel(context.Background())
-	cache := authzcache.NewOPACache()
+	cache := authzcache.NewOPACache(0)
 	go func(ctx context.Context) {
 		mux := http.NewServeMux()
 		srv := &http.Server{
@@ -161,15 +192,15 @@ func TestHttpAuthorizer(t *testing.T) {
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
-	a := NewOPAAuthorizer(nil, &options.AuthorizerOptions{AuthorizerUri: testURI})
-	a.cacher = authzcache.NewOPACache()
-	a.opaURI = strings.Join([]string{testURI, "/404/"}, "")
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{AuthorizerUri: testURI})
+	a.cacher = authzcache.NewOPACache(0)
+	a.endpoints = newOPAEndpoints([]string{testURI + "/404/"}, &options.AuthorizerFailureOptions{})
 	decision, _, err := a.Authorize(testContext, testAccess)
 	if err == nil {
 		t.Error("must be 404")
 	}
 	fmt.Println(err.Error())
-	a.opaURI = strings.Join([]string{testURI, "/deny/"}, "")
+	a.endpoints = newOPAEndpoints([]string{testURI + "/deny/"}, &options.AuthorizerFailureOptions{})
 	decision, _, err = a.Authorize(testContext, testAccess)
 	if err != nil {
 		t.Error(err.Error())
@@ -177,7 +208,7 @@ func TestHttpAuthorizer(t *testing.T) {
 	if decision != authorizer.DecisionDeny {
 		t.Error("must be denied but no")
 	}
-	a.opaURI = strings.Join([]string{testURI, "/allow/"}, "")
+	a.endpoints = newOPAEndpoints([]string{testURI + "/allow/"}, &options.AuthorizerFailureOptions{})
 	decision, _, err = a.Authorize(testContext, testAccess)
 	if err != nil {
 		t.Error(err.Error())
@@ -200,3 +231,503 @@ func (rw testRW) Header() http.Header {
 }
 func (rw testRW) WriteHeader(code int) {
 }
+
+func TestRulesFor(t *testing.T) {
+	var gotInput map[string]rulesReviewInput
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&gotInput); err != nil {
+			t.Errorf("failed to decode rules query: %s", err)
+		}
+		response, _ := json.Marshal(opaRulesResponse{Result: v1.SubjectRulesReviewStatus{
+			ResourceRules: []v1.ResourceRule{{
+				Verbs:     []string{"get"},
+				APIGroups: []string{""},
+				Resources: []string{"pods"},
+			}},
+			NonResourceRules: []v1.NonResourceRule{{
+				Verbs:           []string{"get"},
+				NonResourceURLs: []string{"/version"},
+			}},
+		}})
+		rw.Write(response)
+	}))
+	defer srv.Close()
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{})
+	if a.HasRules() {
+		t.Error("expected authorizer to have no rules")
+	}
+	if _, _, _, err := a.RulesFor(testAccess.user, "default"); err == nil {
+		t.Error("expected error with no rules url")
+	}
+
+	a = newTestOPAAuthorizer(t, &options.AuthorizerOptions{RulesUri: srv.URL})
+	resourceRules, nonResourceRules, incomplete, err := a.RulesFor(testAccess.user, "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if incomplete {
+		t.Error("expected rules to be complete")
+	}
+
+	if len(resourceRules) != 1 || resourceRules[0].GetResources()[0] != "pods" {
+		t.Errorf("got unexpected resource rules: %#v", resourceRules)
+	}
+
+	if len(nonResourceRules) != 1 || nonResourceRules[0].GetNonResourceURLs()[0] != "/version" {
+		t.Errorf("got unexpected non-resource rules: %#v", nonResourceRules)
+	}
+
+	if input := gotInput["input"]; input.User != "testme" || input.Namespace != "default" || len(input.Groups) != 2 {
+		t.Errorf("got unexpected rules query input: %#v", input)
+	}
+}
+
+func TestSubjectAccessReviewUID(t *testing.T) {
+	sar := NewSubjectAccessReviewFromAttributes(testAccess)
+	if sar.Spec.UID != "xuy" {
+		t.Errorf("got unexpected uid in subject access review, exp=%q got=%q", "xuy", sar.Spec.UID)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	opts := options.AuthorizerCacheOptions{
+		AllowedTTL: time.Minute,
+		DeniedTTL:  time.Second * 10,
+		TTLField:   "ttl",
+	}
+
+	tests := map[string]struct {
+		body    string
+		allowed bool
+		expTTL  time.Duration
+	}{
+		"allowed without a TTL field should use the allowed TTL": {
+			body:    `{"result": {}}`,
+			allowed: true,
+			expTTL:  time.Minute,
+		},
+		"denied without a TTL field should use the denied TTL": {
+			body:   `{"result": {}}`,
+			expTTL: time.Second * 10,
+		},
+		"a TTL field of seconds should be used": {
+			body:    `{"result": {"ttl": 5}}`,
+			allowed: true,
+			expTTL:  time.Second * 5,
+		},
+		"a TTL field of a duration string should be used": {
+			body:   `{"result": {"ttl": "2m"}}`,
+			expTTL: time.Minute * 2,
+		},
+		"an invalid TTL field should be ignored": {
+			body:    `{"result": {"ttl": "soon"}}`,
+			allowed: true,
+			expTTL:  time.Minute,
+		},
+	}
+
+	for name, test := range tests {
+		sar := &v1.SubjectAccessReview{Status: v1.SubjectAccessReviewStatus{Allowed: test.allowed}}
+		if ttl := cacheTTL([]byte(test.body), sar, opts); ttl != test.expTTL {
+			t.Errorf("%s: got unexpected TTL, exp=%s got=%s", name, test.expTTL, ttl)
+		}
+	}
+}
+
+func TestAuthzRequestCache(t *testing.T) {
+	var (
+		calls    int
+		revision = "rev-1"
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+		sar, _ := allowAccess(NewSubjectAccessReviewFromAttributes(testAccess), nil)
+		response, _ := json.Marshal(opaResponse{
+			Result: *sar,
+			Provenance: &opaProvenance{Bundles: map[string]opaBundleRevision{
+				"authz": {Revision: revision},
+			}},
+		})
+		rw.Write(response)
+	}))
+	defer srv.Close()
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+		AuthorizerUri: srv.URL,
+		Cache:         options.AuthorizerCacheOptions{Size: 10, AllowedTTL: time.Minute},
+	})
+
+	for i := 0; i < 2; i++ {
+		if decision, _, err := a.Authorize(context.Background(), testAccess); err != nil || decision != authorizer.DecisionAllow {
+			t.Fatalf("expected request to be allowed, got=%s err=%v", decisionString(decision), err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected decision to be cached, got %d calls to Open Policy Agent", calls)
+	}
+
+	// A decision made with a new revision of the policy invalidates the
+	// decisions cached before it.
+	revision = "rev-2"
+	other := testAccess
+	other.verb = "delete"
+	if _, _, err := a.Authorize(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Authorize(context.Background(), testAccess); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected cache to be pruned on a new policy revision, got %d calls to Open Policy Agent", calls)
+	}
+}
+
+func TestAuthzRequestCoalescing(t *testing.T) {
+	var (
+		calls   int32
+		arrived = make(chan struct{}, 1)
+		release = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			arrived <- struct{}{}
+		}
+		<-release
+		sar, _ := allowAccess(NewSubjectAccessReviewFromAttributes(testAccess), nil)
+		response, _ := json.Marshal(opaResponse{Result: *sar})
+		rw.Write(response)
+	}))
+	defer srv.Close()
+
+	// The cache is disabled, so only queries in flight at the same time share
+	// a response.
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{AuthorizerUri: srv.URL})
+
+	const n = 10
+	decisions := make(chan authorizer.Decision, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			decision, _, err := a.Authorize(context.Background(), testAccess)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			decisions <- decision
+		}()
+	}
+
+	// Give the queries time to join the one in flight before it is answered.
+	<-arrived
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+
+	for i := 0; i < n; i++ {
+		if decision := <-decisions; decision != authorizer.DecisionAllow {
+			t.Errorf("expected request to be allowed, got=%s", decisionString(decision))
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected identical queries to be coalesced, got %d calls to Open Policy Agent", calls)
+	}
+}
+
+func TestFailureMode(t *testing.T) {
+	readOnly := testAccess
+	readOnly.verb = "get"
+	readOnly.readOnly = true
+
+	tests := map[string]struct {
+		mode     string
+		attrs    authorizer.Attributes
+		upstream *fakeAuthorizer
+		shadow   bool
+
+		expDecision authorizer.Decision
+		expErr      bool
+	}{
+		"no mode should give no opinion with the error": {
+			attrs:       testAccess,
+			expDecision: authorizer.DecisionNoOpinion,
+			expErr:      true,
+		},
+		"deny should deny": {
+			mode:        options.AuthorizerFailureModeDeny,
+			attrs:       readOnly,
+			expDecision: authorizer.DecisionDeny,
+		},
+		"allow read-only should allow read-only requests": {
+			mode:        options.AuthorizerFailureModeAllowReadOnly,
+			attrs:       readOnly,
+			expDecision: authorizer.DecisionAllow,
+		},
+		"allow read-only should deny other requests": {
+			mode:        options.AuthorizerFailureModeAllowReadOnly,
+			attrs:       testAccess,
+			expDecision: authorizer.DecisionDeny,
+		},
+		"upstream should be decided by the upstream": {
+			mode:        options.AuthorizerFailureModeUpstream,
+			attrs:       testAccess,
+			upstream:    &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			expDecision: authorizer.DecisionAllow,
+		},
+		"upstream without an upstream should give no opinion with the error": {
+			mode:        options.AuthorizerFailureModeUpstream,
+			attrs:       testAccess,
+			expDecision: authorizer.DecisionNoOpinion,
+			expErr:      true,
+		},
+		"a shadow authorizer should not count degraded decisions": {
+			mode:        options.AuthorizerFailureModeDeny,
+			attrs:       testAccess,
+			shadow:      true,
+			expDecision: authorizer.DecisionDeny,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+				AuthorizerUri: "localhost:8080",
+				Failure:       options.AuthorizerFailureOptions{Mode: test.mode},
+			})
+			if test.upstream != nil {
+				a.upstream = test.upstream
+			}
+			a.shadow = test.shadow
+
+			expMode := test.mode
+			if len(expMode) == 0 {
+				expMode = options.AuthorizerFailureModeNoOpinion
+			}
+
+			counter := opaDegradedDecisions.WithLabelValues(expMode)
+			before, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ae := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+			ctx := genericapirequest.WithAuditEvent(context.Background(), ae)
+
+			decision, _, err := a.authorize(ctx, test.attrs, authzError)
+			if decision != test.expDecision {
+				t.Errorf("got unexpected decision, exp=%s got=%s",
+					decisionString(test.expDecision), decisionString(decision))
+			}
+
+			if test.expErr != (err != nil) {
+				t.Errorf("got unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if got := ae.Annotations[AuditDegradedKey]; got != expMode {
+				t.Errorf("got unexpected degraded annotation, exp=%q got=%q", expMode, got)
+			}
+
+			after, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expDegraded := 1.0
+			if test.shadow {
+				expDegraded = 0
+			}
+			if after-before != expDegraded {
+				t.Errorf("got unexpected degraded decisions, exp=%v got=%v", expDegraded, after-before)
+			}
+		})
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	var failingCalls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCalls, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		sar, _ := allowAccess(NewSubjectAccessReviewFromAttributes(testAccess), nil)
+		response, _ := json.Marshal(opaResponse{Result: *sar})
+		rw.Write(response)
+	}))
+	defer healthy.Close()
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+		AuthorizerUri: failing.URL,
+		FallbackUris:  []string{healthy.URL},
+		Failure: options.AuthorizerFailureOptions{
+			CircuitBreakerFailures: 2,
+			CircuitBreakerCooldown: time.Minute,
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		decision, _, err := a.Authorize(context.Background(), testAccess)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if decision != authorizer.DecisionAllow {
+			t.Errorf("expected request to be allowed by the fallback, got=%s", decisionString(decision))
+		}
+	}
+
+	if calls := atomic.LoadInt32(&failingCalls); calls != 2 {
+		t.Errorf("expected failing endpoint not to be queried once its circuit breaker opened, got %d calls", calls)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+		AuthorizerUri: srv.URL,
+		Failure: options.AuthorizerFailureOptions{
+			Mode:                   options.AuthorizerFailureModeAllowReadOnly,
+			CircuitBreakerFailures: 2,
+			CircuitBreakerCooldown: time.Minute,
+		},
+	})
+
+	readOnly := testAccess
+	readOnly.verb = "get"
+	readOnly.readOnly = true
+
+	for i := 0; i < 4; i++ {
+		ae := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+		ctx := genericapirequest.WithAuditEvent(context.Background(), ae)
+
+		decision, _, err := a.Authorize(ctx, readOnly)
+		if decision != authorizer.DecisionNoOpinion || err == nil {
+			t.Errorf("expected a failed query to give no opinion with the error, got=%s err=%v",
+				decisionString(decision), err)
+		}
+		if mode, ok := ae.Annotations[AuditDegradedKey]; ok {
+			t.Errorf("expected a failed query not to be authorized with the failure mode, got=%q", mode)
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 4 {
+		t.Errorf("expected failed queries not to open the circuit breaker, got %d calls", calls)
+	}
+}
+
+func TestDecisionInfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		sar, _ := allowAccess(NewSubjectAccessReviewFromAttributes(testAccess), nil)
+		response, _ := json.Marshal(opaResponse{
+			Result:     *sar,
+			Provenance: &opaProvenance{Revision: "rev-1"},
+		})
+		rw.Write(response)
+	}))
+	defer srv.Close()
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+		AuthorizerUri: srv.URL,
+		Cache:         options.AuthorizerCacheOptions{Size: 10, AllowedTTL: time.Minute},
+	})
+
+	for i, expCacheHit := range []bool{false, true} {
+		info := &decisionInfo{}
+		if _, _, err := a.authorize(context.Background(), testAccess, a.authzRequestFunc(context.Background(), info, nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.cacheHit != expCacheHit {
+			t.Errorf("%d: got unexpected cache hit, exp=%t got=%t", i, expCacheHit, info.cacheHit)
+		}
+		if info.revision != "rev-1" {
+			t.Errorf("%d: got unexpected revision, exp=rev-1 got=%q", i, info.revision)
+		}
+		if info.input == nil || info.input.Spec.User != "testme" {
+			t.Errorf("%d: expected input to be recorded, got=%+v", i, info.input)
+		}
+		if info.result == nil || !info.result.Status.Allowed {
+			t.Errorf("%d: expected result to be recorded, got=%+v", i, info.result)
+		}
+	}
+
+	// Decisions which could not be queried have no result.
+	info := &decisionInfo{}
+	a.endpoints = newOPAEndpoints([]string{"http://127.0.0.1:0"}, &options.AuthorizerFailureOptions{})
+	a.cacher = nil
+	a.authorize(context.Background(), testAccess, a.authzRequestFunc(context.Background(), info, nil, nil))
+	if info.result != nil {
+		t.Errorf("expected no result for a failed query, got=%+v", info.result)
+	}
+}
+
+func TestRecordDecision(t *testing.T) {
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{AuthorizerUri: "http://localhost:8181/v1/data/authz"})
+
+	sar := NewSubjectAccessReviewFromAttributes(testAccess)
+	allowed, _ := allowAccess(sar, nil)
+
+	tests := map[string]struct {
+		info *decisionInfo
+
+		expResult   bool
+		expDegraded string
+		expError    string
+	}{
+		"a decision should record its result": {
+			info:      &decisionInfo{input: sar, result: allowed},
+			expResult: true,
+		},
+		"an unavailable policy should record the failure mode": {
+			info:        &decisionInfo{input: sar, err: &unavailableError{errors.New("connection refused")}},
+			expDegraded: options.AuthorizerFailureModeNoOpinion,
+		},
+		"a failed query should record its error": {
+			info:     &decisionInfo{input: sar, err: errors.New("invalid result")},
+			expError: "invalid result",
+		},
+		"request objects should not be recorded": {
+			info: &decisionInfo{
+				input:   sar,
+				payload: []byte(`{"input":{"kind":"SubjectAccessReview","object":{"data":{"password":"c2VjcmV0"}},"oldObject":{"data":{}},"patchType":"merge"}}`),
+				result:  allowed,
+			},
+			expResult: true,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			first := newDecisionRecord(context.Background(), testAccess)
+			a.recordDecision(first, test.info)
+
+			if first.Path != "http://localhost:8181/v1/data/authz" {
+				t.Errorf("got unexpected path, got=%q", first.Path)
+			}
+			if test.expResult != (first.Result != nil) {
+				t.Errorf("got unexpected result, exp=%t got=%v", test.expResult, first.Result)
+			}
+			if first.Degraded != test.expDegraded {
+				t.Errorf("got unexpected degraded, exp=%q got=%q", test.expDegraded, first.Degraded)
+			}
+			if first.Error != test.expError {
+				t.Errorf("got unexpected error, exp=%q got=%q", test.expError, first.Error)
+			}
+
+			input, err := json.Marshal(first.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(input, []byte("object")) || bytes.Contains(input, []byte("Object")) {
+				t.Errorf("expected request objects not to be recorded, got=%s", input)
+			}
+		})
+	}
+}
@@ -4,111 +4,280 @@ package authzcache
 
 import (
 	"container/list"
-	"crypto"
-
-	_ "crypto/sha256"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
-	"hash"
+	"net/http"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const maxCachedObjects int = 1024
+// DefaultSize is the default number of entries held by the cache.
+const DefaultSize int = 1024
+
+// shardsPerCPU is the number of shards of a cache per CPU, so that
+// concurrent requests rarely contend on the same lock.
+const shardsPerCPU = 4
+
+// Reasons entries are evicted from the cache.
+const (
+	evictionReasonSize        = "size"
+	evictionReasonExpired     = "expired"
+	evictionReasonInvalidated = "invalidated"
+)
+
+// invalidations is the number of times every cache has been invalidated on
+// demand. Caches prune themselves when next used once it changes, so that
+// caches do not need to be held to be invalidated.
+var invalidations uint64
+
+// cacheKey is the SHA-256 digest of a key.
+type cacheKey [sha256.Size]byte
 
 type listEntry struct {
-	key   string
-	value []byte
+	key     cacheKey
+	value   []byte
+	expires time.Time
 }
 
+// OPACache is a cache of authorization decisions. Each entry expires after
+// the TTL it was put with. Keys are spread over shards, each with its own
+// lock and least recently used eviction, so the cache may be used
+// concurrently without contention.
 type OPACache struct {
-	mux       *sync.Mutex
-	cache     map[string]*list.Element
+	// invalidations is the number of invalidations the cache was last
+	// pruned for. It is first to be aligned for atomic operations.
+	invalidations   uint64
+	invalidationMux sync.Mutex
+
+	shards []*shard
+	now    func() time.Time
+
+	revisionMux sync.Mutex
+	revision    string
+}
+
+// shard is a least recently used cache holding a part of the keys of an
+// OPACache.
+type shard struct {
+	mux       sync.Mutex
+	cache     map[cacheKey]*list.Element
 	evictList *list.List
-	hashImpl  hash.Hash
 	count     int
+	size      int
 }
 
-func NewOPACache() *OPACache {
-	c := OPACache{}
-	c.mux = &sync.Mutex{}
-	c.hashImpl = crypto.SHA256.New()
-	c.cache = map[string]*list.Element{}
-	c.evictList = list.New()
-	c.count = 0
-
-	return &c
+// NewOPACache returns a cache holding up to size entries. If size is not
+// positive, DefaultSize is used.
+func NewOPACache(size int) *OPACache {
+	return newOPACache(size, runtime.GOMAXPROCS(0)*shardsPerCPU)
 }
 
-func (c *OPACache) getStringHash(toHash string) (string, error) {
-	_, err := c.hashImpl.Write([]byte(toHash))
-	if err != nil {
-		return "", err
+// newOPACache returns a cache of the size spread over up to the number of
+// shards. The number of shards is rounded down to a power of two no larger
+// than the size.
+func newOPACache(size, shards int) *OPACache {
+	registerMetrics()
+
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	n := 1
+	for n*2 <= shards && n*2 <= size {
+		n *= 2
 	}
-	defer c.hashImpl.Reset()
-	return base64.URLEncoding.EncodeToString(c.hashImpl.Sum(nil)), nil
-}
 
-func (c *OPACache) Put(keystr string, val []byte) error {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	hashedKey, err := c.getStringHash(keystr)
-	if err != nil {
-		return err
+	c := &OPACache{
+		invalidations: atomic.LoadUint64(&invalidations),
+		shards:        make([]*shard, n),
+		now:           time.Now,
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			cache:     map[cacheKey]*list.Element{},
+			evictList: list.New(),
+			// Round up so the cache holds at least size entries.
+			size: (size + n - 1) / n,
+		}
 	}
-	if _, ok := c.get(hashedKey); ok {
+
+	return c
+}
+
+// shardFor returns the hashed key and the shard holding it.
+func (c *OPACache) shardFor(keystr string) (cacheKey, *shard) {
+	key := cacheKey(sha256.Sum256([]byte(keystr)))
+	// The number of shards is a power of two.
+	i := binary.BigEndian.Uint64(key[:8]) & uint64(len(c.shards)-1)
+	return key, c.shards[i]
+}
+
+// Put caches the value for the TTL, replacing any existing entry of the key.
+// Values with a TTL which is not positive are not cached.
+func (c *OPACache) Put(keystr string, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
 		return nil
 	}
-	c.put(hashedKey, val)
+
+	c.pruneIfInvalidated()
+	key, s := c.shardFor(keystr)
+	expires := c.now().Add(ttl)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if found, ok := s.cache[key]; ok {
+		s.remove(found)
+	}
+	s.put(key, val, expires)
 	return nil
 }
-func (c *OPACache) put(key string, val []byte) {
-	if c.count >= maxCachedObjects {
-		c.evictLeastUsed()
+
+func (s *shard) put(key cacheKey, val []byte, expires time.Time) {
+	if s.count >= s.size {
+		s.evictLeastUsed()
 	}
-	newEntry := listEntry{key: key, value: val}
-	newElement := c.evictList.PushFront(newEntry)
-	c.count += 1
-	c.cache[key] = newElement
+	newEntry := listEntry{key: key, value: val, expires: expires}
+	newElement := s.evictList.PushFront(newEntry)
+	s.count += 1
+	s.cache[key] = newElement
+	cacheEntries.Inc()
 }
 
-func (c *OPACache) Get(key string) ([]byte, bool) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	hashedKey, err := c.getStringHash(key)
-	if err != nil {
-		return nil, false
-	}
-	return c.get(hashedKey)
+func (c *OPACache) Get(keystr string) ([]byte, bool) {
+	c.pruneIfInvalidated()
+	key, s := c.shardFor(keystr)
+	now := c.now()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.get(key, now)
 }
 
-func (c *OPACache) get(key string) ([]byte, bool) {
-	found, ok := c.cache[key]
+func (s *shard) get(key cacheKey, now time.Time) ([]byte, bool) {
+	found, ok := s.cache[key]
 	if !ok {
+		cacheMisses.Inc()
 		return nil, ok
 	}
-	c.evictList.MoveToFront(found)
 	result := found.Value.(listEntry)
+	if !now.Before(result.expires) {
+		s.remove(found)
+		cacheEvictions.WithLabelValues(evictionReasonExpired).Inc()
+		cacheMisses.Inc()
+		return nil, false
+	}
+	cacheHits.Inc()
+	s.evictList.MoveToFront(found)
 	return result.value, ok
 }
 
+// Prune removes every entry from the cache.
 func (c *OPACache) Prune() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	for k := range c.cache {
-		delete(c.cache, k)
+	for _, s := range c.shards {
+		s.mux.Lock()
+		s.prune()
+		s.mux.Unlock()
+	}
+}
+
+func (s *shard) prune() {
+	for k := range s.cache {
+		delete(s.cache, k)
+	}
+	cacheEvictions.WithLabelValues(evictionReasonInvalidated).Add(float64(s.count))
+	cacheEntries.Add(-float64(s.count))
+	s.evictList.Init()
+	s.count = 0
+}
+
+// ObserveRevision prunes the cache if the revision of the policy the cached
+// decisions were made with has changed. Empty revisions are ignored.
+func (c *OPACache) ObserveRevision(revision string) {
+	if len(revision) == 0 {
+		return
+	}
+
+	c.revisionMux.Lock()
+	defer c.revisionMux.Unlock()
+	if len(c.revision) > 0 && c.revision != revision {
+		c.Prune()
 	}
-	c.evictList.Init()
-	c.count = 0
+	c.revision = revision
+}
+
+// Revision returns the last revision of the policy observed, which cached
+// decisions were made with.
+func (c *OPACache) Revision() string {
+	c.revisionMux.Lock()
+	defer c.revisionMux.Unlock()
+	return c.revision
+}
+
+// len returns the number of entries in the cache.
+func (c *OPACache) len() int {
+	var n int
+	for _, s := range c.shards {
+		s.mux.Lock()
+		n += s.count
+		s.mux.Unlock()
+	}
+	return n
+}
+
+// pruneIfInvalidated prunes the cache if every cache has been invalidated
+// since it was last pruned.
+func (c *OPACache) pruneIfInvalidated() {
+	n := atomic.LoadUint64(&invalidations)
+	if atomic.LoadUint64(&c.invalidations) == n {
+		return
+	}
+
+	c.invalidationMux.Lock()
+	defer c.invalidationMux.Unlock()
+	if atomic.LoadUint64(&c.invalidations) == n {
+		return
+	}
+	c.Prune()
+	atomic.StoreUint64(&c.invalidations, n)
+}
+
+// InvalidateAll invalidates every cache. Caches are pruned when next used.
+func InvalidateAll() {
+	atomic.AddUint64(&invalidations, 1)
+}
+
+// InvalidateHandler prunes every cache on POST requests.
+func InvalidateHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		InvalidateAll()
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// remove removes the element from the shard. Must be called with the lock
+// held.
+func (s *shard) remove(element *list.Element) {
+	s.evictList.Remove(element)
+	delete(s.cache, element.Value.(listEntry).key)
+	s.count = s.count - 1
+	cacheEntries.Dec()
 }
 
 // вызывается только из синхронизированного кода, поэтому лочить явно тут ничего не надо
-func (c *OPACache) evictLeastUsed() {
-	evictElement := c.evictList.Back()
+func (s *shard) evictLeastUsed() {
+	evictElement := s.evictList.Back()
 	if evictElement == nil {
 		panic(fmt.Errorf("list element must not be nil"))
 	}
-	c.evictList.Remove(evictElement)
-	deleteme := evictElement.Value.(listEntry)
-	delete(c.cache, deleteme.key)
-	c.count = c.count - 1
+	s.remove(evictElement)
+	cacheEvictions.WithLabelValues(evictionReasonSize).Inc()
 }
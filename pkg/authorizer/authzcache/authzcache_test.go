@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,9 +28,9 @@ func TestPutValue(t *testing.T) {
 		Name:  "Test",
 		Value: "Value",
 	}
-	cache := NewOPACache()
+	cache := NewOPACache(DefaultSize)
 	cached, _ := json.Marshal(valueToCache)
-	if err := cache.Put(valueToCache.CalculateKey(), cached); err != nil {
+	if err := cache.Put(valueToCache.CalculateKey(), cached, time.Minute); err != nil {
 		t.Error(err.Error())
 	}
 	valueRestore := TestValue{
@@ -63,11 +66,11 @@ func BenchmarkPut(b *testing.B) {
 	testValues := prepareValues(b)
 	cache := func() *OPACache {
 		b.Helper()
-		return NewOPACache()
+		return NewOPACache(DefaultSize)
 	}()
 	for _, v := range testValues {
 		cached, _ := json.Marshal(v)
-		cache.Put(v.CalculateKey(), cached)
+		cache.Put(v.CalculateKey(), cached, time.Minute)
 		val, ok := cache.Get(v.CalculateKey())
 		if !ok {
 			b.Fail()
@@ -78,45 +81,212 @@ func BenchmarkPut(b *testing.B) {
 			b.Fail()
 		}
 	}
-	b.Logf("cache length %d", len(cache.cache))
+	b.Logf("cache length %d", cache.len())
 }
 
 func TestPrune(t *testing.T) {
-	cache := NewOPACache()
+	cache := NewOPACache(DefaultSize)
 	key := "some key"
 	val := []byte("some value")
-	cache.Put(key, val)
+	cache.Put(key, val, time.Minute)
 	cache.Prune()
 	_, ok := cache.Get(key)
-	if cache.evictList.Len() > 0 {
-		t.Fail()
-	}
 	if ok {
 		t.Fail()
 	}
-	if len(cache.cache) > 0 {
-		t.Fail()
-	}
-	if cache.count > 0 {
-		t.Fail()
+	for _, s := range cache.shards {
+		if s.evictList.Len() > 0 || len(s.cache) > 0 || s.count > 0 {
+			t.Fail()
+		}
 	}
 }
 
 func TestEviction(t *testing.T) {
-	cache := NewOPACache()
+	cache := NewOPACache(DefaultSize)
 	rndg := rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
 	key := func() string { return strconv.FormatInt(rndg.Int63(), 16) }
 	val := []byte("testval")
-	for i := 0; i < maxCachedObjects+100; i++ {
-		cache.Put(key(), val)
+	for i := 0; i < DefaultSize+100; i++ {
+		cache.Put(key(), val, time.Minute)
 	}
-	if len(cache.cache) > maxCachedObjects {
-		t.Fatalf("cached objects count > maxCachedObjects: %d > %d", len(cache.cache), maxCachedObjects)
+	if cache.len() > DefaultSize {
+		t.Fatalf("cached objects count > DefaultSize: %d > %d", cache.len(), DefaultSize)
 	}
-	if cache.count > maxCachedObjects {
-		t.Fail()
+	for _, s := range cache.shards {
+		if len(s.cache) > s.size || s.evictList.Len() > s.size {
+			t.Fail()
+		}
 	}
-	if cache.evictList.Len() > maxCachedObjects {
-		t.Fail()
+}
+
+func TestExpiry(t *testing.T) {
+	cache := NewOPACache(DefaultSize)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if err := cache.Put("allowed", []byte("allowed"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("denied", []byte("denied"), time.Second*10); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("uncached", []byte("uncached"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cache.Get("uncached"); ok {
+		t.Error("expected value with no TTL to not be cached")
+	}
+
+	now = now.Add(time.Second * 30)
+
+	if _, ok := cache.Get("denied"); ok {
+		t.Error("expected value to have expired")
+	}
+	if v, ok := cache.Get("allowed"); !ok || string(v) != "allowed" {
+		t.Errorf("expected value to be cached, got=%q", v)
+	}
+	if cache.len() != 1 {
+		t.Errorf("expected expired value to be removed, count=%d", cache.len())
+	}
+
+	// Putting a key again replaces the value and its expiry.
+	if err := cache.Put("allowed", []byte("updated"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Second * 45)
+
+	if v, ok := cache.Get("allowed"); !ok || string(v) != "updated" {
+		t.Errorf("expected value to be replaced, got=%q", v)
+	}
+	if cache.len() != 1 {
+		t.Errorf("expected replaced value to be cached once, count=%d", cache.len())
+	}
+}
+
+func TestSize(t *testing.T) {
+	// A single shard evicts the least recently used of all values.
+	cache := newOPACache(2, 1)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Put(key, []byte(key), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := cache.Get("a"); ok {
+		t.Error("expected least recently used value to be evicted")
+	}
+	if cache.len() != 2 {
+		t.Errorf("expected cache to hold 2 values, count=%d", cache.len())
 	}
 }
+
+func TestObserveRevision(t *testing.T) {
+	cache := NewOPACache(DefaultSize)
+	cache.ObserveRevision("rev-1")
+	cache.Put("key", []byte("value"), time.Minute)
+
+	cache.ObserveRevision("")
+	cache.ObserveRevision("rev-1")
+	if _, ok := cache.Get("key"); !ok {
+		t.Error("expected value to be kept while the revision is unchanged")
+	}
+
+	cache.ObserveRevision("rev-2")
+	if _, ok := cache.Get("key"); ok {
+		t.Error("expected cache to be pruned when the revision changes")
+	}
+}
+
+func TestInvalidateHandler(t *testing.T) {
+	cache := NewOPACache(DefaultSize)
+	cache.Put("key", []byte("value"), time.Minute)
+
+	w := httptest.NewRecorder()
+	InvalidateHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/authz-cache/invalidate", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got unexpected status code, exp=%d got=%d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if _, ok := cache.Get("key"); !ok {
+		t.Error("expected cache to not be invalidated by a GET request")
+	}
+
+	w = httptest.NewRecorder()
+	InvalidateHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/authz-cache/invalidate", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got unexpected status code, exp=%d got=%d", http.StatusNoContent, w.Code)
+	}
+	if _, ok := cache.Get("key"); ok {
+		t.Error("expected cache to be invalidated")
+	}
+}
+
+func TestShards(t *testing.T) {
+	tests := map[string]struct {
+		size, shards int
+
+		expShards, expShardSize int
+	}{
+		"shards should be rounded down to a power of two": {
+			size: 1024, shards: 12, expShards: 8, expShardSize: 128,
+		},
+		"shards should hold at least the size between them": {
+			size: 1000, shards: 8, expShards: 8, expShardSize: 125,
+		},
+		"shards should not outnumber the size": {
+			size: 3, shards: 16, expShards: 2, expShardSize: 2,
+		},
+		"a size which is not positive should use the default": {
+			size: 0, shards: 1, expShards: 1, expShardSize: DefaultSize,
+		},
+	}
+
+	for name, test := range tests {
+		cache := newOPACache(test.size, test.shards)
+		if len(cache.shards) != test.expShards {
+			t.Errorf("%s: got unexpected number of shards, exp=%d got=%d", name, test.expShards, len(cache.shards))
+		}
+		if size := cache.shards[0].size; size != test.expShardSize {
+			t.Errorf("%s: got unexpected shard size, exp=%d got=%d", name, test.expShardSize, size)
+		}
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	cache := newOPACache(64, 8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := strconv.Itoa((i * j) % 100)
+				cache.Put(key, []byte(key), time.Minute)
+				if v, ok := cache.Get(key); ok && string(v) != key {
+					t.Errorf("got unexpected value for key %s: %s", key, v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := cache.len(); n > 64 {
+		t.Errorf("expected cache to hold at most 64 values, got=%d", n)
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	cache := NewOPACache(DefaultSize)
+	for i := 0; i < DefaultSize; i++ {
+		cache.Put(strconv.Itoa(i), []byte("testval"), time.Hour)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			cache.Get(strconv.Itoa(rnd.Intn(DefaultSize)))
+		}
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authzcache
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	cacheHits = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authz_cache",
+			Name:           "hits_total",
+			Help:           "Number of authorization decisions found in the cache.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	cacheMisses = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authz_cache",
+			Name:           "misses_total",
+			Help:           "Number of authorization decisions not found in the cache.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	cacheEvictions = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authz_cache",
+			Name:           "evictions_total",
+			Help:           "Number of authorization decisions evicted from the cache, by reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	cacheEntries = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authz_cache",
+			Name:           "entries",
+			Help:           "Number of authorization decisions in the cache.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerOnce sync.Once
+)
+
+func registerMetrics() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(cacheHits, cacheMisses, cacheEvictions, cacheEntries)
+	})
+}
@@ -0,0 +1,217 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+// requestObject is the object of a request, added to the input of Open Policy
+// Agent for requests matching the body rules.
+type requestObject struct {
+	// Object is the decoded body of the request, or the patch of patch
+	// requests. It is not set if the body could not be decoded, such as
+	// protobuf bodies.
+	Object json.RawMessage `json:"object,omitempty"`
+
+	// OldObject is the current object of update and patch requests, if it
+	// exists.
+	OldObject json.RawMessage `json:"oldObject,omitempty"`
+
+	// PatchType is the content type of the patch of patch requests.
+	PatchType string `json:"patchType,omitempty"`
+}
+
+// requestBodies reads the bodies of requests matching the rules, so they can
+// be sent to Open Policy Agent.
+type requestBodies struct {
+	rules    []options.AuthorizerBodyRule
+	maxBytes int64
+	client   dynamic.Interface
+}
+
+// newRequestBodies returns the reader of request bodies configured by the
+// options, or nil if no bodies are sent. Old objects are fetched with the
+// credentials of the REST config, if set.
+func newRequestBodies(restConfig *rest.Config, opts *options.AuthorizerBodyOptions) (*requestBodies, error) {
+	rules, err := opts.ParseRules()
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	b := &requestBodies{
+		rules:    rules,
+		maxBytes: opts.MaxBytes,
+	}
+
+	if restConfig != nil {
+		b.client, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// matches returns whether the body of the request is sent.
+func (b *requestBodies) matches(info *request.RequestInfo) bool {
+	if !info.IsResourceRequest {
+		return false
+	}
+
+	resource := info.Resource
+	if len(info.Subresource) > 0 {
+		resource += "/" + info.Subresource
+	}
+
+	for _, rule := range b.rules {
+		if (rule.Verb == "*" && options.AuthorizerBodyVerbs.Has(info.Verb)) || rule.Verb == info.Verb {
+			if (rule.Resource == "*" || rule.Resource == resource) && (rule.Group == "*" || rule.Group == info.APIGroup) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// withRequestBody reads the bodies of requests matching the rules into the
+// context of the request, and replays them unchanged to the handler. Requests
+// with bodies larger than the maximum size are rejected.
+func (b *requestBodies) withRequestBody(handler http.Handler, s runtime.NegotiatedSerializer) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, ok := request.RequestInfoFrom(req.Context())
+		if !ok || !b.matches(info) || req.Body == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if req.ContentLength > b.maxBytes {
+			responsewriters.ErrorNegotiated(b.tooLarge(), s, schema.GroupVersion{}, rw, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, b.maxBytes+1))
+		req.Body.Close()
+		if err != nil {
+			responsewriters.ErrorNegotiated(apierrors.NewBadRequest(fmt.Sprintf("failed to read request body: %s", err)),
+				s, schema.GroupVersion{}, rw, req)
+			return
+		}
+		if int64(len(body)) > b.maxBytes {
+			responsewriters.ErrorNegotiated(b.tooLarge(), s, schema.GroupVersion{}, rw, req)
+			return
+		}
+
+		// The body is replayed to the API server unchanged.
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		obj := &requestObject{
+			Object: decodeBody(req.Header.Get("Content-Type"), body),
+		}
+		if info.Verb == "patch" {
+			obj.PatchType = req.Header.Get("Content-Type")
+		}
+
+		if info.Verb == "update" || info.Verb == "patch" {
+			obj.OldObject, err = b.oldObject(req.Context(), info)
+			if err != nil {
+				responsewriters.InternalError(rw, req, fmt.Errorf("failed to get current object: %s", err))
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), requestObjectKey, obj)
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+func (b *requestBodies) tooLarge() error {
+	return apierrors.NewRequestEntityTooLargeError(
+		fmt.Sprintf("request bodies sent to the authorizer are limited to %d bytes", b.maxBytes))
+}
+
+// oldObject fetches the current object of the request with the credentials of
+// the proxy, returning nil if it does not exist.
+func (b *requestBodies) oldObject(ctx context.Context, info *request.RequestInfo) (json.RawMessage, error) {
+	if b.client == nil || len(info.Name) == 0 {
+		return nil, nil
+	}
+
+	gvr := schema.GroupVersionResource{Group: info.APIGroup, Version: info.APIVersion, Resource: info.Resource}
+	var subresources []string
+	if len(info.Subresource) > 0 {
+		subresources = append(subresources, info.Subresource)
+	}
+
+	obj, err := b.client.Resource(gvr).Namespace(info.Namespace).Get(ctx, info.Name, metav1.GetOptions{}, subresources...)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.MarshalJSON()
+}
+
+// decodeBody returns the body as JSON if it is JSON or YAML, and otherwise
+// nil.
+func decodeBody(contentType string, body []byte) json.RawMessage {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	switch mediaType {
+	case "application/json", "application/merge-patch+json",
+		"application/strategic-merge-patch+json", "application/json-patch+json":
+		if !json.Valid(body) {
+			return nil
+		}
+		return body
+
+	case "application/yaml", "application/apply-patch+yaml":
+		j, err := yaml.YAMLToJSON(body)
+		if err != nil {
+			return nil
+		}
+		return j
+
+	default:
+		klog.V(4).Infof("not decoding request body of content type %q for the authorizer", contentType)
+		return nil
+	}
+}
+
+// requestObjectFrom returns the object of the request of the context, if
+// any.
+func requestObjectFrom(ctx context.Context) *requestObject {
+	obj, _ := ctx.Value(requestObjectKey).(*requestObject)
+	return obj
+}
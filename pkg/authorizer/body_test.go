@@ -0,0 +1,146 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+func TestWithRequestBody(t *testing.T) {
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "existing", "namespace": "default"},
+		"data":       map[string]interface{}{"key": "old"},
+	}}
+
+	tests := map[string]struct {
+		method, path, contentType, body string
+
+		expCode      int
+		expObject    string
+		expOldObject bool
+		expPatchType string
+		expNoObject  bool
+	}{
+		"a matching create should send the object": {
+			method: http.MethodPost, path: "/api/v1/namespaces/default/configmaps",
+			contentType: "application/json", body: `{"data":{"key":"new"}}`,
+			expCode: http.StatusOK, expObject: `{"data":{"key":"new"}}`,
+		},
+		"a YAML body should be sent as JSON": {
+			method: http.MethodPost, path: "/api/v1/namespaces/default/configmaps",
+			contentType: "application/yaml", body: "data:\n  key: new\n",
+			expCode: http.StatusOK, expObject: `{"data":{"key":"new"}}`,
+		},
+		"a protobuf body should not be decoded": {
+			method: http.MethodPost, path: "/api/v1/namespaces/default/configmaps",
+			contentType: "application/vnd.kubernetes.protobuf", body: "k8s\x00",
+			expCode: http.StatusOK,
+		},
+		"an update should send the current object": {
+			method: http.MethodPut, path: "/api/v1/namespaces/default/configmaps/existing",
+			contentType: "application/json", body: `{"data":{"key":"new"}}`,
+			expCode: http.StatusOK, expObject: `{"data":{"key":"new"}}`, expOldObject: true,
+		},
+		"a patch should send the patch type": {
+			method: http.MethodPatch, path: "/api/v1/namespaces/default/configmaps/existing",
+			contentType: "application/merge-patch+json", body: `{"data":{"key":"new"}}`,
+			expCode: http.StatusOK, expObject: `{"data":{"key":"new"}}`, expOldObject: true,
+			expPatchType: "application/merge-patch+json",
+		},
+		"an update of a missing object should not send a current object": {
+			method: http.MethodPut, path: "/api/v1/namespaces/default/configmaps/missing",
+			contentType: "application/json", body: `{"data":{"key":"new"}}`,
+			expCode: http.StatusOK, expObject: `{"data":{"key":"new"}}`,
+		},
+		"a request not matching the rules should not be read": {
+			method: http.MethodPost, path: "/api/v1/namespaces/default/secrets",
+			contentType: "application/json", body: `{"data":{}}`,
+			expCode: http.StatusOK, expNoObject: true,
+		},
+		"a body larger than the maximum should be rejected": {
+			method: http.MethodPost, path: "/api/v1/namespaces/default/configmaps",
+			contentType: "application/json", body: `{"data":{"key":"` + strings.Repeat("a", 64) + `"}}`,
+			expCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			bodies := &requestBodies{
+				rules:    []options.AuthorizerBodyRule{{Verb: "*", Resource: "configmaps", Group: ""}},
+				maxBytes: 64,
+				client:   dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), existing.DeepCopy()),
+			}
+
+			var (
+				gotBody string
+				gotObj  *requestObject
+			)
+			inner := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				b, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotBody = string(b)
+				gotObj = requestObjectFrom(req.Context())
+			})
+
+			codecs := serializer.NewCodecFactory(runtime.NewScheme()).WithoutConversion()
+			handler := genericapifilters.WithRequestInfo(bodies.withRequestBody(inner, codecs), withCustomFactory())
+
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			if rw.Code != test.expCode {
+				t.Fatalf("unexpected response code, exp=%d got=%d: %s", test.expCode, rw.Code, rw.Body)
+			}
+			if test.expCode != http.StatusOK {
+				return
+			}
+
+			if gotBody != test.body {
+				t.Errorf("expected body to be replayed unchanged, exp=%q got=%q", test.body, gotBody)
+			}
+
+			if test.expNoObject {
+				if gotObj != nil {
+					t.Errorf("expected no request object, got=%+v", gotObj)
+				}
+				return
+			}
+			if gotObj == nil {
+				t.Fatal("expected request object in context")
+			}
+
+			if string(gotObj.Object) != test.expObject {
+				t.Errorf("unexpected object, exp=%s got=%s", test.expObject, gotObj.Object)
+			}
+			if test.expOldObject != (gotObj.OldObject != nil) {
+				t.Errorf("unexpected old object, exp=%t got=%s", test.expOldObject, gotObj.OldObject)
+			}
+			if test.expOldObject && !strings.Contains(string(gotObj.OldObject), `"key":"old"`) {
+				t.Errorf("expected the current object, got=%s", gotObj.OldObject)
+			}
+			if gotObj.PatchType != test.expPatchType {
+				t.Errorf("unexpected patch type, exp=%q got=%q", test.expPatchType, gotObj.PatchType)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned for endpoints which are not queried as their
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops queries to an endpoint after a number of consecutive
+// failures. Once the cool-down has passed, a single query is let through to
+// check whether the endpoint has recovered, closing the breaker if it
+// succeeds and opening it for another cool-down if not.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mux         sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	probing     bool
+}
+
+// newCircuitBreaker returns a breaker opening after the number of consecutive
+// failures. The breaker never opens if failures is not positive.
+func newCircuitBreaker(failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failures: failures,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// allow returns whether the endpoint may be queried.
+func (b *circuitBreaker) allow() bool {
+	if b.failures <= 0 {
+		return true
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.consecutive < b.failures {
+		return true
+	}
+
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// success records a successful query, closing the breaker.
+func (b *circuitBreaker) success() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.consecutive = 0
+	b.probing = false
+}
+
+// failure records a failed query, opening the breaker if it has now failed
+// the number of consecutive times.
+func (b *circuitBreaker) failure() {
+	if b.failures <= 0 {
+		return
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.consecutive++
+	if b.consecutive == b.failures || b.probing {
+		b.openUntil = b.now().Add(b.cooldown)
+		opaCircuitBreakerTrips.Inc()
+	}
+	b.probing = false
+}
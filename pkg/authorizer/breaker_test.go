@@ -0,0 +1,56 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	if !b.allow() {
+		t.Fatal("expected breaker to be closed after a single failure")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("expected breaker to open after consecutive failures")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected a probe to be allowed after the cool-down")
+	}
+	if b.allow() {
+		t.Fatal("expected only a single probe to be allowed")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("expected breaker to open again after a failed probe")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected a probe to be allowed after the cool-down")
+	}
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Fatal("expected breaker to close after a successful probe")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Error("expected a disabled breaker never to open")
+	}
+}
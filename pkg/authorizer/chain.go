@@ -0,0 +1,258 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/clusterinfo"
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/decisionlog"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
+)
+
+const (
+	// AuditDecisionKeyPrefix prefixes the audit annotations of the decision
+	// of each authorizer in the chain, followed by the name of the authorizer.
+	AuditDecisionKeyPrefix = "kube-oidc-proxy.jetstack.io/authorizer-decision-"
+
+	// AuditReasonKeyPrefix prefixes the audit annotations of the reason given
+	// by each authorizer in the chain, followed by the name of the authorizer.
+	AuditReasonKeyPrefix = "kube-oidc-proxy.jetstack.io/authorizer-reason-"
+)
+
+// Step is a named authorizer in a chain.
+type Step struct {
+	Name       string
+	Authorizer authorizer.Authorizer
+}
+
+// Chain authorizes requests with each of its authorizers in turn, in the same
+// way as the API server. The first authorizer to allow or deny a request
+// decides it, and authorizers with no opinion pass it to the next. Requests no
+// authorizer has an opinion on are given the final decision.
+type Chain struct {
+	steps         []Step
+	final         authorizer.Decision
+	restConfig    *rest.Config
+	upstream      authorizer.Authorizer
+	userExtraData *clusterinfo.ClusterInfo
+	bodies        *requestBodies
+	input         *requestInput
+}
+
+var _ Interface = &Chain{}
+
+// New builds the chain of authorizers configured by the options. A nil
+// authorizer is returned if authorization is not enabled.
+func New(restConfig *rest.Config, opts *options.AuthorizerOptions) (Interface, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+
+	shared, err := newSharedHandlers(restConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+	for _, name := range opts.Steps() {
+		var (
+			a   authorizer.Authorizer
+			err error
+		)
+
+		switch name {
+		case options.AuthorizerOPA:
+			// Cluster info is added to requests by the chain.
+			opaOpts := *opts
+			opaOpts.ExtrasPath = ""
+			a, err = newOPAAuthorizer(restConfig, &opaOpts, shared)
+			if err == nil && opts.Shadow.Enabled() {
+				a, err = withShadow(restConfig, a, opaOpts, shared)
+			}
+		case options.AuthorizerWebhook:
+			a, err = newWebhookAuthorizer(opts)
+		case options.AuthorizerPolicy:
+			a, err = LoadPolicy(opts.PolicyFile, authorizer.DecisionAllow)
+		case options.AuthorizerDeny:
+			a, err = LoadPolicy(opts.DenyRulesFile, authorizer.DecisionDeny)
+		default:
+			err = fmt.Errorf("unknown authorizer %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, Step{Name: name, Authorizer: a})
+	}
+
+	final := authorizer.DecisionDeny
+	if opts.FinalDecision == options.AuthorizerDecisionAllow {
+		final = authorizer.DecisionAllow
+	}
+
+	ue, err := clusterinfo.FromUrl(opts.ExtrasPath, opts.ExtrasAnnotationPrefix)
+	if err != nil {
+		klog.Error(err.Error())
+		ue = nil
+	}
+
+	chain := NewChain(restConfig, ue, final, steps...)
+	chain.upstream, chain.bodies, chain.input = shared.upstream, shared.bodies, shared.input
+
+	return chain, nil
+}
+
+// withShadow returns the Open Policy Agent authorizer evaluated alongside the
+// shadow policy configured by the options.
+func withShadow(restConfig *rest.Config, enforcing authorizer.Authorizer, opts options.AuthorizerOptions, shared *sharedHandlers) (authorizer.Authorizer, error) {
+	opts.RulesUri = ""
+	opts.FallbackUris = nil
+	opts.Failure = options.AuthorizerFailureOptions{}
+	if len(opts.Shadow.RegoQuery) > 0 {
+		opts.Rego.Query = opts.Shadow.RegoQuery
+	} else {
+		opts.AuthorizerUri = opts.Shadow.Uri
+		opts.Rego = options.AuthorizerRegoOptions{}
+	}
+
+	shadow, err := newOPAAuthorizer(restConfig, &opts, shared)
+	if err != nil {
+		return nil, err
+	}
+	// Only enforced decisions are recorded.
+	shadow.noDecisionLog = true
+	shadow.shadow = true
+
+	return newShadowAuthorizer(enforcing, shadow, opts.Shadow.Warnings, opts.Shadow.Timeout), nil
+}
+
+// NewChain returns a chain of the authorizers, giving the final decision to
+// requests none of them have an opinion on.
+func NewChain(restConfig *rest.Config, userExtraData *clusterinfo.ClusterInfo, final authorizer.Decision, steps ...Step) *Chain {
+	return &Chain{
+		steps:         steps,
+		final:         final,
+		restConfig:    restConfig,
+		userExtraData: userExtraData,
+	}
+}
+
+// Authorize runs the request through the chain, recording the decision and
+// reason of each authorizer as annotations of the audit event. Errors of
+// authorizers with no opinion are returned if no later authorizer decides the
+// request, rather than giving it the final decision. The decision of the
+// chain is logged to the decision log, if enabled.
+func (c *Chain) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	ctx, span := tracing.Start(ctx, "authorize")
+	defer span.End()
+
+	if !decisionlog.Enabled() {
+		decision, reason, _, err := c.authorize(ctx, span, attrs)
+		return decision, reason, err
+	}
+
+	start := time.Now()
+	record := newDecisionRecord(ctx, attrs)
+	decision, reason, step, err := c.authorize(withDecisionRecord(ctx, record), span, attrs)
+	logDecision(record, step, decision, reason, err, time.Since(start))
+
+	return decision, reason, err
+}
+
+// authorize returns the decision of the chain, and the name of the authorizer
+// which made it if not the final decision.
+func (c *Chain) authorize(ctx context.Context, span trace.Span, attrs authorizer.Attributes) (authorizer.Decision, string, string, error) {
+	ae := genericapirequest.AuditEventFrom(ctx)
+
+	var (
+		errs    []error
+		reasons []string
+	)
+
+	for _, step := range c.steps {
+		decision, reason, err := step.Authorizer.Authorize(ctx, attrs)
+
+		if ae != nil {
+			k8saudit.LogAnnotation(ae, AuditDecisionKeyPrefix+step.Name, decisionString(decision))
+			if len(reason) > 0 {
+				k8saudit.LogAnnotation(ae, AuditReasonKeyPrefix+step.Name, reason)
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", step.Name, err))
+		}
+		if len(reason) > 0 {
+			reasons = append(reasons, step.Name+": "+reason)
+		}
+
+		switch decision {
+		case authorizer.DecisionAllow, authorizer.DecisionDeny:
+			span.SetAttributes(decisionAttributeKey.String(decisionString(decision)))
+			return decision, reason, step.Name, err
+		}
+	}
+
+	if len(errs) > 0 {
+		err := utilerrors.NewAggregate(errs)
+		span.SetAttributes(decisionAttributeKey.String(decisionString(authorizer.DecisionNoOpinion)))
+		span.RecordError(err)
+		return authorizer.DecisionNoOpinion, strings.Join(reasons, "\n"), "", err
+	}
+
+	span.SetAttributes(decisionAttributeKey.String(decisionString(c.final)))
+
+	reason := "no authorizer had an opinion"
+	if len(reasons) > 0 {
+		reason = strings.Join(reasons, "\n")
+	}
+
+	return c.final, reason, "", nil
+}
+
+// HasRules returns whether an authorizer in the chain answers rules queries.
+func (c *Chain) HasRules() bool {
+	return c.rulesResolver() != nil
+}
+
+// RulesFor returns the rules of the first authorizer in the chain which
+// answers rules queries.
+func (c *Chain) RulesFor(u user.Info, namespace string) ([]authorizer.ResourceRuleInfo, []authorizer.NonResourceRuleInfo, bool, error) {
+	resolver := c.rulesResolver()
+	if resolver == nil {
+		return nil, nil, true, fmt.Errorf("no authorizer in the chain answers rules queries")
+	}
+
+	return resolver.RulesFor(u, namespace)
+}
+
+func (c *Chain) rulesResolver() rulesResolver {
+	for _, step := range c.steps {
+		if r, ok := step.Authorizer.(rulesResolver); ok && r.HasRules() {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// WithRequest authorizes requests with the chain before they are served by
+// the handler.
+func (c *Chain) WithRequest(handler http.Handler) http.Handler {
+	return withRequest(handler, c, c.restConfig, c.upstream, c.userExtraData, c.bodies, c.input)
+}
@@ -0,0 +1,259 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/decisionlog"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+type fakeAuthorizer struct {
+	decision authorizer.Decision
+	reason   string
+	err      error
+	called   bool
+
+	// before is called before the decision is returned, if set.
+	before func(ctx context.Context)
+}
+
+func (f *fakeAuthorizer) Authorize(ctx context.Context, _ authorizer.Attributes) (authorizer.Decision, string, error) {
+	if f.before != nil {
+		f.before(ctx)
+	}
+	f.called = true
+	return f.decision, f.reason, f.err
+}
+
+func TestChain(t *testing.T) {
+	tests := map[string]struct {
+		steps []*fakeAuthorizer
+		final authorizer.Decision
+
+		expDecision    authorizer.Decision
+		expErr         bool
+		expCalled      []bool
+		expAnnotations map[string]string
+	}{
+		"the first authorizer to allow should decide": {
+			steps: []*fakeAuthorizer{
+				{decision: authorizer.DecisionNoOpinion},
+				{decision: authorizer.DecisionAllow, reason: "allowed"},
+				{decision: authorizer.DecisionDeny},
+			},
+			final:       authorizer.DecisionDeny,
+			expDecision: authorizer.DecisionAllow,
+			expCalled:   []bool{true, true, false},
+			expAnnotations: map[string]string{
+				AuditDecisionKeyPrefix + "a": "no_opinion",
+				AuditDecisionKeyPrefix + "b": "allow",
+				AuditReasonKeyPrefix + "b":   "allowed",
+			},
+		},
+		"the first authorizer to deny should decide": {
+			steps: []*fakeAuthorizer{
+				{decision: authorizer.DecisionDeny, reason: "denied"},
+				{decision: authorizer.DecisionAllow},
+			},
+			final:       authorizer.DecisionAllow,
+			expDecision: authorizer.DecisionDeny,
+			expCalled:   []bool{true, false},
+			expAnnotations: map[string]string{
+				AuditDecisionKeyPrefix + "a": "deny",
+				AuditReasonKeyPrefix + "a":   "denied",
+			},
+		},
+		"no opinion should be given the final decision": {
+			steps: []*fakeAuthorizer{
+				{decision: authorizer.DecisionNoOpinion},
+				{decision: authorizer.DecisionNoOpinion},
+			},
+			final:       authorizer.DecisionAllow,
+			expDecision: authorizer.DecisionAllow,
+			expCalled:   []bool{true, true},
+			expAnnotations: map[string]string{
+				AuditDecisionKeyPrefix + "a": "no_opinion",
+				AuditDecisionKeyPrefix + "b": "no_opinion",
+			},
+		},
+		"an error with no later decision should not be given the final decision": {
+			steps: []*fakeAuthorizer{
+				{decision: authorizer.DecisionNoOpinion, err: errors.New("unavailable")},
+				{decision: authorizer.DecisionNoOpinion},
+			},
+			final:       authorizer.DecisionAllow,
+			expDecision: authorizer.DecisionNoOpinion,
+			expErr:      true,
+			expCalled:   []bool{true, true},
+			expAnnotations: map[string]string{
+				AuditDecisionKeyPrefix + "a": "no_opinion",
+				AuditDecisionKeyPrefix + "b": "no_opinion",
+			},
+		},
+		"an error followed by a decision should be decided": {
+			steps: []*fakeAuthorizer{
+				{decision: authorizer.DecisionNoOpinion, err: errors.New("unavailable")},
+				{decision: authorizer.DecisionAllow},
+			},
+			final:       authorizer.DecisionDeny,
+			expDecision: authorizer.DecisionAllow,
+			expCalled:   []bool{true, true},
+			expAnnotations: map[string]string{
+				AuditDecisionKeyPrefix + "a": "no_opinion",
+				AuditDecisionKeyPrefix + "b": "allow",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var steps []Step
+			for i, a := range test.steps {
+				steps = append(steps, Step{Name: string(rune('a' + i)), Authorizer: a})
+			}
+
+			ae := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+			ctx := genericapirequest.WithAuditEvent(context.Background(), ae)
+
+			chain := NewChain(nil, nil, test.final, steps...)
+			decision, _, err := chain.Authorize(ctx, testAccess)
+
+			if decision != test.expDecision {
+				t.Errorf("got unexpected decision, exp=%s got=%s",
+					decisionString(test.expDecision), decisionString(decision))
+			}
+
+			if test.expErr != (err != nil) {
+				t.Errorf("got unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			for i, a := range test.steps {
+				if a.called != test.expCalled[i] {
+					t.Errorf("got unexpected call of authorizer %d, exp=%t got=%t", i, test.expCalled[i], a.called)
+				}
+			}
+
+			if !reflect.DeepEqual(ae.Annotations, test.expAnnotations) {
+				t.Errorf("got unexpected audit annotations, exp=%v got=%v", test.expAnnotations, ae.Annotations)
+			}
+		})
+	}
+}
+
+func TestChainRules(t *testing.T) {
+	opa := newTestOPAAuthorizer(t, &options.AuthorizerOptions{RulesUri: "http://localhost:8181/v1/data/rules"})
+
+	chain := NewChain(nil, nil, authorizer.DecisionDeny,
+		Step{Name: "deny", Authorizer: &fakeAuthorizer{}},
+		Step{Name: "opa", Authorizer: opa},
+	)
+	if !chain.HasRules() {
+		t.Error("expected chain with an OPA rules query to have rules")
+	}
+
+	chain = NewChain(nil, nil, authorizer.DecisionDeny, Step{Name: "deny", Authorizer: &fakeAuthorizer{}})
+	if chain.HasRules() {
+		t.Error("expected chain without a rules query to not have rules")
+	}
+	if _, _, _, err := chain.RulesFor(testAccess.user, "default"); err == nil {
+		t.Error("expected error getting rules of chain without a rules query")
+	}
+}
+
+func TestChainDecisionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-decisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "decisions.log")
+	shutdown, err := decisionlog.Setup(decisionlog.Options{
+		File:          file,
+		BufferSize:    10,
+		BatchSize:     10,
+		FlushInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := proxycontext.WithRequestID(httptest.NewRequest(http.MethodGet, "/api", nil), "request-1")
+
+	// Decisions of every authorizer, and the final decision, are logged.
+	NewChain(nil, nil, authorizer.DecisionDeny,
+		Step{Name: "webhook", Authorizer: &fakeAuthorizer{decision: authorizer.DecisionNoOpinion}},
+		Step{Name: "policy", Authorizer: &fakeAuthorizer{decision: authorizer.DecisionAllow, reason: "allowed"}},
+	).Authorize(req.Context(), testAccess)
+	NewChain(nil, nil, authorizer.DecisionDeny,
+		Step{Name: "webhook", Authorizer: &fakeAuthorizer{decision: authorizer.DecisionNoOpinion}},
+	).Authorize(req.Context(), testAccess)
+	NewChain(nil, nil, authorizer.DecisionDeny,
+		Step{Name: "webhook", Authorizer: &fakeAuthorizer{decision: authorizer.DecisionNoOpinion, err: errors.New("unavailable")}},
+	).Authorize(req.Context(), testAccess)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []decisionlog.Record{
+		{Step: "policy", Decision: "allow", Reason: "allowed"},
+		{Decision: "deny", Reason: "no authorizer had an opinion"},
+		{Decision: "no_opinion", Error: "webhook: unavailable"},
+	}
+
+	var ids []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for i := 0; dec.More(); i++ {
+		var got decisionlog.Record
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(exp) {
+			t.Fatalf("got unexpected record %+v", got)
+		}
+
+		if got.Step != exp[i].Step || got.Decision != exp[i].Decision ||
+			got.Reason != exp[i].Reason || got.Error != exp[i].Error {
+			t.Errorf("got unexpected record %d, exp=%+v got=%+v", i, exp[i], got)
+		}
+		if got.RequestID != "request-1" {
+			t.Errorf("got unexpected request ID, exp=request-1 got=%q", got.RequestID)
+		}
+		if got.Input == nil {
+			t.Error("expected SubjectAccessReview of the request as input")
+		}
+		ids = append(ids, got.DecisionID)
+	}
+
+	if len(ids) != len(exp) {
+		t.Fatalf("expected %d records, got %d", len(exp), len(ids))
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] || ids[0] == ids[2] {
+		t.Errorf("expected unique decision IDs, got=%v", ids)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// defaultMaxResponseBytes is the maximum size of an authorization response
+	// if not configured.
+	defaultMaxResponseBytes = 1 << 16
+
+	// maxErrorBodyBytes is the maximum size of the body of a non-200 response
+	// included in the error.
+	maxErrorBodyBytes = 512
+)
+
+// opaClient sends queries to Open Policy Agent. Connections are kept alive
+// and reused between queries.
+type opaClient struct {
+	client *http.Client
+
+	maxRetries           int
+	retryInitialInterval time.Duration
+	retryMaxElapsedTime  time.Duration
+
+	// maxResponseBytes is the maximum size of an authorization response.
+	maxResponseBytes int64
+}
+
+func newOPAClient(opts *options.AuthorizerClientOptions) (*opaClient, error) {
+	tlsConfig, err := transport.TLSConfigFor(&transport.Config{
+		TLS: transport.TLSConfig{
+			CAFile:   opts.CAFile,
+			CertFile: opts.CertFile,
+			KeyFile:  opts.KeyFile,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load authorizer TLS configuration: %s", err)
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if len(opts.TokenFile) > 0 {
+		rt, err = transport.NewBearerAuthWithRefreshRoundTripper("", opts.TokenFile, rt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load authorizer token file: %s", err)
+		}
+	}
+
+	maxResponseBytes := opts.MaxResponseBytes
+	if maxResponseBytes <= 0 {
+		maxResponseBytes = defaultMaxResponseBytes
+	}
+
+	return &opaClient{
+		client: &http.Client{
+			Transport: rt,
+			Timeout:   opts.Timeout,
+		},
+		maxRetries:           opts.MaxRetries,
+		retryInitialInterval: opts.RetryInitialInterval,
+		retryMaxElapsedTime:  opts.RetryMaxElapsedTime,
+		maxResponseBytes:     maxResponseBytes,
+	}, nil
+}
+
+// post sends the JSON payload to the Open Policy Agent endpoint and decodes
+// at most maxBytes of the response body into result. Queries which fail to
+// connect or receive a 5xx or 429 response are retried until the context is
+// done. Failures are logged with the ID of the request of the context.
+func (c *opaClient) post(ctx context.Context, uri string, payload []byte, maxBytes int64, result interface{}) error {
+	start := time.Now()
+	err := backoff.Retry(func() error {
+		return c.postOnce(ctx, uri, payload, maxBytes, result)
+	}, backoff.WithContext(c.newBackOff(), ctx))
+	opaRequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		opaRequestErrors.Inc()
+		klog.Errorf("[%s] Authorization server request failed: %s", proxycontext.RequestIDFrom(ctx), err)
+		return err
+	}
+	return nil
+}
+
+func (c *opaClient) postOnce(ctx context.Context, uri string, payload []byte, maxBytes int64, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(payload))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// Queries are not retried once the context is done.
+		if ctx.Err() != nil {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		err := &statusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("authorization server responded %s: %s", resp.Status, strings.TrimSpace(string(body))),
+		}
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			return err
+		}
+		return backoff.Permanent(err)
+	}
+
+	if err := decodeLimited(resp.Body, maxBytes, result); err != nil {
+		return backoff.Permanent(err)
+	}
+
+	// Drain the rest of the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBodyBytes))
+
+	return nil
+}
+
+func (c *opaClient) newBackOff() backoff.BackOff {
+	// WithMaxRetries retries forever if the maximum is 0.
+	if c.maxRetries <= 0 {
+		return &backoff.StopBackOff{}
+	}
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = c.retryInitialInterval
+	b.MaxElapsedTime = c.retryMaxElapsedTime
+	return backoff.WithMaxRetries(b, uint64(c.maxRetries))
+}
+
+// decodeLimited decodes the JSON body into result, failing if the body is
+// larger than maxBytes.
+func decodeLimited(body io.Reader, maxBytes int64, result interface{}) error {
+	lr := &io.LimitedReader{R: body, N: maxBytes + 1}
+	if err := json.NewDecoder(lr).Decode(result); err != nil {
+		if lr.N <= 0 {
+			return fmt.Errorf("authorization server response is larger than %d bytes", maxBytes)
+		}
+		return fmt.Errorf("failed to decode authorization server response: %w", err)
+	}
+	return nil
+}
+
+// statusError is a response of the authorization server other than 200 OK.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// unavailableError is returned when no authorization server could be
+// queried.
+type unavailableError struct {
+	error
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.error
+}
+
+// unavailable returns whether the error shows that the authorization server
+// could not be queried: connection errors, timeouts, and 429, 502, 503 and 504
+// responses. Other errors, such as 4xx responses or invalid responses, are
+// given by the query itself and would fail on any authorization server.
+func unavailable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		return true
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		switch se.code {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
@@ -0,0 +1,251 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+func TestClientPost(t *testing.T) {
+	tests := map[string]struct {
+		responses []int
+		body      string
+		maxBytes  int64
+
+		expErr   bool
+		expCalls int32
+	}{
+		"a 200 response should be decoded": {
+			responses: []int{http.StatusOK},
+			body:      `{"result": "ok"}`,
+			expCalls:  1,
+		},
+		"a 404 response should error without retrying": {
+			responses: []int{http.StatusNotFound},
+			body:      `{"result": "ok"}`,
+			expErr:    true,
+			expCalls:  1,
+		},
+		"a 503 response should be retried": {
+			responses: []int{http.StatusServiceUnavailable, http.StatusOK},
+			body:      `{"result": "ok"}`,
+			expCalls:  2,
+		},
+		"a 429 response should be retried": {
+			responses: []int{http.StatusTooManyRequests, http.StatusOK},
+			body:      `{"result": "ok"}`,
+			expCalls:  2,
+		},
+		"a 500 response should error once out of retries": {
+			responses: []int{http.StatusInternalServerError},
+			body:      `{"result": "ok"}`,
+			expErr:    true,
+			expCalls:  3,
+		},
+		"a response larger than the limit should error": {
+			responses: []int{http.StatusOK},
+			body:      `{"result": "` + strings.Repeat("a", 100) + `"}`,
+			maxBytes:  64,
+			expErr:    true,
+			expCalls:  1,
+		},
+		"an invalid response should error without retrying": {
+			responses: []int{http.StatusOK},
+			body:      `{"result": `,
+			expErr:    true,
+			expCalls:  1,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				i := int(atomic.AddInt32(&calls, 1)) - 1
+				if i >= len(test.responses) {
+					i = len(test.responses) - 1
+				}
+				rw.WriteHeader(test.responses[i])
+				rw.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+
+			client, err := newOPAClient(&options.AuthorizerClientOptions{
+				Timeout:              time.Second,
+				MaxRetries:           2,
+				RetryInitialInterval: time.Millisecond,
+				RetryMaxElapsedTime:  time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			maxBytes := test.maxBytes
+			if maxBytes == 0 {
+				maxBytes = client.maxResponseBytes
+			}
+
+			var result struct {
+				Result string `json:"result"`
+			}
+			err = client.post(context.Background(), srv.URL, []byte("{}"), maxBytes, &result)
+			if test.expErr != (err != nil) {
+				t.Errorf("got unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if !test.expErr && result.Result != "ok" {
+				t.Errorf("got unexpected result, exp=ok got=%s", result.Result)
+			}
+
+			if calls := atomic.LoadInt32(&calls); calls != test.expCalls {
+				t.Errorf("got unexpected number of calls, exp=%d got=%d", test.expCalls, calls)
+			}
+		})
+	}
+}
+
+func TestClientPostCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// The client of the request has gone away.
+		cancel()
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client, err := newOPAClient(&options.AuthorizerClientOptions{
+		Timeout:              time.Second,
+		MaxRetries:           5,
+		RetryInitialInterval: time.Second,
+		RetryMaxElapsedTime:  time.Second * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var result struct{}
+	if err := client.post(ctx, srv.URL, []byte("{}"), client.maxResponseBytes, &result); err == nil {
+		t.Error("expected error of cancelled query")
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Errorf("expected query not to be retried once cancelled, took %s", d)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("got unexpected number of calls, exp=1 got=%d", calls)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	tests := map[string]struct {
+		err error
+		exp bool
+	}{
+		"a connection error should be unavailable": {
+			err: &url.Error{Op: "Post", URL: "http://opa", Err: errors.New("connection refused")},
+			exp: true,
+		},
+		"an open circuit breaker should be unavailable": {
+			err: fmt.Errorf("http://opa: %w", errCircuitOpen),
+			exp: true,
+		},
+		"a 503 response should be unavailable": {
+			err: &statusError{code: http.StatusServiceUnavailable},
+			exp: true,
+		},
+		"a 429 response should be unavailable": {
+			err: &statusError{code: http.StatusTooManyRequests},
+			exp: true,
+		},
+		"a 400 response should not be unavailable": {
+			err: &statusError{code: http.StatusBadRequest},
+		},
+		"a 500 response should not be unavailable": {
+			err: fmt.Errorf("http://opa: %w", &statusError{code: http.StatusInternalServerError}),
+		},
+		"an invalid response should not be unavailable": {
+			err: errors.New("failed to decode authorization server response"),
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if got := unavailable(test.err); got != test.exp {
+				t.Errorf("got unexpected unavailable, exp=%t got=%t", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestClientTLSAndToken(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		rw.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-authorizer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("opa-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newOPAClient(&options.AuthorizerClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.post(context.Background(), srv.URL, []byte("{}"), client.maxResponseBytes, new(interface{})); err == nil {
+		t.Error("expected error verifying a serving certificate not signed by the system roots")
+	}
+
+	client, err = newOPAClient(&options.AuthorizerClientOptions{CAFile: caFile, TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.post(context.Background(), srv.URL, []byte("{}"), client.maxResponseBytes, new(interface{})); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if gotAuth != "Bearer opa-token" {
+		t.Errorf("got unexpected authorization header, exp=%q got=%q", "Bearer opa-token", gotAuth)
+	}
+}
+
+func TestClientInvalidTLS(t *testing.T) {
+	if _, err := newOPAClient(&options.AuthorizerClientOptions{CAFile: "/does/not/exist"}); err == nil {
+		t.Error("expected error loading a missing CA file")
+	}
+}
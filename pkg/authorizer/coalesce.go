@@ -0,0 +1,103 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultQueryTimeout is the maximum time a query is made for if not
+// configured.
+const defaultQueryTimeout = time.Second * 30
+
+// queryGroup coalesces identical queries in flight, so that they share the
+// response of a single query to Open Policy Agent.
+type queryGroup struct {
+	mux     sync.Mutex
+	queries map[string]*sharedQuery
+}
+
+// sharedQuery is a query in flight and the number of requests waiting on it.
+type sharedQuery struct {
+	done    chan struct{}
+	resp    opaResponse
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs the query of the key, unless an identical query is already in
+// flight, and returns its response and whether it was shared. The query is
+// not made with the context of the request, so that requests waiting on it
+// are not failed if the request it was made for is cancelled. It is instead
+// cancelled after the timeout, or once no request is waiting on it. Each
+// request stops waiting once its own context is done.
+func (g *queryGroup) do(ctx context.Context, key string, timeout time.Duration, fn func(context.Context) (opaResponse, error)) (opaResponse, error, bool) {
+	g.mux.Lock()
+	if g.queries == nil {
+		g.queries = make(map[string]*sharedQuery)
+	}
+	q, shared := g.queries[key]
+	if !shared {
+		queryCtx, cancel := context.WithTimeout(detachedContext{ctx}, timeout)
+		q = &sharedQuery{done: make(chan struct{}), cancel: cancel}
+		g.queries[key] = q
+
+		go func() {
+			defer close(q.done)
+			defer cancel()
+			q.resp, q.err = fn(queryCtx)
+			g.forget(key, q)
+		}()
+	}
+	q.waiters++
+	g.mux.Unlock()
+
+	select {
+	case <-q.done:
+		return q.resp, q.err, shared
+
+	case <-ctx.Done():
+		g.mux.Lock()
+		q.waiters--
+		if q.waiters == 0 {
+			q.cancel()
+			g.forgetLocked(key, q)
+		}
+		g.mux.Unlock()
+		return opaResponse{}, ctx.Err(), shared
+	}
+}
+
+// forget removes the query of the key, so that later queries are made again.
+func (g *queryGroup) forget(key string, q *sharedQuery) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.forgetLocked(key, q)
+}
+
+func (g *queryGroup) forgetLocked(key string, q *sharedQuery) {
+	if g.queries[key] == q {
+		delete(g.queries, key)
+	}
+}
+
+// detachedContext carries the values of a context without its deadline or
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueryGroupCancelledWaiter(t *testing.T) {
+	var g queryGroup
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	query := func(ctx context.Context) (opaResponse, error) {
+		close(started)
+		<-release
+		return opaResponse{Provenance: &opaProvenance{Revision: "1"}}, ctx.Err()
+	}
+
+	// The request the query is made for goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err, _ := g.do(ctx, "key", time.Minute, query)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		resp, err, shared := g.do(context.Background(), "key", time.Minute, query)
+		if !shared || resp.Provenance.revision() != "1" {
+			t.Errorf("expected shared response, got=%+v shared=%t", resp, shared)
+		}
+		second <- err
+	}()
+
+	// Wait for the second request to join the query.
+	for {
+		g.mux.Lock()
+		waiters := g.queries["key"].waiters
+		g.mux.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected cancelled request to stop waiting, got=%v", err)
+	}
+
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("expected request waiting on the query not to be cancelled, got=%v", err)
+	}
+}
+
+func TestQueryGroupAbandoned(t *testing.T) {
+	var g queryGroup
+
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.do(ctx, "key", time.Minute, func(ctx context.Context) (opaResponse, error) {
+			cancel()
+			<-ctx.Done()
+			close(cancelled)
+			return opaResponse{}, ctx.Err()
+		})
+	}()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected query to be cancelled once no request is waiting on it")
+	}
+	<-done
+}
+
+func TestQueryGroupTimeout(t *testing.T) {
+	var g queryGroup
+
+	_, err, _ := g.do(context.Background(), "key", time.Millisecond*10, func(ctx context.Context) (opaResponse, error) {
+		<-ctx.Done()
+		return opaResponse{}, ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected query to time out, got=%v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+// Package decisionlog records the authorization decisions of the proxy to a
+// sink, in the format of Open Policy Agent decision logs.
+package decisionlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Options configure the decision log.
+type Options struct {
+	// File is the file records are appended to, or '-' for stdout.
+	File string
+
+	// URL is the Open Policy Agent decision log API compatible endpoint
+	// records are sent to.
+	URL string
+
+	// BufferSize is the maximum number of records waiting to be written.
+	// Records are dropped rather than blocking requests once it is full.
+	BufferSize int
+
+	// BatchSize is the maximum number of records written at once, and
+	// FlushInterval how long records wait for a batch to fill.
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// Enabled returns whether decisions are logged.
+func (o *Options) Enabled() bool {
+	return len(o.File) > 0 || len(o.URL) > 0
+}
+
+// Validate validates the decision log options.
+func (o *Options) Validate() error {
+	if len(o.File) > 0 && len(o.URL) > 0 {
+		return errors.New("only one of a decision log file and URL may be set")
+	}
+
+	if len(o.URL) > 0 {
+		u, err := url.Parse(o.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid decision log URL %q, must be an http or https URL", o.URL)
+		}
+	}
+
+	if o.Enabled() && (o.BufferSize <= 0 || o.BatchSize <= 0 || o.FlushInterval <= 0) {
+		return errors.New("decision log buffer size, batch size and flush interval must be positive")
+	}
+
+	return nil
+}
+
+// Record is an authorization decision. Fields follow the Open Policy Agent
+// decision log format, with the decision of the proxy added.
+type Record struct {
+	DecisionID string           `json:"decision_id"`
+	RequestID  string           `json:"request_id,omitempty"`
+	Path       string           `json:"path"`
+	Input      interface{}      `json:"input,omitempty"`
+	Result     interface{}      `json:"result,omitempty"`
+	Revision   string           `json:"revision,omitempty"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Metrics    map[string]int64 `json:"metrics,omitempty"`
+
+	// Decision and Reason are the decision of the proxy, and Step the name of
+	// the authorizer of the chain which made it, if not the final decision.
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+	Step     string `json:"step,omitempty"`
+
+	// CacheHit is whether the decision was found in the cache.
+	CacheHit bool `json:"cache_hit"`
+
+	// Degraded is the failure mode the decision was made with, if the
+	// policy could not be queried.
+	Degraded string `json:"degraded,omitempty"`
+
+	// Error is the error of the query, if it failed other than by the policy
+	// being unavailable.
+	Error string `json:"error,omitempty"`
+}
+
+// sink writes batches of records.
+type sink interface {
+	write(ctx context.Context, records []*Record) error
+	close() error
+}
+
+// Logger batches records to a sink in the background. Logging never blocks,
+// records are dropped if the buffer is full.
+type Logger struct {
+	sink          sink
+	records       chan *Record
+	batchSize     int
+	flushInterval time.Duration
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+	once   sync.Once
+}
+
+var (
+	// defaultLogger is the logger records are logged to, if set up.
+	defaultLogger *Logger
+)
+
+// Setup starts logging decisions to the sink configured by the options. The
+// returned function flushes the remaining records and stops logging. If no
+// sink is configured, decisions are not logged.
+func Setup(opts Options) (func(context.Context) error, error) {
+	if !opts.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var (
+		s   sink
+		err error
+	)
+	if len(opts.URL) > 0 {
+		s = newHTTPSink(opts.URL)
+	} else {
+		s, err = newFileSink(opts.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := newLogger(s, opts)
+	go l.run()
+
+	defaultLogger = l
+
+	return l.Shutdown, nil
+}
+
+func newLogger(s sink, opts Options) *Logger {
+	registerMetrics()
+
+	return &Logger{
+		sink:          s,
+		records:       make(chan *Record, opts.BufferSize),
+		batchSize:     opts.BatchSize,
+		flushInterval: opts.FlushInterval,
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+}
+
+// Enabled returns whether decisions are logged.
+func Enabled() bool {
+	return defaultLogger != nil
+}
+
+// Log logs the record if decisions are logged.
+func Log(r *Record) {
+	if defaultLogger != nil {
+		defaultLogger.Log(r)
+	}
+}
+
+// Log queues the record to be written, dropping it if the buffer is full.
+func (l *Logger) Log(r *Record) {
+	select {
+	case l.records <- r:
+	default:
+		droppedRecords.WithLabelValues(dropReasonBufferFull).Inc()
+	}
+}
+
+// run writes batches of records until the logger is shut down, after which
+// the remaining records are written.
+func (l *Logger) run() {
+	defer close(l.doneCh)
+
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Record, 0, l.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		l.write(context.Background(), batch)
+		batch = make([]*Record, 0, l.batchSize)
+	}
+
+	for {
+		select {
+		case r := <-l.records:
+			batch = append(batch, r)
+			if len(batch) >= l.batchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-l.stopCh:
+			for {
+				select {
+				case r := <-l.records:
+					batch = append(batch, r)
+					if len(batch) >= l.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) write(ctx context.Context, batch []*Record) {
+	if err := l.sink.write(ctx, batch); err != nil {
+		droppedRecords.WithLabelValues(dropReasonSinkError).Add(float64(len(batch)))
+		klog.Errorf("failed to write %d decision log records: %s", len(batch), err)
+		return
+	}
+	writtenRecords.Add(float64(len(batch)))
+}
+
+// Shutdown writes the remaining records and stops the logger, waiting until
+// the context is done.
+func (l *Logger) Shutdown(ctx context.Context) error {
+	l.once.Do(func() { close(l.stopCh) })
+
+	select {
+	case <-l.doneCh:
+		return l.sink.close()
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush decision log: %s", ctx.Err())
+	}
+}
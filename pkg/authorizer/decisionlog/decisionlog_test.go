@@ -0,0 +1,235 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package decisionlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSink struct {
+	mux     sync.Mutex
+	batches [][]*Record
+	block   chan struct{}
+}
+
+func (f *fakeSink) write(_ context.Context, records []*Record) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.batches = append(f.batches, records)
+	return nil
+}
+
+func (f *fakeSink) close() error {
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		opts   Options
+		expErr bool
+	}{
+		"disabled options should be valid": {
+			opts: Options{},
+		},
+		"a file should be valid": {
+			opts: Options{File: "-", BufferSize: 1, BatchSize: 1, FlushInterval: time.Second},
+		},
+		"a file and URL should be invalid": {
+			opts:   Options{File: "-", URL: "http://localhost", BufferSize: 1, BatchSize: 1, FlushInterval: time.Second},
+			expErr: true,
+		},
+		"a URL which is not http should be invalid": {
+			opts:   Options{URL: "localhost:8181", BufferSize: 1, BatchSize: 1, FlushInterval: time.Second},
+			expErr: true,
+		},
+		"a zero buffer size should be invalid": {
+			opts:   Options{File: "-", BatchSize: 1, FlushInterval: time.Second},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			err := test.opts.Validate()
+			if test.expErr != (err != nil) {
+				t.Errorf("got unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestLoggerBatches(t *testing.T) {
+	sink := new(fakeSink)
+	l := newLogger(sink, Options{BufferSize: 10, BatchSize: 2, FlushInterval: time.Hour})
+	go l.run()
+
+	for i := 0; i < 5; i++ {
+		l.Log(&Record{DecisionID: string(rune('a' + i))})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, batch := range sink.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("expected batches of sizes [2 2 1], got=%v", sizes)
+	}
+}
+
+func TestLoggerFlushInterval(t *testing.T) {
+	sink := new(fakeSink)
+	l := newLogger(sink, Options{BufferSize: 10, BatchSize: 100, FlushInterval: time.Millisecond * 10})
+	go l.run()
+	defer l.Shutdown(context.Background())
+
+	l.Log(&Record{DecisionID: "a"})
+
+	err := waitFor(func() bool {
+		sink.mux.Lock()
+		defer sink.mux.Unlock()
+		return len(sink.batches) == 1
+	})
+	if err != nil {
+		t.Error("expected partial batch to be written after the flush interval")
+	}
+}
+
+func TestLoggerDropsWhenFull(t *testing.T) {
+	sink := &fakeSink{block: make(chan struct{})}
+	l := newLogger(sink, Options{BufferSize: 2, BatchSize: 1, FlushInterval: time.Hour})
+	go l.run()
+
+	done := make(chan struct{})
+	go func() {
+		// The first record is held by the blocked sink, and the buffer holds
+		// two more. The rest must be dropped rather than block.
+		for i := 0; i < 10; i++ {
+			l.Log(&Record{})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("logging blocked on a full buffer")
+	}
+
+	close(sink.block)
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(sink.batches); n > 3 {
+		t.Errorf("expected at most 3 records to be written, got=%d", n)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-decisionlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "decisions.log")
+	sink, err := newFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*Record{{DecisionID: "a", Decision: "allow"}, {DecisionID: "b", Decision: "deny"}}
+	if err := sink.write(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+
+	if len(got) != 2 || got[0].DecisionID != "a" || got[1].Decision != "deny" {
+		t.Errorf("got unexpected records, got=%+v", got)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var got []Record
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected gzip content encoding, got=%q", r.Header.Get("Content-Encoding"))
+		}
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := json.NewDecoder(gr).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sink := newHTTPSink(srv.URL)
+	if err := sink.write(context.Background(), []*Record{{DecisionID: "a", CacheHit: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0].DecisionID != "a" || !got[0].CacheHit {
+		t.Errorf("got unexpected records, got=%+v", got)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	})
+	if err := sink.write(context.Background(), []*Record{{DecisionID: "b"}}); err == nil {
+		t.Error("expected error on a 500 response")
+	}
+}
+
+func waitFor(cond func() bool) error {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return context.DeadlineExceeded
+}
@@ -0,0 +1,47 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package decisionlog
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// Reasons records are dropped.
+const (
+	dropReasonBufferFull = "buffer_full"
+	dropReasonSinkError  = "sink_error"
+)
+
+var (
+	writtenRecords = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "decision_log",
+			Name:           "written_total",
+			Help:           "Number of authorization decisions written to the decision log.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	droppedRecords = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "decision_log",
+			Name:           "dropped_total",
+			Help:           "Number of authorization decisions dropped from the decision log.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	registerOnce sync.Once
+)
+
+func registerMetrics() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(writtenRecords, droppedRecords)
+	})
+}
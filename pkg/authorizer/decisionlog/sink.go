@@ -0,0 +1,108 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package decisionlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// httpTimeout is the timeout of sending a batch of records.
+	httpTimeout = time.Second * 10
+)
+
+// fileSink writes records as lines of JSON to a file.
+type fileSink struct {
+	w    *bufio.Writer
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	if path == "-" {
+		return &fileSink{w: bufio.NewWriter(os.Stdout)}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open decision log file: %s", err)
+	}
+
+	return &fileSink{w: bufio.NewWriter(f), file: f}, nil
+}
+
+func (f *fileSink) write(_ context.Context, records []*Record) error {
+	enc := json.NewEncoder(f.w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return f.w.Flush()
+}
+
+func (f *fileSink) close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// httpSink sends records to an endpoint compatible with the Open Policy Agent
+// decision log API, as a gzipped JSON array.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string) *httpSink {
+	return &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: httpTimeout},
+	}
+}
+
+func (h *httpSink) write(ctx context.Context, records []*Record) error {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gw).Encode(records); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("decision log endpoint responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (h *httpSink) close() error {
+	return nil
+}
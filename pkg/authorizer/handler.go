@@ -5,28 +5,95 @@ package authorizer
 import (
 	"net/http"
 
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/clusterinfo"
 	"github.com/jetstack/kube-oidc-proxy/pkg/noimpersonatedrequest"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/review"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
 	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
 	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest"
+)
+
+type key int
+
+const (
+	// responseHeaderKey is the context key for the header of the response to
+	// the request.
+	responseHeaderKey key = iota
+
+	// requestObjectKey is the context key for the object of the request sent
+	// to Open Policy Agent.
+	requestObjectKey
+
+	// requestContextKey is the context key for the context of the request
+	// sent to Open Policy Agent.
+	requestContextKey
+
+	// upstreamUserKey is the context key for the user the upstream authorizer
+	// impersonates.
+	upstreamUserKey
+
+	// decisionRecordKey is the context key for the decision log record of the
+	// authorization of the request.
+	decisionRecordKey
 )
 
 func (a *OPAAuthorizer) WithRequest(handler http.Handler) http.Handler {
+	return withRequest(handler, a, a.restConfig, a.upstream, a.userExtraData, a.bodies, a.input)
+}
+
+func withRequest(handler http.Handler, authz authorizer.Authorizer, restConfig *rest.Config, upstream authorizer.Authorizer, userExtraData *clusterinfo.ClusterInfo, bodies *requestBodies, input *requestInput) http.Handler {
 	scheme := runtime.NewScheme()
+	codecs := serializer.NewCodecFactory(scheme).WithoutConversion()
 	// Если авторизатор включен, то встраиваем его в обработку запроса
 	// Запрос на API-сервер пойдет от имени SA пода, действующего с правами админа
-	handler = noimpersonatedrequest.WithPodSA(handler, noimpersonatedrequest.RestConfigToken(a.restConfig))
-	handler = genericapifilters.WithAuthorization(handler, a, serializer.NewCodecFactory(scheme).WithoutConversion())
-	if a.userExtraData != nil {
-		handler = a.userExtraData.WithClusterInfo(handler)
+	handler = noimpersonatedrequest.WithPodSA(handler, noimpersonatedrequest.RestConfigToken(restConfig))
+	handler = genericapifilters.WithAuthorization(handler, authz, codecs)
+	// Тела запросов читаются до авторизации, чтобы передать объект в OPA
+	if bodies != nil {
+		handler = bodies.withRequestBody(handler, codecs)
+	}
+	// Запросы can-i обслуживаем сами, чтобы ответ учитывал политику авторизатора
+	handler = withSelfSubjectReviews(handler, authz, upstream)
+	if userExtraData != nil {
+		handler = userExtraData.WithClusterInfo(handler)
 	}
+	if input != nil {
+		handler = input.withRequestContext(handler)
+	}
+	handler = withResponseHeader(handler)
 	// Без проинициализированной фабрики на авторизацию не приходят resourceAttributes, только nonResourceAttributes
 	handler = genericapifilters.WithRequestInfo(handler, withCustomFactory())
 	return handler
 }
 
+// withSelfSubjectReviews answers SelfSubjectAccessReviews, and
+// SelfSubjectRulesReviews if the authorizer answers rules queries, using the
+// authorizer rather than the API server which is unaware of the policy. The
+// upstream authorizer, if any, also decides access reviews.
+func withSelfSubjectReviews(handler http.Handler, authz, upstream authorizer.Authorizer) http.Handler {
+	accessReview := review.NewSelfSubjectAccessReview(authz, upstream)
+
+	var rulesReview http.Handler
+	if resolver, ok := authz.(rulesResolver); ok && resolver.HasRules() {
+		rulesReview = review.NewSelfSubjectRulesReview(resolver, upstream != nil)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case review.SelfSubjectAccessReviewPaths.Has(req.URL.Path):
+			accessReview.ServeHTTP(rw, req)
+		case rulesReview != nil && review.SelfSubjectRulesReviewPaths.Has(req.URL.Path):
+			rulesReview.ServeHTTP(rw, req)
+		default:
+			handler.ServeHTTP(rw, req)
+		}
+	})
+}
+
 func withCustomFactory() *request.RequestInfoFactory {
 	return &request.RequestInfoFactory{
 		APIPrefixes:          sets.NewString("api", "apis"),
@@ -0,0 +1,156 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+// requestInput adds the context of requests to the input sent to Open Policy
+// Agent, as the input of version v2.
+type requestInput struct {
+	claims         []string
+	cacheKeyFields []string
+}
+
+// newRequestInput returns the request input configured by the options, or nil
+// if only the SubjectAccessReview is sent.
+func newRequestInput(opts *options.AuthorizerInputOptions) *requestInput {
+	if opts.Version != options.AuthorizerInputV2 {
+		return nil
+	}
+	return &requestInput{claims: opts.Claims, cacheKeyFields: opts.CacheKeyFields}
+}
+
+// requestContext is the context of a request added to the input of version
+// v2.
+type requestContext struct {
+	InputVersion string         `json:"inputVersion"`
+	Request      requestDetails `json:"request"`
+	Token        *tokenDetails  `json:"token,omitempty"`
+}
+
+// requestDetails are the details of the request.
+type requestDetails struct {
+	ClientIP   string              `json:"clientIP,omitempty"`
+	UserAgent  string              `json:"userAgent,omitempty"`
+	Path       string              `json:"path"`
+	Query      map[string][]string `json:"query,omitempty"`
+	AuthMethod string              `json:"authMethod,omitempty"`
+
+	// Time is the time the request was received. Decisions are only cached
+	// if it is not a cache key field.
+	Time string `json:"time,omitempty"`
+}
+
+// tokenDetails are the issuer and selected claims of the token the request
+// was authenticated with.
+type tokenDetails struct {
+	Issuer string                 `json:"issuer,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// withRequestContext adds the context of the request to its context, to be
+// sent to Open Policy Agent.
+func (i *requestInput) withRequestContext(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The client IP is resolved by the proxy from trusted front ends only.
+		addr := proxycontext.ClientIP(req)
+		if len(addr) == 0 {
+			addr = req.RemoteAddr
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+		}
+
+		rc := &requestContext{
+			InputVersion: options.AuthorizerInputV2,
+			Request: requestDetails{
+				ClientIP:   addr,
+				UserAgent:  req.UserAgent(),
+				Path:       req.URL.Path,
+				AuthMethod: proxycontext.AuthMethod(req),
+				Time:       time.Now().UTC().Format(time.RFC3339),
+			},
+		}
+		if query := req.URL.Query(); len(query) > 0 {
+			rc.Request.Query = query
+		}
+
+		if claims := proxycontext.TokenClaims(req); claims != nil {
+			rc.Token = &tokenDetails{}
+			rc.Token.Issuer, _ = claims["iss"].(string)
+			for _, name := range i.claims {
+				if v, ok := claims[name]; ok {
+					if rc.Token.Claims == nil {
+						rc.Token.Claims = make(map[string]interface{})
+					}
+					rc.Token.Claims[name] = v
+				}
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), requestContextKey, rc)
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// requestContextFrom returns the context of the request of the context, if
+// any.
+func requestContextFrom(ctx context.Context) *requestContext {
+	rc, _ := ctx.Value(requestContextKey).(*requestContext)
+	return rc
+}
+
+// cacheKey returns the request context as added to the cache key, with only
+// the cache key fields of the request, and whether decisions of the request
+// may be cached.
+func (i *requestInput) cacheKey(rc *requestContext) (*requestContext, bool) {
+	key := &requestContext{InputVersion: rc.InputVersion, Token: rc.Token}
+	for _, field := range i.cacheKeyFields {
+		switch field {
+		case "clientIP":
+			key.Request.ClientIP = rc.Request.ClientIP
+		case "userAgent":
+			key.Request.UserAgent = rc.Request.UserAgent
+		case "path":
+			key.Request.Path = rc.Request.Path
+		case "query":
+			key.Request.Query = rc.Request.Query
+		case "authMethod":
+			key.Request.AuthMethod = rc.Request.AuthMethod
+		case "time":
+			// Every request has its own time, so would never hit the cache.
+			return nil, false
+		}
+	}
+	return key, true
+}
+
+// addInputFields adds the fields of v to the input of the Open Policy Agent
+// request payload.
+func addInputFields(payload []byte, v interface{}) ([]byte, error) {
+	var req struct {
+		Input map[string]json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	fields, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fields, &req.Input); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&req)
+}
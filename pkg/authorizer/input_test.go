@@ -0,0 +1,278 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+func TestWithRequestContext(t *testing.T) {
+	tests := map[string]struct {
+		target     string
+		remoteAddr string
+		xff        string
+		clientIP   string
+		claims     map[string]interface{}
+		authMethod string
+
+		exp requestContext
+	}{
+		"a request should have its details added": {
+			target:     "/api/v1/namespaces/default/pods?watch=true&labelSelector=app%3Dweb",
+			remoteAddr: "10.0.0.1:41234",
+			authMethod: "oidc",
+			exp: requestContext{
+				InputVersion: options.AuthorizerInputV2,
+				Request: requestDetails{
+					ClientIP:   "10.0.0.1",
+					UserAgent:  "kubectl/v1.18.0",
+					Path:       "/api/v1/namespaces/default/pods",
+					Query:      map[string][]string{"watch": {"true"}, "labelSelector": {"app=web"}},
+					AuthMethod: "oidc",
+				},
+			},
+		},
+		"the client IP resolved by the proxy should be used": {
+			target:     "/api",
+			remoteAddr: "10.0.0.1:41234",
+			clientIP:   "203.0.113.7",
+			exp: requestContext{
+				InputVersion: options.AuthorizerInputV2,
+				Request: requestDetails{
+					ClientIP:  "203.0.113.7",
+					UserAgent: "kubectl/v1.18.0",
+					Path:      "/api",
+				},
+			},
+		},
+		"a forwarded client IP should not be trusted": {
+			target:     "/api",
+			remoteAddr: "10.0.0.1:41234",
+			xff:        "203.0.113.7",
+			exp: requestContext{
+				InputVersion: options.AuthorizerInputV2,
+				Request: requestDetails{
+					ClientIP:  "10.0.0.1",
+					UserAgent: "kubectl/v1.18.0",
+					Path:      "/api",
+				},
+			},
+		},
+		"only selected claims of the token should be added": {
+			target:     "/api",
+			remoteAddr: "10.0.0.1:41234",
+			claims: map[string]interface{}{
+				"iss":    "https://issuer.example.com",
+				"email":  "alice@example.com",
+				"groups": []interface{}{"developers"},
+				"nonce":  "abc",
+			},
+			authMethod: "oidc",
+			exp: requestContext{
+				InputVersion: options.AuthorizerInputV2,
+				Request: requestDetails{
+					ClientIP:   "10.0.0.1",
+					UserAgent:  "kubectl/v1.18.0",
+					Path:       "/api",
+					AuthMethod: "oidc",
+				},
+				Token: &tokenDetails{
+					Issuer: "https://issuer.example.com",
+					Claims: map[string]interface{}{
+						"email":  "alice@example.com",
+						"groups": []interface{}{"developers"},
+					},
+				},
+			},
+		},
+		"a token without selected claims should only add its issuer": {
+			target:     "/api",
+			remoteAddr: "10.0.0.1:41234",
+			claims:     map[string]interface{}{"iss": "https://issuer.example.com"},
+			exp: requestContext{
+				InputVersion: options.AuthorizerInputV2,
+				Request: requestDetails{
+					ClientIP:  "10.0.0.1",
+					UserAgent: "kubectl/v1.18.0",
+					Path:      "/api",
+				},
+				Token: &tokenDetails{Issuer: "https://issuer.example.com"},
+			},
+		},
+	}
+
+	input := newRequestInput(&options.AuthorizerInputOptions{
+		Version: options.AuthorizerInputV2,
+		Claims:  []string{"email", "groups", "acr"},
+	})
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var got *requestContext
+			handler := input.withRequestContext(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				got = requestContextFrom(req.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set("User-Agent", "kubectl/v1.18.0")
+			if len(test.xff) > 0 {
+				req.Header.Set("X-Forwarded-For", test.xff)
+			}
+			if len(test.clientIP) > 0 {
+				req = proxycontext.WithClientIP(req, test.clientIP)
+			}
+			if test.claims != nil {
+				req = proxycontext.WithTokenClaims(req, test.claims)
+			}
+			if len(test.authMethod) > 0 {
+				req = proxycontext.WithAuthMethod(req, test.authMethod)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got == nil {
+				t.Fatal("expected request context in context")
+			}
+			if _, err := time.Parse(time.RFC3339, got.Request.Time); err != nil {
+				t.Errorf("expected time of request, got=%q", got.Request.Time)
+			}
+
+			got.Request.Time = ""
+			if !reflect.DeepEqual(*got, test.exp) {
+				t.Errorf("unexpected request context,\nexp=%+v\ngot=%+v", test.exp, *got)
+			}
+		})
+	}
+}
+
+func TestNewRequestInput(t *testing.T) {
+	if input := newRequestInput(&options.AuthorizerInputOptions{Version: options.AuthorizerInputV1}); input != nil {
+		t.Errorf("expected no request input for version v1, got=%+v", input)
+	}
+	if input := newRequestInput(&options.AuthorizerInputOptions{}); input != nil {
+		t.Errorf("expected no request input by default, got=%+v", input)
+	}
+}
+
+func TestAddInputFields(t *testing.T) {
+	payload := []byte(`{"input": {"kind":"SubjectAccessReview","spec":{"user":"alice"}}}`)
+	obj := &requestObject{
+		Object:    json.RawMessage(`{"data":{"key":"new"}}`),
+		PatchType: "application/merge-patch+json",
+	}
+
+	got, err := addInputFields(payload, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		Input map[string]json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(got, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]string{
+		"kind":      `"SubjectAccessReview"`,
+		"spec":      `{"user":"alice"}`,
+		"object":    `{"data":{"key":"new"}}`,
+		"patchType": `"application/merge-patch+json"`,
+	}
+	if len(req.Input) != len(exp) {
+		t.Errorf("unexpected input fields, got=%s", got)
+	}
+	for k, v := range exp {
+		if string(req.Input[k]) != v {
+			t.Errorf("unexpected input field %q, exp=%s got=%s", k, v, req.Input[k])
+		}
+	}
+}
+
+func TestRequestContextCacheKey(t *testing.T) {
+	var (
+		calls int32
+		input struct {
+			Input struct {
+				InputVersion string         `json:"inputVersion"`
+				Request      requestDetails `json:"request"`
+			} `json:"input"`
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+		sar, _ := allowAccess(NewSubjectAccessReviewFromAttributes(testAccess), nil)
+		response, _ := json.Marshal(opaResponse{Result: *sar})
+		rw.Write(response)
+	}))
+	defer srv.Close()
+
+	newAuthorizer := func(fields ...string) *OPAAuthorizer {
+		atomic.StoreInt32(&calls, 0)
+		return newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+			AuthorizerUri: srv.URL,
+			Cache:         options.AuthorizerCacheOptions{Size: 10, AllowedTTL: time.Minute},
+			Input: options.AuthorizerInputOptions{
+				Version:        options.AuthorizerInputV2,
+				CacheKeyFields: fields,
+			},
+		})
+	}
+
+	authorize := func(a *OPAAuthorizer, request requestDetails) {
+		rc := &requestContext{InputVersion: options.AuthorizerInputV2, Request: request}
+		ctx := context.WithValue(context.Background(), requestContextKey, rc)
+		if _, _, err := a.Authorize(ctx, testAccess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := newAuthorizer("clientIP", "path", "authMethod")
+
+	authorize(a, requestDetails{ClientIP: "10.0.0.1", Path: "/api", Time: "2022-06-01T12:00:00Z"})
+	if input.Input.InputVersion != options.AuthorizerInputV2 || input.Input.Request.ClientIP != "10.0.0.1" ||
+		input.Input.Request.Time != "2022-06-01T12:00:00Z" {
+		t.Errorf("expected request context in input, got=%+v", input.Input)
+	}
+
+	// Fields which are not part of the cache key do not prevent cache hits.
+	authorize(a, requestDetails{
+		ClientIP:  "10.0.0.1",
+		Path:      "/api",
+		UserAgent: "kubectl/v1.18.0",
+		Query:     map[string][]string{"resourceVersion": {"12345"}},
+		Time:      "2022-06-01T12:00:01Z",
+	})
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected decision to be cached regardless of fields not in the key, got %d queries", n)
+	}
+
+	authorize(a, requestDetails{ClientIP: "10.0.0.2", Path: "/api", Time: "2022-06-01T12:00:02Z"})
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected decision of another client IP not to be cached, got %d queries", n)
+	}
+
+	// Decisions are not cached if the time of the request is part of the key.
+	a = newAuthorizer("clientIP", "time")
+
+	authorize(a, requestDetails{ClientIP: "10.0.0.1", Path: "/api", Time: "2022-06-01T12:00:00Z"})
+	authorize(a, requestDetails{ClientIP: "10.0.0.1", Path: "/api", Time: "2022-06-01T12:00:00Z"})
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected decisions not to be cached with the time in the key, got %d queries", n)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	opaRequestDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "opa",
+			Name:           "request_duration_seconds",
+			Help:           "Latency of requests to Open Policy Agent, including retries.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 14),
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	opaRequestErrors = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "opa",
+			Name:           "request_errors_total",
+			Help:           "Number of requests to Open Policy Agent which failed.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	opaCoalescedRequests = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "opa",
+			Name:           "coalesced_requests_total",
+			Help:           "Number of authorization queries which shared the response of an identical query in flight to Open Policy Agent.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	opaCircuitBreakerTrips = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "opa",
+			Name:           "circuit_breaker_trips_total",
+			Help:           "Number of times the circuit breaker of an Open Policy Agent endpoint opened.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	opaDegradedDecisions = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "opa",
+			Name:           "degraded_decisions_total",
+			Help:           "Number of requests authorized by the failure mode as Open Policy Agent could not be queried.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"mode"},
+	)
+
+	regoEvalDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "rego",
+			Name:           "eval_duration_seconds",
+			Help:           "Latency of evaluating Rego policies in the proxy.",
+			Buckets:        metrics.ExponentialBuckets(0.0001, 2, 14),
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	regoReloadErrors = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "rego",
+			Name:           "reload_errors_total",
+			Help:           "Number of times changed Rego policies failed to reload.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	shadowDisagreements = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authorizer",
+			Name:           "shadow_disagreements_total",
+			Help:           "Number of requests the shadow policy gave a different decision to the enforced decision.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"enforced", "shadow"},
+	)
+
+	shadowTimeouts = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "authorizer",
+			Name:           "shadow_timeouts_total",
+			Help:           "Number of requests the shadow policy did not decide within the shadow timeout.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerOnce sync.Once
+)
+
+func registerMetrics() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(opaRequestDuration, opaRequestErrors, opaCoalescedRequests,
+			opaCircuitBreakerTrips, opaDegradedDecisions, regoEvalDuration, regoReloadErrors,
+			shadowDisagreements, shadowTimeouts)
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyAuthorizer decides requests matched by any of the rules of a policy
+// file. Requests not matched by a rule get no opinion, so are decided by the
+// next authorizer in the chain.
+type PolicyAuthorizer struct {
+	Rules []PolicyRule `json:"rules"`
+
+	path     string
+	decision authorizer.Decision
+}
+
+// PolicyRule matches requests of the users and members of the groups listed,
+// in the style of an RBAC rule. Empty fields other than the subjects match
+// anything, as does '*'.
+type PolicyRule struct {
+	// Users and Groups the rule applies to.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	Verbs []string `json:"verbs,omitempty"`
+
+	// APIGroups, Resources, ResourceNames and Namespaces match resource
+	// requests. Subresources are matched as '<resource>/<subresource>'.
+	APIGroups     []string `json:"apiGroups,omitempty"`
+	Resources     []string `json:"resources,omitempty"`
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	Namespaces    []string `json:"namespaces,omitempty"`
+
+	// NonResourceURLs match non-resource requests. A trailing '*' matches any
+	// suffix. A rule without NonResourceURLs only matches resource requests.
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+var _ authorizer.Authorizer = &PolicyAuthorizer{}
+
+// LoadPolicy loads the YAML or JSON encoded policy file. Requests matched by
+// a rule are given the decision.
+func LoadPolicy(path string, decision authorizer.Decision) (*PolicyAuthorizer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorizer policy file: %s", err)
+	}
+
+	policy := new(PolicyAuthorizer)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to decode authorizer policy file %q: %s", path, err)
+	}
+
+	policy.path, policy.decision = path, decision
+
+	return policy, nil
+}
+
+// Authorize gives the decision of the policy to requests matched by any of
+// the rules. All other requests get no opinion.
+func (p *PolicyAuthorizer) Authorize(_ context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	for i, rule := range p.Rules {
+		if rule.matches(attrs) {
+			return p.decision, fmt.Sprintf("matched rule %d of policy %q", i, p.path), nil
+		}
+	}
+
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+func (r *PolicyRule) matches(attrs authorizer.Attributes) bool {
+	u := attrs.GetUser()
+	if u == nil {
+		return false
+	}
+
+	if !sets.NewString(r.Users...).Has(u.GetName()) &&
+		!sets.NewString(r.Groups...).HasAny(u.GetGroups()...) {
+		return false
+	}
+
+	if !matchesAny(r.Verbs, attrs.GetVerb()) {
+		return false
+	}
+
+	if !attrs.IsResourceRequest() {
+		if len(r.NonResourceURLs) == 0 {
+			return false
+		}
+
+		for _, pattern := range r.NonResourceURLs {
+			if pattern == "*" || pattern == attrs.GetPath() ||
+				(strings.HasSuffix(pattern, "*") && strings.HasPrefix(attrs.GetPath(), strings.TrimSuffix(pattern, "*"))) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(r.NonResourceURLs) > 0 && len(r.Resources) == 0 {
+		return false
+	}
+
+	resource := attrs.GetResource()
+	if len(attrs.GetSubresource()) > 0 {
+		resource += "/" + attrs.GetSubresource()
+	}
+
+	return matchesAny(r.APIGroups, attrs.GetAPIGroup()) &&
+		matchesAny(r.Resources, resource) &&
+		matchesAny(r.ResourceNames, attrs.GetName()) &&
+		matchesAny(r.Namespaces, attrs.GetNamespace())
+}
+
+// matchesAny returns whether the value is in the list, or if the list is empty
+// or contains '*'.
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+
+	s := sets.NewString(list...)
+	return s.Has("*") || s.Has(value)
+}
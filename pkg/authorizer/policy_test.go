@@ -0,0 +1,133 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const testPolicy = `
+rules:
+- groups: ["developers"]
+  verbs: ["get", "list", "watch"]
+  resources: ["pods", "pods/log"]
+  namespaces: ["dev"]
+- users: ["jane"]
+  verbs: ["*"]
+  apiGroups: ["apps"]
+  resources: ["deployments"]
+  resourceNames: ["web"]
+- groups: ["system:authenticated"]
+  verbs: ["get"]
+  nonResourceURLs: ["/healthz", "/version*"]
+`
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(path, authorizer.DecisionDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	developer := &user.DefaultInfo{Name: "john", Groups: []string{"developers", "system:authenticated"}}
+	jane := &user.DefaultInfo{Name: "jane", Groups: []string{"system:authenticated"}}
+
+	tests := map[string]struct {
+		attrs       authorizer.AttributesRecord
+		expDecision authorizer.Decision
+	}{
+		"a group member reading pods in the namespace should match": {
+			attrs: authorizer.AttributesRecord{User: developer, Verb: "list", Resource: "pods",
+				Namespace: "dev", ResourceRequest: true},
+			expDecision: authorizer.DecisionDeny,
+		},
+		"a subresource listed should match": {
+			attrs: authorizer.AttributesRecord{User: developer, Verb: "get", Resource: "pods",
+				Subresource: "log", Namespace: "dev", ResourceRequest: true},
+			expDecision: authorizer.DecisionDeny,
+		},
+		"a subresource not listed should not match": {
+			attrs: authorizer.AttributesRecord{User: developer, Verb: "get", Resource: "pods",
+				Subresource: "exec", Namespace: "dev", ResourceRequest: true},
+			expDecision: authorizer.DecisionNoOpinion,
+		},
+		"another namespace should not match": {
+			attrs: authorizer.AttributesRecord{User: developer, Verb: "list", Resource: "pods",
+				Namespace: "prod", ResourceRequest: true},
+			expDecision: authorizer.DecisionNoOpinion,
+		},
+		"a verb not listed should not match": {
+			attrs: authorizer.AttributesRecord{User: developer, Verb: "delete", Resource: "pods",
+				Namespace: "dev", ResourceRequest: true},
+			expDecision: authorizer.DecisionNoOpinion,
+		},
+		"a user with any verb on a named resource should match": {
+			attrs: authorizer.AttributesRecord{User: jane, Verb: "patch", APIGroup: "apps",
+				Resource: "deployments", Name: "web", Namespace: "prod", ResourceRequest: true},
+			expDecision: authorizer.DecisionDeny,
+		},
+		"another resource name should not match": {
+			attrs: authorizer.AttributesRecord{User: jane, Verb: "patch", APIGroup: "apps",
+				Resource: "deployments", Name: "api", Namespace: "prod", ResourceRequest: true},
+			expDecision: authorizer.DecisionNoOpinion,
+		},
+		"a non-resource URL listed should match": {
+			attrs:       authorizer.AttributesRecord{User: jane, Verb: "get", Path: "/healthz"},
+			expDecision: authorizer.DecisionDeny,
+		},
+		"a non-resource URL prefix should match": {
+			attrs:       authorizer.AttributesRecord{User: jane, Verb: "get", Path: "/version/"},
+			expDecision: authorizer.DecisionDeny,
+		},
+		"a non-resource URL not listed should not match": {
+			attrs:       authorizer.AttributesRecord{User: developer, Verb: "get", Path: "/metrics"},
+			expDecision: authorizer.DecisionNoOpinion,
+		},
+	}
+
+	for name, test := range tests {
+		decision, _, err := policy.Authorize(context.Background(), test.attrs)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+
+		if decision != test.expDecision {
+			t.Errorf("%s: got unexpected decision, exp=%s got=%s", name,
+				decisionString(test.expDecision), decisionString(decision))
+		}
+	}
+}
+
+func TestLoadPolicyUnknownField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte("rules:\n- user: [jane]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPolicy(path, authorizer.DecisionAllow); err == nil {
+		t.Error("expected error loading policy with an unknown field")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/decisionlog"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+// newDecisionRecord returns the record of the authorization of the request
+// for the decision log. Its input is the SubjectAccessReview of the request,
+// unless the Open Policy Agent authorizer records the input it was queried
+// with. Each decision has its own ID, as a request may be authorized several
+// times, such as by its cluster, and records the ID of the request.
+func newDecisionRecord(ctx context.Context, attrs authorizer.Attributes) *decisionlog.Record {
+	return &decisionlog.Record{
+		DecisionID: string(uuid.NewUUID()),
+		RequestID:  proxycontext.RequestIDFrom(ctx),
+		Input:      NewSubjectAccessReviewFromAttributes(attrs),
+	}
+}
+
+// withDecisionRecord returns a copy of the context holding the record of the
+// authorization, for authorizers of the chain to add to.
+func withDecisionRecord(ctx context.Context, record *decisionlog.Record) context.Context {
+	return context.WithValue(ctx, decisionRecordKey, record)
+}
+
+// decisionRecordFrom returns the record of the authorization of the context,
+// if decisions are logged.
+func decisionRecordFrom(ctx context.Context) *decisionlog.Record {
+	record, _ := ctx.Value(decisionRecordKey).(*decisionlog.Record)
+	return record
+}
+
+// logDecision logs the record with the decision of the chain, and the name
+// of the authorizer which made it, if any.
+func logDecision(record *decisionlog.Record, step string, decision authorizer.Decision, reason string, err error, latency time.Duration) {
+	record.Step = step
+	record.Decision = decisionString(decision)
+	record.Reason = reason
+	record.Timestamp = time.Now().UTC()
+	record.Metrics = map[string]int64{"timer_authorize_ns": latency.Nanoseconds()}
+	if err != nil && len(record.Error) == 0 && len(record.Degraded) == 0 {
+		record.Error = err.Error()
+	}
+
+	decisionlog.Log(record)
+}
@@ -0,0 +1,190 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/util"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+// regoEvaluator evaluates Rego policies in the proxy, rather than querying
+// Open Policy Agent.
+type regoEvaluator struct {
+	paths   []string
+	bundles []string
+	query   string
+
+	mux      sync.RWMutex
+	prepared rego.PreparedEvalQuery
+	// revision is a digest of the files the policies were loaded from.
+	revision string
+}
+
+// regoResponse is the response of an evaluation, in the same form as the
+// response of Open Policy Agent.
+type regoResponse struct {
+	Result     interface{}    `json:"result,omitempty"`
+	Provenance *opaProvenance `json:"provenance,omitempty"`
+}
+
+// newRegoEvaluator loads the policies, and reloads them every reload interval
+// if their files change.
+func newRegoEvaluator(opts *options.AuthorizerRegoOptions) (*regoEvaluator, error) {
+	e := &regoEvaluator{
+		paths:   opts.Paths,
+		bundles: opts.Bundles,
+		query:   opts.Query,
+	}
+
+	revision, err := e.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.load(revision); err != nil {
+		return nil, err
+	}
+
+	if opts.ReloadInterval > 0 {
+		go wait.Until(e.reloadIfChanged, opts.ReloadInterval, wait.NeverStop)
+	}
+
+	return e, nil
+}
+
+// load prepares the query with the policies, replacing those previously
+// loaded.
+func (e *regoEvaluator) load(revision string) error {
+	args := []func(*rego.Rego){
+		rego.Query(e.query),
+		rego.Load(e.paths, ignoreKubernetesVolumeData),
+	}
+	for _, b := range e.bundles {
+		args = append(args, rego.LoadBundle(b))
+	}
+
+	prepared, err := rego.New(args...).PrepareForEval(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load rego policies: %s", err)
+	}
+
+	e.mux.Lock()
+	e.prepared = prepared
+	e.revision = revision
+	e.mux.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged reloads the policies if their files have changed. The
+// policies previously loaded are kept if they fail to load.
+func (e *regoEvaluator) reloadIfChanged() {
+	revision, err := e.fingerprint()
+	if err != nil {
+		regoReloadErrors.Inc()
+		klog.Errorf("failed to check rego policies for changes: %s", err)
+		return
+	}
+
+	e.mux.RLock()
+	changed := revision != e.revision
+	e.mux.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := e.load(revision); err != nil {
+		regoReloadErrors.Inc()
+		klog.Errorf("%s, keeping the previous policies", err)
+		return
+	}
+
+	klog.Infof("reloaded rego policies")
+}
+
+// fingerprint returns a digest of the names, sizes and modification times of
+// the files the policies are loaded from.
+func (e *regoEvaluator) fingerprint() (string, error) {
+	h := sha256.New()
+	for _, root := range append(append([]string{}, e.paths...), e.bundles...) {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Follow symbolic links, as files of Kubernetes volumes are links
+			// to the latest data.
+			if info, err = os.Stat(path); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// eval evaluates the query with the input of the Open Policy Agent request
+// payload, and writes the response to body. Evaluation is stopped once the
+// context is done.
+func (e *regoEvaluator) eval(ctx context.Context, payload []byte, body *json.RawMessage) error {
+	var request struct {
+		Input interface{} `json:"input"`
+	}
+	if err := util.UnmarshalJSON(payload, &request); err != nil {
+		return err
+	}
+
+	e.mux.RLock()
+	prepared, revision := e.prepared, e.revision
+	e.mux.RUnlock()
+
+	start := time.Now()
+	rs, err := prepared.Eval(ctx, rego.EvalInput(request.Input))
+	regoEvalDuration.Observe(time.Since(start).Seconds())
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// A policy evaluated past the deadline of the query is unavailable.
+		return fmt.Errorf("failed to evaluate rego policies: %w", ctxErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to evaluate rego policies: %s", err)
+	}
+
+	// An undefined result is no opinion, as with Open Policy Agent.
+	resp := regoResponse{
+		Provenance: &opaProvenance{Revision: revision},
+	}
+	if len(rs) > 0 && len(rs[0].Expressions) > 0 {
+		resp.Result = rs[0].Expressions[0].Value
+	}
+
+	*body, err = json.Marshal(&resp)
+	return err
+}
+
+// ignoreKubernetesVolumeData ignores the hidden directories of the data of
+// Kubernetes volumes, such as ConfigMaps, which would otherwise be loaded
+// alongside the links to them.
+func ignoreKubernetesVolumeData(_ string, info os.FileInfo, _ int) bool {
+	return strings.HasPrefix(info.Name(), "..")
+}
@@ -0,0 +1,149 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+const (
+	allowDevelopersPolicy = `package kubernetes.authz
+
+status = {"allowed": true, "reason": "developers may"} {
+	input.spec.groups[_] == data.groups.allowed
+}
+`
+
+	denyAllPolicy = `package kubernetes.authz
+
+status = {"denied": true, "reason": "nobody may"}
+`
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegoAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.rego")
+	writeFile(t, policyFile, allowDevelopersPolicy)
+	writeFile(t, filepath.Join(dir, "groups.json"), `{"groups": {"allowed": "developers"}}`)
+	// Data of Kubernetes volumes should be ignored.
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "..data", "policy.rego"), denyAllPolicy)
+
+	a := newTestOPAAuthorizer(t, &options.AuthorizerOptions{
+		Rego: options.AuthorizerRegoOptions{
+			Paths: []string{dir},
+			Query: "data.kubernetes.authz",
+		},
+	})
+
+	decision, reason, err := a.Authorize(context.Background(), testAccess)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decision != authorizer.DecisionAllow || reason != "developers may" {
+		t.Errorf("expected request to be allowed, got=%s reason=%q", decisionString(decision), reason)
+	}
+
+	other := testAccess
+	other.user = userInfoT{name: "other", groups: []string{"readers"}}
+	decision, _, err = a.Authorize(context.Background(), other)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decision != authorizer.DecisionNoOpinion {
+		t.Errorf("expected no opinion on an undefined result, got=%s", decisionString(decision))
+	}
+
+	// Policies which fail to load should not replace those loaded.
+	writeFile(t, policyFile, "package kubernetes.authz\n\nstatus = {")
+	a.rego.reloadIfChanged()
+
+	decision, _, err = a.Authorize(context.Background(), testAccess)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decision != authorizer.DecisionAllow {
+		t.Errorf("expected previous policies to be kept, got=%s", decisionString(decision))
+	}
+
+	writeFile(t, policyFile, denyAllPolicy)
+	a.rego.reloadIfChanged()
+
+	decision, reason, err = a.Authorize(context.Background(), testAccess)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decision != authorizer.DecisionDeny || reason != "nobody may" {
+		t.Errorf("expected changed policies to be reloaded, got=%s reason=%q", decisionString(decision), reason)
+	}
+}
+
+func TestRegoAuthorizerInvalidPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "policy.rego"), "package kubernetes.authz\n\nstatus = {")
+
+	_, err = NewOPAAuthorizer(nil, &options.AuthorizerOptions{
+		Rego: options.AuthorizerRegoOptions{
+			Paths: []string{dir},
+			Query: "data.kubernetes.authz",
+		},
+	})
+	if err == nil {
+		t.Error("expected error loading an invalid policy")
+	}
+}
+
+func TestRegoEvalCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "policy.rego"), denyAllPolicy)
+
+	evaluator, err := newRegoEvaluator(&options.AuthorizerRegoOptions{
+		Paths: []string{dir},
+		Query: "data.kubernetes.authz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var body json.RawMessage
+	if err := evaluator.eval(ctx, []byte(`{"input": {}}`), &body); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected evaluation to be cancelled with the context, got=%v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/authorization/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// maxRulesResponseBytes is the maximum size of an Open Policy Agent rules
+// response. Rules for a user can be large so this is much bigger than for
+// authorization responses.
+const maxRulesResponseBytes = 1 << 20
+
+var _ authorizer.RuleResolver = &OPAAuthorizer{}
+
+// rulesReviewInput is the input document of a rules query.
+type rulesReviewInput struct {
+	Namespace string                   `json:"namespace"`
+	User      string                   `json:"user"`
+	UID       string                   `json:"uid,omitempty"`
+	Groups    []string                 `json:"groups"`
+	Extra     map[string]v1.ExtraValue `json:"extra,omitempty"`
+}
+
+type opaRulesResponse struct {
+	Result v1.SubjectRulesReviewStatus
+}
+
+// HasRules returns whether the authorizer is configured to answer rules
+// queries.
+func (a *OPAAuthorizer) HasRules() bool {
+	return len(a.rulesURI) > 0
+}
+
+// RulesFor queries Open Policy Agent for the list of rules that apply to the
+// user in the given namespace.
+func (a *OPAAuthorizer) RulesFor(u user.Info, namespace string) ([]authorizer.ResourceRuleInfo, []authorizer.NonResourceRuleInfo, bool, error) {
+	if !a.HasRules() {
+		return nil, nil, true, errors.New("authorizer rules url is not configured")
+	}
+
+	input := rulesReviewInput{
+		Namespace: namespace,
+		User:      u.GetName(),
+		UID:       u.GetUID(),
+		Groups:    u.GetGroups(),
+		Extra:     convertToV1Authz(u.GetExtra()),
+	}
+
+	payload, err := json.Marshal(map[string]rulesReviewInput{"input": input})
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	var resp opaRulesResponse
+	if err := a.client.post(context.Background(), a.rulesURI, payload, maxRulesResponseBytes, &resp); err != nil {
+		return nil, nil, true, err
+	}
+
+	var resourceRules []authorizer.ResourceRuleInfo
+	for _, rule := range resp.Result.ResourceRules {
+		resourceRules = append(resourceRules, &authorizer.DefaultResourceRuleInfo{
+			Verbs:         rule.Verbs,
+			APIGroups:     rule.APIGroups,
+			Resources:     rule.Resources,
+			ResourceNames: rule.ResourceNames,
+		})
+	}
+
+	var nonResourceRules []authorizer.NonResourceRuleInfo
+	for _, rule := range resp.Result.NonResourceRules {
+		nonResourceRules = append(nonResourceRules, &authorizer.DefaultNonResourceRuleInfo{
+			Verbs:           rule.Verbs,
+			NonResourceURLs: rule.NonResourceURLs,
+		})
+	}
+
+	if len(resp.Result.EvaluationError) > 0 {
+		err = fmt.Errorf("authorizer rules evaluation error: %s", resp.Result.EvaluationError)
+	}
+
+	return resourceRules, nonResourceRules, resp.Result.Incomplete, err
+}
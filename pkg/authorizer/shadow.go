@@ -0,0 +1,185 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// AuditShadowDecisionKey and AuditShadowReasonKey are the audit
+	// annotations of the decision and reason of the shadow policy, if it
+	// disagrees with the enforced decision.
+	AuditShadowDecisionKey = "kube-oidc-proxy.jetstack.io/authorizer-shadow-decision"
+	AuditShadowReasonKey   = "kube-oidc-proxy.jetstack.io/authorizer-shadow-reason"
+)
+
+// shadowAuthorizer enforces the decisions of an authorizer, while evaluating a
+// shadow authorizer alongside it whose decisions are only recorded. The
+// enforced decision never waits for the shadow authorizer.
+type shadowAuthorizer struct {
+	enforcing authorizer.Authorizer
+	shadow    authorizer.Authorizer
+	warnings  bool
+	timeout   time.Duration
+
+	// wg tracks shadow decisions still being evaluated or recorded.
+	wg sync.WaitGroup
+}
+
+var _ rulesResolver = &shadowAuthorizer{}
+
+// newShadowAuthorizer returns an authorizer enforcing the decisions of the
+// enforcing authorizer. Decisions of the shadow authorizer which disagree are
+// logged and counted, unless not made within the timeout. Those made by the
+// time of the enforced decision are also audited, and if warnings is set
+// requests it would deny are given a Warning header.
+func newShadowAuthorizer(enforcing, shadow authorizer.Authorizer, warnings bool, timeout time.Duration) *shadowAuthorizer {
+	return &shadowAuthorizer{
+		enforcing: enforcing,
+		shadow:    shadow,
+		warnings:  warnings,
+		timeout:   timeout,
+	}
+}
+
+type shadowResult struct {
+	decision authorizer.Decision
+	reason   string
+	err      error
+}
+
+func (s *shadowAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	// The shadow authorizer must not annotate the audit event of the request,
+	// and may outlive the request.
+	shadowCtx, cancel := context.WithTimeout(
+		detachedContext{genericapirequest.WithAuditEvent(ctx, nil)}, s.timeout)
+
+	shadowCh := make(chan shadowResult, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		decision, reason, err := s.shadow.Authorize(shadowCtx, attrs)
+		shadowCh <- shadowResult{decision: decision, reason: reason, err: err}
+	}()
+
+	decision, reason, err := s.enforcing.Authorize(ctx, attrs)
+
+	select {
+	case shadow := <-shadowCh:
+		cancel()
+		if shadow.decision != decision {
+			s.disagree(ctx, attrs, decision, shadow, true)
+		}
+
+	default:
+		// The request may complete before the shadow decision is made, so it
+		// is only logged and counted.
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer cancel()
+
+			select {
+			case shadow := <-shadowCh:
+				if shadow.decision != decision {
+					s.disagree(ctx, attrs, decision, shadow, false)
+				}
+			case <-shadowCtx.Done():
+				shadowTimeouts.Inc()
+				klog.V(4).Infof("[%s] shadow authorizer timed out on %s %s for user %q",
+					proxycontext.RequestIDFrom(ctx), attrs.GetVerb(), requestTarget(attrs), attrs.GetUser().GetName())
+			}
+		}()
+	}
+
+	return decision, reason, err
+}
+
+// disagree records a decision of the shadow authorizer which disagrees with
+// the enforced decision. The audit event and response of the request are only
+// annotated if inRequest is set, as they may otherwise be complete.
+func (s *shadowAuthorizer) disagree(ctx context.Context, attrs authorizer.Attributes, enforced authorizer.Decision, shadow shadowResult, inRequest bool) {
+	shadowDisagreements.WithLabelValues(decisionString(enforced), decisionString(shadow.decision)).Inc()
+
+	klog.Infof("[%s] shadow authorizer disagrees on %s %s for user %q: enforced=%s shadow=%s reason=%q err=%v",
+		proxycontext.RequestIDFrom(ctx), attrs.GetVerb(), requestTarget(attrs), attrs.GetUser().GetName(),
+		decisionString(enforced), decisionString(shadow.decision), shadow.reason, shadow.err)
+
+	if !inRequest {
+		return
+	}
+
+	if ae := genericapirequest.AuditEventFrom(ctx); ae != nil {
+		k8saudit.LogAnnotation(ae, AuditShadowDecisionKey, decisionString(shadow.decision))
+		if len(shadow.reason) > 0 {
+			k8saudit.LogAnnotation(ae, AuditShadowReasonKey, shadow.reason)
+		}
+	}
+
+	if s.warnings && enforced == authorizer.DecisionAllow && shadow.decision == authorizer.DecisionDeny {
+		if header, ok := ctx.Value(responseHeaderKey).(http.Header); ok {
+			msg := "request would be denied by the shadow authorization policy"
+			if len(shadow.reason) > 0 {
+				msg += ": " + shadow.reason
+			}
+			header.Add("Warning", "299 - "+strconv.Quote(msg))
+		}
+	}
+}
+
+// requestTarget returns the resource or path of the request for logging.
+func requestTarget(attrs authorizer.Attributes) string {
+	if !attrs.IsResourceRequest() {
+		return attrs.GetPath()
+	}
+
+	target := attrs.GetResource()
+	if len(attrs.GetSubresource()) > 0 {
+		target += "/" + attrs.GetSubresource()
+	}
+	if len(attrs.GetNamespace()) > 0 {
+		target = attrs.GetNamespace() + "/" + target
+	}
+	if len(attrs.GetName()) > 0 {
+		target += "/" + attrs.GetName()
+	}
+	return target
+}
+
+// HasRules returns whether the enforcing authorizer answers rules queries.
+func (s *shadowAuthorizer) HasRules() bool {
+	r, ok := s.enforcing.(rulesResolver)
+	return ok && r.HasRules()
+}
+
+// RulesFor returns the rules of the enforcing authorizer.
+func (s *shadowAuthorizer) RulesFor(u user.Info, namespace string) ([]authorizer.ResourceRuleInfo, []authorizer.NonResourceRuleInfo, bool, error) {
+	r, ok := s.enforcing.(rulesResolver)
+	if !ok {
+		return nil, nil, true, errors.New("authorizer does not answer rules queries")
+	}
+	return r.RulesFor(u, namespace)
+}
+
+// withResponseHeader makes the header of the response available to
+// authorizers through the context of the request.
+func withResponseHeader(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), responseHeaderKey, rw.Header())
+		handler.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
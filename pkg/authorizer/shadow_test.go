@@ -0,0 +1,226 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestShadowAuthorizer(t *testing.T) {
+	registerMetrics()
+
+	tests := map[string]struct {
+		enforcing *fakeAuthorizer
+		shadow    *fakeAuthorizer
+		warnings  bool
+		late      bool
+
+		expDecision      authorizer.Decision
+		expErr           bool
+		expAnnotations   map[string]string
+		expWarning       string
+		expDisagreements float64
+	}{
+		"agreeing decisions should not be recorded": {
+			enforcing:      &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			shadow:         &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			warnings:       true,
+			expDecision:    authorizer.DecisionAllow,
+			expAnnotations: map[string]string{},
+		},
+		"a shadow denial should be audited but not enforced": {
+			enforcing:   &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			shadow:      &fakeAuthorizer{decision: authorizer.DecisionDeny, reason: "not yet"},
+			expDecision: authorizer.DecisionAllow,
+			expAnnotations: map[string]string{
+				AuditShadowDecisionKey: "deny",
+				AuditShadowReasonKey:   "not yet",
+			},
+			expDisagreements: 1,
+		},
+		"a shadow denial should be warned of if enabled": {
+			enforcing:   &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			shadow:      &fakeAuthorizer{decision: authorizer.DecisionDeny, reason: "not yet"},
+			warnings:    true,
+			expDecision: authorizer.DecisionAllow,
+			expAnnotations: map[string]string{
+				AuditShadowDecisionKey: "deny",
+				AuditShadowReasonKey:   "not yet",
+			},
+			expWarning:       `299 - "request would be denied by the shadow authorization policy: not yet"`,
+			expDisagreements: 1,
+		},
+		"a shadow allow of a denied request should not be warned of": {
+			enforcing:   &fakeAuthorizer{decision: authorizer.DecisionDeny, reason: "no"},
+			shadow:      &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			warnings:    true,
+			expDecision: authorizer.DecisionDeny,
+			expAnnotations: map[string]string{
+				AuditShadowDecisionKey: "allow",
+			},
+			expDisagreements: 1,
+		},
+		"a shadow error should not be returned or warned of": {
+			enforcing:   &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			shadow:      &fakeAuthorizer{decision: authorizer.DecisionNoOpinion, err: errors.New("unavailable")},
+			warnings:    true,
+			expDecision: authorizer.DecisionAllow,
+			expAnnotations: map[string]string{
+				AuditShadowDecisionKey: "no_opinion",
+			},
+			expDisagreements: 1,
+		},
+		"an enforcing error should be returned": {
+			enforcing:      &fakeAuthorizer{decision: authorizer.DecisionNoOpinion, err: errors.New("unavailable")},
+			shadow:         &fakeAuthorizer{decision: authorizer.DecisionNoOpinion},
+			expDecision:    authorizer.DecisionNoOpinion,
+			expErr:         true,
+			expAnnotations: map[string]string{},
+		},
+		"a shadow decision after the enforced decision should only be counted": {
+			enforcing:        &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			shadow:           &fakeAuthorizer{decision: authorizer.DecisionDeny, reason: "not yet"},
+			warnings:         true,
+			late:             true,
+			expDecision:      authorizer.DecisionAllow,
+			expAnnotations:   map[string]string{},
+			expDisagreements: 1,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			ae := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+			ctx := genericapirequest.WithAuditEvent(context.Background(), ae)
+			header := http.Header{}
+			ctx = context.WithValue(ctx, responseHeaderKey, header)
+
+			a := newShadowAuthorizer(test.enforcing, test.shadow, test.warnings, time.Minute)
+
+			release := make(chan struct{})
+			if test.late {
+				test.shadow.before = func(context.Context) { <-release }
+			} else {
+				// The shadow decision is made before the enforced decision.
+				test.enforcing.before = func(context.Context) { a.wg.Wait() }
+			}
+
+			counter := shadowDisagreements.WithLabelValues(
+				decisionString(test.enforcing.decision), decisionString(test.shadow.decision))
+			before, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decision, _, err := a.Authorize(ctx, testAccess)
+			close(release)
+			a.wg.Wait()
+
+			if decision != test.expDecision {
+				t.Errorf("got unexpected decision, exp=%s got=%s",
+					decisionString(test.expDecision), decisionString(decision))
+			}
+
+			if test.expErr != (err != nil) {
+				t.Errorf("got unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if !test.shadow.called {
+				t.Error("expected shadow authorizer to be called")
+			}
+
+			if len(ae.Annotations) != len(test.expAnnotations) {
+				t.Errorf("got unexpected annotations, exp=%v got=%v", test.expAnnotations, ae.Annotations)
+			}
+			for k, v := range test.expAnnotations {
+				if ae.Annotations[k] != v {
+					t.Errorf("got unexpected annotation %s, exp=%q got=%q", k, v, ae.Annotations[k])
+				}
+			}
+
+			if got := header.Get("Warning"); got != test.expWarning {
+				t.Errorf("got unexpected warning, exp=%q got=%q", test.expWarning, got)
+			}
+
+			after, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after-before != test.expDisagreements {
+				t.Errorf("got unexpected disagreements, exp=%v got=%v", test.expDisagreements, after-before)
+			}
+		})
+	}
+}
+
+func TestShadowAuthorizerTimeout(t *testing.T) {
+	registerMetrics()
+
+	release := make(chan struct{})
+	shadow := &fakeAuthorizer{
+		decision: authorizer.DecisionDeny,
+		before:   func(context.Context) { <-release },
+	}
+	a := newShadowAuthorizer(&fakeAuthorizer{decision: authorizer.DecisionAllow}, shadow, false, time.Millisecond*10)
+
+	timeouts, err := testutil.GetCounterMetricValue(shadowTimeouts.CounterMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	decision, _, err := a.Authorize(context.Background(), testAccess)
+	if decision != authorizer.DecisionAllow || err != nil {
+		t.Errorf("expected enforced decision, got=%s err=%v", decisionString(decision), err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected enforced decision not to wait for the shadow authorizer, took %s", d)
+	}
+
+	// The shadow decision is no longer recorded once timed out.
+	for i := 0; ; i++ {
+		got, err := testutil.GetCounterMetricValue(shadowTimeouts.CounterMetric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got-timeouts == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected shadow decision to time out, got %v timeouts", got-timeouts)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	close(release)
+	a.wg.Wait()
+}
+
+func TestWithResponseHeader(t *testing.T) {
+	enforcing := &fakeAuthorizer{decision: authorizer.DecisionAllow}
+	a := newShadowAuthorizer(enforcing, &fakeAuthorizer{decision: authorizer.DecisionDeny}, true, time.Minute)
+	enforcing.before = func(context.Context) { a.wg.Wait() }
+
+	handler := withResponseHeader(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		a.Authorize(req.Context(), testAccess)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+	if rw.Header().Get("Warning") == "" {
+		t.Error("expected Warning header on response")
+	}
+}
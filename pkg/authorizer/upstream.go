@@ -0,0 +1,127 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"net/http"
+
+	v1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+)
+
+// UpstreamAuthorizer authorizes requests against the authorization of the API
+// server, for example RBAC, by creating a SelfSubjectAccessReview while
+// impersonating the user of the attributes.
+type UpstreamAuthorizer struct {
+	client kubernetes.Interface
+}
+
+var _ authorizer.Authorizer = &UpstreamAuthorizer{}
+
+// NewUpstreamAuthorizer returns an authorizer querying the API server of the
+// REST config. A single client is shared by all requests, impersonating the
+// user of each request.
+func NewUpstreamAuthorizer(restConfig *rest.Config) (*UpstreamAuthorizer, error) {
+	config := rest.CopyConfig(restConfig)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &impersonatingRoundTripper{delegate: rt}
+	})
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpstreamAuthorizer{client: client}, nil
+}
+
+func (u *UpstreamAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	ssar := &v1.SelfSubjectAccessReview{
+		Spec: SelfSubjectAccessReviewSpecFromAttributes(attrs),
+	}
+
+	ctx = context.WithValue(ctx, upstreamUserKey, attrs.GetUser())
+	resp, err := u.client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, ssar, metav1.CreateOptions{})
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", err
+	}
+
+	switch {
+	case resp.Status.Denied:
+		return authorizer.DecisionDeny, resp.Status.Reason, nil
+	case resp.Status.Allowed:
+		return authorizer.DecisionAllow, resp.Status.Reason, nil
+	default:
+		return authorizer.DecisionNoOpinion, resp.Status.Reason, nil
+	}
+}
+
+// impersonatingRoundTripper impersonates the user of the context of each
+// request, including its UID which client-go does not support.
+type impersonatingRoundTripper struct {
+	delegate http.RoundTripper
+}
+
+func (rt *impersonatingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, ok := req.Context().Value(upstreamUserKey).(user.Info)
+	if !ok || u == nil {
+		return rt.delegate.RoundTrip(req)
+	}
+
+	delegate := rt.delegate
+	if uid := u.GetUID(); len(uid) > 0 {
+		delegate = &uidRoundTripper{uid: uid, delegate: delegate}
+	}
+
+	return transport.NewImpersonatingRoundTripper(transport.ImpersonationConfig{
+		UserName: u.GetName(),
+		Groups:   u.GetGroups(),
+		Extra:    u.GetExtra(),
+	}, delegate).RoundTrip(req)
+}
+
+// uidRoundTripper sets the UID to impersonate on requests, which have already
+// been cloned by the impersonating round tripper.
+type uidRoundTripper struct {
+	uid      string
+	delegate http.RoundTripper
+}
+
+func (rt *uidRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set(impersonation.ImpersonateUIDHeader, rt.uid)
+	return rt.delegate.RoundTrip(req)
+}
+
+// SelfSubjectAccessReviewSpecFromAttributes returns the spec of a
+// SelfSubjectAccessReview for the attributes. Exactly one of resource or
+// non-resource attributes is set.
+func SelfSubjectAccessReviewSpecFromAttributes(attrs authorizer.Attributes) v1.SelfSubjectAccessReviewSpec {
+	if attrs.IsResourceRequest() {
+		return v1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &v1.ResourceAttributes{
+				Namespace:   attrs.GetNamespace(),
+				Verb:        attrs.GetVerb(),
+				Group:       attrs.GetAPIGroup(),
+				Version:     attrs.GetAPIVersion(),
+				Resource:    attrs.GetResource(),
+				Subresource: attrs.GetSubresource(),
+				Name:        attrs.GetName(),
+			},
+		}
+	}
+
+	return v1.SelfSubjectAccessReviewSpec{
+		NonResourceAttributes: &v1.NonResourceAttributes{
+			Path: attrs.GetPath(),
+			Verb: attrs.GetVerb(),
+		},
+	}
+}
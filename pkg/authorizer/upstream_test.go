@@ -0,0 +1,81 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/authorization/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/rest"
+)
+
+func TestUpstreamAuthorizer(t *testing.T) {
+	var got []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+
+		var ssar v1.SelfSubjectAccessReview
+		if err := json.NewDecoder(r.Body).Decode(&ssar); err != nil {
+			t.Error(err)
+		}
+		ssar.Status.Allowed = r.Header.Get("Impersonate-User") == "alice"
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(&ssar)
+	}))
+	defer srv.Close()
+
+	u, err := NewUpstreamAuthorizer(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user        user.Info
+		expDecision authorizer.Decision
+		expHeaders  http.Header
+	}{
+		{
+			user:        &user.DefaultInfo{Name: "alice", UID: "1234", Groups: []string{"developers"}},
+			expDecision: authorizer.DecisionAllow,
+			expHeaders: http.Header{
+				"Impersonate-User":  {"alice"},
+				"Impersonate-Uid":   {"1234"},
+				"Impersonate-Group": {"developers"},
+			},
+		},
+		{
+			user:        &user.DefaultInfo{Name: "bob", Extra: map[string][]string{"scopes": {"view"}}},
+			expDecision: authorizer.DecisionNoOpinion,
+			expHeaders: http.Header{
+				"Impersonate-User":         {"bob"},
+				"Impersonate-Extra-Scopes": {"view"},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		attrs := authorizer.AttributesRecord{User: test.user, Verb: "get", Resource: "pods", ResourceRequest: true}
+		decision, _, err := u.Authorize(context.Background(), attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision != test.expDecision {
+			t.Errorf("%d: unexpected decision, exp=%v got=%v", i, test.expDecision, decision)
+		}
+
+		// Each request impersonates only its own user.
+		for _, header := range []string{"Impersonate-User", "Impersonate-Uid", "Impersonate-Group", "Impersonate-Extra-Scopes"} {
+			if exp := test.expHeaders[header]; !reflect.DeepEqual(got[i][header], exp) {
+				t.Errorf("%d: unexpected header %s, exp=%v got=%v", i, header, exp, got[i][header])
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+
+package authorizer
+
+import (
+	"fmt"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/plugin/pkg/authorizer/webhook"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+// newWebhookAuthorizer returns an authorizer which sends SubjectAccessReviews
+// to the webhook configured by the kubeconfig file, in the same way as the
+// webhook authorization mode of the API server.
+func newWebhookAuthorizer(opts *options.AuthorizerOptions) (authorizer.Authorizer, error) {
+	a, err := webhook.New(opts.WebhookConfigFile, opts.WebhookVersion,
+		opts.WebhookCacheAuthorizedTTL, opts.WebhookCacheDeniedTTL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authorizer webhook from %q: %s", opts.WebhookConfigFile, err)
+	}
+
+	return a, nil
+}
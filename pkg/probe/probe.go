@@ -11,11 +11,18 @@ import (
 
 	"github.com/heptiolabs/healthcheck"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer/authzcache"
 )
 
 const (
 	timeout = time.Second * 10
+
+	// authzCacheInvalidatePath is the path which invalidates the caches of
+	// authorization decisions when POSTed to.
+	authzCacheInvalidatePath = "/authz-cache/invalidate"
 )
 
 type HealthCheck struct {
@@ -36,9 +43,14 @@ func Run(port, fakeJWT string, oidcAuther authenticator.Token) error {
 
 	h.handler.AddReadinessCheck("secure serving", h.Check)
 
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", legacyregistry.Handler())
+	mux.Handle(authzCacheInvalidatePath, loopbackOnly(authzcache.InvalidateHandler()))
+	mux.Handle("/", h.handler)
+
 	go func() {
 		for {
-			err := http.ListenAndServe(net.JoinHostPort("0.0.0.0", port), h.handler)
+			err := http.ListenAndServe(net.JoinHostPort("0.0.0.0", port), mux)
 			if err != nil {
 				klog.Errorf("ready probe listener failed: %s", err)
 			}
@@ -49,6 +61,39 @@ func Run(port, fakeJWT string, oidcAuther authenticator.Token) error {
 	return nil
 }
 
+// RunMetrics serves Prometheus metrics at '/metrics' on a dedicated port.
+func RunMetrics(port string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", legacyregistry.Handler())
+	mux.Handle(authzCacheInvalidatePath, loopbackOnly(authzcache.InvalidateHandler()))
+
+	go func() {
+		for {
+			err := http.ListenAndServe(net.JoinHostPort("0.0.0.0", port), mux)
+			if err != nil {
+				klog.Errorf("metrics listener failed: %s", err)
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+// loopbackOnly rejects requests which are not from a loopback address, as the
+// probe and metrics ports are not authenticated.
+func loopbackOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
 func (h *HealthCheck) Check() error {
 	if h.ready {
 		return nil
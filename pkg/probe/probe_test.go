@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"k8s.io/apiserver/pkg/authentication/authenticator"
@@ -99,3 +100,46 @@ func TestRun(t *testing.T) {
 			200, resp.StatusCode)
 	}
 }
+
+func TestLoopbackOnly(t *testing.T) {
+	tests := map[string]struct {
+		remoteAddr string
+		expCode    int
+	}{
+		"an IPv4 loopback client should be allowed": {
+			remoteAddr: "127.0.0.1:41234",
+			expCode:    http.StatusNoContent,
+		},
+		"an IPv6 loopback client should be allowed": {
+			remoteAddr: "[::1]:41234",
+			expCode:    http.StatusNoContent,
+		},
+		"a remote client should be forbidden": {
+			remoteAddr: "10.0.0.1:41234",
+			expCode:    http.StatusForbidden,
+		},
+		"an invalid address should be forbidden": {
+			remoteAddr: "localhost",
+			expCode:    http.StatusForbidden,
+		},
+	}
+
+	handler := loopbackOnly(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, authzCacheInvalidatePath, nil)
+			req.RemoteAddr = test.remoteAddr
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expCode {
+				t.Errorf("got unexpected status code, exp=%d got=%d", test.expCode, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+// withClientIP records the IP of the client of the request. The
+// X-Forwarded-For header is only used for requests from trusted front ends, so
+// that clients cannot choose their IP.
+func (p *Proxy) withClientIP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(rw, context.WithClientIP(req, p.clientIP(req)))
+	})
+}
+
+// clientIP returns the IP of the client of the request. For requests from
+// trusted front ends, this is the last address of the X-Forwarded-For header
+// which is not itself a trusted front end.
+func (p *Proxy) clientIP(req *http.Request) string {
+	peer := hostOf(req.RemoteAddr)
+	if !containsIP(p.config.ClientIPTrustedCIDRs, net.ParseIP(peer)) {
+		return peer
+	}
+
+	var forwarded []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			if addr = strings.TrimSpace(addr); len(addr) > 0 {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hostOf(forwarded[i]))
+		if ip == nil {
+			// Addresses before an invalid address cannot be trusted.
+			break
+		}
+		if !containsIP(p.config.ClientIPTrustedCIDRs, ip) || i == 0 {
+			return ip.String()
+		}
+	}
+
+	return peer
+}
+
+// hostOf returns the host of the address, without any port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// containsIP returns whether any of the networks contain the IP.
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+func TestClientIP(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Proxy{
+		config: &Config{
+			ClientIPTrustedCIDRs: []*net.IPNet{trusted},
+		},
+	}
+
+	tests := map[string]struct {
+		remoteAddr string
+		xff        []string
+
+		expIP string
+	}{
+		"a request without X-Forwarded-For should use the source address": {
+			remoteAddr: "203.0.113.7:41234",
+			expIP:      "203.0.113.7",
+		},
+		"X-Forwarded-For of an untrusted client should be ignored": {
+			remoteAddr: "203.0.113.7:41234",
+			xff:        []string{"10.1.2.3"},
+			expIP:      "203.0.113.7",
+		},
+		"X-Forwarded-For of a trusted front end should be used": {
+			remoteAddr: "10.0.0.1:41234",
+			xff:        []string{"203.0.113.7"},
+			expIP:      "203.0.113.7",
+		},
+		"addresses added by clients before the front end should be ignored": {
+			remoteAddr: "10.0.0.1:41234",
+			xff:        []string{"10.9.9.9, 198.51.100.1", "203.0.113.7"},
+			expIP:      "203.0.113.7",
+		},
+		"trusted front ends in X-Forwarded-For should be skipped": {
+			remoteAddr: "10.0.0.1:41234",
+			xff:        []string{"203.0.113.7, 10.0.0.2"},
+			expIP:      "203.0.113.7",
+		},
+		"a trusted front end without X-Forwarded-For should use the source address": {
+			remoteAddr: "10.0.0.1:41234",
+			expIP:      "10.0.0.1",
+		},
+		"an invalid X-Forwarded-For should use the source address": {
+			remoteAddr: "10.0.0.1:41234",
+			xff:        []string{"not-an-ip"},
+			expIP:      "10.0.0.1",
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var got string
+			handler := p.withClientIP(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = context.ClientIP(req)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, v := range test.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != test.expIP {
+				t.Errorf("got unexpected client IP, exp=%s got=%s", test.expIP, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer"
+)
+
+const (
+	// PathPrefix is the path prefix used to route requests to a cluster, i.e.
+	// '/clusters/<name>/api/v1/pods'.
+	PathPrefix = "/clusters/"
+)
+
+// Cluster is an upstream API server that requests may be routed to, in
+// addition to the default API server of the proxy.
+type Cluster struct {
+	Name string
+
+	// Hosts are the host names, matched against the TLS server name or Host
+	// header, that route requests to this cluster.
+	Hosts []string
+
+	RESTConfig *rest.Config
+
+	DisableImpersonation bool
+
+	// AuthorizerURL is the Open Policy Agent URL to authorize requests to this
+	// cluster. Authorizer is built by the caller, from it if set and otherwise
+	// from the authorizer options of the default cluster.
+	AuthorizerURL string
+	Authorizer    authorizer.Interface
+}
+
+// File is the format of a cluster list file.
+type File struct {
+	Clusters []FileCluster `json:"clusters"`
+}
+
+// FileCluster is a cluster in a cluster list file.
+type FileCluster struct {
+	Name string `json:"name"`
+
+	// Kubeconfig is the path to the kubeconfig file of the cluster, relative
+	// to the cluster list file. Context is the context to use within it, or
+	// the current context if empty.
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context,omitempty"`
+
+	Hosts                []string `json:"hosts,omitempty"`
+	DisableImpersonation bool     `json:"disableImpersonation,omitempty"`
+	AuthorizerURL        string   `json:"authorizerURL,omitempty"`
+}
+
+// LoadFile loads the clusters of a YAML or JSON cluster list file.
+func LoadFile(path string) ([]*Cluster, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster list file: %s", err)
+	}
+
+	file := new(File)
+	if err := yaml.UnmarshalStrict(data, file); err != nil {
+		return nil, fmt.Errorf("failed to decode cluster list file %q: %s", path, err)
+	}
+
+	var clusters []*Cluster
+	for _, fc := range file.Clusters {
+		kubeconfig := fc.Kubeconfig
+		if !filepath.IsAbs(kubeconfig) {
+			kubeconfig = filepath.Join(filepath.Dir(path), kubeconfig)
+		}
+
+		restConfig, err := restConfigFromKubeconfig(kubeconfig, fc.Context)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", fc.Name, err)
+		}
+
+		clusters = append(clusters, &Cluster{
+			Name:                 fc.Name,
+			Hosts:                fc.Hosts,
+			RESTConfig:           restConfig,
+			DisableImpersonation: fc.DisableImpersonation,
+			AuthorizerURL:        fc.AuthorizerURL,
+		})
+	}
+
+	return clusters, nil
+}
+
+// LoadKubeconfig loads a cluster for each context of the kubeconfig file,
+// named after the context.
+func LoadKubeconfig(path string) ([]*Cluster, error) {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clusters kubeconfig: %s", err)
+	}
+
+	var names []string
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var clusters []*Cluster
+	for _, name := range names {
+		restConfig, err := clientcmd.NewNonInteractiveClientConfig(*config, name,
+			new(clientcmd.ConfigOverrides), nil).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", name, err)
+		}
+
+		clusters = append(clusters, &Cluster{
+			Name:       name,
+			RESTConfig: restConfig,
+		})
+	}
+
+	return clusters, nil
+}
+
+func restConfigFromKubeconfig(path, context string) (*rest.Config, error) {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %s", err)
+	}
+
+	return clientcmd.NewNonInteractiveClientConfig(*config, context,
+		new(clientcmd.ConfigOverrides), nil).ClientConfig()
+}
+
+// Router routes requests to clusters by path prefix or host name.
+type Router struct {
+	byName map[string]*Cluster
+	byHost map[string]*Cluster
+}
+
+// NewRouter returns a router of the clusters. Cluster names and hosts must be
+// unique.
+func NewRouter(clusters []*Cluster) (*Router, error) {
+	r := &Router{
+		byName: make(map[string]*Cluster),
+		byHost: make(map[string]*Cluster),
+	}
+
+	for _, c := range clusters {
+		if errs := validation.IsDNS1123Subdomain(c.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid cluster name %q: %s", c.Name, strings.Join(errs, ", "))
+		}
+
+		if _, ok := r.byName[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate cluster name %q", c.Name)
+		}
+		r.byName[c.Name] = c
+
+		for _, host := range c.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := r.byHost[host]; ok {
+				return nil, fmt.Errorf("host %q used by both clusters %q and %q", host, other.Name, c.Name)
+			}
+			r.byHost[host] = c
+		}
+	}
+
+	return r, nil
+}
+
+// Clusters returns the clusters of the router, sorted by name.
+func (r *Router) Clusters() []*Cluster {
+	var clusters []*Cluster
+	for _, c := range r.byName {
+		clusters = append(clusters, c)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	return clusters
+}
+
+// Route returns the cluster the request is routed to and the request path
+// within the cluster. Requests with the cluster path prefix are routed by the
+// cluster name in the path, otherwise by the TLS server name or Host header.
+// If the request is not routed to a cluster, nil is returned with found false.
+// If the path names a cluster that does not exist, nil is returned with found
+// true.
+func (r *Router) Route(req *http.Request) (c *Cluster, path string, found bool) {
+	path = req.URL.Path
+
+	if strings.HasPrefix(path, PathPrefix) {
+		rest := strings.TrimPrefix(path, PathPrefix)
+
+		name := rest
+		path = "/"
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name, path = rest[:i], rest[i:]
+		}
+
+		return r.byName[name], path, true
+	}
+
+	host := req.Host
+	if req.TLS != nil && len(req.TLS.ServerName) > 0 {
+		host = req.TLS.ServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if c, ok := r.byHost[strings.ToLower(host)]; ok {
+		return c, path, true
+	}
+
+	return nil, path, false
+}
@@ -0,0 +1,219 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package cluster
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+- name: dev
+  cluster:
+    server: https://dev.example.com
+users:
+- name: proxy
+  user:
+    token: fake-token
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: proxy
+- name: dev
+  context:
+    cluster: dev
+    user: proxy
+current-context: prod
+`
+
+func writeTestFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "kube-oidc-proxy-clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusters, err := LoadKubeconfig(writeTestFile(t, dir, "kubeconfig", testKubeconfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got=%d", len(clusters))
+	}
+
+	for i, exp := range []struct{ name, host string }{
+		{"dev", "https://dev.example.com"},
+		{"prod", "https://prod.example.com"},
+	} {
+		if clusters[i].Name != exp.name || clusters[i].RESTConfig.Host != exp.host {
+			t.Errorf("got unexpected cluster, exp=%s (%s) got=%s (%s)",
+				exp.name, exp.host, clusters[i].Name, clusters[i].RESTConfig.Host)
+		}
+
+		if clusters[i].RESTConfig.BearerToken != "fake-token" {
+			t.Errorf("got unexpected bearer token: %q", clusters[i].RESTConfig.BearerToken)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "kube-oidc-proxy-clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, dir, "kubeconfig", testKubeconfig)
+	path := writeTestFile(t, dir, "clusters.yaml", `clusters:
+- name: dev
+  kubeconfig: kubeconfig
+  context: dev
+  hosts: ["dev.kube.example.com"]
+  disableImpersonation: true
+  authorizerURL: http://opa/v1/data/dev
+- name: prod
+  kubeconfig: kubeconfig
+`)
+
+	clusters, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got=%d", len(clusters))
+	}
+
+	dev, prod := clusters[0], clusters[1]
+	if dev.RESTConfig.Host != "https://dev.example.com" || !dev.DisableImpersonation ||
+		dev.AuthorizerURL != "http://opa/v1/data/dev" || len(dev.Hosts) != 1 {
+		t.Errorf("got unexpected dev cluster: %#v", dev)
+	}
+
+	// The current context should be used if none is given.
+	if prod.RESTConfig.Host != "https://prod.example.com" || prod.DisableImpersonation {
+		t.Errorf("got unexpected prod cluster: %#v", prod)
+	}
+
+	writeTestFile(t, dir, "clusters.yaml", `clusters: [{name: dev, unknown: true}]`)
+	if _, err := LoadFile(path); err == nil {
+		t.Error("expected error loading cluster list file with unknown fields")
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := map[string][]*Cluster{
+		"invalid name": {
+			{Name: "Not/Valid"},
+		},
+		"duplicate name": {
+			{Name: "dev"},
+			{Name: "dev"},
+		},
+		"duplicate host": {
+			{Name: "dev", Hosts: []string{"kube.example.com"}},
+			{Name: "prod", Hosts: []string{"Kube.example.com"}},
+		},
+	}
+
+	for name, clusters := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewRouter(clusters); err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	router, err := NewRouter([]*Cluster{
+		{Name: "dev", Hosts: []string{"dev.kube.example.com"}},
+		{Name: "prod"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		target     string
+		serverName string
+
+		expCluster string
+		expPath    string
+		expFound   bool
+	}{
+		"a request to the default cluster should not be routed": {
+			target:  "https://kube.example.com/api/v1/pods",
+			expPath: "/api/v1/pods",
+		},
+		"a request with a cluster path prefix should be routed with the prefix removed": {
+			target:     "https://kube.example.com/clusters/prod/api/v1/pods",
+			expCluster: "prod",
+			expPath:    "/api/v1/pods",
+			expFound:   true,
+		},
+		"a request to the cluster root should be routed to the root path": {
+			target:     "https://kube.example.com/clusters/prod",
+			expCluster: "prod",
+			expPath:    "/",
+			expFound:   true,
+		},
+		"a request with an unknown cluster path prefix should be found with no cluster": {
+			target:   "https://kube.example.com/clusters/staging/api",
+			expPath:  "/api",
+			expFound: true,
+		},
+		"a request with a cluster host should be routed": {
+			target:     "https://dev.kube.example.com:8443/api/v1/pods",
+			expCluster: "dev",
+			expPath:    "/api/v1/pods",
+			expFound:   true,
+		},
+		"a request with a cluster TLS server name should be routed": {
+			target:     "https://kube.example.com/api/v1/pods",
+			serverName: "DEV.kube.example.com",
+			expCluster: "dev",
+			expPath:    "/api/v1/pods",
+			expFound:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", test.target, nil)
+			if len(test.serverName) > 0 {
+				req.TLS = &tls.ConnectionState{ServerName: test.serverName}
+			}
+
+			c, path, found := router.Route(req)
+
+			var name string
+			if c != nil {
+				name = c.Name
+			}
+
+			if name != test.expCluster || path != test.expPath || found != test.expFound {
+				t.Errorf("got unexpected route, exp=(%q, %q, %t) got=(%q, %q, %t)",
+					test.expCluster, test.expPath, test.expFound, name, path, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/cluster"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// AuditClusterKey is the audit annotation key recording the cluster a
+	// request was routed to.
+	AuditClusterKey = "kube-oidc-proxy.jetstack.io/cluster"
+)
+
+var (
+	errUnknownCluster = errors.New("Unknown cluster")
+)
+
+// clusterUpstream is the handler and transports of a cluster requests may be
+// routed to.
+type clusterUpstream struct {
+	cluster *cluster.Cluster
+
+	handler               http.Handler
+	clientTransport       http.RoundTripper
+	noAuthClientTransport http.RoundTripper
+}
+
+// newClusterUpstreams builds the handlers and transports of each cluster.
+func (p *Proxy) newClusterUpstreams() (map[string]*clusterUpstream, error) {
+	upstreams := make(map[string]*clusterUpstream)
+
+	for _, c := range p.clusterRouter.Clusters() {
+		clientRT, err := p.roundTripperForRestConfig(c.RESTConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", c.Name, err)
+		}
+
+		noAuthClientRT, err := p.roundTripperForRestConfig(&rest.Config{
+			APIPath: c.RESTConfig.APIPath,
+			Host:    c.RESTConfig.Host,
+			Timeout: c.RESTConfig.Timeout,
+			TLSClientConfig: rest.TLSClientConfig{
+				CAFile: c.RESTConfig.CAFile,
+				CAData: c.RESTConfig.CAData,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", c.Name, err)
+		}
+
+		url, err := url.Parse(c.RESTConfig.Host)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: failed to parse url: %s", c.Name, err)
+		}
+
+		proxyHandler := httputil.NewSingleHostReverseProxy(url)
+		proxyHandler.Transport = p
+		proxyHandler.ErrorHandler = p.handleError
+		proxyHandler.FlushInterval = p.config.FlushInterval
+
+		var handler http.Handler = proxyHandler
+		if c.Authorizer != nil {
+			handler = c.Authorizer.WithRequest(handler)
+		}
+
+		upstreams[c.Name] = &clusterUpstream{
+			cluster:               c,
+			handler:               handler,
+			clientTransport:       clientRT,
+			noAuthClientTransport: noAuthClientRT,
+		}
+	}
+
+	return upstreams, nil
+}
+
+// clusterUpstream returns the upstream of the cluster the request is routed
+// to, or nil for the default cluster.
+func (p *Proxy) clusterUpstream(req *http.Request) *clusterUpstream {
+	name := context.ClusterName(req)
+	if len(name) == 0 {
+		return nil
+	}
+
+	return p.clusterUpstreams[name]
+}
+
+// disableImpersonation returns whether impersonation is disabled for the
+// cluster the request is routed to.
+func (p *Proxy) disableImpersonation(req *http.Request) bool {
+	if u := p.clusterUpstream(req); u != nil {
+		return u.cluster.DisableImpersonation
+	}
+
+	return p.config.DisableImpersonation
+}
+
+// withClusterRoute determines the cluster the request is routed to, removing
+// the cluster path prefix from the request.
+func (p *Proxy) withClusterRoute(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		c, path, found := p.clusterRouter.Route(req)
+		if !found {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if c == nil {
+			p.handleError(rw, req, errUnknownCluster)
+			return
+		}
+
+		klog.V(4).Infof("[%s] routing request to cluster %q: %s", context.RequestID(req), c.Name, path)
+
+		if path != req.URL.Path {
+			u := *req.URL
+			if prefix := cluster.PathPrefix + c.Name; strings.HasPrefix(u.RawPath, prefix) {
+				u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+			} else {
+				u.RawPath = ""
+			}
+			u.Path = path
+
+			r := new(http.Request)
+			*r = *req
+			r.URL = &u
+			req = r
+		}
+
+		req = context.WithClusterName(req, c.Name)
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withClusterUpstreams passes requests routed to a cluster on to the cluster's
+// handler. Requests to the default cluster continue down the chain.
+func (p *Proxy) withClusterUpstreams(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name := context.ClusterName(req)
+		if len(name) == 0 {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		u, ok := p.clusterUpstreams[name]
+		if !ok {
+			p.handleError(rw, req, errUnknownCluster)
+			return
+		}
+
+		u.handler.ServeHTTP(rw, req)
+	})
+}
+
+// withClusterAudit records the cluster the request is routed to in the audit
+// event.
+func (p *Proxy) withClusterAudit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if name := context.ClusterName(req); len(name) > 0 {
+			if ae := genericapirequest.AuditEventFrom(req.Context()); ae != nil {
+				k8saudit.LogAnnotation(ae, AuditClusterKey, name)
+			}
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
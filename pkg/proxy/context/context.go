@@ -2,11 +2,15 @@
 package context
 
 import (
+	gocontext "context"
 	"net/http"
 
 	"github.com/sebest/xff"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/session"
 )
 
 type key int
@@ -23,8 +27,52 @@ const (
 
 	// bearerTokenKey is the context key for the client address.
 	clientAddressKey
+
+	// tokenClaimsKey is the context key for the claims of the authenticated
+	// token.
+	tokenClaimsKey
+
+	// impersonatedUserKey is the context key for the user the client requested
+	// to impersonate.
+	impersonatedUserKey
+
+	// impersonationUIDKey is the context key for the UID to impersonate.
+	impersonationUIDKey
+
+	// clusterNameKey is the context key for the name of the cluster the
+	// request is routed to.
+	clusterNameKey
+
+	// tokenKey is the context key for the bearer token the request was
+	// authenticated with.
+	tokenKey
+
+	// sessionKey is the context key for the session of a long running
+	// request.
+	sessionKey
+
+	// requestMetricsKey is the context key for the metric labels of the
+	// request.
+	requestMetricsKey
+
+	// requestIDKey is the context key for the ID of the request.
+	requestIDKey
+
+	// authMethodKey is the context key for the method the request was
+	// authenticated with.
+	authMethodKey
+
+	// clientIPKey is the context key for the IP of the client, as trusted by
+	// the proxy.
+	clientIPKey
 )
 
+// RequestMetrics are the metric labels of a request which are only known once
+// it has been handled further down the handler chain.
+type RequestMetrics struct {
+	AuthMethod string
+}
+
 // WithNoImpersonation returns a copy of the request in which the noImpersonation context value is set.
 func WithNoImpersonation(req *http.Request) *http.Request {
 	return req.WithContext(request.WithValue(req.Context(), noImpersonationKey, true))
@@ -47,6 +95,31 @@ func ImpersonationConfig(req *http.Request) *transport.ImpersonationConfig {
 	return conf
 }
 
+// WithImpersonationUID returns a copy of the request which contains the UID
+// to impersonate, as client-go impersonation configuration does not hold one.
+func WithImpersonationUID(req *http.Request, uid string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), impersonationUIDKey, uid))
+}
+
+// ImpersonationUID returns the UID to impersonate held in the context, if any.
+func ImpersonationUID(req *http.Request) string {
+	uid, _ := req.Context().Value(impersonationUIDKey).(string)
+	return uid
+}
+
+// WithClusterName returns a copy of the request which contains the name of the
+// cluster the request is routed to.
+func WithClusterName(req *http.Request, name string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), clusterNameKey, name))
+}
+
+// ClusterName returns the name of the cluster the request is routed to, or an
+// empty string for the default cluster.
+func ClusterName(req *http.Request) string {
+	name, _ := req.Context().Value(clusterNameKey).(string)
+	return name
+}
+
 // WithBearerToken will add the bearer token to the request context from an http.Header to the request context.
 func WithBearerToken(req *http.Request, header http.Header) *http.Request {
 	return req.WithContext(request.WithValue(req.Context(), bearerTokenKey, header.Get("Authorization")))
@@ -58,6 +131,38 @@ func BearerToken(req *http.Request) string {
 	return token
 }
 
+// WithTokenClaims returns a copy of the request which contains the claims of
+// the token that authenticated the request.
+func WithTokenClaims(req *http.Request, claims map[string]interface{}) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), tokenClaimsKey, claims))
+}
+
+// TokenClaims returns the claims of the token that authenticated the request
+// held in the context, if existing.
+func TokenClaims(req *http.Request) map[string]interface{} {
+	return TokenClaimsFrom(req.Context())
+}
+
+// TokenClaimsFrom returns the claims of the token that authenticated the
+// request of the context, if existing.
+func TokenClaimsFrom(ctx gocontext.Context) map[string]interface{} {
+	claims, _ := ctx.Value(tokenClaimsKey).(map[string]interface{})
+	return claims
+}
+
+// WithImpersonatedUser returns a copy of the request which contains the user
+// the client requested to impersonate.
+func WithImpersonatedUser(req *http.Request, u user.Info) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), impersonatedUserKey, u))
+}
+
+// ImpersonatedUser returns the user the client requested to impersonate held
+// in the context, if existing.
+func ImpersonatedUser(req *http.Request) (user.Info, bool) {
+	u, ok := req.Context().Value(impersonatedUserKey).(user.Info)
+	return u, ok
+}
+
 // RemoteAddress will attempt to return the source client address if available
 // in the request context. If it is not, it will be gathered from the request
 // and entered into the context.
@@ -72,3 +177,87 @@ func RemoteAddr(req *http.Request) (*http.Request, string) {
 
 	return req, clientAddress
 }
+
+// WithToken returns a copy of the request which contains the bearer token the
+// request was authenticated with.
+func WithToken(req *http.Request, token string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), tokenKey, token))
+}
+
+// Token returns the bearer token the request was authenticated with, if any.
+func Token(req *http.Request) string {
+	token, _ := req.Context().Value(tokenKey).(string)
+	return token
+}
+
+// WithSession returns a copy of the request which contains the session of the
+// long running request.
+func WithSession(req *http.Request, s *session.Session) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), sessionKey, s))
+}
+
+// Session returns the session of the long running request, if any.
+func Session(req *http.Request) *session.Session {
+	s, _ := req.Context().Value(sessionKey).(*session.Session)
+	return s
+}
+
+// WithRequestMetrics returns a copy of the request which contains metric
+// labels to be set by later handlers, and the labels.
+func WithRequestMetrics(req *http.Request) (*http.Request, *RequestMetrics) {
+	labels := new(RequestMetrics)
+	return req.WithContext(request.WithValue(req.Context(), requestMetricsKey, labels)), labels
+}
+
+// RequestMetricsFrom returns the metric labels of the request, if any.
+func RequestMetricsFrom(req *http.Request) *RequestMetrics {
+	labels, _ := req.Context().Value(requestMetricsKey).(*RequestMetrics)
+	return labels
+}
+
+// WithRequestID returns a copy of the request which contains the ID of the
+// request.
+func WithRequestID(req *http.Request, id string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), requestIDKey, id))
+}
+
+// RequestID returns the ID of the request, if any.
+func RequestID(req *http.Request) string {
+	return RequestIDFrom(req.Context())
+}
+
+// RequestIDFrom returns the ID of the request of the context, if any.
+func RequestIDFrom(ctx gocontext.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithAuthMethod returns a copy of the request which contains the method the
+// request was authenticated with.
+func WithAuthMethod(req *http.Request, method string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), authMethodKey, method))
+}
+
+// AuthMethod returns the method the request was authenticated with, if any.
+func AuthMethod(req *http.Request) string {
+	method, _ := req.Context().Value(authMethodKey).(string)
+	return method
+}
+
+// WithClientIP returns a copy of the request which contains the IP of the
+// client.
+func WithClientIP(req *http.Request, ip string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), clientIPKey, ip))
+}
+
+// ClientIP returns the IP of the client of the request, if known.
+func ClientIP(req *http.Request) string {
+	return ClientIPFrom(req.Context())
+}
+
+// ClientIPFrom returns the IP of the client of the request of the context, if
+// known.
+func ClientIPFrom(ctx gocontext.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	k8saudit "k8s.io/apiserver/pkg/audit"
 	authuser "k8s.io/apiserver/pkg/authentication/user"
 	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/transport"
@@ -12,6 +13,14 @@ import (
 
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/review"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/upstream"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/userextra"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
 )
 
 func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
@@ -19,10 +28,43 @@ func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
 	if p.authorizer != nil {
 		handler = p.authorizer.WithRequest(handler)
 	}
+	if p.clusterRouter != nil {
+		handler = p.withClusterUpstreams(handler)
+	}
+	if p.selfSubjectReview != nil {
+		handler = p.withSelfSubjectReview(handler)
+	}
+	handler = p.withImpersonatedUser(handler)
+	if p.clusterRouter != nil {
+		handler = p.withClusterAudit(handler)
+	}
+	if p.config.TerminateExpiredLongRunning {
+		handler = p.withSessionExpiry(handler)
+	}
+	if p.config.InFlightLimiter != nil {
+		handler = p.withInFlightLimit(handler)
+	}
+	handler = p.withLongRunningMetrics(handler)
+	if p.config.RateLimiter != nil {
+		handler = p.withRateLimit(handler)
+	}
 	handler = p.auditor.WithRequest(handler)
 	handler = p.withImpersonateRequest(handler)
 	handler = p.withAuthenticateRequest(handler)
 
+	if p.clusterRouter != nil {
+		handler = p.withClusterRoute(handler)
+	}
+
+	if p.tokenReviewEndpoint != nil {
+		handler = p.withTokenReviewEndpoint(handler)
+	}
+
+	handler = p.withMetrics(handler)
+	handler = p.withTracing(handler)
+	handler = p.withClientIP(handler)
+	handler = p.withRequestID(handler)
+
 	// Add the auditor backend as a shutdown hook
 	p.hooks.AddPreShutdownHook("AuditBackend", p.auditor.Shutdown)
 
@@ -34,8 +76,15 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 	tokenReviewHandler := p.withTokenReview(handler)
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The bearer token is removed from the request once authenticated so
+		// hold onto it to retrieve its claims.
+		token, _ := util.ParseTokenFromRequest(req)
+		req = context.WithToken(req, token)
+
 		// Auth request and handle unauthed
+		_, span := tracing.Start(req.Context(), "authenticate")
 		info, ok, err := p.oidcRequestAuther.AuthenticateRequest(req)
+		endSpan(span, err)
 		if err != nil {
 			// Since we have failed OIDC auth, we will try a token review, if enabled.
 			tokenReviewHandler.ServeHTTP(rw, req)
@@ -44,6 +93,7 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 
 		// Failed authorization
 		if !ok {
+			authenticationFailures.WithLabelValues(authFailureMissingToken).Inc()
 			p.handleError(rw, req, errUnauthorized)
 			return
 		}
@@ -51,7 +101,17 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 		var remoteAddr string
 		req, remoteAddr = context.RemoteAddr(req)
 
-		klog.V(4).Infof("authenticated request: %s", remoteAddr)
+		klog.V(4).Infof("[%s] authenticated request: %s", context.RequestID(req), remoteAddr)
+		req = recordAuthMethod(req, authMethodOIDC)
+
+		// The token has been verified by the OIDC authenticator so it is safe to
+		// read its claims.
+		if claims, err := util.ParseTokenClaims(token); err == nil {
+			req = context.WithTokenClaims(req, claims)
+		} else {
+			klog.V(4).Infof("[%s] failed to parse claims of authenticated token (%s): %s",
+				context.RequestID(req), remoteAddr, err)
+		}
 
 		// Add the user info to the request context
 		req = req.WithContext(genericapirequest.WithUser(req.Context(), info.User))
@@ -59,12 +119,43 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 	})
 }
 
+// withTokenReviewEndpoint serves the TokenReview API from the proxy, rather
+// than passing these requests on to the API server. Callers of the endpoint are
+// authenticated by the endpoint itself.
+func (p *Proxy) withTokenReviewEndpoint(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL != nil && review.TokenReviewPaths.Has(req.URL.Path) {
+			p.tokenReviewEndpoint.ServeHTTP(rw, req)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withSelfSubjectReview answers SelfSubjectReview requests with the user as
+// derived by the proxy. Requests that are not impersonated are passed on to the
+// API server which will see the same user as the proxy.
+func (p *Proxy) withSelfSubjectReview(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL != nil && review.SelfSubjectReviewPaths.Has(req.URL.Path) &&
+			!context.NoImpersonation(req) {
+			p.selfSubjectReview.ServeHTTP(rw, req)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
 // withTokenReview will attempt a token review on the incoming request, if
 // enabled.
 func (p *Proxy) withTokenReview(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		// If token review is not enabled then error.
-		if !p.config.TokenReview {
+		// If token review is not enabled then error. Tokens are only reviewed by
+		// the default cluster so requests routed to other clusters also error.
+		if !p.config.TokenReview || len(context.ClusterName(req)) > 0 {
+			authenticationFailures.WithLabelValues(authFailureInvalidToken).Inc()
 			p.handleError(rw, req, errUnauthorized)
 			return
 		}
@@ -76,6 +167,8 @@ func (p *Proxy) withTokenReview(handler http.Handler) http.Handler {
 			return
 		}
 
+		req = recordAuthMethod(req, authMethodTokenReview)
+
 		// Set no impersonation headers and re-add removed headers.
 		req = context.WithNoImpersonation(req)
 
@@ -96,15 +189,17 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		req, remoteAddr = context.RemoteAddr(req)
 
 		// If we have disabled impersonation we can forward the request right away
-		if p.config.DisableImpersonation {
-			klog.V(2).Infof("passing on request with no impersonation: %s", remoteAddr)
+		if p.disableImpersonation(req) {
+			klog.V(2).Infof("[%s] passing on request with no impersonation: %s", context.RequestID(req), remoteAddr)
 			// Indicate we need to not use impersonation.
 			req = context.WithNoImpersonation(req)
 			handler.ServeHTTP(rw, req)
 			return
 		}
 
-		if p.hasImpersonation(req.Header) {
+		// User requested impersonation is only allowed with a policy.
+		hasImpersonation := p.hasImpersonation(req.Header)
+		if hasImpersonation && p.config.ImpersonationPolicy == nil {
 			p.handleError(rw, req, errImpersonateHeader)
 			return
 		}
@@ -129,8 +224,31 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 			groups = append(groups, authuser.AllAuthenticated)
 		}
 
+		username := user.GetName()
+		uid := user.GetUID()
 		extra := user.GetExtra()
 
+		// If the client requested impersonation and the policy allows it, the
+		// requested identity is impersonated instead of the authenticated user.
+		if hasImpersonation {
+			requested, err := p.authorizeImpersonation(req, user)
+			if err != nil {
+				p.handleError(rw, req, err)
+				return
+			}
+
+			klog.V(2).Infof("[%s] user %q impersonating %q (%s)",
+				context.RequestID(req), user.GetName(), requested.UserName, remoteAddr)
+
+			impersonation.Strip(req.Header)
+			req = context.WithImpersonatedUser(req, requested.User())
+
+			username = requested.UserName
+			uid = requested.UID
+			groups = requested.Groups
+			extra = requested.Extra
+		}
+
 		if extra == nil {
 			extra = make(map[string][]string)
 		}
@@ -138,8 +256,8 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		// If client IP user extra header option set then append the remote client
 		// address.
 		if p.config.ExtraUserHeadersClientIPEnabled {
-			klog.V(6).Infof("adding impersonate extra user header %s: %s (%s)",
-				UserHeaderClientIPKey, remoteAddr, remoteAddr)
+			klog.V(6).Infof("[%s] adding impersonate extra user header %s: %s (%s)",
+				context.RequestID(req), UserHeaderClientIPKey, remoteAddr, remoteAddr)
 
 			extra[UserHeaderClientIPKey] = append(extra[UserHeaderClientIPKey], remoteAddr)
 		}
@@ -147,21 +265,82 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		// Add custom extra user headers to impersonation request.
 		for k, vs := range p.config.ExtraUserHeaders {
 			for _, v := range vs {
-				klog.V(6).Infof("adding impersonate extra user header %s: %s (%s)",
-					k, v, remoteAddr)
+				klog.V(6).Infof("[%s] adding impersonate extra user header %s: %s (%s)",
+					context.RequestID(req), k, v, remoteAddr)
 
 				extra[k] = append(extra[k], v)
 			}
 		}
 
+		// Add extra user headers rendered from the token claims and request.
+		if p.config.ExtraUserHeaderTemplates != nil {
+			data := userextra.NewData(req, remoteAddr, user, context.TokenClaims(req))
+			for k, vs := range p.config.ExtraUserHeaderTemplates.Execute(data) {
+				klog.V(6).Infof("[%s] adding impersonate extra user header %s: %s (%s)",
+					context.RequestID(req), k, vs, remoteAddr)
+
+				extra[k] = append(extra[k], vs...)
+			}
+		}
+
 		conf := &transport.ImpersonationConfig{
-			UserName: user.GetName(),
+			UserName: username,
 			Groups:   groups,
 			Extra:    extra,
 		}
 
 		// Add the impersonation configuration to the context.
 		req = context.WithImpersonationConfig(req, conf)
+		if len(uid) > 0 {
+			req = context.WithImpersonationUID(req, uid)
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// authorizeImpersonation returns the identity requested to be impersonated by
+// the client, if allowed by the impersonation policy.
+func (p *Proxy) authorizeImpersonation(req *http.Request, user authuser.Info) (*impersonation.Request, error) {
+	requested, _, err := impersonation.FromHeader(req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := tracing.Start(req.Context(), "impersonation.authorize")
+	err = impersonation.Authorize(ctx, p.config.ImpersonationPolicy, user, requested)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return requested, nil
+}
+
+// withImpersonatedUser replaces the user of the request context with the
+// user requested to be impersonated by the client, if any, so that later
+// handlers act on the impersonated user. Both identities are recorded in the
+// audit event.
+func (p *Proxy) withImpersonatedUser(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		impersonatedUser, ok := context.ImpersonatedUser(req)
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		ctx := req.Context()
+		if ae := genericapirequest.AuditEventFrom(ctx); ae != nil {
+			if user, ok := genericapirequest.UserFrom(ctx); ok {
+				k8saudit.LogAnnotation(ae, AuditAuthenticatedUserKey, user.GetName())
+				k8saudit.LogAnnotation(ae, AuditAuthenticatedGroupsKey, strings.Join(user.GetGroups(), ","))
+			}
+
+			k8saudit.LogAnnotation(ae, AuditImpersonatedUserKey, impersonatedUser.GetName())
+			k8saudit.LogAnnotation(ae, AuditImpersonatedGroupsKey, strings.Join(impersonatedUser.GetGroups(), ","))
+			k8saudit.LogImpersonatedUser(ae, impersonatedUser)
+		}
+
+		req = req.WithContext(genericapirequest.WithUser(ctx, impersonatedUser))
 		handler.ServeHTTP(rw, req)
 	})
 }
@@ -169,7 +348,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 // newErrorHandler returns a handler failed requests.
 func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request, err error) {
 	unauthedHandler := audit.NewUnauthenticatedHandler(p.auditor, func(rw http.ResponseWriter, r *http.Request) {
-		klog.V(2).Infof("unauthenticated user request %s", r.RemoteAddr)
+		klog.V(2).Infof("[%s] unauthenticated user request %s", context.RequestID(r), r.RemoteAddr)
 		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
 	})
 
@@ -180,6 +359,27 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 			return
 		}
 
+		// User is not allowed to impersonate the requested identity
+		if forbidden, ok := err.(*impersonation.ForbiddenError); ok {
+			klog.V(2).Infof("[%s] impersonation forbidden %s: %s", context.RequestID(r), r.RemoteAddr, forbidden)
+			http.Error(rw, forbidden.Error(), http.StatusForbidden)
+			return
+		}
+
+		// User is over their rate limit
+		if rejected, ok := err.(*ratelimit.RejectedError); ok {
+			klog.V(2).Infof("[%s] rate limited request %s: %s", context.RequestID(r), r.RemoteAddr, rejected)
+			writeStatus(rw, rejected.Status())
+			return
+		}
+
+		// Too many requests in flight
+		if rejected, ok := err.(*inflight.RejectedError); ok {
+			klog.V(2).Infof("[%s] in flight limited request %s: %s", context.RequestID(r), r.RemoteAddr, rejected)
+			writeStatus(rw, rejected.Status())
+			return
+		}
+
 		switch err {
 
 		// Failed auth
@@ -187,31 +387,49 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 			// If Unauthorized then error and report to audit
 			unauthedHandler.ServeHTTP(rw, r)
 			return
+
+		// No API server endpoints available
+		case upstream.ErrNoEndpoints:
+			klog.Errorf("[%s] no upstream endpoints available for request %s", context.RequestID(r), r.RemoteAddr)
+			http.Error(rw, "No API server endpoints available", http.StatusServiceUnavailable)
+			return
+
+		// Request routed to a cluster that does not exist
+		case errUnknownCluster:
+			http.Error(rw, "Cluster not found", http.StatusNotFound)
+			return
+
+		// Malformed impersonation request
+		case impersonation.ErrNoUser:
+			klog.V(2).Infof("[%s] impersonation request without user %s", context.RequestID(r), r.RemoteAddr)
+			http.Error(rw, "Impersonate-User header is required to impersonate groups or extra", http.StatusBadRequest)
+			return
+
 		// Access denied to object
 		// case errAccessDenied:
 		// 	http.Error(rw, "Access denied", http.StatusForbidden)
 		// 	return
 		// User request with impersonation
 		case errImpersonateHeader:
-			klog.V(2).Infof("impersonation user request %s", r.RemoteAddr)
+			klog.V(2).Infof("[%s] impersonation user request %s", context.RequestID(r), r.RemoteAddr)
 			http.Error(rw, "Impersonation requests are disabled when using kube-oidc-proxy", http.StatusForbidden)
 			return
 
 			// No name given or available in oidc request
 		case errNoName:
-			klog.V(2).Infof("no name available in oidc info %s", r.RemoteAddr)
+			klog.V(2).Infof("[%s] no name available in oidc info %s", context.RequestID(r), r.RemoteAddr)
 			http.Error(rw, "Username claim not available in OIDC Issuer response", http.StatusForbidden)
 			return
 
 			// No impersonation configuration found in context
 		case errNoImpersonationConfig:
-			klog.Errorf("if you are seeing this, there is likely a bug in the proxy (%s): %s", r.RemoteAddr, err)
+			klog.Errorf("[%s] if you are seeing this, there is likely a bug in the proxy (%s): %s", context.RequestID(r), r.RemoteAddr, err)
 			http.Error(rw, "", http.StatusInternalServerError)
 			return
 
 			// Server or unknown error
 		default:
-			klog.Errorf("unknown error (%s): %s", r.RemoteAddr, err)
+			klog.Errorf("[%s] unknown error (%s): %s", context.RequestID(r), r.RemoteAddr, err)
 			http.Error(rw, "", http.StatusInternalServerError)
 		}
 	}
@@ -220,6 +438,7 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 func (p *Proxy) hasImpersonation(header http.Header) bool {
 	for h := range header {
 		if strings.ToLower(h) == impersonateUserHeader ||
+			strings.ToLower(h) == impersonateUIDHeader ||
 			strings.ToLower(h) == impersonateGroupHeader ||
 			strings.HasPrefix(strings.ToLower(h), impersonateExtraHeader) {
 
@@ -0,0 +1,225 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package impersonation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/transport"
+)
+
+const (
+	// ImpersonateUIDHeader is used to impersonate a particular UID during an
+	// API server request.
+	ImpersonateUIDHeader = "Impersonate-Uid"
+)
+
+var (
+	// ErrNoUser is returned when groups or extras are requested to be
+	// impersonated without a user.
+	ErrNoUser = errors.New("requested impersonation of groups or extra without a user")
+)
+
+// ForbiddenError is returned when the policy does not allow the user to
+// impersonate the requested identity.
+type ForbiddenError struct {
+	User   string
+	Reason string
+}
+
+func (f *ForbiddenError) Error() string {
+	return fmt.Sprintf("user %q is not allowed to impersonate %s", f.User, f.Reason)
+}
+
+// Request is the identity a client has requested to impersonate using the
+// Impersonate-* headers.
+type Request struct {
+	UserName string
+	UID      string
+	Groups   []string
+	Extra    map[string][]string
+}
+
+// FromHeader returns the impersonation request held in the given headers, if
+// any impersonation headers are present.
+func FromHeader(header http.Header) (*Request, bool, error) {
+	r := &Request{
+		Extra: make(map[string][]string),
+	}
+
+	found := false
+	for k, vs := range header {
+		key := textproto.CanonicalMIMEHeaderKey(k)
+
+		switch {
+		case key == transport.ImpersonateUserHeader:
+			found = true
+			if len(vs) > 0 {
+				r.UserName = vs[0]
+			}
+
+		case key == ImpersonateUIDHeader:
+			found = true
+			if len(vs) > 0 {
+				r.UID = vs[0]
+			}
+
+		case key == transport.ImpersonateGroupHeader:
+			found = true
+			r.Groups = append(r.Groups, vs...)
+
+		case strings.HasPrefix(key, transport.ImpersonateUserExtraHeaderPrefix):
+			found = true
+			extraKey := unescapeExtraKey(strings.ToLower(
+				strings.TrimPrefix(key, transport.ImpersonateUserExtraHeaderPrefix)))
+			r.Extra[extraKey] = append(r.Extra[extraKey], vs...)
+		}
+	}
+
+	if !found {
+		return nil, false, nil
+	}
+
+	if len(r.UserName) == 0 {
+		return nil, true, ErrNoUser
+	}
+
+	return r, true, nil
+}
+
+// Strip removes all impersonation headers from the given headers.
+func Strip(header http.Header) {
+	for k := range header {
+		key := textproto.CanonicalMIMEHeaderKey(k)
+		if key == transport.ImpersonateUserHeader ||
+			key == ImpersonateUIDHeader ||
+			key == transport.ImpersonateGroupHeader ||
+			strings.HasPrefix(key, transport.ImpersonateUserExtraHeaderPrefix) {
+			delete(header, k)
+		}
+	}
+}
+
+// User returns the user info of the impersonated identity, as the API server
+// will resolve it.
+func (r *Request) User() user.Info {
+	groups := append([]string{}, r.Groups...)
+
+	// Service accounts impersonated without groups get their default groups.
+	if namespace, _, err := serviceaccount.SplitUsername(r.UserName); err == nil && len(groups) == 0 {
+		groups = serviceaccount.MakeGroupNames(namespace)
+	}
+
+	builtin := user.AllAuthenticated
+	if r.UserName == user.Anonymous {
+		builtin = user.AllUnauthenticated
+	}
+
+	found := false
+	for _, g := range groups {
+		if g == builtin {
+			found = true
+			break
+		}
+	}
+	if !found {
+		groups = append(groups, builtin)
+	}
+
+	return &user.DefaultInfo{
+		Name:   r.UserName,
+		UID:    r.UID,
+		Groups: groups,
+		Extra:  r.Extra,
+	}
+}
+
+// Authorize checks that the user is allowed by the policy to impersonate each
+// part of the requested identity, using the same authorization attributes as
+// the API server uses for impersonation.
+func Authorize(ctx context.Context, policy authorizer.Authorizer, u user.Info, r *Request) error {
+	for _, attrs := range r.attributes(u) {
+		decision, reason, err := policy.Authorize(ctx, attrs)
+		if err != nil {
+			return err
+		}
+
+		if decision != authorizer.DecisionAllow {
+			target := fmt.Sprintf("%s %q", attrs.Resource, attrs.Name)
+			if attrs.Resource == "userextras" {
+				target = fmt.Sprintf("userextras %q %q", attrs.Subresource, attrs.Name)
+			}
+			if len(reason) > 0 {
+				target = fmt.Sprintf("%s: %s", target, reason)
+			}
+
+			return &ForbiddenError{
+				User:   u.GetName(),
+				Reason: target,
+			}
+		}
+	}
+
+	return nil
+}
+
+// attributes returns the authorization attributes of each part of the
+// requested identity.
+func (r *Request) attributes(u user.Info) []authorizer.AttributesRecord {
+	newAttrs := func(apiGroup, resource, namespace, subresource, name string) authorizer.AttributesRecord {
+		return authorizer.AttributesRecord{
+			User:            u,
+			Verb:            "impersonate",
+			APIGroup:        apiGroup,
+			Resource:        resource,
+			Namespace:       namespace,
+			Subresource:     subresource,
+			Name:            name,
+			ResourceRequest: true,
+		}
+	}
+
+	var attrs []authorizer.AttributesRecord
+
+	if namespace, name, err := serviceaccount.SplitUsername(r.UserName); err == nil {
+		attrs = append(attrs, newAttrs("", "serviceaccounts", namespace, "", name))
+	} else {
+		attrs = append(attrs, newAttrs("", "users", "", "", r.UserName))
+	}
+
+	for _, group := range r.Groups {
+		attrs = append(attrs, newAttrs("", "groups", "", "", group))
+	}
+
+	if len(r.UID) > 0 {
+		attrs = append(attrs, newAttrs(authv1.GroupName, "uids", "", "", r.UID))
+	}
+
+	for key, values := range r.Extra {
+		for _, value := range values {
+			attrs = append(attrs, newAttrs(authv1.GroupName, "userextras", "", key, value))
+		}
+	}
+
+	return attrs
+}
+
+// unescapeExtraKey unescapes the percent encoded extra key of an
+// Impersonate-Extra-* header.
+func unescapeExtraKey(encodedKey string) string {
+	key, err := url.PathUnescape(encodedKey)
+	if err != nil {
+		return encodedKey
+	}
+
+	return key
+}
@@ -0,0 +1,298 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package impersonation
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestFromHeader(t *testing.T) {
+	tests := map[string]struct {
+		header http.Header
+
+		expRequest *Request
+		expFound   bool
+		expErr     error
+	}{
+		"no impersonation headers should not be found": {
+			header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+		},
+		"impersonation of groups without a user should error": {
+			header: http.Header{
+				"Impersonate-Group": []string{"a-group"},
+			},
+			expFound: true,
+			expErr:   ErrNoUser,
+		},
+		"all impersonation headers should be returned": {
+			header: http.Header{
+				"Impersonate-User":                 []string{"a-user"},
+				"Impersonate-Uid":                  []string{"1234"},
+				"Impersonate-Group":                []string{"a-group", "b-group"},
+				"Impersonate-Extra-Foo":            []string{"a", "b"},
+				"Impersonate-Extra-Example.com%2f": []string{"c"},
+			},
+			expRequest: &Request{
+				UserName: "a-user",
+				UID:      "1234",
+				Groups:   []string{"a-group", "b-group"},
+				Extra: map[string][]string{
+					"foo":          []string{"a", "b"},
+					"example.com/": []string{"c"},
+				},
+			},
+			expFound: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, found, err := FromHeader(test.header)
+			if err != test.expErr {
+				t.Errorf("got unexpected error, exp=%v got=%v", test.expErr, err)
+			}
+
+			if found != test.expFound {
+				t.Errorf("got unexpected found, exp=%t got=%t", test.expFound, found)
+			}
+
+			if !reflect.DeepEqual(test.expRequest, r) {
+				t.Errorf("got unexpected request, exp=%#v got=%#v", test.expRequest, r)
+			}
+		})
+	}
+}
+
+func TestStrip(t *testing.T) {
+	header := http.Header{
+		"Authorization":         []string{"bearer fake-token"},
+		"Impersonate-User":      []string{"a-user"},
+		"Impersonate-Uid":       []string{"1234"},
+		"Impersonate-Group":     []string{"a-group"},
+		"Impersonate-Extra-Foo": []string{"a"},
+	}
+
+	Strip(header)
+
+	exp := http.Header{
+		"Authorization": []string{"bearer fake-token"},
+	}
+	if !reflect.DeepEqual(exp, header) {
+		t.Errorf("got unexpected headers, exp=%#v got=%#v", exp, header)
+	}
+}
+
+func TestRequestUser(t *testing.T) {
+	tests := map[string]struct {
+		request *Request
+		expUser user.Info
+	}{
+		"a user should get the authenticated group": {
+			request: &Request{
+				UserName: "a-user",
+				Groups:   []string{"a-group"},
+			},
+			expUser: &user.DefaultInfo{
+				Name:   "a-user",
+				Groups: []string{"a-group", user.AllAuthenticated},
+			},
+		},
+		"a service account without groups should get its default groups": {
+			request: &Request{
+				UserName: "system:serviceaccount:default:a-sa",
+			},
+			expUser: &user.DefaultInfo{
+				Name: "system:serviceaccount:default:a-sa",
+				Groups: []string{
+					"system:serviceaccounts",
+					"system:serviceaccounts:default",
+					user.AllAuthenticated,
+				},
+			},
+		},
+		"the anonymous user should get the unauthenticated group": {
+			request: &Request{
+				UserName: user.Anonymous,
+			},
+			expUser: &user.DefaultInfo{
+				Name:   user.Anonymous,
+				Groups: []string{user.AllUnauthenticated},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if u := test.request.User(); !reflect.DeepEqual(test.expUser, u) {
+				t.Errorf("got unexpected user, exp=%#v got=%#v", test.expUser, u)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy := &StaticPolicy{
+		Rules: []Rule{
+			{
+				Groups:        []string{"admins"},
+				Resources:     []string{"*"},
+				ResourceNames: []string{},
+			},
+			{
+				Users:         []string{"a-user"},
+				Resources:     []string{"users", "groups"},
+				ResourceNames: []string{"dev-*"},
+			},
+			{
+				Users:         []string{"a-user"},
+				Resources:     []string{"serviceaccounts"},
+				ResourceNames: []string{"default/*"},
+			},
+			{
+				Users:         []string{"a-user"},
+				Resources:     []string{"userextras"},
+				ResourceNames: []string{"scopes=view"},
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		user    user.Info
+		request *Request
+
+		expErr string
+	}{
+		"a member of an allowed group should be able to impersonate anything": {
+			user: &user.DefaultInfo{Name: "b-user", Groups: []string{"admins"}},
+			request: &Request{
+				UserName: "system:admin",
+				UID:      "1234",
+				Groups:   []string{"system:masters"},
+			},
+		},
+		"a user should be able to impersonate matching users, groups and extra": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "dev-user",
+				Groups:   []string{"dev-group"},
+				Extra:    map[string][]string{"scopes": []string{"view"}},
+			},
+		},
+		"a user should be able to impersonate a matching service account": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "system:serviceaccount:default:a-sa",
+			},
+		},
+		"a user should not be able to impersonate a service account in another namespace": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "system:serviceaccount:kube-system:a-sa",
+			},
+			expErr: `user "a-user" is not allowed to impersonate serviceaccounts "a-sa": no impersonation policy rule matched`,
+		},
+		"a user should not be able to impersonate a group not matched": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "dev-user",
+				Groups:   []string{"dev-group", "system:masters"},
+			},
+			expErr: `user "a-user" is not allowed to impersonate groups "system:masters": no impersonation policy rule matched`,
+		},
+		"a user should not be able to impersonate extra not matched": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "dev-user",
+				Extra:    map[string][]string{"scopes": []string{"edit"}},
+			},
+			expErr: `user "a-user" is not allowed to impersonate userextras "scopes" "edit": no impersonation policy rule matched`,
+		},
+		"a user should not be able to impersonate a uid not matched": {
+			user: &user.DefaultInfo{Name: "a-user"},
+			request: &Request{
+				UserName: "dev-user",
+				UID:      "1234",
+			},
+			expErr: `user "a-user" is not allowed to impersonate uids "1234": no impersonation policy rule matched`,
+		},
+		"a user not in any rule should not be able to impersonate": {
+			user: &user.DefaultInfo{Name: "c-user"},
+			request: &Request{
+				UserName: "dev-user",
+			},
+			expErr: `user "c-user" is not allowed to impersonate users "dev-user": no impersonation policy rule matched`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Authorize(context.TODO(), policy, test.user, test.request)
+			if len(test.expErr) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			if _, ok := err.(*ForbiddenError); !ok {
+				t.Fatalf("expected forbidden error, got=%#v", err)
+			}
+
+			if err.Error() != test.expErr {
+				t.Errorf("got unexpected error, exp=%s got=%s", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadStaticPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "kube-oidc-proxy-impersonation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(`rules:
+- groups: ["admins"]
+  resources: ["users", "groups"]
+  resourceNames: ["dev-*"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadStaticPolicy(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := &StaticPolicy{
+		Rules: []Rule{
+			{
+				Groups:        []string{"admins"},
+				Resources:     []string{"users", "groups"},
+				ResourceNames: []string{"dev-*"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(exp, policy) {
+		t.Errorf("got unexpected policy, exp=%#v got=%#v", exp, policy)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`rules: [{unknown: true}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadStaticPolicy(path); err == nil {
+		t.Error("expected error loading policy with unknown fields")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package impersonation
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"sigs.k8s.io/yaml"
+)
+
+// StaticPolicy is an impersonation policy loaded from a file. A user may
+// impersonate an identity if a rule matching the user allows every part of
+// the identity.
+type StaticPolicy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows the users and members of groups listed to impersonate the
+// resources listed.
+type Rule struct {
+	// Users and Groups the rule applies to.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Resources that may be impersonated. One or more of 'users', 'groups',
+	// 'serviceaccounts', 'uids' and 'userextras', or '*' for all.
+	Resources []string `json:"resources"`
+
+	// ResourceNames that may be impersonated. Service accounts are named
+	// '<namespace>/<name>' and user extras '<key>=<value>'. A trailing '*'
+	// matches any suffix. If empty, all names may be impersonated.
+	ResourceNames []string `json:"resourceNames,omitempty"`
+}
+
+var _ authorizer.Authorizer = &StaticPolicy{}
+
+// LoadStaticPolicy loads the YAML or JSON encoded policy file.
+func LoadStaticPolicy(path string) (*StaticPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read impersonation policy file: %s", err)
+	}
+
+	policy := new(StaticPolicy)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to decode impersonation policy file %q: %s", path, err)
+	}
+
+	return policy, nil
+}
+
+// Authorize allows impersonate requests matched by any of the rules. All other
+// requests get no opinion.
+func (s *StaticPolicy) Authorize(_ context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	if attrs.GetVerb() != "impersonate" {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	for _, rule := range s.Rules {
+		if rule.matches(attrs) {
+			return authorizer.DecisionAllow, "", nil
+		}
+	}
+
+	return authorizer.DecisionNoOpinion, "no impersonation policy rule matched", nil
+}
+
+func (r *Rule) matches(attrs authorizer.Attributes) bool {
+	u := attrs.GetUser()
+	if !sets.NewString(r.Users...).Has(u.GetName()) &&
+		!sets.NewString(r.Groups...).HasAny(u.GetGroups()...) {
+		return false
+	}
+
+	resources := sets.NewString(r.Resources...)
+	if !resources.Has("*") && !resources.Has(attrs.GetResource()) {
+		return false
+	}
+
+	if len(r.ResourceNames) == 0 {
+		return true
+	}
+
+	name := attrs.GetName()
+	switch attrs.GetResource() {
+	case "serviceaccounts":
+		name = attrs.GetNamespace() + "/" + name
+	case "userextras":
+		name = attrs.GetSubresource() + "=" + name
+	}
+
+	for _, pattern := range r.ResourceNames {
+		if pattern == name {
+			return true
+		}
+
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
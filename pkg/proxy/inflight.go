@@ -0,0 +1,38 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net/http"
+
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+)
+
+// withInFlightLimit rejects requests of authenticated users over the limits
+// of requests in flight.
+func (p *Proxy) withInFlightLimit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u, ok := genericapirequest.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		info, _ := genericapirequest.RequestInfoFrom(req.Context())
+		kind, ok := inflight.KindOf(req, info, inflight.LongRunningRequestCheck)
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		release, err := p.config.InFlightLimiter.Acquire(kind, u)
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+		defer release()
+
+		handler.ServeHTTP(rw, req)
+	})
+}
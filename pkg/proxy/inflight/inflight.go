@@ -0,0 +1,226 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package inflight
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+)
+
+// Kind is the kind of request concurrency is limited by.
+type Kind string
+
+const (
+	// ReadOnly are requests that are not long running and do not mutate.
+	ReadOnly Kind = "readonly"
+
+	// Mutating are requests that are not long running and mutate.
+	Mutating Kind = "mutating"
+
+	// Watch are open watches.
+	Watch Kind = "watch"
+
+	// Exec are open exec, attach and port forward sessions.
+	Exec Kind = "exec"
+)
+
+// Kinds are all kinds of request.
+var Kinds = []Kind{ReadOnly, Mutating, Watch, Exec}
+
+// LongRunningRequestCheck treats the same verbs and subresources as long
+// running as kube-apiserver, so that watches and exec sessions are limited
+// separately from other requests. This is independent of the audit log, which
+// only treats watches as long running.
+var LongRunningRequestCheck = genericfilters.BasicLongRunningRequestCheck(
+	sets.NewString("watch", "proxy"),
+	sets.NewString("attach", "exec", "proxy", "log", "portforward"))
+
+var (
+	nonMutatingVerbs = sets.NewString("get", "list", "watch")
+	execSubresources = sets.NewString("exec", "attach", "portforward")
+)
+
+// KindOf returns the kind of the request, using longRunning to determine
+// whether the request is long running. Long running requests which are
+// neither watches nor exec sessions, such as following logs, are not limited.
+func KindOf(req *http.Request, info *request.RequestInfo, longRunning request.LongRunningRequestCheck) (Kind, bool) {
+	if info == nil {
+		return "", false
+	}
+
+	if longRunning != nil && longRunning(req, info) {
+		switch {
+		case info.Verb == "watch":
+			return Watch, true
+		case info.IsResourceRequest && execSubresources.Has(info.Subresource):
+			return Exec, true
+		default:
+			return "", false
+		}
+	}
+
+	if nonMutatingVerbs.Has(info.Verb) {
+		return ReadOnly, true
+	}
+
+	return Mutating, true
+}
+
+// ParseLimits parses the maximum number of requests in flight of each kind.
+func ParseLimits(limits map[string]string) (map[Kind]int, error) {
+	parsed := make(map[Kind]int)
+
+	for k, v := range limits {
+		kind, err := parseKind(k)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid in flight limit %q for %q, must be a positive integer", v, k)
+		}
+
+		parsed[kind] = n
+	}
+
+	return parsed, nil
+}
+
+func parseKind(s string) (Kind, error) {
+	for _, k := range Kinds {
+		if string(k) == s {
+			return k, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown in flight request kind %q, must be one of %v", s, Kinds)
+}
+
+// Options configure a Limiter.
+type Options struct {
+	// Limits are the maximum number of requests in flight in total, per kind.
+	Limits map[Kind]int
+
+	// PerUserLimits are the maximum number of requests in flight of each
+	// user, per kind.
+	PerUserLimits map[Kind]int
+
+	// ExemptGroups are groups whose members are not limited.
+	ExemptGroups []string
+}
+
+// RejectedError is returned when a request is over an in flight limit.
+type RejectedError struct {
+	Kind    Kind
+	PerUser bool
+}
+
+func (r *RejectedError) Error() string {
+	if r.PerUser {
+		return fmt.Sprintf("too many %s requests in flight for user", r.Kind)
+	}
+
+	return fmt.Sprintf("too many %s requests in flight", r.Kind)
+}
+
+// Status returns the Kubernetes Status of the error, as a 429 to retry after
+// one second.
+func (r *RejectedError) Status() metav1.Status {
+	status := apierrors.NewTooManyRequests(
+		fmt.Sprintf("Too many %s requests in flight, please try again later.", r.Kind), 1).Status()
+	status.TypeMeta = metav1.TypeMeta{
+		Kind:       "Status",
+		APIVersion: "v1",
+	}
+
+	return status
+}
+
+// Limiter limits the number of requests in flight, in total and per user.
+type Limiter struct {
+	opts         Options
+	exemptGroups sets.String
+
+	mu      sync.Mutex
+	total   map[Kind]int
+	perUser map[Kind]map[string]int
+}
+
+// New returns an in flight limiter with the given options.
+func New(opts Options) *Limiter {
+	registerMetrics()
+
+	for kind, limit := range opts.Limits {
+		inflightLimit.WithLabelValues(string(kind)).Set(float64(limit))
+	}
+
+	return &Limiter{
+		opts:         opts,
+		exemptGroups: sets.NewString(opts.ExemptGroups...),
+		total:        make(map[Kind]int),
+		perUser:      make(map[Kind]map[string]int),
+	}
+}
+
+// Acquire takes an in flight slot of the kind for the user, returning a
+// function to release it once the request has finished. If the request is
+// over a limit, a RejectedError is returned.
+func (l *Limiter) Acquire(kind Kind, u user.Info) (func(), error) {
+	if l.exemptGroups.HasAny(u.GetGroups()...) {
+		return func() {}, nil
+	}
+
+	name := u.GetName()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit, ok := l.opts.Limits[kind]; ok && l.total[kind] >= limit {
+		inflightRejected.WithLabelValues(string(kind), "total").Inc()
+		return nil, &RejectedError{Kind: kind}
+	}
+
+	users, ok := l.perUser[kind]
+	if !ok {
+		users = make(map[string]int)
+		l.perUser[kind] = users
+	}
+
+	if limit, ok := l.opts.PerUserLimits[kind]; ok && users[name] >= limit {
+		inflightRejected.WithLabelValues(string(kind), "user").Inc()
+		return nil, &RejectedError{Kind: kind, PerUser: true}
+	}
+
+	l.total[kind]++
+	users[name]++
+	inflightRequests.WithLabelValues(string(kind)).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(kind, name)
+		})
+	}, nil
+}
+
+func (l *Limiter) release(kind Kind, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total[kind]--
+	inflightRequests.WithLabelValues(string(kind)).Dec()
+
+	users := l.perUser[kind]
+	if users[name]--; users[name] <= 0 {
+		delete(users, name)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package inflight
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := map[string]struct {
+		info *request.RequestInfo
+
+		expKind Kind
+		expOK   bool
+	}{
+		"no request info should not be limited": {},
+		"a get should be read only": {
+			info:    &request.RequestInfo{IsResourceRequest: true, Verb: "get", Resource: "pods"},
+			expKind: ReadOnly,
+			expOK:   true,
+		},
+		"a non resource get should be read only": {
+			info:    &request.RequestInfo{Verb: "get"},
+			expKind: ReadOnly,
+			expOK:   true,
+		},
+		"a create should be mutating": {
+			info:    &request.RequestInfo{IsResourceRequest: true, Verb: "create", Resource: "pods"},
+			expKind: Mutating,
+			expOK:   true,
+		},
+		"a watch should be a watch": {
+			info:    &request.RequestInfo{IsResourceRequest: true, Verb: "watch", Resource: "pods"},
+			expKind: Watch,
+			expOK:   true,
+		},
+		"an exec should be an exec": {
+			info:    &request.RequestInfo{IsResourceRequest: true, Verb: "create", Resource: "pods", Subresource: "exec"},
+			expKind: Exec,
+			expOK:   true,
+		},
+		"a port forward should be an exec": {
+			info:    &request.RequestInfo{IsResourceRequest: true, Verb: "get", Resource: "pods", Subresource: "portforward"},
+			expKind: Exec,
+			expOK:   true,
+		},
+		"following logs should not be limited": {
+			info: &request.RequestInfo{IsResourceRequest: true, Verb: "get", Resource: "pods", Subresource: "log"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+
+			kind, ok := KindOf(req, test.info, LongRunningRequestCheck)
+			if kind != test.expKind || ok != test.expOK {
+				t.Errorf("got unexpected kind, exp=(%q, %t) got=(%q, %t)",
+					test.expKind, test.expOK, kind, ok)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(map[string]string{"readonly": "400", "exec": "10"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if limits[ReadOnly] != 400 || limits[Exec] != 10 || len(limits) != 2 {
+		t.Errorf("got unexpected limits: %v", limits)
+	}
+
+	for name, limits := range map[string]map[string]string{
+		"unknown kind":   {"read": "1"},
+		"invalid number": {"watch": "many"},
+		"zero":           {"watch": "0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseLimits(limits); err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	l := New(Options{
+		Limits:        map[Kind]int{Watch: 3},
+		PerUserLimits: map[Kind]int{Watch: 2},
+		ExemptGroups:  []string{"system:masters"},
+	})
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+	admin := &user.DefaultInfo{Name: "admin", Groups: []string{"system:masters"}}
+
+	mustAcquire := func(u user.Info) func() {
+		release, err := l.Acquire(Watch, u)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return release
+	}
+
+	expRejected := func(u user.Info, perUser bool) {
+		_, err := l.Acquire(Watch, u)
+		rejected, ok := err.(*RejectedError)
+		if !ok {
+			t.Fatalf("expected rejected error, got=%v", err)
+		}
+		if rejected.PerUser != perUser {
+			t.Errorf("got unexpected rejection scope, exp per user=%t got=%t", perUser, rejected.PerUser)
+		}
+		if status := rejected.Status(); status.Code != 429 || status.Details.RetryAfterSeconds != 1 {
+			t.Errorf("got unexpected status: %+v", status)
+		}
+	}
+
+	releaseAlice := mustAcquire(alice)
+	mustAcquire(alice)
+
+	// alice is over the per user limit, but bob is not.
+	expRejected(alice, true)
+	mustAcquire(bob)
+
+	// The total limit has been reached, except for exempt groups.
+	expRejected(bob, false)
+	mustAcquire(admin)
+
+	// Releasing should free a slot, even if released more than once.
+	releaseAlice()
+	releaseAlice()
+	mustAcquire(bob)
+	expRejected(alice, false)
+
+	// Other kinds are not limited.
+	if _, err := l.Acquire(ReadOnly, alice); err != nil {
+		t.Errorf("unexpected error for unlimited kind: %s", err)
+	}
+}
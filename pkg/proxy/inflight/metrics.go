@@ -0,0 +1,57 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package inflight
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	namespace = "kube_oidc_proxy"
+	subsystem = "inflight"
+)
+
+var (
+	inflightRequests = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "requests",
+			Help:           "Number of requests currently in flight by kind.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	inflightLimit = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "limit",
+			Help:           "Maximum number of requests in flight in total by kind.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	inflightRejected = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Subsystem:      subsystem,
+			Name:           "rejected_total",
+			Help:           "Number of requests rejected for being over an in flight limit by kind and scope, either 'total' or 'user'.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind", "scope"},
+	)
+
+	registerOnce sync.Once
+)
+
+func registerMetrics() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(inflightRequests, inflightLimit, inflightRejected)
+	})
+}
@@ -0,0 +1,305 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/sets"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+)
+
+const (
+	metricsNamespace = "kube_oidc_proxy"
+
+	// Authentication methods of requests.
+	authMethodNone        = "none"
+	authMethodOIDC        = "oidc"
+	authMethodTokenReview = "tokenreview"
+
+	// Reasons requests failed authentication.
+	authFailureMissingToken      = "missing_token"
+	authFailureInvalidToken      = "invalid_token"
+	authFailureTokenReviewDenied = "token_review_denied"
+	authFailureTokenReviewError  = "token_review_error"
+
+	// metricsVerbOther and metricsResourceOther are the verb and resource
+	// labels of requests with unknown verbs and resources.
+	metricsVerbOther     = "other"
+	metricsResourceOther = "other"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "requests_total",
+			Help:           "Number of requests by verb, resource, subresource, response code, authentication method and cluster.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"verb", "resource", "subresource", "code", "auth_method", "cluster"},
+	)
+
+	requestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      metricsNamespace,
+			Name:           "request_duration_seconds",
+			Help:           "Latency of requests which are not long running by verb, resource, subresource, authentication method and cluster.",
+			Buckets:        []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"verb", "resource", "subresource", "auth_method", "cluster"},
+	)
+
+	longRunningRequests = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "long_running_requests",
+			Help:           "Number of open long running requests, such as watches and exec sessions, by verb, resource, subresource and cluster.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"verb", "resource", "subresource", "cluster"},
+	)
+
+	authenticationFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "authentication_failures_total",
+			Help:           "Number of requests which failed authentication by reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	upstreamErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "upstream_errors_total",
+			Help:           "Number of requests which failed to be sent to the upstream API server by cluster.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster"},
+	)
+
+	registerMetricsOnce sync.Once
+
+	// metricsRequestInfoFactory resolves the request info of requests for
+	// their metric labels.
+	metricsRequestInfoFactory = &genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	// metricsVerbs are the verbs of resource requests, and the lower case
+	// methods of non-resource requests, which requests are labelled by.
+	metricsVerbs = sets.NewString("get", "list", "watch", "create", "update",
+		"patch", "delete", "deletecollection", "proxy", "post", "put", "head",
+		"options")
+
+	// metricsResources and metricsSubresources are the resources and
+	// subresources of the built-in Kubernetes APIs, which requests are
+	// labelled by.
+	metricsResources    = builtinResources()
+	metricsSubresources = sets.NewString("status", "scale", "log", "exec", "attach",
+		"portforward", "proxy", "binding", "eviction", "ephemeralcontainers", "token",
+		"approval", "finalize")
+)
+
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(
+			requestsTotal,
+			requestDuration,
+			longRunningRequests,
+			authenticationFailures,
+			upstreamErrors,
+		)
+	})
+}
+
+// withMetrics records the metrics of requests. Requests are only labelled by
+// resource once authenticated, so that unauthenticated clients cannot create
+// unbounded series.
+func (p *Proxy) withMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		var cluster string
+		path := req.URL.Path
+		if p.clusterRouter != nil {
+			if c, routedPath, found := p.clusterRouter.Route(req); found && c != nil {
+				cluster, path = c.Name, routedPath
+			}
+		}
+
+		r := new(http.Request)
+		*r = *req
+		u := *req.URL
+		u.Path = path
+		r.URL = &u
+
+		info, err := metricsRequestInfoFactory.NewRequestInfo(r)
+		if err != nil {
+			info = &genericapirequest.RequestInfo{Verb: strings.ToLower(req.Method)}
+		}
+		longRunning := inflight.LongRunningRequestCheck(r, info)
+
+		var labels *context.RequestMetrics
+		req, labels = context.WithRequestMetrics(req)
+
+		delegate := &responseWriterDelegator{ResponseWriter: rw}
+		handler.ServeHTTP(delegate, req)
+
+		verb, resource, subresource := metricsVerb(info.Verb), "", ""
+		authMethod := labels.AuthMethod
+		if len(authMethod) == 0 {
+			authMethod = authMethodNone
+		} else {
+			resource, subresource = metricsResource(info)
+		}
+
+		requestsTotal.WithLabelValues(verb, resource, subresource,
+			strconv.Itoa(delegate.Status()), authMethod, cluster).Inc()
+
+		if !longRunning {
+			requestDuration.WithLabelValues(verb, resource, subresource,
+				authMethod, cluster).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// withLongRunningMetrics records the number of open long running requests. It
+// is only called for authenticated requests.
+func (p *Proxy) withLongRunningMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, ok := genericapirequest.RequestInfoFrom(req.Context())
+		if ok && inflight.LongRunningRequestCheck(req, info) {
+			resource, subresource := metricsResource(info)
+			gauge := longRunningRequests.WithLabelValues(metricsVerb(info.Verb),
+				resource, subresource, context.ClusterName(req))
+			gauge.Inc()
+			defer gauge.Dec()
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// metricsVerb returns the verb label of the request verb, so that clients
+// cannot create unbounded series with arbitrary HTTP methods.
+func metricsVerb(verb string) string {
+	if metricsVerbs.Has(verb) {
+		return verb
+	}
+	return metricsVerbOther
+}
+
+// metricsResource returns the resource and subresource labels of the request,
+// so that clients cannot create unbounded series with arbitrary paths.
+// Resources other than those of the built-in APIs, such as custom resources,
+// are labelled as other.
+func metricsResource(info *genericapirequest.RequestInfo) (string, string) {
+	resource, subresource := info.Resource, info.Subresource
+	if len(resource) > 0 && !metricsResources.Has(resource) {
+		resource = metricsResourceOther
+	}
+	if len(subresource) > 0 && !metricsSubresources.Has(subresource) {
+		subresource = metricsResourceOther
+	}
+	return resource, subresource
+}
+
+// builtinResources returns the resources of the kinds of the built-in
+// Kubernetes APIs.
+func builtinResources() sets.String {
+	// Resources of the API extension and aggregation servers.
+	resources := sets.NewString("customresourcedefinitions", "apiservices")
+	for gvk := range scheme.Scheme.AllKnownTypes() {
+		if strings.HasSuffix(gvk.Kind, "List") {
+			continue
+		}
+		plural, _ := meta.UnsafeGuessKindToResource(gvk)
+		resources.Insert(plural.Resource)
+	}
+	return resources
+}
+
+// recordAuthMethod records the method the request was authenticated with, for
+// metrics and later handlers.
+func recordAuthMethod(req *http.Request, method string) *http.Request {
+	if labels := context.RequestMetricsFrom(req); labels != nil {
+		labels.AuthMethod = method
+	}
+	return context.WithAuthMethod(req, method)
+}
+
+// responseWriterDelegator records the status code of the response, while
+// still allowing the response to be flushed and hijacked for streaming and
+// upgraded requests.
+type responseWriterDelegator struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+}
+
+func (r *responseWriterDelegator) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseWriterDelegator) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseWriterDelegator) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseWriterDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	// Connections are only hijacked to switch protocols.
+	if !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.wroteHeader = true
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController.
+func (r *responseWriterDelegator) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the status code of the response.
+func (r *responseWriterDelegator) Status() int {
+	if !r.wroteHeader {
+		return http.StatusOK
+	}
+	return r.status
+}
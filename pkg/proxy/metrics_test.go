@@ -0,0 +1,214 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	registerMetrics()
+
+	p := newTestProxy(t)
+	defer p.ctrl.Finish()
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(
+		&authenticator.Response{
+			User: &user.DefaultInfo{Name: "a-user"},
+		}, true, nil).Times(2)
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "bad-token").Return(
+		nil, false, errors.New("invalid token"))
+
+	tests := map[string]struct {
+		token  string
+		method string
+		path   string
+
+		expVerb       string
+		expResource   string
+		expCode       int
+		expAuthMethod string
+		expFailure    string
+	}{
+		"an authenticated request should be counted by its response code and auth method": {
+			token:         "fake-token",
+			expVerb:       "create",
+			expResource:   "pods",
+			expCode:       http.StatusCreated,
+			expAuthMethod: authMethodOIDC,
+		},
+		"a request without a token should count a missing token failure": {
+			expVerb:       "create",
+			expCode:       http.StatusUnauthorized,
+			expAuthMethod: authMethodNone,
+			expFailure:    authFailureMissingToken,
+		},
+		"a request with an invalid token should count an invalid token failure": {
+			token:         "bad-token",
+			expVerb:       "create",
+			expCode:       http.StatusUnauthorized,
+			expAuthMethod: authMethodNone,
+			expFailure:    authFailureInvalidToken,
+		},
+		"a request of an unknown resource should be counted as another resource": {
+			token:         "fake-token",
+			path:          "/apis/example.com/v1/namespaces/default/a1b2c3d4",
+			expVerb:       "create",
+			expResource:   metricsResourceOther,
+			expCode:       http.StatusCreated,
+			expAuthMethod: authMethodOIDC,
+		},
+		"a request with an unknown method should be counted as another verb": {
+			method:        "FOO",
+			expVerb:       metricsVerbOther,
+			expCode:       http.StatusUnauthorized,
+			expAuthMethod: authMethodNone,
+			expFailure:    authFailureMissingToken,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			counter := requestsTotal.WithLabelValues(test.expVerb, test.expResource, "",
+				strconv.Itoa(test.expCode), test.expAuthMethod, "")
+
+			before, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var failuresBefore float64
+			if len(test.expFailure) > 0 {
+				failuresBefore, err = testutil.GetCounterMetricValue(
+					authenticationFailures.WithLabelValues(test.expFailure))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			method := http.MethodPost
+			if len(test.method) > 0 {
+				method = test.method
+			}
+
+			path := "/api/v1/namespaces/default/pods"
+			if len(test.path) > 0 {
+				path = test.path
+			}
+
+			req := httptest.NewRequest(method, path, nil)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", "bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.expCode {
+				t.Errorf("got unexpected response code, exp=%d got=%d", test.expCode, w.Code)
+			}
+
+			after, err := testutil.GetCounterMetricValue(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after-before != 1 {
+				t.Errorf("expected request to be counted once, got=%v", after-before)
+			}
+
+			if len(test.expFailure) > 0 {
+				failuresAfter, err := testutil.GetCounterMetricValue(
+					authenticationFailures.WithLabelValues(test.expFailure))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if failuresAfter-failuresBefore != 1 {
+					t.Errorf("expected authentication failure to be counted once, got=%v",
+						failuresAfter-failuresBefore)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsResource(t *testing.T) {
+	tests := map[string]struct {
+		info *genericapirequest.RequestInfo
+
+		expResource    string
+		expSubresource string
+	}{
+		"a built-in resource should be labelled": {
+			info:        &genericapirequest.RequestInfo{Resource: "deployments"},
+			expResource: "deployments",
+		},
+		"a built-in subresource should be labelled": {
+			info:           &genericapirequest.RequestInfo{Resource: "pods", Subresource: "exec"},
+			expResource:    "pods",
+			expSubresource: "exec",
+		},
+		"an unknown resource should be labelled as other": {
+			info:        &genericapirequest.RequestInfo{Resource: "a1b2c3d4"},
+			expResource: metricsResourceOther,
+		},
+		"an unknown subresource should be labelled as other": {
+			info:           &genericapirequest.RequestInfo{Resource: "pods", Subresource: "a1b2c3d4"},
+			expResource:    "pods",
+			expSubresource: metricsResourceOther,
+		},
+		"a non-resource request should not be labelled": {
+			info: &genericapirequest.RequestInfo{Path: "/healthz"},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			resource, subresource := metricsResource(test.info)
+			if resource != test.expResource || subresource != test.expSubresource {
+				t.Errorf("got unexpected labels, exp=%q/%q got=%q/%q",
+					test.expResource, test.expSubresource, resource, subresource)
+			}
+		})
+	}
+}
+
+func TestResponseWriterDelegator(t *testing.T) {
+	w := httptest.NewRecorder()
+	d := &responseWriterDelegator{ResponseWriter: w}
+
+	if d.Status() != http.StatusOK {
+		t.Errorf("expected status to default to 200, got=%d", d.Status())
+	}
+
+	d.WriteHeader(http.StatusNotFound)
+	d.WriteHeader(http.StatusInternalServerError)
+
+	if d.Status() != http.StatusNotFound {
+		t.Errorf("expected first status code to be recorded, exp=%d got=%d",
+			http.StatusNotFound, d.Status())
+	}
+
+	d.Flush()
+	if !w.Flushed {
+		t.Error("expected flush to be passed to the underlying response writer")
+	}
+
+	if _, _, err := d.Hijack(); err != http.ErrNotSupported {
+		t.Errorf("expected hijack of a response writer which cannot hijack to fail, got=%v", err)
+	}
+}
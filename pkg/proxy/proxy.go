@@ -4,15 +4,22 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
 
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	unionrequest "k8s.io/apiserver/pkg/authentication/request/union"
+	x509request "k8s.io/apiserver/pkg/authentication/request/x509"
+	uniontoken "k8s.io/apiserver/pkg/authentication/token/union"
+	k8sauthorizer "k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
 	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
@@ -21,13 +28,32 @@ import (
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/authorizer"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/cluster"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/hooks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/review"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/upstream"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/userextra"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
 )
 
 const (
 	UserHeaderClientIPKey = "Remote-Client-IP"
+
+	// FrontProxyUIDHeader is the request header used to assert the UID of the
+	// user when acting as a front proxy.
+	FrontProxyUIDHeader = "X-Remote-Uid"
+
+	// Audit annotation keys recording the authenticated and impersonated
+	// identities of user requested impersonation.
+	AuditAuthenticatedUserKey   = "kube-oidc-proxy.jetstack.io/authenticated-user"
+	AuditAuthenticatedGroupsKey = "kube-oidc-proxy.jetstack.io/authenticated-groups"
+	AuditImpersonatedUserKey    = "kube-oidc-proxy.jetstack.io/impersonated-user"
+	AuditImpersonatedGroupsKey  = "kube-oidc-proxy.jetstack.io/impersonated-groups"
 )
 
 var (
@@ -38,6 +64,7 @@ var (
 
 	// http headers are case-insensitive
 	impersonateUserHeader  = strings.ToLower(transport.ImpersonateUserHeader)
+	impersonateUIDHeader   = strings.ToLower(impersonation.ImpersonateUIDHeader)
 	impersonateGroupHeader = strings.ToLower(transport.ImpersonateGroupHeader)
 	impersonateExtraHeader = strings.ToLower(transport.ImpersonateUserExtraHeaderPrefix)
 )
@@ -46,12 +73,68 @@ type Config struct {
 	DisableImpersonation bool
 	TokenReview          bool
 
+	// FrontProxy asserts the identity of requests to the API server using
+	// request headers, authenticating with the front proxy client certificate,
+	// rather than impersonation.
+	FrontProxy               bool
+	FrontProxyClientCertFile string
+	FrontProxyClientKeyFile  string
+
 	FlushInterval   time.Duration
 	ExternalAddress string
 
 	ExtraUserHeaders                map[string][]string
 	ExtraUserHeadersClientIPEnabled bool
 	Authorizer                      bool
+
+	// ExtraUserHeaderTemplates are extra user headers rendered per request
+	// from the token claims and request attributes. May be nil.
+	ExtraUserHeaderTemplates *userextra.Templates
+
+	// ImpersonationPolicy decides whether the authenticated user may
+	// impersonate the identity requested with Impersonate-* headers. If nil,
+	// requests with impersonation headers are rejected.
+	ImpersonationPolicy k8sauthorizer.Authorizer
+
+	SelfSubjectReviewTokenClaims bool
+
+	// RateLimiter rate limits requests of authenticated users, if set.
+	RateLimiter *ratelimit.Limiter
+
+	// TerminateExpiredLongRunning terminates long running requests once the
+	// token that authenticated them expires, or is found to be revoked every
+	// LongRunningReauthenticationInterval, after the grace period.
+	TerminateExpiredLongRunning         bool
+	LongRunningExpiryGracePeriod        time.Duration
+	LongRunningReauthenticationInterval time.Duration
+
+	// InFlightLimiter limits the requests of authenticated users in flight,
+	// if set.
+	InFlightLimiter *inflight.Limiter
+
+	// Upstream configures balancing across multiple endpoints of the default
+	// API server. If no endpoints are given, only the host of the client
+	// configuration is used.
+	Upstream upstream.Options
+
+	// Clusters are upstream clusters requests may be routed to by path prefix
+	// or host name, in addition to the default cluster.
+	Clusters []*cluster.Cluster
+
+	// RequestIDTrustedCIDRs are the networks of front ends whose X-Request-Id
+	// header is used as the ID of the request. Requests from other clients
+	// are given a new ID.
+	RequestIDTrustedCIDRs []*net.IPNet
+
+	// ClientIPTrustedCIDRs are the networks of front ends whose
+	// X-Forwarded-For header is used to find the IP of the client. The IP of
+	// other clients is the source address of the connection.
+	ClientIPTrustedCIDRs []*net.IPNet
+
+	TokenReviewEndpoint              bool
+	TokenReviewEndpointAllowedUsers  []string
+	TokenReviewEndpointAllowedGroups []string
+	TokenReviewEndpointClientCAFile  string
 }
 
 type errorHandlerFn func(http.ResponseWriter, *http.Request, error)
@@ -62,7 +145,15 @@ type Proxy struct {
 	tokenReviewer     *tokenreview.TokenReview
 	secureServingInfo *server.SecureServingInfo
 	auditor           *audit.Audit
-	authorizer        *authorizer.OPAAuthorizer
+	authorizer        authorizer.Interface
+
+	tokenReviewEndpoint http.Handler
+	selfSubjectReview   http.Handler
+
+	clusterRouter    *cluster.Router
+	clusterUpstreams map[string]*clusterUpstream
+
+	upstreamPool *upstream.Pool
 
 	restConfig            *rest.Config
 	clientTransport       http.RoundTripper
@@ -78,9 +169,11 @@ func New(restConfig *rest.Config,
 	oidcOptions *options.OIDCAuthenticationOptions,
 	auditOptions *options.AuditOptions,
 	tokenReviewer *tokenreview.TokenReview,
-	ssinfo *server.SecureServingInfo, authz *authorizer.OPAAuthorizer,
+	ssinfo *server.SecureServingInfo, authz authorizer.Interface,
 	config *Config) (*Proxy, error) {
 
+	registerMetrics()
+
 	// generate tokenAuther from oidc config
 	tokenAuther, err := oidc.New(oidc.Options{
 		CAFile:               oidcOptions.CAFile,
@@ -97,21 +190,91 @@ func New(restConfig *rest.Config,
 		return nil, err
 	}
 
+	var tokenAutherWithUID authenticator.Token = tokenAuther
+	if len(oidcOptions.UIDClaim) > 0 {
+		tokenAutherWithUID = newUIDClaimAuthenticator(tokenAuther, oidcOptions.UIDClaim)
+	}
+
 	auditor, err := audit.New(auditOptions, config.ExternalAddress, ssinfo)
 	if err != nil {
 		return nil, err
 	}
-	return &Proxy{
+	p := &Proxy{
 		restConfig:        restConfig,
 		hooks:             hooks.New(),
 		tokenReviewer:     tokenReviewer,
 		secureServingInfo: ssinfo,
 		config:            config,
-		oidcRequestAuther: bearertoken.New(tokenAuther),
-		tokenAuther:       tokenAuther,
+		oidcRequestAuther: bearertoken.New(tokenAutherWithUID),
+		tokenAuther:       tokenAutherWithUID,
 		auditor:           auditor,
 		authorizer:        authz,
-	}, nil
+		selfSubjectReview: review.NewSelfSubjectReview(config.SelfSubjectReviewTokenClaims),
+	}
+
+	if config.TokenReviewEndpoint {
+		p.tokenReviewEndpoint, err = p.newTokenReviewEndpoint()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.Clusters) > 0 {
+		p.clusterRouter, err = cluster.NewRouter(config.Clusters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.Upstream.Endpoints) > 0 {
+		p.upstreamPool, err = upstream.NewPool(config.Upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// newTokenReviewEndpoint builds the handler serving the TokenReview API.
+// Tokens are reviewed with the same authenticators used to proxy requests.
+func (p *Proxy) newTokenReviewEndpoint() (http.Handler, error) {
+	tokenAuthers := []authenticator.Token{p.tokenAuther}
+	if p.config.TokenReview && p.tokenReviewer != nil {
+		tokenAuthers = append(tokenAuthers, p.tokenReviewer)
+	}
+
+	callerAuthers := []authenticator.Request{p.oidcRequestAuther}
+
+	// If a client CA is given, then require clients to present a certificate
+	// and authenticate them using it.
+	if len(p.config.TokenReviewEndpointClientCAFile) > 0 {
+		clientCA, err := dynamiccertificates.NewDynamicCAContentFromFile(
+			"token-review-endpoint-client-ca", p.config.TokenReviewEndpointClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token review endpoint client CA: %s", err)
+		}
+
+		if p.secureServingInfo != nil {
+			if p.secureServingInfo.ClientCA == nil {
+				p.secureServingInfo.ClientCA = clientCA
+			} else {
+				p.secureServingInfo.ClientCA = dynamiccertificates.NewUnionCAContentProvider(
+					p.secureServingInfo.ClientCA, clientCA)
+			}
+		}
+
+		callerAuthers = append([]authenticator.Request{
+			x509request.NewDynamic(clientCA.VerifyOptions, x509request.CommonNameUserConversion),
+		}, callerAuthers...)
+	}
+
+	return review.NewTokenReview(
+		unionrequest.New(callerAuthers...),
+		uniontoken.New(tokenAuthers...),
+		p.config.TokenReviewEndpointAllowedUsers,
+		p.config.TokenReviewEndpointAllowedGroups,
+	), nil
 }
 
 func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
@@ -122,6 +285,27 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	}
 	p.clientTransport = clientRT
 
+	// Front proxy round tripper authenticates with the front proxy client
+	// certificate instead of the proxy's credentials.
+	if p.config.FrontProxy {
+		frontProxyClientRT, err := p.roundTripperForRestConfig(&rest.Config{
+			APIPath: p.restConfig.APIPath,
+			Host:    p.restConfig.Host,
+			Timeout: p.restConfig.Timeout,
+			TLSClientConfig: rest.TLSClientConfig{
+				CAFile:   p.restConfig.CAFile,
+				CAData:   p.restConfig.CAData,
+				CertFile: p.config.FrontProxyClientCertFile,
+				KeyFile:  p.config.FrontProxyClientKeyFile,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		p.clientTransport = frontProxyClientRT
+	}
+
 	// No auth round tripper for no impersonation
 	if p.config.DisableImpersonation || p.config.TokenReview {
 		noAuthClientRT, err := p.roundTripperForRestConfig(&rest.Config{
@@ -140,6 +324,16 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 		p.noAuthClientTransport = noAuthClientRT
 	}
 
+	// Balance requests across the API server endpoints, if given.
+	if p.upstreamPool != nil {
+		p.clientTransport = p.upstreamPool.RoundTripper(p.clientTransport)
+		if p.noAuthClientTransport != nil {
+			p.noAuthClientTransport = p.upstreamPool.RoundTripper(p.noAuthClientTransport)
+		}
+
+		p.upstreamPool.RunHealthChecks(clientRT, stopCh)
+	}
+
 	// get API server url
 	url, err := url.Parse(p.restConfig.Host)
 	if err != nil {
@@ -154,6 +348,13 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	proxyHandler.ErrorHandler = p.handleError
 	proxyHandler.FlushInterval = p.config.FlushInterval
 
+	if p.clusterRouter != nil {
+		p.clusterUpstreams, err = p.newClusterUpstreams()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	waitCh, err := p.serve(proxyHandler, stopCh)
 	if err != nil {
 		return nil, err
@@ -182,15 +383,47 @@ func (p *Proxy) serve(handler http.Handler, stopCh <-chan struct{}) (<-chan stru
 
 // RoundTrip is called last and is used to manipulate the forwarded request using context.
 func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, span := startUpstreamSpan(req)
+	resp, err := p.roundTrip(req)
+	endUpstreamSpan(span, resp, err)
+	if err != nil {
+		if err != errNoImpersonationConfig {
+			upstreamErrors.WithLabelValues(context.ClusterName(req)).Inc()
+		}
+		return nil, err
+	}
+
+	// The Audit-ID the API server responds with is the ID of the request,
+	// which has already been set on the response.
+	if resp != nil && len(context.RequestID(req)) > 0 {
+		resp.Header.Del(auditinternal.HeaderAuditID)
+	}
+
+	// Long running requests are ended once their session is terminated.
+	if s := context.Session(req); s != nil {
+		s.WrapResponse(resp)
+	}
+
+	return resp, nil
+}
+
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
 	// Here we have successfully authenticated so now need to determine whether
 	// we need use impersonation or not.
 
 	// If no impersonation then we return here without setting impersonation
 	// header but re-introduce the token we removed.
+	clientTransport, noAuthClientTransport := p.clientTransport, p.noAuthClientTransport
+	frontProxy := p.config.FrontProxy
+	if u := p.clusterUpstream(req); u != nil {
+		clientTransport, noAuthClientTransport = u.clientTransport, u.noAuthClientTransport
+		frontProxy = false
+	}
+
 	if context.NoImpersonation(req) {
 		token := context.BearerToken(req)
 		req.Header.Add("Authorization", token)
-		return p.noAuthClientTransport.RoundTrip(req)
+		return noAuthClientTransport.RoundTrip(req)
 	}
 
 	// Get the impersonation headers from the context.
@@ -199,8 +432,25 @@ func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, errNoImpersonationConfig
 	}
 
+	// Assert the identity using request headers when acting as a front proxy.
+	// Any request headers sent by the client are replaced.
+	if frontProxy {
+		req.Header.Del(FrontProxyUIDHeader)
+		if uid := context.ImpersonationUID(req); len(uid) > 0 {
+			req.Header.Set(FrontProxyUIDHeader, uid)
+		}
+
+		rt := transport.NewAuthProxyRoundTripper(conf.UserName, conf.Groups, conf.Extra, clientTransport)
+		return rt.RoundTrip(req)
+	}
+
+	// client-go does not support impersonating UIDs so set the header here.
+	if uid := context.ImpersonationUID(req); len(uid) > 0 {
+		req.Header.Set(impersonation.ImpersonateUIDHeader, uid)
+	}
+
 	// Set up impersonation request.
-	rt := transport.NewImpersonatingRoundTripper(*conf, p.clientTransport)
+	rt := transport.NewImpersonatingRoundTripper(*conf, clientTransport)
 
 	// Push request through round trippers to the API server.
 	return rt.RoundTrip(req)
@@ -210,19 +460,23 @@ func (p *Proxy) reviewToken(rw http.ResponseWriter, req *http.Request) bool {
 	var remoteAddr string
 	req, remoteAddr = context.RemoteAddr(req)
 
-	klog.V(4).Infof("attempting to validate a token in request using TokenReview endpoint(%s)",
-		remoteAddr)
+	klog.V(4).Infof("[%s] attempting to validate a token in request using TokenReview endpoint(%s)",
+		context.RequestID(req), remoteAddr)
 
-	ok, err := p.tokenReviewer.Review(req)
+	ctx, span := tracing.Start(req.Context(), "tokenreview")
+	ok, err := p.tokenReviewer.Review(req.WithContext(ctx))
+	endSpan(span, err)
 	if err != nil {
-		klog.Errorf("unable to authenticate the request via TokenReview due to an error (%s): %s",
-			remoteAddr, err)
+		authenticationFailures.WithLabelValues(authFailureTokenReviewError).Inc()
+		klog.Errorf("[%s] unable to authenticate the request via TokenReview due to an error (%s): %s",
+			context.RequestID(req), remoteAddr, err)
 		return false
 	}
 
 	if !ok {
-		klog.V(4).Infof("passing request with valid token through (%s)",
-			remoteAddr)
+		authenticationFailures.WithLabelValues(authFailureTokenReviewDenied).Inc()
+		klog.V(4).Infof("[%s] passing request with valid token through (%s)",
+			context.RequestID(req), remoteAddr)
 
 		return false
 	}
@@ -3,6 +3,7 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -15,15 +16,23 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/transport"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/mocks"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/cluster"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/hooks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/review"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/userextra"
 )
 
 type fakeProxy struct {
@@ -43,6 +52,7 @@ type fakeRT struct {
 	t *testing.T
 
 	expUser  string
+	expUID   string
 	expGroup []string
 	expExtra map[string][]string
 }
@@ -79,6 +89,11 @@ func (f *fakeRT) RoundTrip(h *http.Request) (*http.Response, error) {
 			f.expUser, h.Header.Get("Impersonate-User"))
 	}
 
+	if h.Header.Get("Impersonate-Uid") != f.expUID {
+		f.t.Errorf("client transport got unexpected uid impersonation header, exp=%s got=%s",
+			f.expUID, h.Header.Get("Impersonate-Uid"))
+	}
+
 	if exp, act := sort.StringSlice(f.expGroup), sort.StringSlice(h.Header["Impersonate-Group"]); !reflect.DeepEqual(exp, act) {
 		f.t.Errorf(
 			"client transport got unexpected group impersonation header, exp=%#v got=%#v",
@@ -211,6 +226,9 @@ func TestHasImpersonation(t *testing.T) {
 		{
 			"impersonate-group": nil,
 		},
+		{
+			"Impersonate-Uid": []string{"1234"},
+		},
 		{
 			"impersonate-Group": []string{"bar", "foo"},
 		},
@@ -284,6 +302,21 @@ func newTestProxy(t *testing.T) *fakeProxy {
 	return p
 }
 
+var testImpersonationPolicy = &impersonation.StaticPolicy{
+	Rules: []impersonation.Rule{
+		{
+			Users:         []string{"a-user"},
+			Resources:     []string{"users", "groups", "uids"},
+			ResourceNames: []string{"b-*"},
+		},
+		{
+			Users:         []string{"a-user"},
+			Resources:     []string{"userextras"},
+			ResourceNames: []string{"foo=a"},
+		},
+	},
+}
+
 func TestHandlers(t *testing.T) {
 	type authResponse struct {
 		resp *authenticator.Response
@@ -302,6 +335,7 @@ func TestHandlers(t *testing.T) {
 		expBody string
 
 		expUser  string
+		expUID   string
 		expGroup []string
 		expExtra map[string][]string
 	}{
@@ -534,6 +568,167 @@ func TestHandlers(t *testing.T) {
 			expGroup: nil,
 			expExtra: nil,
 		},
+		"an authed request with user uid should impersonate the uid and 200": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user", UID: "1234"},
+				},
+				pass: true,
+				err:  nil,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expUID:   "1234",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request with uid impersonation but no policy should 403": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":   []string{"bearer fake-token"},
+					"Impersonate-Uid": []string{"5678"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user", UID: "1234"},
+				},
+				pass: true,
+				err:  nil,
+			},
+			expCode: http.StatusForbidden,
+			expBody: "Impersonation requests are disabled when using kube-oidc-proxy",
+		},
+		"an authed request with uid impersonation not allowed by the policy should 403": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":    []string{"bearer fake-token"},
+					"Impersonate-User": []string{"b-user"},
+					"Impersonate-Uid":  []string{"5678"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user", UID: "1234"},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationPolicy: testImpersonationPolicy,
+			},
+			expCode: http.StatusForbidden,
+			expBody: `user "a-user" is not allowed to impersonate uids "5678": no impersonation policy rule matched`,
+		},
+		"an authed request with uid impersonation allowed by the policy should impersonate the requested uid and 200": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":    []string{"bearer fake-token"},
+					"Impersonate-User": []string{"b-user"},
+					"Impersonate-Uid":  []string{"b-5678"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user", UID: "1234"},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationPolicy: testImpersonationPolicy,
+			},
+			expCode: http.StatusOK,
+			expBody: "",
+			expUser: "b-user",
+			expUID:  "b-5678",
+		},
+		"an authed request with impersonation allowed by the policy should impersonate the requested user and 200": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":         []string{"bearer fake-token"},
+					"Impersonate-User":      []string{"b-user"},
+					"Impersonate-Group":     []string{"b-group"},
+					"Impersonate-Extra-Foo": []string{"a"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name:   "a-user",
+						Groups: []string{"my-group"},
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationPolicy: testImpersonationPolicy,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "b-user",
+			expGroup: []string{"b-group"},
+			expExtra: map[string][]string{
+				"Impersonate-Extra-Foo": []string{"a"},
+			},
+		},
+		"an authed request with impersonation not allowed by the policy should 403": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":     []string{"bearer fake-token"},
+					"Impersonate-User":  []string{"b-user"},
+					"Impersonate-Group": []string{"system:masters"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name:   "a-user",
+						Groups: []string{"my-group"},
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationPolicy: testImpersonationPolicy,
+			},
+			expCode: http.StatusForbidden,
+			expBody: `user "a-user" is not allowed to impersonate groups "system:masters": no impersonation policy rule matched`,
+		},
+		"an authed request with impersonation of a group without a user should 400": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":     []string{"bearer fake-token"},
+					"Impersonate-Group": []string{"b-group"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user"},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationPolicy: testImpersonationPolicy,
+			},
+			expCode: http.StatusBadRequest,
+			expBody: "Impersonate-User header is required to impersonate groups or extra",
+		},
 	}
 
 	for name, test := range tests {
@@ -548,6 +743,7 @@ func TestHandlers(t *testing.T) {
 			}
 
 			p.fakeRT.expUser = test.expUser
+			p.fakeRT.expUID = test.expUID
 			p.fakeRT.expGroup = test.expGroup
 			p.fakeRT.expExtra = test.expExtra
 
@@ -642,6 +838,22 @@ func TestHeadersConfig(t *testing.T) {
 				"Impersonate-Extra-Remote-Client-Ip": []string{"8.8.8.8"},
 			},
 		},
+		"if extra header templates set then should return rendered extras, omitting missing claims": {
+			config: &Config{
+				ExtraUserHeaders: map[string][]string{
+					"foo": []string{"a"},
+				},
+				ExtraUserHeaderTemplates: mustUserExtraTemplates(t, map[string][]string{
+					"foo":        []string{"{{ .User.Name }}"},
+					"client":     []string{"{{ .Request.RemoteAddr }}"},
+					"department": []string{"{{ .Claims.department }}"},
+				}),
+			},
+			expExtra: map[string][]string{
+				"Impersonate-Extra-Foo":    []string{"a", "a-user"},
+				"Impersonate-Extra-Client": []string{"8.8.8.8"},
+			},
+		},
 	}
 
 	for name, test := range tests {
@@ -690,3 +902,228 @@ func TestHeadersConfig(t *testing.T) {
 		})
 	}
 }
+
+func mustUserExtraTemplates(t *testing.T, templates map[string][]string) *userextra.Templates {
+	tmpls, err := userextra.New(templates)
+	if err != nil {
+		t.Fatalf("failed to parse extra user header templates: %s", err)
+	}
+	return tmpls
+}
+
+func TestSelfSubjectReview(t *testing.T) {
+	p := newTestProxy(t)
+	p.config = &Config{
+		ExtraUserHeaders: map[string][]string{
+			"foo": []string{"a", "b"},
+		},
+	}
+	p.selfSubjectReview = review.NewSelfSubjectReview(false)
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(
+		&authenticator.Response{
+			User: &user.DefaultInfo{
+				Name:   "a-user",
+				Groups: []string{"my-group"},
+			},
+		}, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("self subject review should not be proxied to the API server")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/apis/authentication.k8s.io/v1/selfsubjectreviews", nil)
+	req.Header.Set("Authorization", "bearer fake-token")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got unexpected response code, exp=%d got=%d (%s)",
+			http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var ssr review.SelfSubjectReviewObject
+	if err := json.Unmarshal(w.Body.Bytes(), &ssr); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	expUser := authv1.UserInfo{
+		Username: "a-user",
+		Groups:   []string{"my-group", user.AllAuthenticated},
+		Extra: map[string]authv1.ExtraValue{
+			"foo": []string{"a", "b"},
+		},
+	}
+	if !reflect.DeepEqual(expUser, ssr.Status.UserInfo) {
+		t.Errorf("got unexpected user info, exp=%#v got=%#v", expUser, ssr.Status.UserInfo)
+	}
+
+	p.ctrl.Finish()
+}
+
+type recordRT struct {
+	req *http.Request
+}
+
+func (r *recordRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.req = req
+	return nil, nil
+}
+
+func TestFrontProxyRoundTrip(t *testing.T) {
+	rt := new(recordRT)
+	p := &Proxy{
+		clientTransport: rt,
+		config: &Config{
+			FrontProxy: true,
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	req.Header = http.Header{
+		"X-Remote-User":      []string{"system:admin"},
+		"X-Remote-Uid":       []string{"0"},
+		"X-Remote-Group":     []string{"system:masters"},
+		"X-Remote-Extra-Foo": []string{"bar"},
+	}
+	req = context.WithImpersonationConfig(req, &transport.ImpersonationConfig{
+		UserName: "a-user",
+		Groups:   []string{"my-group", user.AllAuthenticated},
+		Extra: map[string][]string{
+			"remote-client-ip": []string{"8.8.8.8"},
+		},
+	})
+	req = context.WithImpersonationUID(req, "1234")
+
+	if _, err := p.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := http.Header{
+		"X-Remote-User":                   []string{"a-user"},
+		"X-Remote-Uid":                    []string{"1234"},
+		"X-Remote-Group":                  []string{"my-group", user.AllAuthenticated},
+		"X-Remote-Extra-Remote-Client-Ip": []string{"8.8.8.8"},
+	}
+	if !reflect.DeepEqual(exp, rt.req.Header) {
+		t.Errorf("got unexpected front proxy headers, exp=%#v got=%#v", exp, rt.req.Header)
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	p := newTestProxy(t)
+
+	devRT := new(recordRT)
+	var devPath string
+
+	clusters := []*cluster.Cluster{{Name: "dev"}}
+	router, err := cluster.NewRouter(clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clusterRouter = router
+	p.clusterUpstreams = map[string]*clusterUpstream{
+		"dev": {
+			cluster: clusters[0],
+			handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				devPath = req.URL.Path
+				if _, err := p.RoundTrip(req); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}),
+			clientTransport: devRT,
+		},
+	}
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("request routed to a cluster should not be sent to the default cluster")
+	}))
+
+	// A request to an unknown cluster should 404 before authentication.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clusters/prod/api/v1/pods", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got unexpected response code for unknown cluster, exp=%d got=%d",
+			http.StatusNotFound, w.Code)
+	}
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(
+		&authenticator.Response{
+			User: &user.DefaultInfo{Name: "a-user"},
+		}, true, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/clusters/dev/api/v1/pods", nil)
+	req.Header.Set("Authorization", "bearer fake-token")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if devPath != "/api/v1/pods" {
+		t.Errorf("got unexpected path routed to cluster, exp=%s got=%s", "/api/v1/pods", devPath)
+	}
+
+	if devRT.req == nil {
+		t.Fatal("expected request to be sent with the cluster transport")
+	}
+
+	if user := devRT.req.Header.Get("Impersonate-User"); user != "a-user" {
+		t.Errorf("got unexpected impersonated user, exp=a-user got=%s", user)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestRateLimit(t *testing.T) {
+	p := newTestProxy(t)
+
+	limiter, err := ratelimit.New(ratelimit.Options{
+		Key:    ratelimit.KeyUser,
+		Limits: map[ratelimit.Class]ratelimit.Limit{ratelimit.Read: {QPS: 0.1, Burst: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.config.RateLimiter = limiter
+
+	var served int
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		served++
+	}))
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(
+		&authenticator.Response{
+			User: &user.DefaultInfo{Name: "a-user"},
+		}, true, nil).Times(2)
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods", nil)
+		req.Header.Set("Authorization", "bearer fake-token")
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+	}
+
+	if served != 1 {
+		t.Errorf("expected only the first request to be served, got=%d", served)
+	}
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got unexpected response code, exp=%d got=%d", http.StatusTooManyRequests, w.Code)
+	}
+
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("got unexpected Retry-After, exp=10 got=%s", retryAfter)
+	}
+
+	var status map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode status response: %s", err)
+	}
+	if status["kind"] != "Status" || status["reason"] != "TooManyRequests" {
+		t.Errorf("got unexpected status response: %s", w.Body.String())
+	}
+
+	p.ctrl.Finish()
+}
@@ -0,0 +1,61 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
+)
+
+// withRateLimit rejects requests of authenticated users over their rate limit.
+func (p *Proxy) withRateLimit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u, ok := genericapirequest.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		info, _ := genericapirequest.RequestInfoFrom(req.Context())
+		class := ratelimit.ClassOf(info, req.Method)
+
+		ctx, span := tracing.Start(req.Context(), "ratelimit")
+		err := p.config.RateLimiter.Wait(ctx, class, u, context.ClientIP(req))
+		endSpan(span, err)
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// writeStatus writes the Kubernetes Status to the response, setting the
+// Retry-After header if the status has a retry delay.
+func writeStatus(rw http.ResponseWriter, status metav1.Status) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		klog.Errorf("failed to encode status response: %s", err)
+		http.Error(rw, "", http.StatusInternalServerError)
+		return
+	}
+
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(int(status.Code))
+	if _, err := rw.Write(body); err != nil {
+		klog.Errorf("failed to write status response: %s", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// fairQueue admits requests at the rate of a shared token bucket. Requests
+// over the rate are queued per flow, and flows are dispatched in turn so that
+// one flow with many requests cannot starve others, similar to API Priority
+// and Fairness.
+type fairQueue struct {
+	limiter *rate.Limiter
+	length  int
+
+	mu          sync.Mutex
+	flows       map[string][]*waiter
+	order       []string
+	queued      int
+	dispatching bool
+}
+
+type waiter struct {
+	ready chan struct{}
+}
+
+func newFairQueue(limit Limit, length int) *fairQueue {
+	return &fairQueue{
+		limiter: rate.NewLimiter(rate.Limit(limit.QPS), limit.Burst),
+		length:  length,
+		flows:   make(map[string][]*waiter),
+	}
+}
+
+// wait returns once the request of the flow is dispatched, or a RejectedError
+// if the queue of the flow is full or the request is not dispatched within
+// the timeout.
+func (q *fairQueue) wait(ctx context.Context, class Class, flow string, timeout time.Duration) error {
+	q.mu.Lock()
+
+	if q.queued == 0 && q.limiter.Allow() {
+		q.mu.Unlock()
+		return nil
+	}
+
+	if len(q.flows[flow]) >= q.length {
+		err := q.rejected(class)
+		q.mu.Unlock()
+		return err
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	if len(q.flows[flow]) == 0 {
+		q.order = append(q.order, flow)
+	}
+	q.flows[flow] = append(q.flows[flow], w)
+	q.queued++
+
+	if !q.dispatching {
+		q.dispatching = true
+		go q.dispatch()
+	}
+
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The request may have been dispatched while acquiring the lock.
+	select {
+	case <-w.ready:
+		return nil
+	default:
+	}
+
+	q.remove(flow, w)
+
+	return q.rejected(class)
+}
+
+// dispatch admits queued requests as tokens become available, taking the next
+// request from each flow in turn, until the queue is empty.
+func (q *fairQueue) dispatch() {
+	for {
+		r := q.limiter.Reserve()
+		time.Sleep(r.Delay())
+
+		q.mu.Lock()
+
+		if q.queued == 0 {
+			q.dispatching = false
+			q.mu.Unlock()
+			return
+		}
+
+		flow := q.order[0]
+		q.order = q.order[1:]
+
+		ws := q.flows[flow]
+		w := ws[0]
+		if len(ws) > 1 {
+			q.flows[flow] = ws[1:]
+			q.order = append(q.order, flow)
+		} else {
+			delete(q.flows, flow)
+		}
+		q.queued--
+
+		close(w.ready)
+
+		q.mu.Unlock()
+	}
+}
+
+// remove removes a waiter which has given up from the queue of its flow.
+func (q *fairQueue) remove(flow string, w *waiter) {
+	ws := q.flows[flow]
+	for i := range ws {
+		if ws[i] != w {
+			continue
+		}
+
+		ws = append(ws[:i], ws[i+1:]...)
+		q.queued--
+		break
+	}
+
+	if len(ws) > 0 {
+		q.flows[flow] = ws
+		return
+	}
+
+	delete(q.flows, flow)
+	for i := range q.order {
+		if q.order[i] == flow {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// rejected returns the error for a rejected request, estimating when to retry
+// from the number of queued requests.
+func (q *fairQueue) rejected(class Class) error {
+	retryAfter := time.Duration(float64(q.queued+1) / float64(q.limiter.Limit()) * float64(time.Second))
+
+	return &RejectedError{
+		Class:      class,
+		RetryAfter: retryAfter,
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// Class is the class of verb a request is rate limited by.
+type Class string
+
+const (
+	Read  Class = "read"
+	Write Class = "write"
+	Watch Class = "watch"
+	Exec  Class = "exec"
+)
+
+// Classes are all verb classes.
+var Classes = []Class{Read, Write, Watch, Exec}
+
+const (
+	// KeyUser limits each authenticated user by username.
+	KeyUser = "user"
+
+	// KeyGroup limits each group of the authenticated user. A request must be
+	// allowed by the limits of all of the user's groups.
+	KeyGroup = "group"
+
+	// KeyIP limits each client source IP.
+	KeyIP = "ip"
+)
+
+const (
+	// gcInterval is the interval idle token buckets are removed.
+	gcInterval = time.Minute
+)
+
+// ClassOf returns the verb class of a request.
+func ClassOf(info *request.RequestInfo, method string) Class {
+	if info == nil || !info.IsResourceRequest {
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return Read
+		default:
+			return Write
+		}
+	}
+
+	switch info.Subresource {
+	case "exec", "attach", "portforward":
+		return Exec
+	}
+
+	switch info.Verb {
+	case "watch":
+		return Watch
+	case "get", "list":
+		return Read
+	default:
+		return Write
+	}
+}
+
+// Limit is a token bucket rate limit.
+type Limit struct {
+	QPS   float64
+	Burst int
+}
+
+// ParseLimits parses the queries per second and burst of each verb class. If
+// no burst is given for a class, the burst is the QPS rounded up.
+func ParseLimits(qps, burst map[string]string) (map[Class]Limit, error) {
+	limits := make(map[Class]Limit)
+
+	for c, v := range qps {
+		class, err := parseClass(c)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := strconv.ParseFloat(v, 64)
+		if err != nil || q <= 0 {
+			return nil, fmt.Errorf("invalid rate limit QPS %q for %q, must be a positive number", v, c)
+		}
+
+		limits[class] = Limit{
+			QPS:   q,
+			Burst: int(math.Ceil(q)),
+		}
+	}
+
+	for c, v := range burst {
+		class, err := parseClass(c)
+		if err != nil {
+			return nil, err
+		}
+
+		limit, ok := limits[class]
+		if !ok {
+			return nil, fmt.Errorf("rate limit burst given for %q without a QPS", c)
+		}
+
+		b, err := strconv.Atoi(v)
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid rate limit burst %q for %q, must be a positive integer", v, c)
+		}
+
+		limit.Burst = b
+		limits[class] = limit
+	}
+
+	return limits, nil
+}
+
+func parseClass(s string) (Class, error) {
+	for _, c := range Classes {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown rate limit verb class %q, must be one of %v", s, Classes)
+}
+
+// Options configure a Limiter.
+type Options struct {
+	// Key is what requests are limited by, one of KeyUser, KeyGroup or KeyIP.
+	Key string
+
+	// Limits are the token bucket limits of each key, per verb class.
+	Limits map[Class]Limit
+
+	// TotalLimits are the limits shared by all keys, per verb class. Requests
+	// over the limit are queued, and dispatched fairly between keys.
+	TotalLimits map[Class]Limit
+
+	// QueueLength is the maximum number of requests of a key that may be
+	// queued per verb class.
+	QueueLength int
+
+	// QueueTimeout is the maximum time a request is queued for.
+	QueueTimeout time.Duration
+}
+
+// RejectedError is returned when a request is rate limited.
+type RejectedError struct {
+	Class      Class
+	RetryAfter time.Duration
+}
+
+func (r *RejectedError) Error() string {
+	return fmt.Sprintf("too many %s requests, retry after %s", r.Class, r.RetryAfter)
+}
+
+// Status returns the Kubernetes Status of the error, as a 429 with the number
+// of seconds to retry after.
+func (r *RejectedError) Status() metav1.Status {
+	seconds := int(math.Ceil(r.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	status := apierrors.NewTooManyRequests(
+		fmt.Sprintf("Too many %s requests, please try again later.", r.Class), seconds).Status()
+	status.TypeMeta = metav1.TypeMeta{
+		Kind:       "Status",
+		APIVersion: "v1",
+	}
+
+	return status
+}
+
+// bucket is the token bucket of a key.
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter rate limits requests by user, group or source IP.
+type Limiter struct {
+	opts Options
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	lastGC  time.Time
+
+	queues map[Class]*fairQueue
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// New returns a rate limiter with the given options.
+func New(opts Options) (*Limiter, error) {
+	switch opts.Key {
+	case KeyUser, KeyGroup, KeyIP:
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q, must be one of %q, %q or %q",
+			opts.Key, KeyUser, KeyGroup, KeyIP)
+	}
+
+	if len(opts.TotalLimits) > 0 && opts.QueueLength < 0 {
+		return nil, fmt.Errorf("rate limit queue length must not be negative, got=%d", opts.QueueLength)
+	}
+
+	l := &Limiter{
+		opts:    opts,
+		buckets: make(map[string]*bucket),
+		queues:  make(map[Class]*fairQueue),
+		now:     time.Now,
+	}
+
+	for class, limit := range opts.TotalLimits {
+		l.queues[class] = newFairQueue(limit, opts.QueueLength)
+	}
+
+	return l, nil
+}
+
+// keys returns the keys a request of the user and remote address is limited
+// by. Requests from the same IP are limited together regardless of their port.
+func (l *Limiter) keys(u user.Info, remoteAddr string) []string {
+	switch l.opts.Key {
+	case KeyIP:
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			return []string{host}
+		}
+		return []string{remoteAddr}
+
+	case KeyGroup:
+		var groups []string
+		for _, g := range u.GetGroups() {
+			// Every authenticated user is a member of this group so limiting it
+			// would be a global limit.
+			if g != user.AllAuthenticated {
+				groups = append(groups, "group:"+g)
+			}
+		}
+
+		if len(groups) > 0 {
+			sort.Strings(groups)
+			return groups
+		}
+	}
+
+	return []string{"user:" + u.GetName()}
+}
+
+// Wait returns nil if the request is allowed, waiting in the fair queue of
+// the verb class if it is over the total limit. If the request is rate
+// limited, a RejectedError is returned.
+func (l *Limiter) Wait(ctx context.Context, class Class, u user.Info, remoteAddr string) error {
+	keys := l.keys(u, remoteAddr)
+
+	if err := l.reserve(class, keys); err != nil {
+		return err
+	}
+
+	if q, ok := l.queues[class]; ok {
+		return q.wait(ctx, class, strings.Join(keys, ","), l.opts.QueueTimeout)
+	}
+
+	return nil
+}
+
+// reserve takes a token from the bucket of each key. If any bucket is empty,
+// no tokens are taken and the request is rejected.
+func (l *Limiter) reserve(class Class, keys []string) error {
+	limit, ok := l.opts.Limits[class]
+	if !ok {
+		return nil
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gc(now)
+
+	var (
+		reservations []*rate.Reservation
+		delay        time.Duration
+	)
+
+	for _, key := range keys {
+		name := string(class) + "/" + key
+
+		b, ok := l.buckets[name]
+		if !ok {
+			b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.QPS), limit.Burst)}
+			l.buckets[name] = b
+		}
+		b.lastSeen = now
+
+		r := b.limiter.ReserveN(now, 1)
+		reservations = append(reservations, r)
+
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+
+		return &RejectedError{
+			Class:      class,
+			RetryAfter: delay,
+		}
+	}
+
+	return nil
+}
+
+// gc removes buckets which have been idle long enough to have refilled.
+func (l *Limiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < gcInterval {
+		return
+	}
+	l.lastGC = now
+
+	for name, b := range l.buckets {
+		limit := b.limiter.Limit()
+		refill := time.Duration(float64(b.limiter.Burst()) / float64(limit) * float64(time.Second))
+
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, name)
+		}
+	}
+}
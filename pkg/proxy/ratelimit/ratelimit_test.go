@@ -0,0 +1,288 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func TestClassOf(t *testing.T) {
+	tests := map[string]struct {
+		info   *request.RequestInfo
+		method string
+		exp    Class
+	}{
+		"a non resource GET should be a read": {
+			info:   &request.RequestInfo{Verb: "get"},
+			method: "GET",
+			exp:    Read,
+		},
+		"a non resource POST should be a write": {
+			info:   &request.RequestInfo{Verb: "post"},
+			method: "POST",
+			exp:    Write,
+		},
+		"a list should be a read": {
+			info:   &request.RequestInfo{IsResourceRequest: true, Verb: "list"},
+			method: "GET",
+			exp:    Read,
+		},
+		"a watch should be a watch": {
+			info:   &request.RequestInfo{IsResourceRequest: true, Verb: "watch"},
+			method: "GET",
+			exp:    Watch,
+		},
+		"a delete should be a write": {
+			info:   &request.RequestInfo{IsResourceRequest: true, Verb: "delete"},
+			method: "DELETE",
+			exp:    Write,
+		},
+		"an exec should be an exec": {
+			info:   &request.RequestInfo{IsResourceRequest: true, Verb: "create", Subresource: "exec"},
+			method: "POST",
+			exp:    Exec,
+		},
+		"a port forward should be an exec": {
+			info:   &request.RequestInfo{IsResourceRequest: true, Verb: "get", Subresource: "portforward"},
+			method: "GET",
+			exp:    Exec,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if class := ClassOf(test.info, test.method); class != test.exp {
+				t.Errorf("got unexpected class, exp=%s got=%s", test.exp, class)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits(
+		map[string]string{"read": "2.5", "write": "10"},
+		map[string]string{"write": "20"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if l := limits[Read]; l.QPS != 2.5 || l.Burst != 3 {
+		t.Errorf("got unexpected read limit: %+v", l)
+	}
+	if l := limits[Write]; l.QPS != 10 || l.Burst != 20 {
+		t.Errorf("got unexpected write limit: %+v", l)
+	}
+
+	for name, test := range map[string][2]map[string]string{
+		"unknown class":        {{"list": "1"}, nil},
+		"invalid qps":          {{"read": "fast"}, nil},
+		"zero qps":             {{"read": "0"}, nil},
+		"burst without qps":    {{"read": "1"}, {"write": "1"}},
+		"negative burst value": {{"read": "1"}, {"read": "-1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseLimits(test[0], test[1]); err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestWaitPerKey(t *testing.T) {
+	now := time.Now()
+
+	l, err := New(Options{
+		Key:    KeyUser,
+		Limits: map[Class]Limit{Write: {QPS: 1, Burst: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(context.TODO(), Write, alice, ""); err != nil {
+			t.Fatalf("unexpected error within burst: %s", err)
+		}
+	}
+
+	err = l.Wait(context.TODO(), Write, alice, "")
+	rejected, ok := err.(*RejectedError)
+	if !ok {
+		t.Fatalf("expected rejected error, got=%v", err)
+	}
+	if rejected.RetryAfter != time.Second {
+		t.Errorf("got unexpected retry after, exp=%s got=%s", time.Second, rejected.RetryAfter)
+	}
+
+	status := rejected.Status()
+	if status.Code != 429 || status.Details == nil || status.Details.RetryAfterSeconds != 1 {
+		t.Errorf("got unexpected status: %+v", status)
+	}
+
+	// Other users and verb classes should not be limited.
+	if err := l.Wait(context.TODO(), Write, bob, ""); err != nil {
+		t.Errorf("unexpected error for other user: %s", err)
+	}
+	if err := l.Wait(context.TODO(), Read, alice, ""); err != nil {
+		t.Errorf("unexpected error for unlimited class: %s", err)
+	}
+
+	// Tokens should be refilled over time.
+	now = now.Add(time.Second)
+	if err := l.Wait(context.TODO(), Write, alice, ""); err != nil {
+		t.Errorf("unexpected error after refill: %s", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	u := &user.DefaultInfo{
+		Name:   "alice",
+		Groups: []string{"team-b", user.AllAuthenticated, "team-a"},
+	}
+
+	tests := map[string]struct {
+		key  string
+		user user.Info
+		exp  []string
+	}{
+		"user": {
+			key:  KeyUser,
+			user: u,
+			exp:  []string{"user:alice"},
+		},
+		"ip": {
+			key:  KeyIP,
+			user: u,
+			exp:  []string{"10.0.0.1"},
+		},
+		"groups excluding all authenticated": {
+			key:  KeyGroup,
+			user: u,
+			exp:  []string{"group:team-a", "group:team-b"},
+		},
+		"user without groups falls back to username": {
+			key:  KeyGroup,
+			user: &user.DefaultInfo{Name: "bob", Groups: []string{user.AllAuthenticated}},
+			exp:  []string{"user:bob"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l, err := New(Options{Key: test.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := l.keys(test.user, "10.0.0.1:41234")
+			if len(keys) != len(test.exp) {
+				t.Fatalf("got unexpected keys, exp=%v got=%v", test.exp, keys)
+			}
+			for i := range keys {
+				if keys[i] != test.exp[i] {
+					t.Errorf("got unexpected keys, exp=%v got=%v", test.exp, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue(Limit{QPS: 20, Burst: 1}, 10)
+
+	// Use up the burst so all following requests are queued.
+	if err := q.wait(context.TODO(), Read, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the lock so all requests are queued before any are dispatched.
+	q.mu.Lock()
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+
+	enqueue := func(flow string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.wait(context.TODO(), Read, flow, time.Second*5); err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, flow)
+			mu.Unlock()
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		enqueue("alice")
+	}
+	enqueue("bob")
+
+	q.mu.Unlock()
+
+	// Wait for all requests to be queued, then check bob is not dispatched
+	// behind all of alice's requests.
+	wg.Wait()
+
+	var bob int
+	for i, flow := range order {
+		if flow == "bob" {
+			bob = i
+		}
+	}
+	if bob > 1 {
+		t.Errorf("expected bob's request to be dispatched fairly, got order=%v", order)
+	}
+}
+
+func TestFairQueueFull(t *testing.T) {
+	q := newFairQueue(Limit{QPS: 0.001, Burst: 1}, 1)
+
+	if err := q.wait(context.TODO(), Read, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request is queued, but never dispatched before the timeout.
+	go q.wait(context.TODO(), Read, "alice", time.Second*5)
+
+	for i := 0; i < 100; i++ {
+		q.mu.Lock()
+		queued := q.queued
+		q.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// The queue of alice is full so should be rejected immediately, while
+	// bob is queued and times out.
+	if _, ok := q.wait(context.TODO(), Read, "alice", time.Second).(*RejectedError); !ok {
+		t.Error("expected request over the queue length to be rejected")
+	}
+
+	if _, ok := q.wait(context.TODO(), Read, "bob", time.Millisecond*10).(*RejectedError); !ok {
+		t.Error("expected request to be rejected after the queue timeout")
+	}
+
+	q.mu.Lock()
+	if len(q.flows["bob"]) != 0 {
+		t.Error("expected timed out request to be removed from the queue")
+	}
+	q.mu.Unlock()
+}
@@ -0,0 +1,55 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// RequestIDHeader is the header holding the ID of a request.
+	RequestIDHeader = "X-Request-Id"
+)
+
+// validRequestID matches request IDs from trusted front ends which are safe
+// to log and forward.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID assigns the request an ID, which is returned in the response
+// and forwarded to the API server as both the X-Request-Id and Audit-ID, so
+// that audit events of the proxy and the API server can be correlated. The
+// X-Request-Id of requests from trusted front ends is kept.
+func (p *Proxy) withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !p.trustedRequestID(req) || !validRequestID.MatchString(id) {
+			id = string(uuid.NewUUID())
+		}
+
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+
+		// Any Audit-ID sent by the client is replaced so that clients cannot
+		// choose the ID the API server audits the request with.
+		req.Header.Set(RequestIDHeader, id)
+		req.Header.Set(auditinternal.HeaderAuditID, id)
+
+		rw.Header().Set(RequestIDHeader, id)
+		rw.Header().Set(auditinternal.HeaderAuditID, id)
+
+		handler.ServeHTTP(rw, context.WithRequestID(req, id))
+	})
+}
+
+// trustedRequestID returns whether the request was sent by a trusted front
+// end, whose request ID is kept.
+func (p *Proxy) trustedRequestID(req *http.Request) bool {
+	return containsIP(p.config.RequestIDTrustedCIDRs, net.ParseIP(hostOf(req.RemoteAddr)))
+}
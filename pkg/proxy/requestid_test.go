@@ -0,0 +1,136 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+func TestRequestID(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Proxy{
+		config: &Config{
+			RequestIDTrustedCIDRs: []*net.IPNet{trusted},
+		},
+	}
+
+	tests := map[string]struct {
+		remoteAddr string
+		headers    map[string]string
+
+		expID string
+	}{
+		"a request without an ID should be given one": {
+			remoteAddr: "10.0.0.1:1234",
+		},
+		"the ID of a request from a trusted front end should be kept": {
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{RequestIDHeader: "front-end-id"},
+			expID:      "front-end-id",
+		},
+		"the ID of a request from an untrusted client should be replaced": {
+			remoteAddr: "192.168.0.1:1234",
+			headers:    map[string]string{RequestIDHeader: "client-id"},
+		},
+		"an invalid ID of a request from a trusted front end should be replaced": {
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{RequestIDHeader: "bad id\n"},
+		},
+		"an Audit-ID sent by the client should be replaced": {
+			remoteAddr: "192.168.0.1:1234",
+			headers:    map[string]string{auditinternal.HeaderAuditID: "client-audit-id"},
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			var got *http.Request
+			handler := p.withRequestID(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.RemoteAddr = test.remoteAddr
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			id := context.RequestID(got)
+			if len(id) == 0 {
+				t.Fatal("expected request to have an ID")
+			}
+
+			if len(test.expID) > 0 && id != test.expID {
+				t.Errorf("got unexpected request ID, exp=%s got=%s", test.expID, id)
+			}
+
+			for _, v := range test.headers {
+				if id == v && v != test.expID {
+					t.Errorf("expected request ID sent by the client to be replaced, got=%s", id)
+				}
+			}
+
+			for _, header := range []string{RequestIDHeader, auditinternal.HeaderAuditID} {
+				if v := got.Header.Get(header); v != id {
+					t.Errorf("expected %s to be forwarded as the request ID, exp=%s got=%s", header, id, v)
+				}
+
+				if v := w.Header().Get(header); v != id {
+					t.Errorf("expected %s of the response to be the request ID, exp=%s got=%s", header, id, v)
+				}
+			}
+		})
+	}
+}
+
+type auditIDRT struct{}
+
+func (auditIDRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+	}
+	resp.Header.Set(auditinternal.HeaderAuditID, req.Header.Get(auditinternal.HeaderAuditID))
+
+	return resp, nil
+}
+
+func TestRoundTripAuditID(t *testing.T) {
+	p := &Proxy{
+		clientTransport: auditIDRT{},
+		config:          new(Config),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	req.Header.Set(auditinternal.HeaderAuditID, "an-id")
+	req = context.WithRequestID(req, "an-id")
+	req = context.WithImpersonationConfig(req, &transport.ImpersonationConfig{
+		UserName: "a-user",
+	})
+
+	resp, err := p.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The Audit-ID is already set on the response by withRequestID, so is not
+	// copied from the upstream response a second time.
+	if v := resp.Header.Get(auditinternal.HeaderAuditID); len(v) > 0 {
+		t.Errorf("expected Audit-ID of the upstream response to be removed, got=%s", v)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"net/http"
+
+	authzv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+var (
+	selfSubjectAccessReviewResource = schema.GroupResource{
+		Group:    authzv1.GroupName,
+		Resource: "selfsubjectaccessreviews",
+	}
+
+	selfSubjectRulesReviewResource = schema.GroupResource{
+		Group:    authzv1.GroupName,
+		Resource: "selfsubjectrulesreviews",
+	}
+
+	// SelfSubjectAccessReviewPaths are the request paths served by the
+	// SelfSubjectAccessReview endpoint.
+	SelfSubjectAccessReviewPaths = sets.NewString(
+		"/apis/authorization.k8s.io/v1/selfsubjectaccessreviews",
+		"/apis/authorization.k8s.io/v1beta1/selfsubjectaccessreviews",
+	)
+
+	// SelfSubjectRulesReviewPaths are the request paths served by the
+	// SelfSubjectRulesReview endpoint.
+	SelfSubjectRulesReviewPaths = sets.NewString(
+		"/apis/authorization.k8s.io/v1/selfsubjectrulesreviews",
+		"/apis/authorization.k8s.io/v1beta1/selfsubjectrulesreviews",
+	)
+)
+
+const (
+	// upstreamRulesIncomplete is the evaluation error reported in
+	// SelfSubjectRulesReviews of impersonated users, since their requests are
+	// also subject to the authorization of the API server.
+	upstreamRulesIncomplete = "rules do not include the authorization of the upstream API server"
+)
+
+// SelfSubjectAccessReview answers SelfSubjectAccessReview requests ('kubectl
+// auth can-i') using the proxy's authorizer. If an upstream authorizer is given,
+// requests allowed by the proxy authorizer which are impersonated are also
+// checked against it, the same as the API server would for proxied requests.
+type SelfSubjectAccessReview struct {
+	authorizer authorizer.Authorizer
+	upstream   authorizer.Authorizer
+}
+
+// NewSelfSubjectAccessReview returns a SelfSubjectAccessReview endpoint
+// handler. upstream may be nil.
+func NewSelfSubjectAccessReview(authz, upstream authorizer.Authorizer) *SelfSubjectAccessReview {
+	return &SelfSubjectAccessReview{
+		authorizer: authz,
+		upstream:   upstream,
+	}
+}
+
+func (s *SelfSubjectAccessReview) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, methodNotAllowed(req, selfSubjectAccessReviewResource))
+		return
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok {
+		writeError(rw, errNoUserInContext)
+		return
+	}
+
+	// v1beta1 is identical on the wire to v1.
+	review := new(authzv1.SelfSubjectAccessReview)
+	if err := decodeRequest(req, review); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	spec := review.Spec
+	if (spec.ResourceAttributes == nil) == (spec.NonResourceAttributes == nil) {
+		writeError(rw, apierrors.NewBadRequest(
+			"exactly one of nonResourceAttributes or resourceAttributes must be specified"))
+		return
+	}
+
+	attrs := attributesFromSpec(spec, user)
+	decision, reason, err := s.authorizer.Authorize(req.Context(), attrs)
+
+	// Impersonated requests that are allowed by the proxy are still subject to
+	// the authorization of the API server.
+	if decision == authorizer.DecisionAllow && s.upstream != nil && !context.NoImpersonation(req) {
+		if conf := context.ImpersonationConfig(req); conf != nil {
+			attrs.User = &authuser.DefaultInfo{
+				Name:   conf.UserName,
+				UID:    context.ImpersonationUID(req),
+				Groups: conf.Groups,
+				Extra:  conf.Extra,
+			}
+			decision, reason, err = s.upstream.Authorize(req.Context(), attrs)
+		}
+	}
+
+	if err != nil {
+		klog.Errorf("[%s] failed to evaluate self subject access review (%s): %s",
+			context.RequestID(req), req.RemoteAddr, err)
+	}
+
+	review.TypeMeta.APIVersion = groupVersionFromPath(req.URL.Path)
+	review.TypeMeta.Kind = "SelfSubjectAccessReview"
+	review.Status = accessReviewStatus(decision, reason, err)
+
+	writeObject(rw, http.StatusCreated, review)
+}
+
+// SelfSubjectRulesReview answers SelfSubjectRulesReview requests ('kubectl
+// auth can-i --list') using the rules of the proxy's authorizer.
+type SelfSubjectRulesReview struct {
+	resolver authorizer.RuleResolver
+
+	// upstreamAuthorization is whether impersonated requests are also
+	// authorized by the API server. If so, the rules of the proxy are not
+	// complete.
+	upstreamAuthorization bool
+}
+
+// NewSelfSubjectRulesReview returns a SelfSubjectRulesReview endpoint handler.
+func NewSelfSubjectRulesReview(resolver authorizer.RuleResolver, upstreamAuthorization bool) *SelfSubjectRulesReview {
+	return &SelfSubjectRulesReview{
+		resolver:              resolver,
+		upstreamAuthorization: upstreamAuthorization,
+	}
+}
+
+func (s *SelfSubjectRulesReview) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, methodNotAllowed(req, selfSubjectRulesReviewResource))
+		return
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok {
+		writeError(rw, errNoUserInContext)
+		return
+	}
+
+	review := new(authzv1.SelfSubjectRulesReview)
+	if err := decodeRequest(req, review); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	resourceInfo, nonResourceInfo, incomplete, err := s.resolver.RulesFor(user, review.Spec.Namespace)
+
+	status := authzv1.SubjectRulesReviewStatus{
+		ResourceRules:    []authzv1.ResourceRule{},
+		NonResourceRules: []authzv1.NonResourceRule{},
+		Incomplete:       incomplete,
+	}
+
+	for _, rule := range resourceInfo {
+		status.ResourceRules = append(status.ResourceRules, authzv1.ResourceRule{
+			Verbs:         rule.GetVerbs(),
+			APIGroups:     rule.GetAPIGroups(),
+			Resources:     rule.GetResources(),
+			ResourceNames: rule.GetResourceNames(),
+		})
+	}
+
+	for _, rule := range nonResourceInfo {
+		status.NonResourceRules = append(status.NonResourceRules, authzv1.NonResourceRule{
+			Verbs:           rule.GetVerbs(),
+			NonResourceURLs: rule.GetNonResourceURLs(),
+		})
+	}
+
+	if err != nil {
+		klog.Errorf("[%s] failed to evaluate self subject rules review (%s): %s",
+			context.RequestID(req), req.RemoteAddr, err)
+		status.EvaluationError = err.Error()
+	} else if s.upstreamAuthorization && !context.NoImpersonation(req) {
+		status.Incomplete = true
+		status.EvaluationError = upstreamRulesIncomplete
+	}
+
+	review.TypeMeta.APIVersion = groupVersionFromPath(req.URL.Path)
+	review.TypeMeta.Kind = "SelfSubjectRulesReview"
+	review.Status = status
+
+	writeObject(rw, http.StatusCreated, review)
+}
+
+// attributesFromSpec builds the authorization attributes of the review spec
+// for the user.
+func attributesFromSpec(spec authzv1.SelfSubjectAccessReviewSpec, user authuser.Info) authorizer.AttributesRecord {
+	if attrs := spec.ResourceAttributes; attrs != nil {
+		return authorizer.AttributesRecord{
+			User:            user,
+			Verb:            attrs.Verb,
+			Namespace:       attrs.Namespace,
+			APIGroup:        attrs.Group,
+			APIVersion:      attrs.Version,
+			Resource:        attrs.Resource,
+			Subresource:     attrs.Subresource,
+			Name:            attrs.Name,
+			ResourceRequest: true,
+		}
+	}
+
+	return authorizer.AttributesRecord{
+		User:            user,
+		Verb:            spec.NonResourceAttributes.Verb,
+		Path:            spec.NonResourceAttributes.Path,
+		ResourceRequest: false,
+	}
+}
+
+func accessReviewStatus(decision authorizer.Decision, reason string, err error) authzv1.SubjectAccessReviewStatus {
+	status := authzv1.SubjectAccessReviewStatus{
+		Allowed: decision == authorizer.DecisionAllow,
+		Denied:  decision == authorizer.DecisionDeny,
+		Reason:  reason,
+	}
+
+	if err != nil {
+		status.EvaluationError = err.Error()
+	}
+
+	return status
+}
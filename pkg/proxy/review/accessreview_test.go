@@ -0,0 +1,276 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"bytes"
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+type fakeAuthorizer struct {
+	decision authorizer.Decision
+	reason   string
+	err      error
+
+	attrs authorizer.Attributes
+}
+
+func (f *fakeAuthorizer) Authorize(_ gocontext.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	f.attrs = attrs
+	return f.decision, f.reason, f.err
+}
+
+type fakeRuleResolver struct {
+	resourceRules    []authorizer.ResourceRuleInfo
+	nonResourceRules []authorizer.NonResourceRuleInfo
+	incomplete       bool
+	err              error
+}
+
+func (f *fakeRuleResolver) RulesFor(user.Info, string) ([]authorizer.ResourceRuleInfo, []authorizer.NonResourceRuleInfo, bool, error) {
+	return f.resourceRules, f.nonResourceRules, f.incomplete, f.err
+}
+
+func newReviewRequest(path, body string, noImpersonation bool) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req = req.WithContext(genericapirequest.WithUser(req.Context(),
+		&user.DefaultInfo{Name: "oidc:jane", Groups: []string{"oidc:admins"}}))
+
+	if noImpersonation {
+		return context.WithNoImpersonation(req)
+	}
+
+	return context.WithImpersonationConfig(req, &transport.ImpersonationConfig{
+		UserName: "oidc:jane",
+		Groups:   []string{"oidc:admins", user.AllAuthenticated},
+	})
+}
+
+func TestSelfSubjectAccessReview(t *testing.T) {
+	const (
+		path         = "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews"
+		resourceBody = `{"spec":{"resourceAttributes":{"namespace":"default","verb":"get","resource":"pods"}}}`
+	)
+
+	tests := map[string]struct {
+		body            string
+		noImpersonation bool
+		authz           *fakeAuthorizer
+		upstream        *fakeAuthorizer
+
+		expCode          int
+		expStatus        authzv1.SubjectAccessReviewStatus
+		expUpstreamCheck bool
+	}{
+		"a review with no attributes should 400": {
+			body:    `{"spec":{}}`,
+			authz:   &fakeAuthorizer{},
+			expCode: http.StatusBadRequest,
+		},
+		"a review with both attributes should 400": {
+			body:    `{"spec":{"resourceAttributes":{"verb":"get"},"nonResourceAttributes":{"verb":"get"}}}`,
+			authz:   &fakeAuthorizer{},
+			expCode: http.StatusBadRequest,
+		},
+		"a review denied by the authorizer should not check upstream": {
+			body:     resourceBody,
+			authz:    &fakeAuthorizer{decision: authorizer.DecisionDeny, reason: "policy says no"},
+			upstream: &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			expCode:  http.StatusCreated,
+			expStatus: authzv1.SubjectAccessReviewStatus{
+				Denied: true,
+				Reason: "policy says no",
+			},
+		},
+		"a review with an authorizer error should return the evaluation error": {
+			body:    resourceBody,
+			authz:   &fakeAuthorizer{decision: authorizer.DecisionNoOpinion, err: errors.New("opa down")},
+			expCode: http.StatusCreated,
+			expStatus: authzv1.SubjectAccessReviewStatus{
+				EvaluationError: "opa down",
+			},
+		},
+		"a review allowed by the authorizer but not upstream should not be allowed": {
+			body:     resourceBody,
+			authz:    &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			upstream: &fakeAuthorizer{decision: authorizer.DecisionNoOpinion, reason: "no RBAC"},
+			expCode:  http.StatusCreated,
+			expStatus: authzv1.SubjectAccessReviewStatus{
+				Reason: "no RBAC",
+			},
+			expUpstreamCheck: true,
+		},
+		"a review allowed by the authorizer and upstream should be allowed": {
+			body:     resourceBody,
+			authz:    &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			upstream: &fakeAuthorizer{decision: authorizer.DecisionAllow, reason: "RBAC allowed"},
+			expCode:  http.StatusCreated,
+			expStatus: authzv1.SubjectAccessReviewStatus{
+				Allowed: true,
+				Reason:  "RBAC allowed",
+			},
+			expUpstreamCheck: true,
+		},
+		"a review of a request not impersonated should not check upstream": {
+			body:            `{"spec":{"nonResourceAttributes":{"verb":"get","path":"/healthz"}}}`,
+			noImpersonation: true,
+			authz:           &fakeAuthorizer{decision: authorizer.DecisionAllow},
+			upstream:        &fakeAuthorizer{decision: authorizer.DecisionNoOpinion},
+			expCode:         http.StatusCreated,
+			expStatus: authzv1.SubjectAccessReviewStatus{
+				Allowed: true,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var upstream authorizer.Authorizer
+			if test.upstream != nil {
+				upstream = test.upstream
+			}
+
+			w := httptest.NewRecorder()
+			NewSelfSubjectAccessReview(test.authz, upstream).ServeHTTP(w,
+				newReviewRequest(path, test.body, test.noImpersonation))
+
+			if w.Code != test.expCode {
+				t.Fatalf("got unexpected response code, exp=%d got=%d (%s)",
+					test.expCode, w.Code, w.Body.String())
+			}
+
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var review authzv1.SelfSubjectAccessReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			if !reflect.DeepEqual(test.expStatus, review.Status) {
+				t.Errorf("got unexpected status, exp=%#v got=%#v", test.expStatus, review.Status)
+			}
+
+			if test.authz.attrs.GetUser().GetName() != "oidc:jane" {
+				t.Errorf("authorizer got unexpected user: %#v", test.authz.attrs.GetUser())
+			}
+
+			if upstreamChecked := test.upstream != nil && test.upstream.attrs != nil; upstreamChecked != test.expUpstreamCheck {
+				t.Errorf("unexpected upstream check, exp=%t got=%t", test.expUpstreamCheck, upstreamChecked)
+			}
+
+			if test.expUpstreamCheck {
+				expGroups := []string{"oidc:admins", user.AllAuthenticated}
+				if groups := test.upstream.attrs.GetUser().GetGroups(); !reflect.DeepEqual(expGroups, groups) {
+					t.Errorf("upstream got unexpected groups, exp=%v got=%v", expGroups, groups)
+				}
+			}
+		})
+	}
+}
+
+func TestSelfSubjectRulesReview(t *testing.T) {
+	const path = "/apis/authorization.k8s.io/v1/selfsubjectrulesreviews"
+
+	resolver := &fakeRuleResolver{
+		resourceRules: []authorizer.ResourceRuleInfo{
+			&authorizer.DefaultResourceRuleInfo{
+				Verbs:     []string{"get", "list"},
+				APIGroups: []string{""},
+				Resources: []string{"pods"},
+			},
+		},
+		nonResourceRules: []authorizer.NonResourceRuleInfo{
+			&authorizer.DefaultNonResourceRuleInfo{
+				Verbs:           []string{"get"},
+				NonResourceURLs: []string{"/healthz"},
+			},
+		},
+	}
+
+	expRules := authzv1.SubjectRulesReviewStatus{
+		ResourceRules: []authzv1.ResourceRule{{
+			Verbs:     []string{"get", "list"},
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+		}},
+		NonResourceRules: []authzv1.NonResourceRule{{
+			Verbs:           []string{"get"},
+			NonResourceURLs: []string{"/healthz"},
+		}},
+	}
+
+	tests := map[string]struct {
+		upstreamAuthorization bool
+		noImpersonation       bool
+		resolver              *fakeRuleResolver
+
+		expIncomplete      bool
+		expEvaluationError string
+	}{
+		"rules should be returned when not authorized upstream": {
+			resolver: resolver,
+		},
+		"rules should be incomplete when impersonated requests are authorized upstream": {
+			upstreamAuthorization: true,
+			resolver:              resolver,
+			expIncomplete:         true,
+			expEvaluationError:    upstreamRulesIncomplete,
+		},
+		"rules should be complete for requests not impersonated": {
+			upstreamAuthorization: true,
+			noImpersonation:       true,
+			resolver:              resolver,
+		},
+		"a resolver error should be returned as the evaluation error": {
+			resolver: &fakeRuleResolver{
+				resourceRules:    resolver.resourceRules,
+				nonResourceRules: resolver.nonResourceRules,
+				incomplete:       true,
+				err:              errors.New("opa down"),
+			},
+			expIncomplete:      true,
+			expEvaluationError: "opa down",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewSelfSubjectRulesReview(test.resolver, test.upstreamAuthorization).ServeHTTP(w,
+				newReviewRequest(path, `{"spec":{"namespace":"default"}}`, test.noImpersonation))
+
+			if w.Code != http.StatusCreated {
+				t.Fatalf("got unexpected response code, exp=%d got=%d (%s)",
+					http.StatusCreated, w.Code, w.Body.String())
+			}
+
+			var review authzv1.SelfSubjectRulesReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			exp := expRules
+			exp.Incomplete = test.expIncomplete
+			exp.EvaluationError = test.expEvaluationError
+
+			if !reflect.DeepEqual(exp, review.Status) {
+				t.Errorf("got unexpected status, exp=%#v got=%#v", exp, review.Status)
+			}
+		})
+	}
+}
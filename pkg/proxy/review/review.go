@@ -0,0 +1,90 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+const (
+	// maxRequestBodyBytes is the largest review request body that will be
+	// decoded. Reviews are small objects so this is generous.
+	maxRequestBodyBytes = 1 << 20
+)
+
+var (
+	errNoUserInContext = apierrors.NewInternalError(errors.New("no user in request context"))
+)
+
+// decodeRequest reads the JSON encoded review object from the request body
+// into obj, limiting the number of bytes read.
+func decodeRequest(req *http.Request, obj interface{}) error {
+	if req.Body == nil {
+		return apierrors.NewBadRequest("request body is empty")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestBodyBytes+1))
+	if err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to read request body: %s", err))
+	}
+
+	if len(body) > maxRequestBodyBytes {
+		return apierrors.NewRequestEntityTooLargeError(
+			fmt.Sprintf("limit is %d bytes", maxRequestBodyBytes))
+	}
+
+	if err := json.Unmarshal(body, obj); err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("failed to decode request body: %s", err))
+	}
+
+	return nil
+}
+
+// writeObject writes the given object to the response as JSON with the given
+// status code.
+func writeObject(rw http.ResponseWriter, code int, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		klog.Errorf("failed to encode review response: %s", err)
+		http.Error(rw, "", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if _, err := rw.Write(body); err != nil {
+		klog.Errorf("failed to write review response: %s", err)
+	}
+}
+
+// writeError writes the error to the response as a Kubernetes Status object.
+// Errors which are not API status errors are reported as internal errors.
+func writeError(rw http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{
+		Kind:       "Status",
+		APIVersion: "v1",
+	}
+
+	writeObject(rw, int(s.Code), s)
+}
+
+// methodNotAllowed returns the API error for a request to a review endpoint
+// using a method other than POST.
+func methodNotAllowed(req *http.Request, resource schema.GroupResource) error {
+	return apierrors.NewMethodNotSupported(resource, req.Method)
+}
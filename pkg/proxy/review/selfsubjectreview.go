@@ -0,0 +1,140 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// TokenClaimsAnnotationKey is the annotation key used to expose the claims
+	// of the authenticating token in SelfSubjectReview responses.
+	TokenClaimsAnnotationKey = "kube-oidc-proxy.jetstack.io/token-claims"
+)
+
+var (
+	selfSubjectReviewResource = schema.GroupResource{
+		Group:    authv1.GroupName,
+		Resource: "selfsubjectreviews",
+	}
+
+	// SelfSubjectReviewPaths are the request paths served by the
+	// SelfSubjectReview endpoint.
+	SelfSubjectReviewPaths = sets.NewString(
+		"/apis/authentication.k8s.io/v1/selfsubjectreviews",
+		"/apis/authentication.k8s.io/v1beta1/selfsubjectreviews",
+		"/apis/authentication.k8s.io/v1alpha1/selfsubjectreviews",
+	)
+)
+
+// SelfSubjectReviewObject is the SelfSubjectReview API type. The type is not
+// available in the vendored Kubernetes API so is defined here, and is
+// identical on the wire across the v1alpha1, v1beta1 and v1 versions.
+type SelfSubjectReviewObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status SelfSubjectReviewStatus `json:"status,omitempty"`
+}
+
+// SelfSubjectReviewStatus is filled with the user attributes of the
+// requester.
+type SelfSubjectReviewStatus struct {
+	UserInfo authv1.UserInfo `json:"userInfo,omitempty"`
+}
+
+// SelfSubjectReview answers SelfSubjectReview requests ('kubectl auth
+// whoami') with the user as derived by the proxy, rather than the user as seen
+// by the API server after impersonation.
+type SelfSubjectReview struct {
+	includeTokenClaims bool
+}
+
+// NewSelfSubjectReview returns a SelfSubjectReview endpoint handler. If
+// includeTokenClaims is true, the claims of the authenticating token are added
+// to responses as an annotation.
+func NewSelfSubjectReview(includeTokenClaims bool) *SelfSubjectReview {
+	return &SelfSubjectReview{
+		includeTokenClaims: includeTokenClaims,
+	}
+}
+
+func (s *SelfSubjectReview) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, methodNotAllowed(req, selfSubjectReviewResource))
+		return
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	conf := context.ImpersonationConfig(req)
+	if !ok || conf == nil {
+		klog.Errorf("[%s] if you are seeing this, there is likely a bug in the proxy (%s): no user in context",
+			context.RequestID(req), req.RemoteAddr)
+		writeError(rw, errNoUserInContext)
+		return
+	}
+
+	review := &SelfSubjectReviewObject{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "SelfSubjectReview",
+			APIVersion: groupVersionFromPath(req.URL.Path),
+		},
+		Status: SelfSubjectReviewStatus{
+			UserInfo: authv1.UserInfo{
+				Username: conf.UserName,
+				UID:      user.GetUID(),
+				Groups:   conf.Groups,
+				Extra:    toExtraValues(conf.Extra),
+			},
+		},
+	}
+
+	if s.includeTokenClaims {
+		if claims := context.TokenClaims(req); claims != nil {
+			claimsJSON, err := json.Marshal(claims)
+			if err != nil {
+				klog.Errorf("failed to encode token claims: %s", err)
+			} else {
+				review.Annotations = map[string]string{
+					TokenClaimsAnnotationKey: string(claimsJSON),
+				}
+			}
+		}
+	}
+
+	writeObject(rw, http.StatusCreated, review)
+}
+
+// groupVersionFromPath returns the group version of an '/apis/<group>/<version>/..'
+// request path.
+func groupVersionFromPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 {
+		return authv1.SchemeGroupVersion.String()
+	}
+
+	return schema.GroupVersion{Group: parts[1], Version: parts[2]}.String()
+}
+
+func toExtraValues(extra map[string][]string) map[string]authv1.ExtraValue {
+	if len(extra) == 0 {
+		return nil
+	}
+
+	values := make(map[string]authv1.ExtraValue)
+	for k, v := range extra {
+		values[k] = v
+	}
+
+	return values
+}
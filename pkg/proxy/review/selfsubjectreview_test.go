@@ -0,0 +1,128 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+func TestSelfSubjectReview(t *testing.T) {
+	conf := &transport.ImpersonationConfig{
+		UserName: "oidc:jane",
+		Groups:   []string{"oidc:admins", user.AllAuthenticated},
+		Extra: map[string][]string{
+			"Remote-Client-IP": {"1.2.3.4"},
+		},
+	}
+
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"sub": "jane",
+	}
+
+	tests := map[string]struct {
+		method        string
+		path          string
+		includeClaims bool
+		noUser        bool
+
+		expCode        int
+		expAPIVersion  string
+		expAnnotations map[string]string
+	}{
+		"a non POST request should 405": {
+			method:  http.MethodGet,
+			path:    "/apis/authentication.k8s.io/v1/selfsubjectreviews",
+			expCode: http.StatusMethodNotAllowed,
+		},
+		"a request without a user in the context should 500": {
+			method:  http.MethodPost,
+			path:    "/apis/authentication.k8s.io/v1/selfsubjectreviews",
+			noUser:  true,
+			expCode: http.StatusInternalServerError,
+		},
+		"a v1 request should return the proxy user": {
+			method:        http.MethodPost,
+			path:          "/apis/authentication.k8s.io/v1/selfsubjectreviews",
+			expCode:       http.StatusCreated,
+			expAPIVersion: "authentication.k8s.io/v1",
+		},
+		"a v1alpha1 request should return the proxy user with the same version": {
+			method:        http.MethodPost,
+			path:          "/apis/authentication.k8s.io/v1alpha1/selfsubjectreviews",
+			expCode:       http.StatusCreated,
+			expAPIVersion: "authentication.k8s.io/v1alpha1",
+		},
+		"a request with token claims enabled should include the annotation": {
+			method:        http.MethodPost,
+			path:          "/apis/authentication.k8s.io/v1beta1/selfsubjectreviews",
+			includeClaims: true,
+			expCode:       http.StatusCreated,
+			expAPIVersion: "authentication.k8s.io/v1beta1",
+			expAnnotations: map[string]string{
+				TokenClaimsAnnotationKey: `{"iss":"https://issuer.example.com","sub":"jane"}`,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if !test.noUser {
+				req = req.WithContext(genericapirequest.WithUser(req.Context(),
+					&user.DefaultInfo{Name: "oidc:jane", UID: "1234"}))
+				req = context.WithImpersonationConfig(req, conf)
+			}
+			req = context.WithTokenClaims(req, claims)
+
+			w := httptest.NewRecorder()
+			NewSelfSubjectReview(test.includeClaims).ServeHTTP(w, req)
+
+			if w.Code != test.expCode {
+				t.Fatalf("got unexpected response code, exp=%d got=%d (%s)",
+					test.expCode, w.Code, w.Body.String())
+			}
+
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var review SelfSubjectReviewObject
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			if review.APIVersion != test.expAPIVersion || review.Kind != "SelfSubjectReview" {
+				t.Errorf("got unexpected type meta: %#v", review.TypeMeta)
+			}
+
+			expUser := authv1.UserInfo{
+				Username: "oidc:jane",
+				UID:      "1234",
+				Groups:   []string{"oidc:admins", user.AllAuthenticated},
+				Extra: map[string]authv1.ExtraValue{
+					"Remote-Client-IP": {"1.2.3.4"},
+				},
+			}
+			if !reflect.DeepEqual(expUser, review.Status.UserInfo) {
+				t.Errorf("got unexpected user info, exp=%#v got=%#v",
+					expUser, review.Status.UserInfo)
+			}
+
+			if !reflect.DeepEqual(test.expAnnotations, review.Annotations) {
+				t.Errorf("got unexpected annotations, exp=%v got=%v",
+					test.expAnnotations, review.Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"fmt"
+	"net/http"
+
+	authv1 "k8s.io/api/authentication/v1"
+	authv1beta1 "k8s.io/api/authentication/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+var (
+	tokenReviewResource = schema.GroupResource{
+		Group:    authv1.GroupName,
+		Resource: "tokenreviews",
+	}
+
+	// TokenReviewPaths are the request paths served by the TokenReview
+	// endpoint.
+	TokenReviewPaths = sets.NewString(
+		"/apis/authentication.k8s.io/v1/tokenreviews",
+		"/apis/authentication.k8s.io/v1beta1/tokenreviews",
+	)
+)
+
+// TokenReview serves the TokenReview API using the proxy's token
+// authenticators. This allows the proxy to be used as a webhook token
+// authenticator by the Kubernetes API server, or any other component, so
+// that tokens are validated with the same claim mapping as the proxy.
+type TokenReview struct {
+	// callerAuther authenticates the client calling the endpoint.
+	callerAuther authenticator.Request
+	// tokenAuther authenticates the token under review.
+	tokenAuther authenticator.Token
+
+	allowedUsers  sets.String
+	allowedGroups sets.String
+}
+
+// NewTokenReview returns a TokenReview endpoint handler. Callers
+// authenticated by callerAuther must be in either the allowed users or allowed
+// groups to be able to review tokens.
+func NewTokenReview(callerAuther authenticator.Request, tokenAuther authenticator.Token,
+	allowedUsers, allowedGroups []string) *TokenReview {
+	return &TokenReview{
+		callerAuther:  callerAuther,
+		tokenAuther:   tokenAuther,
+		allowedUsers:  sets.NewString(allowedUsers...),
+		allowedGroups: sets.NewString(allowedGroups...),
+	}
+}
+
+func (t *TokenReview) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, methodNotAllowed(req, tokenReviewResource))
+		return
+	}
+
+	if err := t.authorizeCaller(req); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	// The v1beta1 TokenReview is identical on the wire to v1 so we decode both
+	// into v1, and respond with the API version that was sent.
+	review := new(authv1.TokenReview)
+	if err := decodeRequest(req, review); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	if review.APIVersion != authv1beta1.SchemeGroupVersion.String() {
+		review.APIVersion = authv1.SchemeGroupVersion.String()
+	}
+	review.Kind = "TokenReview"
+
+	if len(review.Spec.Token) == 0 {
+		writeError(rw, apierrors.NewBadRequest("token must be set in TokenReview spec"))
+		return
+	}
+
+	review.Status = t.review(req, review.Spec)
+
+	writeObject(rw, http.StatusCreated, review)
+}
+
+// authorizeCaller ensures the request comes from an allowed client identity.
+func (t *TokenReview) authorizeCaller(req *http.Request) error {
+	resp, ok, err := t.callerAuther.AuthenticateRequest(req)
+	if err != nil || !ok {
+		klog.V(2).Infof("[%s] unauthenticated token review request %s", context.RequestID(req), req.RemoteAddr)
+		return apierrors.NewUnauthorized("Unauthorized")
+	}
+
+	caller := resp.User
+	if t.allowedUsers.Has(caller.GetName()) || t.allowedGroups.HasAny(caller.GetGroups()...) {
+		return nil
+	}
+
+	klog.V(2).Infof("[%s] user %q is not allowed to review tokens (%s)",
+		context.RequestID(req), caller.GetName(), req.RemoteAddr)
+
+	return apierrors.NewForbidden(tokenReviewResource, "",
+		fmt.Errorf("user %q is not allowed to review tokens", caller.GetName()))
+}
+
+// review authenticates the token using the proxy authenticators and builds
+// the resulting status.
+func (t *TokenReview) review(req *http.Request, spec authv1.TokenReviewSpec) authv1.TokenReviewStatus {
+	ctx := req.Context()
+	if len(spec.Audiences) > 0 {
+		ctx = authenticator.WithAudiences(ctx, spec.Audiences)
+	}
+
+	resp, ok, err := t.tokenAuther.AuthenticateToken(ctx, spec.Token)
+	if err != nil {
+		klog.V(4).Infof("[%s] token review failed to authenticate token (%s): %s",
+			context.RequestID(req), req.RemoteAddr, err)
+		return authv1.TokenReviewStatus{
+			Error: err.Error(),
+		}
+	}
+
+	if !ok || resp == nil || resp.User == nil {
+		return authv1.TokenReviewStatus{}
+	}
+
+	var audiences []string
+	if len(spec.Audiences) > 0 {
+		audiences = resp.Audiences
+	}
+
+	return authv1.TokenReviewStatus{
+		Authenticated: true,
+		User:          UserInfoToV1(resp.User),
+		Audiences:     audiences,
+	}
+}
+
+// UserInfoToV1 converts the given user info into the authentication v1 API
+// type, ensuring the system:authenticated group is present in the same way
+// the proxy does for impersonated requests.
+func UserInfoToV1(info authuser.Info) authv1.UserInfo {
+	groups := append([]string{}, info.GetGroups()...)
+	if !sets.NewString(groups...).Has(authuser.AllAuthenticated) {
+		groups = append(groups, authuser.AllAuthenticated)
+	}
+
+	return authv1.UserInfo{
+		Username: info.GetName(),
+		UID:      info.GetUID(),
+		Groups:   groups,
+		Extra:    toExtraValues(info.GetExtra()),
+	}
+}
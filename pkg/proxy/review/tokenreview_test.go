@@ -0,0 +1,154 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package review
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestTokenReview(t *testing.T) {
+	callerAuther := authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+		switch req.Header.Get("Authorization") {
+		case "Bearer allowed-user":
+			return &authenticator.Response{User: &user.DefaultInfo{Name: "apiserver"}}, true, nil
+		case "Bearer allowed-group":
+			return &authenticator.Response{User: &user.DefaultInfo{
+				Name: "foo", Groups: []string{"reviewers"}}}, true, nil
+		case "Bearer not-allowed":
+			return &authenticator.Response{User: &user.DefaultInfo{
+				Name: "bar", Groups: []string{"developers"}}}, true, nil
+		}
+		return nil, false, nil
+	})
+
+	tokenAuther := authenticator.TokenFunc(func(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+		switch token {
+		case "good-token":
+			return &authenticator.Response{User: &user.DefaultInfo{
+				Name:   "oidc:jane",
+				Groups: []string{"oidc:admins"},
+				Extra:  map[string][]string{"foo": {"bar"}},
+			}}, true, nil
+		case "error-token":
+			return nil, false, errors.New("oidc: token is expired")
+		}
+		return nil, false, nil
+	})
+
+	endpoint := NewTokenReview(callerAuther, tokenAuther,
+		[]string{"apiserver"}, []string{"reviewers"})
+
+	tests := map[string]struct {
+		method string
+		auth   string
+		body   string
+
+		expCode   int
+		expStatus *authv1.TokenReviewStatus
+	}{
+		"a non POST request should 405": {
+			method:  http.MethodGet,
+			auth:    "Bearer allowed-user",
+			expCode: http.StatusMethodNotAllowed,
+		},
+		"an unauthenticated caller should 401": {
+			method:  http.MethodPost,
+			body:    `{"spec":{"token":"good-token"}}`,
+			expCode: http.StatusUnauthorized,
+		},
+		"a caller not allowed should 403": {
+			method:  http.MethodPost,
+			auth:    "Bearer not-allowed",
+			body:    `{"spec":{"token":"good-token"}}`,
+			expCode: http.StatusForbidden,
+		},
+		"a malformed body should 400": {
+			method:  http.MethodPost,
+			auth:    "Bearer allowed-user",
+			body:    `{"spec":`,
+			expCode: http.StatusBadRequest,
+		},
+		"an empty token should 400": {
+			method:  http.MethodPost,
+			auth:    "Bearer allowed-user",
+			body:    `{"spec":{"token":""}}`,
+			expCode: http.StatusBadRequest,
+		},
+		"an allowed user reviewing a valid token should return the user": {
+			method:  http.MethodPost,
+			auth:    "Bearer allowed-user",
+			body:    `{"apiVersion":"authentication.k8s.io/v1","kind":"TokenReview","spec":{"token":"good-token"}}`,
+			expCode: http.StatusCreated,
+			expStatus: &authv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authv1.UserInfo{
+					Username: "oidc:jane",
+					Groups:   []string{"oidc:admins", user.AllAuthenticated},
+					Extra:    map[string]authv1.ExtraValue{"foo": {"bar"}},
+				},
+			},
+		},
+		"an allowed group reviewing an invalid token should return unauthenticated": {
+			method:    http.MethodPost,
+			auth:      "Bearer allowed-group",
+			body:      `{"spec":{"token":"bad-token"}}`,
+			expCode:   http.StatusCreated,
+			expStatus: &authv1.TokenReviewStatus{},
+		},
+		"an error authenticating the token should be returned in the status": {
+			method:  http.MethodPost,
+			auth:    "Bearer allowed-user",
+			body:    `{"spec":{"token":"error-token"}}`,
+			expCode: http.StatusCreated,
+			expStatus: &authv1.TokenReviewStatus{
+				Error: "oidc: token is expired",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/apis/authentication.k8s.io/v1/tokenreviews",
+				bytes.NewBufferString(test.body))
+			if len(test.auth) > 0 {
+				req.Header.Set("Authorization", test.auth)
+			}
+
+			w := httptest.NewRecorder()
+			endpoint.ServeHTTP(w, req)
+
+			if w.Code != test.expCode {
+				t.Errorf("got unexpected response code, exp=%d got=%d (%s)",
+					test.expCode, w.Code, w.Body.String())
+			}
+
+			if test.expStatus == nil {
+				return
+			}
+
+			var review authv1.TokenReview
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			if review.Kind != "TokenReview" || review.APIVersion != "authentication.k8s.io/v1" {
+				t.Errorf("got unexpected type meta: %#v", review.TypeMeta)
+			}
+
+			if !reflect.DeepEqual(*test.expStatus, review.Status) {
+				t.Errorf("got unexpected status, exp=%#v got=%#v",
+					*test.expStatus, review.Status)
+			}
+		})
+	}
+}
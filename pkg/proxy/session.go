@@ -0,0 +1,143 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	gocontext "context"
+	"net/http"
+	"time"
+
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/inflight"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/session"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+const (
+	// reauthenticationTimeout is the timeout to re-authenticate the token of
+	// a long running request.
+	reauthenticationTimeout = time.Second * 10
+)
+
+// withSessionExpiry terminates long running requests once the token that
+// authenticated them expires or is revoked.
+func (p *Proxy) withSessionExpiry(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, ok := genericapirequest.RequestInfoFrom(req.Context())
+		token := context.Token(req)
+		if !ok || len(token) == 0 || !inflight.LongRunningRequestCheck(req, info) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		req, _ = context.RemoteAddr(req)
+
+		s := session.New()
+		req = context.WithSession(req, s)
+
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+
+		go p.runSession(s, req, token, stopCh)
+
+		handler.ServeHTTP(rw, req)
+
+		// Watches are ended with a final Status event so clients know why.
+		s.WriteFinalEvent(rw)
+	})
+}
+
+// runSession terminates the session after the grace period once the token
+// expires or is revoked, until stopCh is closed.
+func (p *Proxy) runSession(s *session.Session, req *http.Request, token string, stopCh <-chan struct{}) {
+	_, remoteAddr := context.RemoteAddr(req)
+	grace := p.config.LongRunningExpiryGracePeriod
+
+	var expiryCh <-chan time.Time
+	if exp, ok := tokenExpiry(token); ok {
+		timer := time.NewTimer(time.Until(exp.Add(grace)))
+		defer timer.Stop()
+		expiryCh = timer.C
+	}
+
+	var reauthCh, revokedCh <-chan time.Time
+	if interval := p.config.LongRunningReauthenticationInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		reauthCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+
+		case <-expiryCh:
+			klog.V(2).Infof("[%s] terminating long running request, token expired (%s)",
+				context.RequestID(req), remoteAddr)
+			s.Terminate("The token used to authenticate the request has expired")
+			return
+
+		case <-reauthCh:
+			if !p.tokenRevoked(req, token) {
+				continue
+			}
+
+			reauthCh = nil
+			revokedCh = time.After(grace)
+
+		case <-revokedCh:
+			klog.V(2).Infof("[%s] terminating long running request, token revoked (%s)",
+				context.RequestID(req), remoteAddr)
+			s.Terminate("The token used to authenticate the request has been revoked")
+			return
+		}
+	}
+}
+
+// tokenRevoked re-authenticates the token, returning true if it is no longer
+// valid. Errors authenticating are not treated as revocation, as they may be
+// transient.
+func (p *Proxy) tokenRevoked(req *http.Request, token string) bool {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), reauthenticationTimeout)
+	defer cancel()
+
+	_, ok, err := p.tokenAuther.AuthenticateToken(ctx, token)
+	if ok {
+		return false
+	}
+
+	if p.config.TokenReview && p.tokenReviewer != nil {
+		_, ok, err = p.tokenReviewer.AuthenticateToken(ctx, token)
+		if ok {
+			return false
+		}
+	}
+
+	if err != nil {
+		_, remoteAddr := context.RemoteAddr(req)
+		klog.V(4).Infof("[%s] failed to re-authenticate token of long running request (%s): %s",
+			context.RequestID(req), remoteAddr, err)
+		return false
+	}
+
+	return true
+}
+
+// tokenExpiry returns the expiry of the token from its exp claim, if it is a
+// JWT with one. The token has already been authenticated.
+func tokenExpiry(token string) (time.Time, bool) {
+	claims, err := util.ParseTokenClaims(token)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(exp), 0), true
+}
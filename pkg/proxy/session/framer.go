@@ -0,0 +1,176 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package session
+
+import (
+	"encoding/binary"
+)
+
+// framer tracks the message boundaries of a stream.
+type framer interface {
+	// scan consumes p, returning the number of bytes consumed. If stop is
+	// true, scanning stops at the first message boundary, returning true.
+	scan(p []byte, stop bool) (int, bool)
+
+	// atBoundary returns whether the stream is between messages.
+	atBoundary() bool
+}
+
+// noFramer is used for streams without messages, which are always at a
+// boundary.
+type noFramer struct{}
+
+func (noFramer) scan(p []byte, stop bool) (int, bool) {
+	if stop {
+		return 0, true
+	}
+	return len(p), false
+}
+
+func (noFramer) atBoundary() bool {
+	return true
+}
+
+// lineFramer tracks messages which are terminated by a new line, such as
+// JSON watch events.
+type lineFramer struct {
+	partial bool
+}
+
+func (l *lineFramer) scan(p []byte, stop bool) (int, bool) {
+	for i, c := range p {
+		if stop && !l.partial {
+			return i, true
+		}
+		l.partial = c != '\n'
+	}
+
+	return len(p), stop && !l.partial
+}
+
+func (l *lineFramer) atBoundary() bool {
+	return !l.partial
+}
+
+// lengthFramer tracks messages which are prefixed by their length as a 4 byte
+// big endian integer, such as protobuf watch events.
+type lengthFramer struct {
+	header    [4]byte
+	headerN   int
+	remaining uint32
+}
+
+func (l *lengthFramer) scan(p []byte, stop bool) (int, bool) {
+	i := 0
+	for i < len(p) {
+		if stop && l.atBoundary() {
+			return i, true
+		}
+
+		if l.remaining == 0 {
+			n := copy(l.header[l.headerN:], p[i:])
+			l.headerN += n
+			i += n
+
+			if l.headerN == len(l.header) {
+				l.headerN = 0
+				l.remaining = binary.BigEndian.Uint32(l.header[:])
+			}
+			continue
+		}
+
+		n := len(p) - i
+		if uint32(n) > l.remaining {
+			n = int(l.remaining)
+		}
+		l.remaining -= uint32(n)
+		i += n
+	}
+
+	return i, stop && l.atBoundary()
+}
+
+func (l *lengthFramer) atBoundary() bool {
+	return l.headerN == 0 && l.remaining == 0
+}
+
+// websocketFramer tracks the frames of a WebSocket connection.
+type websocketFramer struct {
+	header    []byte
+	remaining uint64
+}
+
+func (w *websocketFramer) scan(p []byte, stop bool) (int, bool) {
+	i := 0
+	for i < len(p) {
+		if stop && w.atBoundary() {
+			return i, true
+		}
+
+		if w.remaining > 0 {
+			n := uint64(len(p) - i)
+			if n > w.remaining {
+				n = w.remaining
+			}
+			w.remaining -= n
+			i += int(n)
+			continue
+		}
+
+		w.header = append(w.header, p[i])
+		i++
+
+		if size, length, ok := parseWebsocketHeader(w.header); ok && len(w.header) == size {
+			w.header = w.header[:0]
+			w.remaining = length
+		}
+	}
+
+	return i, stop && w.atBoundary()
+}
+
+func (w *websocketFramer) atBoundary() bool {
+	return len(w.header) == 0 && w.remaining == 0
+}
+
+// parseWebsocketHeader returns the size of the frame header and the length of
+// the payload, once enough of the header is known.
+func parseWebsocketHeader(header []byte) (int, uint64, bool) {
+	if len(header) < 2 {
+		return 0, 0, false
+	}
+
+	size := 2
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+		if len(header) < 4 {
+			return 0, 0, false
+		}
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		size += 8
+		if len(header) < 10 {
+			return 0, 0, false
+		}
+		length = binary.BigEndian.Uint64(header[2:10])
+	}
+
+	return size, length, len(header) >= size
+}
+
+// websocketCloseFrame returns a WebSocket close frame with the given code and
+// reason.
+func websocketCloseFrame(code uint16, reason string) []byte {
+	// Control frame payloads must be at most 125 bytes.
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	frame := []byte{0x88, byte(2 + len(reason)), byte(code >> 8), byte(code)}
+	return append(frame, reason...)
+}
@@ -0,0 +1,242 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// boundaryTimeout is how long a terminated stream waits for the current
+	// message to finish before the stream is closed regardless.
+	boundaryTimeout = time.Second * 5
+
+	// websocketPolicyViolation is the WebSocket close code sent when a
+	// session is terminated.
+	websocketPolicyViolation = 1008
+)
+
+// Session is a long running request which is terminated once the credential
+// that authenticated it expires or is revoked. Streams are ended at a message
+// boundary so clients see a clean end of the stream.
+type Session struct {
+	mu         sync.Mutex
+	reason     string
+	terminated bool
+	bodies     []*body
+
+	// watchJSON is whether the response is a JSON watch stream, which is
+	// ended with a final Status event.
+	watchJSON bool
+}
+
+// New returns a new session.
+func New() *Session {
+	return new(Session)
+}
+
+// WrapResponse wraps the body of the upstream response so that it may be
+// ended when the session is terminated.
+func (s *Session) WrapResponse(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+
+	b := &body{
+		rc:     resp.Body,
+		framer: noFramer{},
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		if strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+			b.framer = new(websocketFramer)
+			b.final = websocketCloseFrame(websocketPolicyViolation, "credential expired or revoked")
+		}
+
+	case strings.HasPrefix(contentType, "application/json"):
+		b.framer = new(lineFramer)
+		s.mu.Lock()
+		s.watchJSON = resp.StatusCode == http.StatusOK
+		s.mu.Unlock()
+
+	case strings.HasPrefix(contentType, "application/vnd.kubernetes.protobuf") &&
+		strings.Contains(contentType, "stream=watch"):
+		b.framer = new(lengthFramer)
+	}
+
+	s.mu.Lock()
+	s.bodies = append(s.bodies, b)
+	terminated := s.terminated
+	s.mu.Unlock()
+
+	if terminated {
+		b.terminate()
+	}
+
+	resp.Body = b
+}
+
+// Terminate ends the streams of the session with the given reason.
+func (s *Session) Terminate(reason string) {
+	s.mu.Lock()
+	if s.terminated {
+		s.mu.Unlock()
+		return
+	}
+	s.terminated = true
+	s.reason = reason
+	bodies := s.bodies
+	s.mu.Unlock()
+
+	for _, b := range bodies {
+		b.terminate()
+	}
+}
+
+// Terminated returns whether the session has been terminated, and why.
+func (s *Session) Terminated() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason, s.terminated
+}
+
+// WriteFinalEvent writes a final watch event with an Unauthorized Status to
+// the response if the session was terminated and the response is a JSON
+// watch stream.
+func (s *Session) WriteFinalEvent(rw http.ResponseWriter) {
+	s.mu.Lock()
+	reason, terminated, watchJSON := s.reason, s.terminated, s.watchJSON
+	s.mu.Unlock()
+
+	if !terminated || !watchJSON {
+		return
+	}
+
+	status := apierrors.NewUnauthorized(reason).Status()
+	status.TypeMeta = metav1.TypeMeta{
+		Kind:       "Status",
+		APIVersion: "v1",
+	}
+
+	event, err := json.Marshal(&watchEvent{
+		Type:   "ERROR",
+		Object: status,
+	})
+	if err != nil {
+		klog.Errorf("failed to encode final watch event: %s", err)
+		return
+	}
+
+	if _, err := rw.Write(append(event, '\n')); err != nil {
+		klog.V(4).Infof("failed to write final watch event: %s", err)
+		return
+	}
+
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// watchEvent is a watch event as encoded in a JSON watch stream.
+type watchEvent struct {
+	Type   string        `json:"type"`
+	Object metav1.Status `json:"object"`
+}
+
+// body is an upstream response body which ends at the next message boundary
+// once terminated, followed by any final bytes.
+type body struct {
+	rc     io.ReadCloser
+	framer framer
+	final  []byte
+
+	mu        sync.Mutex
+	stopping  bool
+	finishing bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.finishing {
+		defer b.mu.Unlock()
+		return b.readFinal(p)
+	}
+	b.mu.Unlock()
+
+	n, err := b.rc.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.stopping {
+		b.framer.scan(p[:n], false)
+		return n, err
+	}
+
+	// Only pass on the rest of the current message.
+	n, reached := b.framer.scan(p[:n], true)
+	if reached || err != nil {
+		b.finishing = true
+		if n == 0 {
+			return b.readFinal(p)
+		}
+	}
+
+	return n, nil
+}
+
+// readFinal reads the final bytes once the stream has reached the end of the
+// last message.
+func (b *body) readFinal(p []byte) (int, error) {
+	if len(b.final) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.final)
+	b.final = b.final[n:]
+
+	return n, nil
+}
+
+// Write is implemented for upgraded connections which are returned as a
+// response body that is also writable.
+func (b *body) Write(p []byte) (int, error) {
+	w, ok := b.rc.(io.Writer)
+	if !ok {
+		return 0, io.ErrClosedPipe
+	}
+	return w.Write(p)
+}
+
+func (b *body) Close() error {
+	return b.rc.Close()
+}
+
+// terminate stops the body at the next message boundary. The upstream body is
+// closed to unblock any pending read.
+func (b *body) terminate() {
+	b.mu.Lock()
+	b.stopping = true
+	atBoundary := b.framer.atBoundary()
+	b.mu.Unlock()
+
+	if atBoundary {
+		b.rc.Close()
+		return
+	}
+
+	time.AfterFunc(boundaryTimeout, func() {
+		b.rc.Close()
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineFramer(t *testing.T) {
+	f := new(lineFramer)
+
+	f.scan([]byte("{\"type\":\"ADDED\"}\n{\"ty"), false)
+	if f.atBoundary() {
+		t.Fatal("expected framer to be within a message")
+	}
+
+	n, reached := f.scan([]byte("pe\":\"DELETED\"}\n{\"type\""), true)
+	if n != len("pe\":\"DELETED\"}\n") || !reached {
+		t.Errorf("got unexpected scan, exp=(%d, true) got=(%d, %t)",
+			len("pe\":\"DELETED\"}\n"), n, reached)
+	}
+}
+
+func TestLengthFramer(t *testing.T) {
+	f := new(lengthFramer)
+
+	msg := make([]byte, 4+10)
+	binary.BigEndian.PutUint32(msg, 10)
+
+	// Split the header across scans.
+	f.scan(msg[:2], false)
+	f.scan(msg[2:8], false)
+	if f.atBoundary() {
+		t.Fatal("expected framer to be within a message")
+	}
+
+	n, reached := f.scan(append(msg[8:], msg...), true)
+	if n != 6 || !reached {
+		t.Errorf("got unexpected scan, exp=(6, true) got=(%d, %t)", n, reached)
+	}
+}
+
+func TestWebsocketFramer(t *testing.T) {
+	f := new(websocketFramer)
+
+	small := append([]byte{0x82, 3}, "abc"...)
+
+	large := []byte{0x82, 126, 0x01, 0x00}
+	large = append(large, bytes.Repeat([]byte("x"), 256)...)
+
+	f.scan(small, false)
+	if !f.atBoundary() {
+		t.Fatal("expected framer to be at a boundary after a whole frame")
+	}
+
+	f.scan(large[:3], false)
+	f.scan(large[3:100], false)
+	if f.atBoundary() {
+		t.Fatal("expected framer to be within a frame")
+	}
+
+	n, reached := f.scan(append(large[100:], small...), true)
+	if n != len(large)-100 || !reached {
+		t.Errorf("got unexpected scan, exp=(%d, true) got=(%d, %t)", len(large)-100, n, reached)
+	}
+}
+
+func TestTerminateJSONWatch(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       pr,
+	}
+
+	s := New()
+	s.WrapResponse(resp)
+
+	go func() {
+		pw.Write([]byte("{\"type\":\"ADDED\"}\n{\"type\":"))
+		time.Sleep(time.Millisecond * 50)
+		s.Terminate("token expired")
+		pw.Write([]byte("\"MODIFIED\"}\n{\"type\":\"DELETED\"}\n"))
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := "{\"type\":\"ADDED\"}\n{\"type\":\"MODIFIED\"}\n"
+	if string(body) != exp {
+		t.Errorf("got unexpected body, exp=%q got=%q", exp, body)
+	}
+
+	rw := httptest.NewRecorder()
+	s.WriteFinalEvent(rw)
+
+	if !strings.HasPrefix(rw.Body.String(), `{"type":"ERROR","object":{"kind":"Status"`) ||
+		!strings.Contains(rw.Body.String(), `"code":401`) {
+		t.Errorf("got unexpected final event: %s", rw.Body.String())
+	}
+}
+
+func TestTerminateWebsocket(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     http.Header{"Upgrade": []string{"websocket"}},
+		Body:       pr,
+	}
+
+	s := New()
+	s.WrapResponse(resp)
+
+	frame := append([]byte{0x82, 3}, "abc"...)
+
+	go func() {
+		pw.Write(frame)
+		time.Sleep(time.Millisecond * 50)
+		s.Terminate("token expired")
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	exp := append(frame, websocketCloseFrame(websocketPolicyViolation, "credential expired or revoked")...)
+	if !bytes.Equal(body, exp) {
+		t.Errorf("got unexpected body, exp=%v got=%v", exp, body)
+	}
+
+	// The final event is only written to JSON watches.
+	rw := httptest.NewRecorder()
+	s.WriteFinalEvent(rw)
+	if rw.Body.Len() > 0 {
+		t.Errorf("unexpected final event: %s", rw.Body.String())
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/session"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+// tokenWithExpiry returns an unsigned JWT with the given expiry.
+func tokenWithExpiry(exp time.Time) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(`{"sub":"fake","exp":%d}`, exp.Unix()))) + "."
+}
+
+func TestTokenExpiry(t *testing.T) {
+	noExp, err := util.FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := tokenExpiry(noExp); ok {
+		t.Error("expected no expiry for token without exp claim")
+	}
+
+	if _, ok := tokenExpiry("not-a-jwt"); ok {
+		t.Error("expected no expiry for token which is not a JWT")
+	}
+
+	exp := time.Unix(1893456000, 0)
+	if got, ok := tokenExpiry(tokenWithExpiry(exp)); !ok || !got.Equal(exp) {
+		t.Errorf("got unexpected expiry, exp=%s got=%s (%t)", exp, got, ok)
+	}
+}
+
+func waitForTermination(t *testing.T, s *session.Session) string {
+	for i := 0; i < 100; i++ {
+		if reason, ok := s.Terminated(); ok {
+			return reason
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("expected session to be terminated")
+	return ""
+}
+
+func TestRunSessionExpiry(t *testing.T) {
+	p := newTestProxy(t)
+	defer p.ctrl.Finish()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	s := session.New()
+	go p.runSession(s, httptest.NewRequest(http.MethodGet, "/api/v1/pods?watch=true", nil), tokenWithExpiry(time.Now().Add(-time.Second)), stopCh)
+
+	if reason := waitForTermination(t, s); reason != "The token used to authenticate the request has expired" {
+		t.Errorf("got unexpected termination reason: %s", reason)
+	}
+}
+
+func TestRunSessionRevoked(t *testing.T) {
+	p := newTestProxy(t)
+	defer p.ctrl.Finish()
+
+	p.tokenAuther = p.fakeToken
+	p.config.LongRunningReauthenticationInterval = time.Millisecond * 10
+
+	token := tokenWithExpiry(time.Now().Add(time.Hour))
+
+	// The token is still valid on the first re-authentication, then revoked.
+	gomock.InOrder(
+		p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(nil, true, nil),
+		p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(nil, false, nil),
+	)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	s := session.New()
+	go p.runSession(s, httptest.NewRequest(http.MethodGet, "/api/v1/pods?watch=true", nil), token, stopCh)
+
+	if reason := waitForTermination(t, s); reason != "The token used to authenticate the request has been revoked" {
+		t.Errorf("got unexpected termination reason: %s", reason)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tokenreview
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	requestDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "token_review",
+			Name:           "request_duration_seconds",
+			Help:           "Latency of TokenReview requests to the API server.",
+			Buckets:        metrics.ExponentialBuckets(0.005, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	requestErrors = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      "kube_oidc_proxy",
+			Subsystem:      "token_review",
+			Name:           "request_errors_total",
+			Help:           "Number of TokenReview requests to the API server which failed.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerOnce sync.Once
+)
+
+func registerMetrics() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(requestDuration, requestErrors)
+	})
+}
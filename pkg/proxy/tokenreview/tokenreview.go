@@ -10,6 +10,8 @@ import (
 
 	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/client-go/kubernetes"
 	clientauthv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
 	"k8s.io/client-go/rest"
@@ -21,6 +23,8 @@ var (
 	timeout = time.Second * 10
 )
 
+var _ authenticator.Token = &TokenReview{}
+
 type TokenReview struct {
 	reviewRequester clientauthv1.TokenReviewInterface
 	audiences       []string
@@ -32,6 +36,8 @@ func New(restConfig *rest.Config, audiences []string) (*TokenReview, error) {
 		return nil, err
 	}
 
+	registerMetrics()
+
 	return &TokenReview{
 		reviewRequester: kubeclient.AuthenticationV1().TokenReviews(),
 		audiences:       audiences,
@@ -44,22 +50,49 @@ func (t *TokenReview) Review(req *http.Request) (bool, error) {
 		return false, errors.New("bearer token not found in request")
 	}
 
+	_, authed, err := t.AuthenticateToken(req.Context(), token)
+	return authed, err
+}
+
+// AuthenticateToken reviews the token against the API server and returns the
+// user info that the API server resolved the token to.
+func (t *TokenReview) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
 	review := t.buildReview(token)
 
-	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	start := time.Now()
 	resp, err := t.reviewRequester.Create(ctx, review, metav1.CreateOptions{})
+	requestDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return false, err
+		requestErrors.Inc()
+		return nil, false, err
 	}
 
 	if len(resp.Status.Error) > 0 {
-		return false, fmt.Errorf("error authenticating using token review: %s",
+		return nil, false, fmt.Errorf("error authenticating using token review: %s",
 			resp.Status.Error)
 	}
 
-	return resp.Status.Authenticated, nil
+	if !resp.Status.Authenticated {
+		return nil, false, nil
+	}
+
+	extra := make(map[string][]string)
+	for k, v := range resp.Status.User.Extra {
+		extra[k] = v
+	}
+
+	return &authenticator.Response{
+		Audiences: resp.Status.Audiences,
+		User: &user.DefaultInfo{
+			Name:   resp.Status.User.Username,
+			UID:    resp.Status.User.UID,
+			Groups: resp.Status.User.Groups,
+			Extra:  extra,
+		},
+	}, true, nil
 }
 
 func (t *TokenReview) buildReview(token string) *authv1.TokenReview {
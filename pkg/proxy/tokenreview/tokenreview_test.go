@@ -2,12 +2,14 @@
 package tokenreview
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"reflect"
 	"testing"
 
 	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
 
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview/fake"
 )
@@ -95,3 +97,48 @@ func runTest(t *testing.T, test testT) {
 			test.expAuth, authed)
 	}
 }
+
+func TestAuthenticateToken(t *testing.T) {
+	tReviewer := &TokenReview{
+		reviewRequester: fake.New().WithCreate(&authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authv1.UserInfo{
+					Username: "system:serviceaccount:default:foo",
+					UID:      "1234",
+					Groups:   []string{"system:serviceaccounts"},
+					Extra: map[string]authv1.ExtraValue{
+						"foo": []string{"bar"},
+					},
+				},
+				Audiences: []string{"aud"},
+			},
+		}, nil),
+	}
+
+	resp, authed, err := tReviewer.AuthenticateToken(context.TODO(), "test-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !authed {
+		t.Fatal("expected token to be authenticated")
+	}
+
+	expUser := &user.DefaultInfo{
+		Name:   "system:serviceaccount:default:foo",
+		UID:    "1234",
+		Groups: []string{"system:serviceaccounts"},
+		Extra: map[string][]string{
+			"foo": []string{"bar"},
+		},
+	}
+
+	if !reflect.DeepEqual(expUser, resp.User) {
+		t.Errorf("got unexpected user, exp=%#v got=%#v", expUser, resp.User)
+	}
+
+	if !reflect.DeepEqual([]string{"aud"}, []string(resp.Audiences)) {
+		t.Errorf("got unexpected audiences: %v", resp.Audiences)
+	}
+}
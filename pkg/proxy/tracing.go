@@ -0,0 +1,93 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/tracing"
+)
+
+// clusterAttributeKey is the span attribute of the cluster a request is
+// routed to.
+const clusterAttributeKey = attribute.Key("kube_oidc_proxy.cluster")
+
+// requestIDAttributeKey is the span attribute of the ID of a request.
+const requestIDAttributeKey = attribute.Key("kube_oidc_proxy.request_id")
+
+// withTracing starts the span of the request, continuing any trace started by
+// the client.
+func (p *Proxy) withTracing(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+		ctx, span := tracing.Start(ctx, "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("kube-oidc-proxy", "", req)...),
+		)
+		defer span.End()
+
+		if id := context.RequestID(req); len(id) > 0 {
+			span.SetAttributes(requestIDAttributeKey.String(id))
+		}
+
+		delegate := &responseWriterDelegator{ResponseWriter: rw}
+		handler.ServeHTTP(delegate, req.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(delegate.Status())...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(delegate.Status(), trace.SpanKindServer))
+	})
+}
+
+// startUpstreamSpan starts the span of a request to the upstream API server,
+// and propagates the trace context to it via the 'traceparent' header.
+func startUpstreamSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracing.Start(req.Context(), "upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+
+	if cluster := context.ClusterName(req); len(cluster) > 0 {
+		span.SetAttributes(clusterAttributeKey.String(cluster))
+	}
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	return req, span
+}
+
+// endUpstreamSpan ends the span of a request to the upstream API server with
+// the outcome of the request.
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	defer span.End()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	if resp == nil {
+		return
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(resp.StatusCode, trace.SpanKindClient))
+}
+
+// endSpan ends the span, recording the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
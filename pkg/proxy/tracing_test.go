@@ -0,0 +1,139 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	testTraceID    = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpan = "00f067aa0ba902b7"
+)
+
+// withTestTracing installs a global tracer provider which records spans,
+// returning a function to restore the previous provider.
+func withTestTracing() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	prevTP, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return recorder, func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+	}
+}
+
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+
+	t.Fatalf("expected span %q to be ended", name)
+	return nil
+}
+
+func TestTracingHandlers(t *testing.T) {
+	recorder, restore := withTestTracing()
+	defer restore()
+
+	p := newTestProxy(t)
+	defer p.ctrl.Finish()
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(
+		&authenticator.Response{
+			User: &user.DefaultInfo{Name: "a-user"},
+		}, true, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods", nil)
+	req.Header.Set("Authorization", "bearer fake-token")
+	req.Header.Set("Traceparent", "00-"+testTraceID+"-"+testParentSpan+"-01")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	server := endedSpan(t, recorder, "HTTP GET")
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("got unexpected span kind, exp=%s got=%s", trace.SpanKindServer, server.SpanKind())
+	}
+	if got := server.SpanContext().TraceID().String(); got != testTraceID {
+		t.Errorf("expected the trace of the client to be continued, exp=%s got=%s", testTraceID, got)
+	}
+	if got := server.Parent().SpanID().String(); got != testParentSpan {
+		t.Errorf("got unexpected parent span, exp=%s got=%s", testParentSpan, got)
+	}
+
+	var code int64
+	for _, kv := range server.Attributes() {
+		if kv.Key == "http.status_code" {
+			code = kv.Value.AsInt64()
+		}
+	}
+	if code != http.StatusAccepted {
+		t.Errorf("got unexpected status code attribute, exp=%d got=%d", http.StatusAccepted, code)
+	}
+
+	authn := endedSpan(t, recorder, "authenticate")
+	if authn.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("expected authenticate span to be a child of the request span")
+	}
+}
+
+func TestTracingRoundTrip(t *testing.T) {
+	recorder, restore := withTestTracing()
+	defer restore()
+
+	rt := new(recordRT)
+	p := &Proxy{
+		clientTransport: rt,
+		config:          new(Config),
+	}
+
+	ctx, parent := otel.Tracer("test").Start(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "parent")
+	defer parent.End()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil).WithContext(ctx)
+	req = context.WithImpersonationConfig(req, &transport.ImpersonationConfig{
+		UserName: "a-user",
+	})
+
+	if _, err := p.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	upstream := endedSpan(t, recorder, "upstream")
+	if upstream.SpanKind() != trace.SpanKindClient {
+		t.Errorf("got unexpected span kind, exp=%s got=%s", trace.SpanKindClient, upstream.SpanKind())
+	}
+	if upstream.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected upstream span to be a child of the request span")
+	}
+
+	traceparent := rt.req.Header.Get("Traceparent")
+	exp := upstream.SpanContext().TraceID().String() + "-" + upstream.SpanContext().SpanID().String()
+	if !strings.Contains(traceparent, exp) {
+		t.Errorf("expected the upstream span to be propagated, exp=%s got=%s", exp, traceparent)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+// uidClaimAuthenticator sets the UID of users authenticated by the wrapped
+// OIDC token authenticator from a claim of the token.
+type uidClaimAuthenticator struct {
+	authenticator.Token
+	claim string
+}
+
+var _ authenticator.Token = &uidClaimAuthenticator{}
+
+func newUIDClaimAuthenticator(auther authenticator.Token, claim string) authenticator.Token {
+	return &uidClaimAuthenticator{
+		Token: auther,
+		claim: claim,
+	}
+}
+
+func (u *uidClaimAuthenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	resp, ok, err := u.Token.AuthenticateToken(ctx, token)
+	if err != nil || !ok || resp == nil || resp.User == nil {
+		return resp, ok, err
+	}
+
+	// The token has been verified so it is safe to read its claims.
+	claims, err := util.ParseTokenClaims(token)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse token claims: %s", err)
+	}
+
+	uid, err := uidFromClaim(claims, u.claim)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(uid) == 0 {
+		klog.V(4).Infof("uid claim %q not present in token of user %q",
+			u.claim, resp.User.GetName())
+		return resp, ok, nil
+	}
+
+	resp.User = &user.DefaultInfo{
+		Name:   resp.User.GetName(),
+		UID:    uid,
+		Groups: resp.User.GetGroups(),
+		Extra:  resp.User.GetExtra(),
+	}
+
+	return resp, ok, nil
+}
+
+// uidFromClaim returns the value of the string or numeric claim, or an empty
+// string if the claim is not present.
+func uidFromClaim(claims map[string]interface{}, claim string) (string, error) {
+	switch v := claims[claim].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return fmt.Sprintf("%.0f", v), nil
+	default:
+		return "", fmt.Errorf("uid claim %q is not a string: %T", claim, v)
+	}
+}
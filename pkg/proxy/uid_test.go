@@ -0,0 +1,81 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/mocks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+func TestUIDClaimAuthenticator(t *testing.T) {
+	token, err := util.FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		claim   string
+		authErr error
+
+		expUID string
+		expErr bool
+	}{
+		"the uid should be set from the claim": {
+			claim:  "sub",
+			expUID: "fake",
+		},
+		"a missing claim should leave the uid unset": {
+			claim:  "oid",
+			expUID: "",
+		},
+		"a numeric claim should be formatted as an integer": {
+			claim:  "nbf",
+			expUID: "1451606400",
+		},
+		"an authentication error should be returned": {
+			claim:   "sub",
+			authErr: errors.New("bad token"),
+			expErr:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			fakeToken := mocks.NewMockToken(ctrl)
+			fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(
+				&authenticator.Response{
+					User: &user.DefaultInfo{Name: "a-user", Groups: []string{"a-group"}},
+				}, test.authErr == nil, test.authErr)
+
+			resp, ok, err := newUIDClaimAuthenticator(fakeToken, test.claim).AuthenticateToken(context.TODO(), token)
+			if test.expErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("unexpected authentication failure, ok=%t err=%v", ok, err)
+			}
+
+			if uid := resp.User.GetUID(); uid != test.expUID {
+				t.Errorf("got unexpected uid, exp=%q got=%q", test.expUID, uid)
+			}
+
+			if name := resp.User.GetName(); name != "a-user" {
+				t.Errorf("got unexpected username: %q", name)
+			}
+		})
+	}
+}
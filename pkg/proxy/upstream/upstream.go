@@ -0,0 +1,334 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// RoundRobin balances requests across healthy endpoints in turn.
+	RoundRobin = "round-robin"
+
+	// LeastConnections balances requests to the healthy endpoint with the
+	// fewest requests in flight.
+	LeastConnections = "least-connections"
+)
+
+var (
+	// ErrNoEndpoints is returned when there are no endpoints left to send a
+	// request to.
+	ErrNoEndpoints = errors.New("no upstream endpoints available")
+)
+
+// Options configure a pool of upstream endpoints.
+type Options struct {
+	// Endpoints are the URLs of the API server endpoints.
+	Endpoints []string
+
+	// Balancer is either RoundRobin or LeastConnections.
+	Balancer string
+
+	// HealthCheckInterval is the interval /readyz of each endpoint is checked.
+	// If zero, endpoints are not actively health checked.
+	HealthCheckInterval time.Duration
+
+	// EjectionDuration is how long an endpoint is ejected from the pool after
+	// a connection error or failed health check.
+	EjectionDuration time.Duration
+
+	// MaxRetries is the maximum number of times an idempotent request is
+	// retried on another endpoint after a connection error.
+	MaxRetries int
+}
+
+// endpoint is an API server endpoint of the pool.
+type endpoint struct {
+	url *url.URL
+
+	inflight     int64
+	ejectedUntil atomic.Value // time.Time
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	until, _ := e.ejectedUntil.Load().(time.Time)
+	return !now.Before(until)
+}
+
+// Pool balances requests across the endpoints of an API server.
+type Pool struct {
+	endpoints []*endpoint
+	opts      Options
+
+	mu   sync.Mutex
+	next int
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// NewPool returns a pool of the given endpoints.
+func NewPool(opts Options) (*Pool, error) {
+	if len(opts.Endpoints) == 0 {
+		return nil, errors.New("no upstream endpoints given")
+	}
+
+	switch opts.Balancer {
+	case "":
+		opts.Balancer = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return nil, fmt.Errorf("unknown upstream balancer %q, must be one of %q or %q",
+			opts.Balancer, RoundRobin, LeastConnections)
+	}
+
+	p := &Pool{
+		opts: opts,
+		now:  time.Now,
+	}
+
+	for _, e := range opts.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse upstream endpoint %q: %s", e, err)
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" || len(u.Host) == 0 {
+			return nil, fmt.Errorf("upstream endpoint %q must be a http or https URL", e)
+		}
+
+		ep := &endpoint{url: u}
+		ep.ejectedUntil.Store(time.Time{})
+		p.endpoints = append(p.endpoints, ep)
+	}
+
+	return p, nil
+}
+
+// pick returns the endpoint to send the next request to, excluding those
+// already tried. Healthy endpoints are preferred, but if none are left an
+// ejected endpoint is picked rather than failing the request outright.
+func (p *Pool) pick(tried map[*endpoint]bool) (*endpoint, error) {
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var picked, ejected *endpoint
+	for i := range p.endpoints {
+		e := p.endpoints[(p.next+i)%len(p.endpoints)]
+		if tried[e] {
+			continue
+		}
+
+		if !e.healthy(now) {
+			if ejected == nil {
+				ejected = e
+			}
+			continue
+		}
+
+		if p.opts.Balancer == RoundRobin {
+			picked = e
+			break
+		}
+
+		if picked == nil || atomic.LoadInt64(&e.inflight) < atomic.LoadInt64(&picked.inflight) {
+			picked = e
+		}
+	}
+
+	if picked == nil {
+		picked = ejected
+	}
+
+	if picked == nil {
+		return nil, ErrNoEndpoints
+	}
+
+	p.next = (p.next + 1) % len(p.endpoints)
+
+	return picked, nil
+}
+
+// eject removes the endpoint from the pool for the ejection duration.
+func (p *Pool) eject(e *endpoint, reason string) {
+	if e.healthy(p.now()) {
+		klog.Warningf("ejecting upstream endpoint %s for %s: %s",
+			e.url.Host, p.opts.EjectionDuration, reason)
+	}
+
+	e.ejectedUntil.Store(p.now().Add(p.opts.EjectionDuration))
+}
+
+// RoundTripper returns a round tripper which sends requests to the endpoints
+// of the pool using rt. Requests to different hosts are rewritten to the
+// picked endpoint.
+func (p *Pool) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &roundTripper{
+		pool: p,
+		rt:   rt,
+	}
+}
+
+type roundTripper struct {
+	pool *Pool
+	rt   http.RoundTripper
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*endpoint]bool)
+
+	for attempt := 0; ; attempt++ {
+		e, err := r.pool.pick(tried)
+		if err != nil {
+			return nil, err
+		}
+		tried[e] = true
+
+		resp, err := r.roundTrip(e, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		// The client has gone away so this is not a fault of the endpoint.
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+
+		// Connection errors eject the endpoint. The request is retried on
+		// another endpoint if it is safe to do so, which is before any
+		// response has been written back to the client.
+		r.pool.eject(e, err.Error())
+
+		if attempt >= r.pool.opts.MaxRetries || !retryable(req) {
+			return nil, err
+		}
+
+		klog.V(2).Infof("retrying %s %s on another upstream endpoint: %s",
+			req.Method, req.URL.Path, err)
+	}
+}
+
+func (r *roundTripper) roundTrip(e *endpoint, req *http.Request) (*http.Response, error) {
+	outreq := new(http.Request)
+	*outreq = *req
+
+	u := *req.URL
+	u.Scheme = e.url.Scheme
+	u.Host = e.url.Host
+	outreq.URL = &u
+	outreq.Host = ""
+
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outreq.Body = body
+	}
+
+	atomic.AddInt64(&e.inflight, 1)
+
+	resp, err := r.rt.RoundTrip(outreq)
+	if err != nil {
+		atomic.AddInt64(&e.inflight, -1)
+		return nil, err
+	}
+
+	resp.Body = &inflightBody{ReadCloser: resp.Body, endpoint: e}
+
+	return resp, nil
+}
+
+// retryable returns whether the request is idempotent and can be resent.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// inflightBody decrements the in flight requests of the endpoint once the
+// response body is closed.
+type inflightBody struct {
+	io.ReadCloser
+	endpoint *endpoint
+	once     sync.Once
+}
+
+func (i *inflightBody) Close() error {
+	i.once.Do(func() {
+		atomic.AddInt64(&i.endpoint.inflight, -1)
+	})
+	return i.ReadCloser.Close()
+}
+
+// Write is implemented for upgraded connections which are returned as a
+// response body that is also writable.
+func (i *inflightBody) Write(b []byte) (int, error) {
+	w, ok := i.ReadCloser.(io.Writer)
+	if !ok {
+		return 0, errors.New("upstream response body is not writable")
+	}
+	return w.Write(b)
+}
+
+// RunHealthChecks checks /readyz of each endpoint every health check interval
+// using rt, ejecting endpoints that are not ready, until stopCh is closed.
+func (p *Pool) RunHealthChecks(rt http.RoundTripper, stopCh <-chan struct{}) {
+	if p.opts.HealthCheckInterval <= 0 {
+		return
+	}
+
+	client := &http.Client{
+		Transport: rt,
+		Timeout:   p.opts.HealthCheckInterval,
+	}
+
+	for _, e := range p.endpoints {
+		e := e
+		go wait.Until(func() {
+			if err := p.checkHealth(client, e); err != nil {
+				p.eject(e, err.Error())
+				return
+			}
+
+			// Ready endpoints are returned to the pool.
+			if !e.healthy(p.now()) {
+				klog.Infof("upstream endpoint %s is ready, returning to pool", e.url.Host)
+				e.ejectedUntil.Store(time.Time{})
+			}
+		}, p.opts.HealthCheckInterval, stopCh)
+	}
+}
+
+func (p *Pool) checkHealth(client *http.Client, e *endpoint) error {
+	u := *e.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/readyz"
+
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package upstream
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRT records the hosts requests are sent to, failing to connect to the
+// given hosts.
+type fakeRT struct {
+	mu    sync.Mutex
+	hosts []string
+	down  map[string]bool
+}
+
+func (f *fakeRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.hosts = append(f.hosts, req.URL.Host)
+
+	if f.down[req.URL.Host] {
+		return nil, errors.New("connection refused")
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("ok")),
+	}, nil
+}
+
+func newTestPool(t *testing.T, opts Options) *Pool {
+	if len(opts.Endpoints) == 0 {
+		opts.Endpoints = []string{"https://a:6443", "https://b:6443", "https://c:6443"}
+	}
+
+	p, err := NewPool(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func doRequests(t *testing.T, rt http.RoundTripper, method string, n int) []error {
+	var errs []error
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(method, "https://proxy.example.com/api/v1/pods", nil)
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func TestNewPool(t *testing.T) {
+	tests := map[string]Options{
+		"no endpoints": {},
+		"endpoint without scheme": {
+			Endpoints: []string{"10.0.0.1:6443"},
+		},
+		"unknown balancer": {
+			Endpoints: []string{"https://10.0.0.1:6443"},
+			Balancer:  "random",
+		},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewPool(opts); err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := newTestPool(t, Options{})
+	rt := new(fakeRT)
+
+	for _, err := range doRequests(t, p.RoundTripper(rt), "GET", 6) {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	exp := "a:6443,b:6443,c:6443,a:6443,b:6443,c:6443"
+	if got := strings.Join(rt.hosts, ","); got != exp {
+		t.Errorf("unexpected hosts, exp=%s got=%s", exp, got)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	p := newTestPool(t, Options{Balancer: LeastConnections})
+	rt := new(fakeRT)
+
+	// Hold open the response bodies of the first two requests so the third
+	// endpoint has the fewest connections.
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "https://proxy.example.com/api", nil)
+		if _, err := p.RoundTripper(rt).RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doRequests(t, p.RoundTripper(rt), "GET", 1)
+
+	exp := "a:6443,b:6443,c:6443"
+	if got := strings.Join(rt.hosts, ","); got != exp {
+		t.Errorf("unexpected hosts, exp=%s got=%s", exp, got)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	now := time.Now()
+
+	p := newTestPool(t, Options{
+		EjectionDuration: time.Minute,
+		MaxRetries:       2,
+	})
+	p.now = func() time.Time { return now }
+
+	rt := &fakeRT{down: map[string]bool{"a:6443": true}}
+
+	// The first request should fail over to the next endpoint, ejecting the
+	// failed endpoint for subsequent requests.
+	for _, err := range doRequests(t, p.RoundTripper(rt), "GET", 3) {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	exp := "a:6443,b:6443,c:6443,b:6443"
+	if got := strings.Join(rt.hosts, ","); got != exp {
+		t.Errorf("unexpected hosts, exp=%s got=%s", exp, got)
+	}
+
+	// Once the ejection duration has passed the endpoint should be tried
+	// again.
+	now = now.Add(time.Minute)
+	rt.hosts = nil
+	rt.down = nil
+
+	doRequests(t, p.RoundTripper(rt), "GET", 3)
+	if got := strings.Join(rt.hosts, ","); !strings.Contains(got, "a:6443") {
+		t.Errorf("expected ejected endpoint to be returned to the pool, got=%s", got)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	p := newTestPool(t, Options{MaxRetries: 2})
+	rt := &fakeRT{down: map[string]bool{"a:6443": true}}
+
+	// Non idempotent requests must not be retried.
+	errs := doRequests(t, p.RoundTripper(rt), "POST", 1)
+	if errs[0] == nil {
+		t.Error("expected error, got none")
+	}
+
+	if len(rt.hosts) != 1 {
+		t.Errorf("expected a single attempt, got=%v", rt.hosts)
+	}
+}
+
+func TestAllEndpointsDown(t *testing.T) {
+	p := newTestPool(t, Options{
+		EjectionDuration: time.Minute,
+		MaxRetries:       5,
+	})
+
+	rt := &fakeRT{down: map[string]bool{"a:6443": true, "b:6443": true, "c:6443": true}}
+
+	errs := doRequests(t, p.RoundTripper(rt), "GET", 1)
+	if errs[0] != ErrNoEndpoints {
+		t.Errorf("expected no endpoints error, got=%v", errs[0])
+	}
+
+	// Ejected endpoints should still be tried if none are healthy.
+	rt.hosts = nil
+	rt.down = nil
+
+	if errs := doRequests(t, p.RoundTripper(rt), "GET", 1); errs[0] != nil {
+		t.Errorf("unexpected error: %s", errs[0])
+	}
+}
+
+func TestRunHealthChecks(t *testing.T) {
+	var mu sync.Mutex
+	ready := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.URL.Path != "/readyz" || !ready {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	p := newTestPool(t, Options{
+		Endpoints:           []string{server.URL},
+		HealthCheckInterval: time.Millisecond * 10,
+		EjectionDuration:    time.Hour,
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p.RunHealthChecks(http.DefaultTransport, stopCh)
+
+	waitFor := func(healthy bool) {
+		for i := 0; i < 100; i++ {
+			if p.endpoints[0].healthy(time.Now()) == healthy {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("expected endpoint healthy=%t", healthy)
+	}
+
+	waitFor(false)
+
+	mu.Lock()
+	ready = true
+	mu.Unlock()
+
+	waitFor(true)
+}
@@ -0,0 +1,155 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package userextra
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog"
+)
+
+// Templates are extra user header values rendered per request, keyed by the
+// extra user key.
+type Templates struct {
+	templates map[string][]*template.Template
+}
+
+// Data is the data available to templates.
+type Data struct {
+	// Claims of the token that authenticated the request.
+	Claims map[string]interface{}
+
+	// Issuer of the token that authenticated the request.
+	Issuer string
+
+	User    UserData
+	Request RequestData
+}
+
+// UserData is the authenticated user of the request.
+type UserData struct {
+	Name   string
+	UID    string
+	Groups []string
+}
+
+// RequestData are attributes of the request.
+type RequestData struct {
+	Host       string
+	Method     string
+	Path       string
+	UserAgent  string
+	RemoteAddr string
+}
+
+var funcs = template.FuncMap{
+	"join": join,
+}
+
+// New parses the given templates, keyed by extra user key. Templates use the
+// Go text/template syntax with Data, e.g. '{{ .Claims.department }}'.
+func New(templates map[string][]string) (*Templates, error) {
+	t := &Templates{
+		templates: make(map[string][]*template.Template),
+	}
+
+	for key, texts := range templates {
+		for _, text := range texts {
+			tmpl, err := template.New(key).Funcs(funcs).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse extra user header template %q: %s", key, err)
+			}
+
+			t.templates[key] = append(t.templates[key], tmpl)
+		}
+	}
+
+	return t, nil
+}
+
+// NewData returns the template data of the request, authenticated as the user
+// with the given token claims. claims may be nil.
+func NewData(req *http.Request, remoteAddr string, u user.Info, claims map[string]interface{}) *Data {
+	data := &Data{
+		Claims: claims,
+		User: UserData{
+			Name:   u.GetName(),
+			UID:    u.GetUID(),
+			Groups: u.GetGroups(),
+		},
+		Request: RequestData{
+			Host:       req.Host,
+			Method:     req.Method,
+			UserAgent:  req.UserAgent(),
+			RemoteAddr: remoteAddr,
+		},
+	}
+
+	if data.Claims == nil {
+		data.Claims = make(map[string]interface{})
+	}
+
+	if iss, ok := data.Claims["iss"].(string); ok {
+		data.Issuer = iss
+	}
+
+	if req.URL != nil {
+		data.Request.Path = req.URL.Path
+	}
+
+	return data
+}
+
+// Execute renders the templates with the given data. Templates which fail to
+// render, such as those referring to claims not present in the token, or
+// render to an empty string are omitted.
+func (t *Templates) Execute(data *Data) map[string][]string {
+	extra := make(map[string][]string)
+
+	// Render in a stable order so values of the same key keep their order.
+	keys := make([]string, 0, len(t.templates))
+	for key := range t.templates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, tmpl := range t.templates[key] {
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				klog.V(4).Infof("omitting extra user header %s: %s", key, err)
+				continue
+			}
+
+			if value := buf.String(); len(value) > 0 {
+				extra[key] = append(extra[key], value)
+			}
+		}
+	}
+
+	return extra
+}
+
+// join joins the elements of a list claim with the separator. Scalar values
+// are returned as is.
+func join(value interface{}, sep string) string {
+	switch v := value.(type) {
+	case []interface{}:
+		var ss []string
+		for _, e := range v {
+			ss = append(ss, fmt.Sprint(e))
+		}
+		return strings.Join(ss, sep)
+	case []string:
+		return strings.Join(v, sep)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package userextra
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New(map[string][]string{"foo": []string{"{{ .Claims.foo "}}); err == nil {
+		t.Error("expected error parsing malformed template")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://kube.example.com/api/v1/pods", nil)
+	req.Header.Set("User-Agent", "kubectl/v1.18.0")
+
+	claims := map[string]interface{}{
+		"iss":         "https://issuer.example.com",
+		"department":  "engineering",
+		"employee_id": float64(1234),
+		"tenants":     []interface{}{"a", "b"},
+		"empty":       "",
+	}
+
+	u := &user.DefaultInfo{
+		Name:   "a-user",
+		UID:    "1234",
+		Groups: []string{"a-group"},
+	}
+
+	tests := map[string]struct {
+		templates map[string][]string
+		claims    map[string]interface{}
+		expExtra  map[string][]string
+	}{
+		"claims should be rendered": {
+			templates: map[string][]string{
+				"department":  []string{"{{ .Claims.department }}"},
+				"employee-id": []string{"{{ .Claims.employee_id }}"},
+				"tenants":     []string{`{{ join .Claims.tenants "," }}`},
+			},
+			claims: claims,
+			expExtra: map[string][]string{
+				"department":  []string{"engineering"},
+				"employee-id": []string{"1234"},
+				"tenants":     []string{"a,b"},
+			},
+		},
+		"missing and empty claims should be omitted": {
+			templates: map[string][]string{
+				"missing": []string{"{{ .Claims.missing }}"},
+				"empty":   []string{"{{ .Claims.empty }}"},
+			},
+			claims:   claims,
+			expExtra: map[string][]string{},
+		},
+		"no claims should omit claim templates": {
+			templates: map[string][]string{
+				"department": []string{"{{ .Claims.department }}"},
+				"user":       []string{"{{ .User.Name }}"},
+			},
+			expExtra: map[string][]string{
+				"user": []string{"a-user"},
+			},
+		},
+		"request attributes, issuer and user should be rendered": {
+			templates: map[string][]string{
+				"request": []string{
+					"{{ .Request.Host }}",
+					"{{ .Request.Method }} {{ .Request.Path }}",
+					"{{ .Request.UserAgent }}",
+					"{{ .Request.RemoteAddr }}",
+				},
+				"issuer": []string{"{{ .Issuer }}"},
+				"user":   []string{`{{ .User.UID }}/{{ join .User.Groups ";" }}`},
+			},
+			claims: claims,
+			expExtra: map[string][]string{
+				"request": []string{
+					"kube.example.com",
+					"GET /api/v1/pods",
+					"kubectl/v1.18.0",
+					"8.8.8.8",
+				},
+				"issuer": []string{"https://issuer.example.com"},
+				"user":   []string{"1234/a-group"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			templates, err := New(test.templates)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			extra := templates.Execute(NewData(req, "8.8.8.8", u, test.claims))
+			if !reflect.DeepEqual(test.expExtra, extra) {
+				t.Errorf("got unexpected extra, exp=%#v got=%#v", test.expExtra, extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	tracesPath    = "/v1/traces"
+	exportTimeout = time.Second * 10
+)
+
+// exporter exports spans to an OTLP/HTTP collector using the JSON encoding.
+// The upstream OTLP exporters depend on a version of gRPC which is
+// incompatible with the etcd client used by k8s.io/apiserver.
+type exporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+var _ sdktrace.SpanExporter = &exporter{}
+
+func newExporter(endpoint string, headers map[string]string) *exporter {
+	return &exporter{
+		url:     strings.TrimSuffix(endpoint, "/") + tracesPath,
+		headers: headers,
+		client:  &http.Client{Timeout: exportTimeout},
+	}
+}
+
+// ExportSpans sends the spans to the collector.
+func (e *exporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to export spans: collector responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Shutdown is a no-op, as the exporter holds no resources.
+func (e *exporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// The following types are the JSON encoding of an OTLP
+// ExportTraceServiceRequest.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resourceJSON `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+	SchemaURL  string       `json:"schemaUrl,omitempty"`
+}
+
+type resourceJSON struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeSpans struct {
+	Scope     scope      `json:"scope"`
+	Spans     []spanJSON `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type spanJSON struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Events            []eventJSON `json:"events,omitempty"`
+	Links             []linkJSON  `json:"links,omitempty"`
+	Status            statusJSON  `json:"status"`
+}
+
+type eventJSON struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+type linkJSON struct {
+	TraceID    string     `json:"traceId"`
+	SpanID     string     `json:"spanId"`
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type statusJSON struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+// OTLP status codes, which differ in order from the OpenTelemetry API.
+const (
+	statusCodeUnset = 0
+	statusCodeOK    = 1
+	statusCodeError = 2
+)
+
+// encodeSpans groups the spans by resource and instrumentation scope.
+func encodeSpans(spans []sdktrace.ReadOnlySpan) *exportRequest {
+	req := new(exportRequest)
+
+	resources := make(map[string]int)
+	scopes := make(map[string]map[string]int)
+
+	for _, s := range spans {
+		var resKey string
+		var attrs []keyValue
+		var schemaURL string
+		if res := s.Resource(); res != nil {
+			resKey = res.Encoded(attribute.DefaultEncoder())
+			attrs = encodeAttributes(res.Attributes())
+			schemaURL = res.SchemaURL()
+		}
+
+		ri, ok := resources[resKey]
+		if !ok {
+			ri = len(req.ResourceSpans)
+			resources[resKey] = ri
+			scopes[resKey] = make(map[string]int)
+			req.ResourceSpans = append(req.ResourceSpans, resourceSpans{
+				Resource:  resourceJSON{Attributes: attrs},
+				SchemaURL: schemaURL,
+			})
+		}
+
+		lib := s.InstrumentationLibrary()
+		scopeKey := lib.Name + "@" + lib.Version
+
+		rs := &req.ResourceSpans[ri]
+		si, ok := scopes[resKey][scopeKey]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopes[resKey][scopeKey] = si
+			rs.ScopeSpans = append(rs.ScopeSpans, scopeSpans{
+				Scope:     scope{Name: lib.Name, Version: lib.Version},
+				SchemaURL: lib.SchemaURL,
+			})
+		}
+
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, encodeSpan(s))
+	}
+
+	return req
+}
+
+func encodeSpan(s sdktrace.ReadOnlySpan) spanJSON {
+	sc := s.SpanContext()
+
+	span := spanJSON{
+		TraceID:           sc.TraceID().String(),
+		SpanID:            sc.SpanID().String(),
+		Name:              s.Name(),
+		Kind:              int(s.SpanKind()),
+		StartTimeUnixNano: unixNano(s.StartTime()),
+		EndTimeUnixNano:   unixNano(s.EndTime()),
+		Attributes:        encodeAttributes(s.Attributes()),
+	}
+
+	if parent := s.Parent(); parent.HasSpanID() {
+		span.ParentSpanID = parent.SpanID().String()
+	}
+
+	for _, e := range s.Events() {
+		span.Events = append(span.Events, eventJSON{
+			TimeUnixNano: unixNano(e.Time),
+			Name:         e.Name,
+			Attributes:   encodeAttributes(e.Attributes),
+		})
+	}
+
+	for _, l := range s.Links() {
+		span.Links = append(span.Links, linkJSON{
+			TraceID:    l.SpanContext.TraceID().String(),
+			SpanID:     l.SpanContext.SpanID().String(),
+			Attributes: encodeAttributes(l.Attributes),
+		})
+	}
+
+	switch status := s.Status(); status.Code {
+	case codes.Ok:
+		span.Status.Code = statusCodeOK
+	case codes.Error:
+		span.Status.Code = statusCodeError
+		span.Status.Message = status.Description
+	default:
+		span.Status.Code = statusCodeUnset
+	}
+
+	return span
+}
+
+func encodeAttributes(attrs []attribute.KeyValue) []keyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		kvs = append(kvs, keyValue{
+			Key:   string(kv.Key),
+			Value: encodeValue(kv.Value),
+		})
+	}
+
+	return kvs
+}
+
+func encodeValue(v attribute.Value) anyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return anyValue{BoolValue: &b}
+	case attribute.INT64:
+		return intValue(v.AsInt64())
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return anyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		var values []anyValue
+		for _, b := range v.AsBoolSlice() {
+			b := b
+			values = append(values, anyValue{BoolValue: &b})
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case attribute.INT64SLICE:
+		var values []anyValue
+		for _, i := range v.AsInt64Slice() {
+			values = append(values, intValue(i))
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case attribute.FLOAT64SLICE:
+		var values []anyValue
+		for _, f := range v.AsFloat64Slice() {
+			f := f
+			values = append(values, anyValue{DoubleValue: &f})
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case attribute.STRINGSLICE:
+		var values []anyValue
+		for _, s := range v.AsStringSlice() {
+			s := s
+			values = append(values, anyValue{StringValue: &s})
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	default:
+		s := v.Emit()
+		return anyValue{StringValue: &s}
+	}
+}
+
+// intValue encodes a 64 bit integer as a string, as required by the JSON
+// encoding of OTLP.
+func intValue(i int64) anyValue {
+	s := strconv.FormatInt(i, 10)
+	return anyValue{IntValue: &s}
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
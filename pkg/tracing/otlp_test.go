@@ -0,0 +1,154 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestExporter(t *testing.T) {
+	var (
+		got        exportRequest
+		gotPath    string
+		gotHeaders http.Header
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotPath, gotHeaders = req.URL.Path, req.Header
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode export request: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(newExporter(server.URL+"/", map[string]string{"Authorization": "Bearer collector-token"})),
+	)
+	tracer := tp.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "parent", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := tracer.Start(ctx, "child", trace.WithAttributes(
+		attribute.Int64("count", 3),
+		attribute.StringSlice("groups", []string{"a", "b"}),
+	))
+	child.SetStatus(codes.Error, "failed")
+	child.End()
+
+	if gotPath != "/v1/traces" {
+		t.Errorf("got unexpected export path, exp=/v1/traces got=%s", gotPath)
+	}
+	if auth := gotHeaders.Get("Authorization"); auth != "Bearer collector-token" {
+		t.Errorf("expected export headers to be set, got=%q", auth)
+	}
+	if ct := gotHeaders.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got unexpected content type, exp=application/json got=%s", ct)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(got.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected a single span to be exported, got=%+v", got)
+	}
+
+	span := got.ResourceSpans[0].ScopeSpans[0].Spans[0]
+
+	if span.TraceID != parent.SpanContext().TraceID().String() {
+		t.Errorf("got unexpected trace id, exp=%s got=%s", parent.SpanContext().TraceID(), span.TraceID)
+	}
+	if span.ParentSpanID != parent.SpanContext().SpanID().String() {
+		t.Errorf("got unexpected parent span id, exp=%s got=%s", parent.SpanContext().SpanID(), span.ParentSpanID)
+	}
+	if span.Kind != int(trace.SpanKindInternal) {
+		t.Errorf("got unexpected span kind, exp=%d got=%d", trace.SpanKindInternal, span.Kind)
+	}
+	if span.Status.Code != statusCodeError || span.Status.Message != "failed" {
+		t.Errorf("got unexpected status, got=%+v", span.Status)
+	}
+
+	attrs := make(map[string]anyValue)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["count"].IntValue; v == nil || *v != "3" {
+		t.Errorf("expected int attribute to be encoded as a string, got=%+v", attrs["count"])
+	}
+	if v := attrs["groups"].ArrayValue; v == nil || len(v.Values) != 2 || *v.Values[1].StringValue != "b" {
+		t.Errorf("got unexpected slice attribute, got=%+v", attrs["groups"])
+	}
+
+	var serviceName string
+	for _, kv := range got.ResourceSpans[0].Resource.Attributes {
+		if kv.Key == "service.name" && kv.Value.StringValue != nil {
+			serviceName = *kv.Value.StringValue
+		}
+	}
+	if len(serviceName) == 0 {
+		t.Errorf("expected resource to have a service name")
+	}
+}
+
+func TestExporterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	e := newExporter(server.URL, nil)
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(&errExporter{exporter: e, errs: errs}))
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+
+	if err := <-errs; err == nil {
+		t.Error("expected error exporting to a collector responding 503")
+	}
+}
+
+// errExporter records the errors of the wrapped exporter.
+type errExporter struct {
+	*exporter
+	errs chan error
+}
+
+func (e *errExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.exporter.ExportSpans(ctx, spans)
+	e.errs <- err
+	return err
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := map[string]struct {
+		opts   Options
+		expErr bool
+	}{
+		"no endpoint should be valid": {
+			opts: Options{SamplingRatio: 1},
+		},
+		"an http endpoint should be valid": {
+			opts: Options{Endpoint: "http://localhost:4318", SamplingRatio: 0.5},
+		},
+		"an endpoint which is not a URL should error": {
+			opts:   Options{Endpoint: "localhost:4318", SamplingRatio: 1},
+			expErr: true,
+		},
+		"a sampling ratio over 1 should error": {
+			opts:   Options{SamplingRatio: 2},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		err := test.opts.Validate()
+		if test.expErr != (err != nil) {
+			t.Errorf("%s: got unexpected error, exp=%t got=%v", name, test.expErr, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// instrumentationName is the name of the tracer spans are created with.
+	instrumentationName = "github.com/jetstack/kube-oidc-proxy"
+
+	serviceName = "kube-oidc-proxy"
+)
+
+// Options configure the export of traces.
+type Options struct {
+	// Endpoint is the base URL of the OTLP/HTTP collector, such as
+	// 'http://localhost:4318'. Traces are not exported if empty.
+	Endpoint string
+
+	// Headers are added to export requests, such as for authentication.
+	Headers map[string]string
+
+	// SamplingRatio is the ratio of traces started by the proxy that are
+	// sampled. Traces started by clients keep the sampling decision of the
+	// client.
+	SamplingRatio float64
+}
+
+// Validate validates the tracing options.
+func (o *Options) Validate() error {
+	if len(o.Endpoint) > 0 {
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid tracing endpoint %q, must be an http or https URL", o.Endpoint)
+		}
+	}
+
+	if o.SamplingRatio < 0 || o.SamplingRatio > 1 {
+		return fmt.Errorf("invalid tracing sampling ratio %v, must be between 0 and 1", o.SamplingRatio)
+	}
+
+	return nil
+}
+
+// Setup installs a global tracer provider which exports spans to the OTLP
+// endpoint, and propagates trace context using the W3C 'traceparent' header.
+// The returned function flushes and stops the export of spans. If no
+// endpoint is configured, tracing is left disabled.
+func Setup(opts Options) (func(context.Context) error, error) {
+	if len(opts.Endpoint) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	tp := NewTracerProvider(newExporter(opts.Endpoint, opts.Headers), opts.SamplingRatio)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// NewTracerProvider returns a tracer provider which batches spans to the
+// exporter, sampling the given ratio of new traces.
+func NewTracerProvider(exporter sdktrace.SpanExporter, samplingRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+}
+
+// Tracer returns the tracer of the proxy from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span as a child of any span in the context.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
@@ -36,6 +36,23 @@ func ParseTokenFromRequest(req *http.Request) (string, bool) {
 	return token, true
 }
 
+// ParseTokenClaims returns the claims of the given JWT without verifying its
+// signature. This must only be used on tokens that have already been verified,
+// such as by the OIDC authenticator.
+func ParseTokenClaims(token string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
 // fakeJWT generates a valid JWT using the passed input parameters which is
 // signed by a generated key. This is useful for checking the status of a
 // signer.
@@ -142,3 +142,23 @@ func TestParseTokenFromHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTokenClaims(t *testing.T) {
+	token, err := FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatalf("failed to create fake JWT: %s", err)
+	}
+
+	claims, err := ParseTokenClaims(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if claims["iss"] != "https://issuer.example.com" || claims["sub"] != "fake" {
+		t.Errorf("got unexpected claims: %v", claims)
+	}
+
+	if _, err := ParseTokenClaims("not-a-jwt"); err == nil {
+		t.Error("expected error parsing malformed token")
+	}
+}